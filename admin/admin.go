@@ -0,0 +1,297 @@
+// Package admin provides authenticated HTTP endpoints that let operators
+// change the maintenance state directly, without filing an issue for every
+// machine.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+// Machines lists the machines that are known to siteinfo.
+type Machines interface {
+	MachineNames() []string
+}
+
+// Admin serves the administrative endpoints for a MaintenanceState.
+type Admin struct {
+	state    *maintenancestate.MaintenanceState
+	machines Machines
+	project  string
+}
+
+// PatternRequest is the body of a request to change the maintenance of every
+// machine matching a pattern.
+type PatternRequest struct {
+	// Pattern is matched against the full names of the machines (e.g.
+	// mlab3-abc01).
+	Pattern string
+	// Syntax is either "glob" (the default) or "regex". Regular expressions
+	// must match the whole name.
+	Syntax string
+	// Action is either "enter" or "leave".
+	Action string
+	// Issue is the issue on behalf of which the machines enter or leave
+	// maintenance.
+	Issue string
+}
+
+// PatternResponse lists the machines matched by a PatternRequest.
+type PatternResponse struct {
+	Machines      []string
+	Modifications int
+}
+
+// matcher returns a function reporting whether a machine name matches the
+// pattern of r.
+func (r *PatternRequest) matcher() (func(string) bool, error) {
+	switch r.Syntax {
+	case "", "glob":
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return nil, err
+		}
+		return func(name string) bool {
+			ok, _ := path.Match(r.Pattern, name)
+			return ok
+		}, nil
+	case "regex":
+		re, err := regexp.Compile("^(?:" + r.Pattern + ")$")
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	default:
+		return nil, fmt.Errorf("unknown pattern syntax: %q", r.Syntax)
+	}
+}
+
+// Pattern puts every known machine matching a pattern into maintenance, or
+// removes it from maintenance, and responds with the machines that matched.
+func (a *Admin) Pattern(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var r PatternRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(resp, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := maintenancestate.EnterMaintenance
+	switch r.Action {
+	case "enter":
+	case "leave":
+		action = maintenancestate.LeaveMaintenance
+	default:
+		http.Error(resp, "action must be enter or leave", http.StatusBadRequest)
+		return
+	}
+	if r.Pattern == "" || r.Issue == "" {
+		http.Error(resp, "pattern and issue are required", http.StatusBadRequest)
+		return
+	}
+	match, err := r.matcher()
+	if err != nil {
+		http.Error(resp, "invalid pattern: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := PatternResponse{Machines: []string{}}
+	for _, name := range a.machines.MachineNames() {
+		if !match(name) {
+			continue
+		}
+		result.Machines = append(result.Machines, name)
+		c := maintenancestate.Change{Kind: "machine", Name: name, Action: action}
+		result.Modifications += a.state.Apply(c, r.Issue, a.project)
+	}
+	slog.Info("Admin request", "remote", req.RemoteAddr, "action", r.Action, "pattern", r.Pattern,
+		"issue", r.Issue, "machines", len(result.Machines))
+
+	if result.Modifications > 0 {
+		if err := a.state.Write(); err != nil {
+			slog.Error("Failed to write state after admin request", "err", err)
+			metrics.CountError("writefile", "admin.Pattern")
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(result)
+}
+
+var (
+	machineRegExp = regexp.MustCompile(`^mlab[1-4]-[a-z]{3}[0-9][0-9ct]$`)
+	siteRegExp    = regexp.MustCompile(`^[a-z]{3}[0-9][0-9ct]$`)
+)
+
+// manualIssue is the issue on behalf of which manual changes are made if the
+// request names none.
+const manualIssue = "manual"
+
+// MaintenanceRequest is the body of a request to put a single machine or site
+// into maintenance, or to take it out, without going through an issue.
+type MaintenanceRequest struct {
+	// Kind is either "machine" or "site".
+	Kind string
+	// Name is the name of the machine (e.g. mlab1-abc01) or site (e.g.
+	// abc01).
+	Name string
+	// Action is either "enter" or "leave".
+	Action string
+	// Issue is the issue on behalf of which the change is made. It defaults
+	// to "manual".
+	Issue string
+	// Reason, if set, is why the machine or site enters maintenance.
+	Reason string `json:",omitempty"`
+}
+
+// MaintenanceResponse reports the outcome of a MaintenanceRequest, or of
+// closing an issue.
+type MaintenanceResponse struct {
+	Modifications int
+}
+
+// Maintenance puts a machine or site into maintenance, or removes it from
+// maintenance, as if flagged in an issue. The resulting transitions have
+// the cause "manual", so that they are distinguished in the audit log.
+func (a *Admin) Maintenance(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var r MaintenanceRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(resp, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := maintenancestate.EnterMaintenance
+	switch r.Action {
+	case "enter":
+	case "leave":
+		action = maintenancestate.LeaveMaintenance
+	default:
+		http.Error(resp, "action must be enter or leave", http.StatusBadRequest)
+		return
+	}
+	switch r.Kind {
+	case "machine":
+		if !machineRegExp.MatchString(r.Name) {
+			http.Error(resp, "invalid machine name: "+r.Name, http.StatusBadRequest)
+			return
+		}
+	case "site":
+		if !siteRegExp.MatchString(r.Name) {
+			http.Error(resp, "invalid site name: "+r.Name, http.StatusBadRequest)
+			return
+		}
+		if _, err := a.state.SiteMachines(r.Name); err != nil {
+			http.Error(resp, "unknown site: "+r.Name, http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(resp, "kind must be machine or site", http.StatusBadRequest)
+		return
+	}
+	if r.Issue == "" {
+		r.Issue = manualIssue
+	}
+
+	c := maintenancestate.Change{Kind: r.Kind, Name: r.Name, Action: action, Origin: maintenancestate.Origin{Cause: "manual"}, Reason: r.Reason}
+	result := MaintenanceResponse{Modifications: a.state.Apply(c, r.Issue, a.project)}
+	slog.Info("Admin request", "remote", req.RemoteAddr, "action", r.Action, "kind", r.Kind, "entity", r.Name,
+		"issue", r.Issue, "modifications", result.Modifications)
+
+	if result.Modifications > 0 {
+		if err := a.state.Write(); err != nil {
+			slog.Error("Failed to write state after admin request", "err", err)
+			metrics.CountError("writefile", "admin.Maintenance")
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(result)
+}
+
+// CloseIssue removes all maintenance of the issue given by the "issue"
+// parameter, as if it had been closed, e.g. because it was closed while the
+// exporter was down. The resulting transitions have the cause "manual".
+func (a *Admin) CloseIssue(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	issue := req.URL.Query().Get("issue")
+	if issue == "" {
+		http.Error(resp, "issue is required", http.StatusBadRequest)
+		return
+	}
+	result := MaintenanceResponse{Modifications: a.state.CloseIssueFrom(issue, a.project, maintenancestate.Origin{Cause: "manual"})}
+	slog.Info("Admin request to close issue", "remote", req.RemoteAddr, "issue", issue, "modifications", result.Modifications)
+
+	if result.Modifications > 0 {
+		if err := a.state.Write(); err != nil {
+			slog.Error("Failed to write state after admin request", "err", err)
+			metrics.CountError("writefile", "admin.CloseIssue")
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(result)
+}
+
+// RollbackResponse reports the backup restored by a rollback.
+type RollbackResponse struct {
+	RestoredFrom time.Time
+}
+
+// Rollback restores the newest backup of the state made at or before the time
+// given by the "to" parameter, in RFC3339 format.
+func (a *Admin) Rollback(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	to, err := time.Parse(time.RFC3339, req.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(resp, "to must be an RFC3339 time", http.StatusBadRequest)
+		return
+	}
+	slog.Info("Admin request to roll back the state", "remote", req.RemoteAddr, "to", to.Format(time.RFC3339))
+	restored, err := a.state.Rollback(to, a.project)
+	switch {
+	case errors.Is(err, maintenancestate.ErrNoBackup):
+		http.Error(resp, "there is no backup from before "+to.Format(time.RFC3339), http.StatusNotFound)
+		return
+	case err != nil && restored.IsZero():
+		slog.Error("Failed to roll back the state", "err", err)
+		metrics.CountError("rollback", "admin.Rollback")
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	case err != nil:
+		// The state was restored, but could not be written.
+		slog.Error("Failed to write state after rollback", "err", err)
+		metrics.CountError("writefile", "admin.Rollback")
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(RollbackResponse{RestoredFrom: restored})
+}
+
+// New creates an Admin for the given state, whose machines are listed by
+// machines.
+func New(state *maintenancestate.MaintenanceState, machines Machines, project string) *Admin {
+	return &Admin{state: state, machines: machines, project: project}
+}
@@ -0,0 +1,251 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+// fakeSites implements the maintenancestate.Sites and Machines interfaces for
+// testing.
+type fakeSites struct{}
+
+func (f *fakeSites) Machines(site string) ([]string, error) {
+	if site == "zzz99" {
+		return nil, errors.New("site not found")
+	}
+	return []string{"mlab1", "mlab2", "mlab3"}, nil
+}
+
+func (f *fakeSites) Reload(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeSites) MachineNames() []string {
+	return []string{"mlab1-abc01", "mlab3-abc01", "mlab1-xyz01", "mlab3-xyz01"}
+}
+
+func TestPattern(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := maintenancestate.New(dir+"/state.json", &fakeSites{}, "mlab-oti")
+	a := New(s, &fakeSites{}, "mlab-oti")
+
+	tests := []struct {
+		name         string
+		method       string
+		body         string
+		wantStatus   int
+		wantMachines []string
+	}{
+		{
+			name:         "glob",
+			method:       "POST",
+			body:         `{"Pattern": "mlab3-*", "Action": "enter", "Issue": "10"}`,
+			wantStatus:   http.StatusOK,
+			wantMachines: []string{"mlab3-abc01", "mlab3-xyz01"},
+		},
+		{
+			name:         "regex",
+			method:       "POST",
+			body:         `{"Pattern": "mlab[13]-abc01", "Syntax": "regex", "Action": "enter", "Issue": "11"}`,
+			wantStatus:   http.StatusOK,
+			wantMachines: []string{"mlab1-abc01", "mlab3-abc01"},
+		},
+		{
+			name:         "regex-is-anchored",
+			method:       "POST",
+			body:         `{"Pattern": "abc", "Syntax": "regex", "Action": "enter", "Issue": "11"}`,
+			wantStatus:   http.StatusOK,
+			wantMachines: []string{},
+		},
+		{
+			name:         "leave",
+			method:       "POST",
+			body:         `{"Pattern": "*-xyz01", "Action": "leave", "Issue": "10"}`,
+			wantStatus:   http.StatusOK,
+			wantMachines: []string{"mlab1-xyz01", "mlab3-xyz01"},
+		},
+		{name: "bad-method", method: "GET", wantStatus: http.StatusMethodNotAllowed},
+		{name: "bad-json", method: "POST", body: `{`, wantStatus: http.StatusBadRequest},
+		{name: "bad-action", method: "POST", body: `{"Pattern": "*", "Action": "pause", "Issue": "1"}`, wantStatus: http.StatusBadRequest},
+		{name: "no-issue", method: "POST", body: `{"Pattern": "*", "Action": "enter"}`, wantStatus: http.StatusBadRequest},
+		{name: "bad-glob", method: "POST", body: `{"Pattern": "[", "Action": "enter", "Issue": "1"}`, wantStatus: http.StatusBadRequest},
+		{name: "bad-regex", method: "POST", body: `{"Pattern": "(", "Syntax": "regex", "Action": "enter", "Issue": "1"}`, wantStatus: http.StatusBadRequest},
+		{name: "bad-syntax", method: "POST", body: `{"Pattern": "*", "Syntax": "sql", "Action": "enter", "Issue": "1"}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			a.Pattern(rec, httptest.NewRequest(tt.method, "/admin/v1/pattern", strings.NewReader(tt.body)))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("Pattern() status = %d; want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got PatternResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("Could not unmarshal response: %v", err)
+			}
+			if !reflect.DeepEqual(got.Machines, tt.wantMachines) {
+				t.Errorf("Pattern() machines = %v; want %v", got.Machines, tt.wantMachines)
+			}
+		})
+	}
+
+	want := map[string][]string{
+		"mlab1-abc01": {"11"},
+		"mlab3-abc01": {"10", "11"},
+	}
+	if got := s.Snapshot().Machines; !reflect.DeepEqual(got, want) {
+		t.Errorf("Machines = %v; want %v", got, want)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	dir := t.TempDir()
+	storage := &maintenancestate.FileStorage{Filename: dir + "/state.json", KeepBackups: 5}
+	s, _ := maintenancestate.NewWithStorage(storage, &fakeSites{}, "mlab-oti")
+	a := New(s, &fakeSites{}, "mlab-oti")
+
+	rollback := func(method, to string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		a.Rollback(rec, httptest.NewRequest(method, "/admin/rollback?to="+to, nil))
+		return rec
+	}
+	if rec := rollback("GET", "2030-01-01T00:00:00Z"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d; want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	if rec := rollback("POST", "yesterday"); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid time status = %d; want %d", rec.Code, http.StatusBadRequest)
+	}
+	if rec := rollback("POST", "2030-01-01T00:00:00Z"); rec.Code != http.StatusNotFound {
+		t.Errorf("status without backups = %d; want %d", rec.Code, http.StatusNotFound)
+	}
+
+	s.Write()
+	s.UpdateMachine("mlab1-abc01", maintenancestate.EnterMaintenance, "1", "mlab-oti")
+	s.Write()
+	rec := rollback("POST", "2100-01-01T00:00:00Z")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", rec.Code, http.StatusOK)
+	}
+	var got RollbackResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got.RestoredFrom.IsZero() {
+		t.Errorf("response = %s, %v; want the time of the restored backup", rec.Body, err)
+	}
+	if n := len(s.Snapshot().Machines); n != 0 {
+		t.Errorf("%d machines in maintenance after rollback; want 0", n)
+	}
+}
+
+// fakeListener records the transitions of a state.
+type fakeListener struct {
+	transitions []maintenancestate.Transition
+}
+
+func (f *fakeListener) Transition(t maintenancestate.Transition) {
+	f.transitions = append(f.transitions, t)
+}
+
+func TestMaintenance(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := maintenancestate.New(dir+"/state.json", &fakeSites{}, "mlab-oti")
+	l := &fakeListener{}
+	s.AddListener(l)
+	a := New(s, &fakeSites{}, "mlab-oti")
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+		wantMods   int
+	}{
+		{name: "machine", method: "POST", body: `{"Kind": "machine", "Name": "mlab1-xyz01", "Action": "enter"}`, wantStatus: http.StatusOK, wantMods: 1},
+		{name: "site", method: "POST", body: `{"Kind": "site", "Name": "abc01", "Action": "enter", "Issue": "42"}`, wantStatus: http.StatusOK, wantMods: 4},
+		{name: "again", method: "POST", body: `{"Kind": "machine", "Name": "mlab1-xyz01", "Action": "enter"}`, wantStatus: http.StatusOK, wantMods: 0},
+		{name: "leave", method: "POST", body: `{"Kind": "machine", "Name": "mlab1-xyz01", "Action": "leave"}`, wantStatus: http.StatusOK, wantMods: 1},
+		{name: "bad-method", method: "GET", wantStatus: http.StatusMethodNotAllowed},
+		{name: "bad-json", method: "POST", body: `{`, wantStatus: http.StatusBadRequest},
+		{name: "bad-action", method: "POST", body: `{"Kind": "machine", "Name": "mlab1-xyz01", "Action": "pause"}`, wantStatus: http.StatusBadRequest},
+		{name: "bad-kind", method: "POST", body: `{"Kind": "rack", "Name": "r1", "Action": "enter"}`, wantStatus: http.StatusBadRequest},
+		{name: "bad-machine", method: "POST", body: `{"Kind": "machine", "Name": "mlab1.xyz01.example", "Action": "enter"}`, wantStatus: http.StatusBadRequest},
+		{name: "bad-site", method: "POST", body: `{"Kind": "site", "Name": "abc", "Action": "enter"}`, wantStatus: http.StatusBadRequest},
+		{name: "unknown-site", method: "POST", body: `{"Kind": "site", "Name": "zzz99", "Action": "enter"}`, wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			a.Maintenance(rec, httptest.NewRequest(tt.method, "/admin/maintenance", strings.NewReader(tt.body)))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("Maintenance() status = %d; want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got MaintenanceResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("Could not unmarshal response: %v", err)
+			}
+			if got.Modifications != tt.wantMods {
+				t.Errorf("Maintenance() modifications = %d; want %d", got.Modifications, tt.wantMods)
+			}
+		})
+	}
+
+	want := map[string][]string{
+		"mlab1-abc01": {"42"},
+		"mlab2-abc01": {"42"},
+		"mlab3-abc01": {"42"},
+	}
+	if got := s.Snapshot().Machines; !reflect.DeepEqual(got, want) {
+		t.Errorf("Machines = %v; want %v", got, want)
+	}
+	if len(l.transitions) != 6 {
+		t.Fatalf("%d transitions; want 6", len(l.transitions))
+	}
+	for _, tr := range l.transitions {
+		if tr.Cause != "manual" {
+			t.Errorf("transition %+v does not have the cause manual", tr)
+		}
+	}
+	if l.transitions[0].Issue != "manual" {
+		t.Errorf("issue of a change without one = %q; want manual", l.transitions[0].Issue)
+	}
+}
+
+func TestCloseIssue(t *testing.T) {
+	s, _ := maintenancestate.New(t.TempDir()+"/state.json", &fakeSites{}, "mlab-oti")
+	a := New(s, &fakeSites{}, "mlab-oti")
+	s.UpdateSite("abc01", maintenancestate.EnterMaintenance, "42", "mlab-oti")
+	s.UpdateMachine("mlab1-xyz01", maintenancestate.EnterMaintenance, "43", "mlab-oti")
+
+	rec := httptest.NewRecorder()
+	a.CloseIssue(rec, httptest.NewRequest("POST", "/admin/close-issue?issue=42", nil))
+	var got MaintenanceResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); rec.Code != http.StatusOK || err != nil || got.Modifications != 4 {
+		t.Errorf("CloseIssue() = %d %q; want 4 modifications", rec.Code, rec.Body.String())
+	}
+	if n := s.IssueEntities("42") + s.IssueEntities("43"); n != 1 {
+		t.Errorf("%d entities left in maintenance; want only that of issue 43", n)
+	}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/admin/close-issue?issue=43", nil),
+		httptest.NewRequest("POST", "/admin/close-issue", nil),
+	} {
+		rec := httptest.NewRecorder()
+		a.CloseIssue(rec, req)
+		if rec.Code == http.StatusOK {
+			t.Errorf("CloseIssue(%s %s) succeeded", req.Method, req.URL)
+		}
+	}
+}
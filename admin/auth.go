@@ -0,0 +1,61 @@
+package admin
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+// ReadTokens reads bearer tokens from a file, one per line. Blank lines and
+// lines starting with # are ignored.
+func ReadTokens(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	return tokens, scanner.Err()
+}
+
+// RequireToken only passes on requests to h that carry one of tokens as a
+// bearer token in their Authorization header. All requests are refused if
+// there are no tokens.
+func RequireToken(tokens []string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		got, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if ok && validToken(tokens, got) {
+			h.ServeHTTP(resp, req)
+			return
+		}
+		slog.Warn("Refusing unauthenticated request", "remote", req.RemoteAddr, "path", req.URL.Path)
+		metrics.CountError("unauthenticated", "admin.RequireToken")
+		resp.Header().Set("WWW-Authenticate", "Bearer")
+		resp.WriteHeader(http.StatusUnauthorized)
+	})
+}
+
+// validToken reports whether got is one of tokens.
+func validToken(tokens []string, got string) bool {
+	valid := false
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(got)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
@@ -0,0 +1,55 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+)
+
+func TestReadTokens(t *testing.T) {
+	dir := t.TempDir()
+	rtx.Must(os.WriteFile(dir+"/tokens", []byte("# operators\nabc\n\n  def  \n"), 0600), "Could not write tokens")
+	tokens, err := ReadTokens(dir + "/tokens")
+	if err != nil {
+		t.Fatalf("ReadTokens() error = %v", err)
+	}
+	if want := []string{"abc", "def"}; !reflect.DeepEqual(tokens, want) {
+		t.Errorf("ReadTokens() = %v; want %v", tokens, want)
+	}
+	if _, err := ReadTokens(dir + "/missing"); err == nil {
+		t.Error("ReadTokens() should fail for a missing file")
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	ok := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {})
+	tests := []struct {
+		name   string
+		tokens []string
+		header string
+		want   int
+	}{
+		{name: "valid", tokens: []string{"abc", "def"}, header: "Bearer def", want: http.StatusOK},
+		{name: "invalid", tokens: []string{"abc"}, header: "Bearer def", want: http.StatusUnauthorized},
+		{name: "missing", tokens: []string{"abc"}, want: http.StatusUnauthorized},
+		{name: "not-bearer", tokens: []string{"abc"}, header: "Basic abc", want: http.StatusUnauthorized},
+		{name: "no-tokens", header: "Bearer ", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/admin/v1/pattern", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			RequireToken(tt.tokens, ok).ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d; want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+// Package api provides HTTP endpoints that expose the maintenance state as
+// JSON for other services to consume.
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+// API serves read-only views of a MaintenanceState.
+type API struct {
+	state   *maintenancestate.MaintenanceState
+	history History
+}
+
+// History reconstructs the maintenance state of a project at a moment in the
+// past.
+type History interface {
+	At(project string, t time.Time) (maintenancestate.Snapshot, error)
+}
+
+// marshalJSON serializes v for a response, responding with an internal
+// server error if that fails.
+func marshalJSON(resp http.ResponseWriter, v interface{}, function string) ([]byte, bool) {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		slog.Error("Failed to marshal JSON response", "err", err)
+		metrics.CountError("marshaljson", function)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	return data, true
+}
+
+// writeJSON serializes v as the JSON response to a request.
+func writeJSON(resp http.ResponseWriter, v interface{}, function string) {
+	data, ok := marshalJSON(resp, v, function)
+	if !ok {
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(data)
+}
+
+// writeVersionedJSON serializes v as the JSON response to a request, tagged
+// with a version derived from its contents. If the request's If-None-Match
+// header names the same version, only a 304 Not Modified is sent, so that
+// frequent pollers do not download unchanged state.
+func writeVersionedJSON(resp http.ResponseWriter, req *http.Request, v interface{}, function string) {
+	data, ok := marshalJSON(resp, v, function)
+	if !ok {
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	resp.Header().Set("ETag", etag)
+	if etagMatches(req.Header.Get("If-None-Match"), etag) {
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(data)
+}
+
+// etagMatches reports whether an If-None-Match header matches etag.
+func etagMatches(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Schedule returns the changes that have been accepted but will only take
+// effect later, ordered by the time at which they will be applied.
+func (a *API) Schedule(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeVersionedJSON(resp, req, a.state.Scheduled(), "api.Schedule")
+}
+
+// State returns the machines and sites in maintenance, along with the issues
+// for which they are in maintenance. If the "at" parameter gives an RFC3339
+// time, the state at that time is reconstructed from the history instead. It
+// supports conditional requests with If-None-Match.
+func (a *API) State(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	at := req.URL.Query().Get("at")
+	if at == "" {
+		writeVersionedJSON(resp, req, a.state.Snapshot(), "api.State")
+		return
+	}
+	t, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		http.Error(resp, "at must be an RFC3339 time", http.StatusBadRequest)
+		return
+	}
+	if a.history == nil {
+		http.Error(resp, "history is not enabled", http.StatusNotImplemented)
+		return
+	}
+	snapshot, err := a.history.At(a.state.Project(), t)
+	if err != nil {
+		slog.Error("Failed to reconstruct the state", "at", at, "err", err)
+		metrics.CountError("history", "api.State")
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeVersionedJSON(resp, req, snapshot, "api.State")
+}
+
+// New creates an API for the given state.
+func New(state *maintenancestate.MaintenanceState) *API {
+	return &API{state: state}
+}
+
+// WithHistory sets the History used to answer queries about the past, and
+// returns a.
+func (a *API) WithHistory(h History) *API {
+	a.history = h
+	return a
+}
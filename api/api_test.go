@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/go/rtx"
+)
+
+// fakeSites implements the maintenancestate.Sites interface for testing.
+type fakeSites struct{}
+
+func (f *fakeSites) Machines(site string) ([]string, error) {
+	return []string{"mlab1", "mlab2"}, nil
+}
+
+func (f *fakeSites) Reload(ctx context.Context) error {
+	return nil
+}
+
+func newTestState(t *testing.T) *maintenancestate.MaintenanceState {
+	dir := t.TempDir()
+	s, _ := maintenancestate.New(dir+"/state.json", &fakeSites{}, "mlab-oti")
+	return s
+}
+
+func TestSchedule(t *testing.T) {
+	s := newTestState(t)
+	at := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	rtx.Must(s.Schedule([]maintenancestate.ScheduledChange{
+		{
+			Change: maintenancestate.Change{Kind: "site", Name: "abc01", Action: maintenancestate.EnterMaintenance},
+			Issue:  "1",
+			At:     at.Add(time.Hour),
+		},
+		{
+			Change: maintenancestate.Change{Kind: "machine", Name: "mlab1-xyz01", Action: maintenancestate.EnterMaintenance},
+			Issue:  "2",
+			At:     at,
+		},
+	}), "Could not schedule changes")
+	a := New(s)
+
+	rec := httptest.NewRecorder()
+	a.Schedule(rec, httptest.NewRequest("GET", "/api/v1/schedule", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Schedule() returned status %d", rec.Code)
+	}
+	var got []maintenancestate.ScheduledChange
+	rtx.Must(json.Unmarshal(rec.Body.Bytes(), &got), "Could not unmarshal response")
+	if len(got) != 2 || got[0].Name != "mlab1-xyz01" || got[1].Name != "abc01" {
+		t.Errorf("Schedule() returned the wrong changes: %+v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	a.Schedule(rec, httptest.NewRequest("POST", "/api/v1/schedule", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Schedule() should not allow POST; got status %d", rec.Code)
+	}
+}
+
+func TestState(t *testing.T) {
+	s := newTestState(t)
+	s.UpdateSite("abc01", maintenancestate.EnterMaintenance, "1", "mlab-oti")
+	a := New(s)
+
+	rec := httptest.NewRecorder()
+	a.State(rec, httptest.NewRequest("GET", "/api/v1/state", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("State() returned status %d", rec.Code)
+	}
+	var got maintenancestate.Snapshot
+	rtx.Must(json.Unmarshal(rec.Body.Bytes(), &got), "Could not unmarshal response")
+	if len(got.Sites) != 1 || len(got.Machines) != 2 || got.Sites["abc01"][0] != "1" {
+		t.Errorf("State() returned the wrong state: %+v", got)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("State() did not set an ETag")
+	}
+
+	// An unchanged state is not sent again.
+	req := httptest.NewRequest("GET", "/api/v1/state", nil)
+	req.Header.Set("If-None-Match", `"other", `+etag)
+	rec = httptest.NewRecorder()
+	a.State(rec, req)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("State() with a matching ETag returned status %d and %d bytes", rec.Code, rec.Body.Len())
+	}
+
+	// A changed state is.
+	s.UpdateSite("abc01", maintenancestate.LeaveMaintenance, "1", "mlab-oti")
+	rec = httptest.NewRecorder()
+	a.State(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("State() after a change returned status %d with ETag %s", rec.Code, rec.Header().Get("ETag"))
+	}
+
+	rec = httptest.NewRecorder()
+	a.State(rec, httptest.NewRequest("POST", "/api/v1/state", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("State() should not allow POST; got status %d", rec.Code)
+	}
+}
+
+type fakeHistory struct {
+	err error
+}
+
+func (f *fakeHistory) At(project string, t time.Time) (maintenancestate.Snapshot, error) {
+	return maintenancestate.Snapshot{Sites: map[string][]string{"abc01": {t.Format(time.RFC3339)}}}, f.err
+}
+
+func TestStateAt(t *testing.T) {
+	s := newTestState(t)
+	get := func(a *API, at string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		a.State(rec, httptest.NewRequest("GET", "/api/v1/state?at="+at, nil))
+		return rec
+	}
+
+	if rec := get(New(s), "2030-01-01T00:00:00Z"); rec.Code != http.StatusNotImplemented {
+		t.Errorf("State() without history returned status %d; want %d", rec.Code, http.StatusNotImplemented)
+	}
+	a := New(s).WithHistory(&fakeHistory{})
+	if rec := get(a, "noon"); rec.Code != http.StatusBadRequest {
+		t.Errorf("State() with an invalid time returned status %d; want %d", rec.Code, http.StatusBadRequest)
+	}
+	rec := get(a, "2030-01-01T00:00:00Z")
+	var got maintenancestate.Snapshot
+	rtx.Must(json.Unmarshal(rec.Body.Bytes(), &got), "Could not unmarshal response")
+	if rec.Code != http.StatusOK || got.Sites["abc01"][0] != "2030-01-01T00:00:00Z" {
+		t.Errorf("State() returned status %d and state %+v", rec.Code, got)
+	}
+	a = New(s).WithHistory(&fakeHistory{err: errors.New("corrupt")})
+	if rec := get(a, "2030-01-01T00:00:00Z"); rec.Code != http.StatusInternalServerError {
+		t.Errorf("State() with a failing history returned status %d; want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+// peerTimeout bounds how long a federated request waits for each peer.
+const peerTimeout = 10 * time.Second
+
+// Peer is another instance of the exporter, serving the state of a project.
+type Peer struct {
+	Project string
+	// URL is the base URL of the peer, e.g. https://gmx.mlab-staging.example.
+	URL string
+	// Token, if set, is sent to the peer as a bearer token.
+	Token string
+}
+
+// Federation serves a merged view of the states of this instance and its
+// peers.
+type Federation struct {
+	project string
+	state   *maintenancestate.MaintenanceState
+	peers   []Peer
+	client  *http.Client
+}
+
+// FederatedState is the state of several projects, keyed by project. Peers
+// whose state could not be fetched are listed in Errors instead.
+type FederatedState struct {
+	Projects map[string]maintenancestate.Snapshot
+	Errors   map[string]string `json:",omitempty"`
+}
+
+// NewFederation creates a Federation of the state of project with the states
+// of peers.
+func NewFederation(project string, state *maintenancestate.MaintenanceState, peers []Peer) *Federation {
+	return &Federation{
+		project: project,
+		state:   state,
+		peers:   peers,
+		client:  &http.Client{Timeout: peerTimeout},
+	}
+}
+
+// fetch gets the current state of a peer.
+func (f *Federation) fetch(ctx context.Context, p Peer) (maintenancestate.Snapshot, error) {
+	var snapshot maintenancestate.Snapshot
+	url := strings.TrimSuffix(p.URL, "/") + "/api/v1/state"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return snapshot, err
+	}
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return snapshot, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return snapshot, fmt.Errorf("unexpected status from %s: %s", url, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&snapshot)
+	return snapshot, err
+}
+
+// Federated returns the states of this instance and all of its peers, fetched
+// concurrently. It supports conditional requests with If-None-Match.
+func (f *Federation) Federated(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	result := FederatedState{
+		Projects: map[string]maintenancestate.Snapshot{f.project: f.state.Snapshot()},
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range f.peers {
+		wg.Add(1)
+		go func(p Peer) {
+			defer wg.Done()
+			snapshot, err := f.fetch(req.Context(), p)
+			if err != nil {
+				slog.Error("Could not fetch the state of a peer", "project", p.Project, "url", p.URL, "err", err)
+				metrics.CountError("federation", "api.Federated")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if result.Errors == nil {
+					result.Errors = make(map[string]string)
+				}
+				result.Errors[p.Project] = err.Error()
+				return
+			}
+			result.Projects[p.Project] = snapshot
+		}(p)
+	}
+	wg.Wait()
+	writeVersionedJSON(resp, req, result, "api.Federated")
+}
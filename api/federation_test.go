@@ -0,0 +1,89 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/go/rtx"
+)
+
+func TestFederated(t *testing.T) {
+	local := newTestState(t)
+	local.UpdateSite("abc01", maintenancestate.EnterMaintenance, "1", "mlab-oti")
+	peerState := newTestState(t)
+	peerState.UpdateMachine("mlab1-xyz01", maintenancestate.EnterMaintenance, "7", "mlab-staging")
+	peer := httptest.NewServer(http.HandlerFunc(New(peerState).State))
+	defer peer.Close()
+	broken := httptest.NewServer(http.NotFoundHandler())
+	defer broken.Close()
+
+	f := NewFederation("mlab-oti", local, []Peer{
+		{Project: "mlab-staging", URL: peer.URL + "/"},
+		{Project: "mlab-sandbox", URL: broken.URL},
+	})
+	rec := httptest.NewRecorder()
+	f.Federated(rec, httptest.NewRequest("GET", "/api/v1/federated", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Federated() returned status %d", rec.Code)
+	}
+	var got FederatedState
+	rtx.Must(json.Unmarshal(rec.Body.Bytes(), &got), "Could not unmarshal response")
+	if len(got.Projects) != 2 {
+		t.Fatalf("Federated() returned projects %+v; want mlab-oti and mlab-staging", got.Projects)
+	}
+	if _, ok := got.Projects["mlab-oti"].Sites["abc01"]; !ok {
+		t.Errorf("Federated() is missing the local site: %+v", got.Projects["mlab-oti"])
+	}
+	if issues := got.Projects["mlab-staging"].Machines["mlab1-xyz01"]; len(issues) != 1 || issues[0] != "7" {
+		t.Errorf("Federated() has the wrong peer machines: %+v", got.Projects["mlab-staging"])
+	}
+	if _, ok := got.Errors["mlab-sandbox"]; !ok || len(got.Errors) != 1 {
+		t.Errorf("Federated() errors = %+v; want only mlab-sandbox", got.Errors)
+	}
+
+	etag := rec.Header().Get("ETag")
+	req := httptest.NewRequest("GET", "/api/v1/federated", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	f.Federated(rec, req)
+	if etag == "" || rec.Code != http.StatusNotModified {
+		t.Errorf("Federated() with If-None-Match returned status %d; want %d", rec.Code, http.StatusNotModified)
+	}
+
+	rec = httptest.NewRecorder()
+	f.Federated(rec, httptest.NewRequest("POST", "/api/v1/federated", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Federated() POST returned status %d; want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestFederatedToken(t *testing.T) {
+	peerState := newTestState(t)
+	peerState.UpdateMachine("mlab1-xyz01", maintenancestate.EnterMaintenance, "7", "mlab-staging")
+	peer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		New(peerState).State(resp, req)
+	}))
+	defer peer.Close()
+
+	f := NewFederation("mlab-oti", newTestState(t), []Peer{
+		{Project: "mlab-staging", URL: peer.URL, Token: "secret"},
+		{Project: "mlab-sandbox", URL: peer.URL},
+	})
+	rec := httptest.NewRecorder()
+	f.Federated(rec, httptest.NewRequest("GET", "/api/v1/federated", nil))
+	var got FederatedState
+	rtx.Must(json.Unmarshal(rec.Body.Bytes(), &got), "Could not unmarshal response")
+	if _, ok := got.Projects["mlab-staging"]; !ok {
+		t.Errorf("Federated() could not fetch the state of a peer with its token: %+v", got)
+	}
+	if _, ok := got.Errors["mlab-sandbox"]; !ok {
+		t.Errorf("Federated() fetched the state of a peer without its token: %+v", got)
+	}
+}
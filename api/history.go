@@ -0,0 +1,94 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+// historyResponse is the body of a response from History.
+type historyResponse struct {
+	Entity        string
+	At            time.Time
+	InMaintenance bool
+	// Issues holds, for the entity and each entity containing it (e.g. the
+	// site of a machine) that was in maintenance, the issues for which it
+	// was.
+	Issues map[string][]string
+}
+
+// parseTime parses an RFC3339 time, also accepting times without seconds,
+// e.g. 2024-06-01T12:00Z.
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		var err2 error
+		if t, err2 = time.Parse("2006-01-02T15:04Z07:00", s); err2 == nil {
+			return t, nil
+		}
+	}
+	return t, err
+}
+
+// containing returns entity followed by the entities whose maintenance also
+// puts it in maintenance, e.g. the machine and site of an experiment.
+func containing(entity string) []string {
+	names := []string{entity}
+	if _, machine, ok := strings.Cut(entity, "@"); ok {
+		names = append(names, machine)
+		entity = machine
+	}
+	if _, site, ok := strings.Cut(entity, "-"); ok {
+		site, _, _ = strings.Cut(site, ".")
+		names = append(names, site)
+	}
+	return names
+}
+
+// History reports whether the entity named by the "entity" parameter, e.g.
+// mlab1-abc01, was in maintenance at the time given by the "at" parameter, or
+// now if it is omitted. A machine is in maintenance while its site is, and an
+// experiment while its machine or site is.
+func (a *API) History(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	entity := req.URL.Query().Get("entity")
+	if entity == "" {
+		http.Error(resp, "entity is required", http.StatusBadRequest)
+		return
+	}
+	t := time.Now().UTC()
+	if at := req.URL.Query().Get("at"); at != "" {
+		var err error
+		if t, err = parseTime(at); err != nil {
+			http.Error(resp, "at must be an RFC3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	if a.history == nil {
+		http.Error(resp, "history is not enabled", http.StatusNotImplemented)
+		return
+	}
+	snapshot, err := a.history.At(a.state.Project(), t)
+	if err != nil {
+		slog.Error("Failed to reconstruct the state", "at", t, "err", err)
+		metrics.CountError("history", "api.History")
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	result := historyResponse{Entity: entity, At: t, Issues: map[string][]string{}}
+	for _, name := range containing(entity) {
+		for _, m := range []map[string][]string{snapshot.Machines, snapshot.Sites, snapshot.Experiments, snapshot.Switches} {
+			if issues, ok := m[name]; ok {
+				result.Issues[name] = issues
+				result.InMaintenance = true
+			}
+		}
+	}
+	writeJSON(resp, result, "api.History")
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/go/rtx"
+)
+
+// siteHistory has site abc01 in maintenance for issue 1 from noon on
+// 2024-06-01 onwards.
+type siteHistory struct{}
+
+func (siteHistory) At(project string, t time.Time) (maintenancestate.Snapshot, error) {
+	snapshot := maintenancestate.Snapshot{
+		Machines: map[string][]string{"mlab2-xyz01": {"2"}},
+		Sites:    map[string][]string{},
+	}
+	if !t.Before(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)) {
+		snapshot.Sites["abc01"] = []string{"1"}
+	}
+	return snapshot, nil
+}
+
+func TestHistory(t *testing.T) {
+	s := newTestState(t)
+	tests := []struct {
+		name       string
+		history    History
+		query      string
+		wantStatus int
+		wantIn     bool
+		wantIssues map[string][]string
+	}{
+		{
+			name:       "machine-via-site",
+			history:    siteHistory{},
+			query:      "?entity=mlab1-abc01&at=2024-06-01T12:00Z",
+			wantStatus: http.StatusOK,
+			wantIn:     true,
+			wantIssues: map[string][]string{"abc01": {"1"}},
+		},
+		{
+			name:       "before",
+			history:    siteHistory{},
+			query:      "?entity=mlab1-abc01&at=2024-06-01T11:59:59Z",
+			wantStatus: http.StatusOK,
+			wantIssues: map[string][]string{},
+		},
+		{
+			name:       "experiment-via-machine",
+			history:    siteHistory{},
+			query:      "?entity=ndt@mlab2-xyz01&at=2024-06-01T00:00:00Z",
+			wantStatus: http.StatusOK,
+			wantIn:     true,
+			wantIssues: map[string][]string{"mlab2-xyz01": {"2"}},
+		},
+		{
+			name:       "missing-entity",
+			history:    siteHistory{},
+			query:      "?at=2024-06-01T12:00Z",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "bad-time",
+			history:    siteHistory{},
+			query:      "?entity=abc01&at=noon",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "no-history",
+			query:      "?entity=abc01",
+			wantStatus: http.StatusNotImplemented,
+		},
+		{
+			name:       "failing-history",
+			history:    &fakeHistory{err: errors.New("corrupt")},
+			query:      "?entity=abc01",
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(s)
+			if tt.history != nil {
+				a.WithHistory(tt.history)
+			}
+			rec := httptest.NewRecorder()
+			a.History(rec, httptest.NewRequest("GET", "/history"+tt.query, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("History() returned status %d; want %d", rec.Code, tt.wantStatus)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var got historyResponse
+			rtx.Must(json.Unmarshal(rec.Body.Bytes(), &got), "Could not unmarshal response")
+			if got.InMaintenance != tt.wantIn || !reflect.DeepEqual(got.Issues, tt.wantIssues) {
+				t.Errorf("History() = %+v; want InMaintenance %t and issues %v", got, tt.wantIn, tt.wantIssues)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+// Loader reports when data was last successfully loaded.
+type Loader interface {
+	Loaded() time.Time
+}
+
+// Status tracks the health of the exporter and serves it as JSON, so that
+// external monitoring can tell that the exporter is actually functioning. It
+// implements handler.Tracker.
+type Status struct {
+	state *maintenancestate.MaintenanceState
+	// states holds the state of every project, including state.
+	states  []*maintenancestate.MaintenanceState
+	sites   Loader
+	started time.Time
+
+	mu        sync.Mutex
+	received  time.Time
+	processed time.Time
+}
+
+// statusResponse is the body of a response from Status.
+type statusResponse struct {
+	Started              time.Time
+	UptimeSeconds        float64
+	LastWebhookReceived  time.Time
+	LastWebhookProcessed time.Time
+	LastStateWrite       time.Time
+	SiteinfoLoaded       time.Time
+	SiteinfoAgeSeconds   float64
+	// QueueDepth is the number of changes waiting to be applied.
+	QueueDepth int
+	Entities   maintenancestate.Counts
+	// Degraded is true while state-changing webhooks are being refused.
+	Degraded bool
+	// Projects holds the status of the state of every project, keyed by
+	// project. The fields above are those of the default project.
+	Projects map[string]projectStatus
+}
+
+// projectStatus is the status of the state of a single project.
+type projectStatus struct {
+	LastStateWrite time.Time
+	QueueDepth     int
+	Entities       maintenancestate.Counts
+	Degraded       bool
+}
+
+// WebhookReceived records that a webhook was received.
+func (s *Status) WebhookReceived() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received = time.Now()
+}
+
+// WebhookProcessed records that a webhook was validated and processed.
+func (s *Status) WebhookProcessed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.processed = time.Now()
+}
+
+// ServeHTTP returns the current status of the exporter.
+func (s *Status) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	counts := s.state.Counts()
+	loaded := s.sites.Loaded()
+	projects := make(map[string]projectStatus, len(s.states))
+	for _, state := range s.states {
+		c := state.Counts()
+		projects[state.Project()] = projectStatus{
+			LastStateWrite: state.Written(),
+			QueueDepth:     c.Scheduled,
+			Entities:       c,
+			Degraded:       state.Degraded(),
+		}
+	}
+
+	s.mu.Lock()
+	r := statusResponse{
+		Started:              s.started,
+		UptimeSeconds:        now.Sub(s.started).Seconds(),
+		LastWebhookReceived:  s.received,
+		LastWebhookProcessed: s.processed,
+		LastStateWrite:       s.state.Written(),
+		SiteinfoLoaded:       loaded,
+		QueueDepth:           counts.Scheduled,
+		Entities:             counts,
+		Degraded:             s.state.Degraded(),
+		Projects:             projects,
+	}
+	s.mu.Unlock()
+	if !loaded.IsZero() {
+		r.SiteinfoAgeSeconds = now.Sub(loaded).Seconds()
+	}
+	writeJSON(resp, r, "api.Status")
+}
+
+// Ready responds with 200 OK once the siteinfo data has been loaded, and 503
+// Service Unavailable until then, so that no webhooks are routed to the
+// exporter before it can handle them. The state is always restored before
+// the Status is created.
+func (s *Status) Ready(resp http.ResponseWriter, req *http.Request) {
+	if s.sites.Loaded().IsZero() {
+		http.Error(resp, "siteinfo data has not been loaded", http.StatusServiceUnavailable)
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	fmt.Fprintln(resp, "ready")
+}
+
+// Live responds with 200 OK as long as the exporter is serving requests.
+func (s *Status) Live(resp http.ResponseWriter, req *http.Request) {
+	resp.WriteHeader(http.StatusOK)
+	fmt.Fprintln(resp, "ok")
+}
+
+// NewStatus creates a Status for the given state and siteinfo data, counting
+// uptime from now.
+func NewStatus(state *maintenancestate.MaintenanceState, sites Loader) *Status {
+	return &Status{
+		state:   state,
+		states:  []*maintenancestate.MaintenanceState{state},
+		sites:   sites,
+		started: time.Now(),
+	}
+}
+
+// WithProjects adds the states of other projects, which repositories are
+// routed to, to the status, and returns s.
+func (s *Status) WithProjects(states ...*maintenancestate.MaintenanceState) *Status {
+	s.states = append(s.states, states...)
+	return s
+}
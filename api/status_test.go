@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/go/rtx"
+)
+
+type fakeLoader struct {
+	loaded time.Time
+}
+
+func (f *fakeLoader) Loaded() time.Time {
+	return f.loaded
+}
+
+func TestStatus(t *testing.T) {
+	s := newTestState(t)
+	s.UpdateSite("abc01", maintenancestate.EnterMaintenance, "1", "mlab-oti")
+	rtx.Must(s.Write(), "Could not write state")
+	loaded := time.Now().Add(-time.Minute)
+	st := NewStatus(s, &fakeLoader{loaded: loaded})
+	st.WebhookReceived()
+	st.WebhookProcessed()
+
+	rec := httptest.NewRecorder()
+	st.ServeHTTP(rec, httptest.NewRequest("GET", "/statusz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ServeHTTP() returned status %d", rec.Code)
+	}
+	var got statusResponse
+	rtx.Must(json.Unmarshal(rec.Body.Bytes(), &got), "Could not unmarshal response")
+	if got.LastWebhookReceived.IsZero() || got.LastWebhookProcessed.IsZero() || got.LastStateWrite.IsZero() {
+		t.Errorf("ServeHTTP() returned zero timestamps: %+v", got)
+	}
+	if !got.SiteinfoLoaded.Equal(loaded) || got.SiteinfoAgeSeconds < 60 {
+		t.Errorf("ServeHTTP() returned wrong siteinfo freshness: %+v", got)
+	}
+	want := maintenancestate.Counts{Machines: 2, Sites: 1}
+	if got.Entities != want {
+		t.Errorf("ServeHTTP() returned entities %+v; want %+v", got.Entities, want)
+	}
+
+	rec = httptest.NewRecorder()
+	st.ServeHTTP(rec, httptest.NewRequest("POST", "/statusz", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("ServeHTTP() with POST returned status %d; want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestStatusProjects(t *testing.T) {
+	s := newTestState(t)
+	s.UpdateSite("abc01", maintenancestate.EnterMaintenance, "1", "mlab-oti")
+	other, _ := maintenancestate.New(t.TempDir()+"/state.json", &fakeSites{}, "mlab-staging")
+	other.UpdateMachine("mlab1-def01", maintenancestate.EnterMaintenance, "2", "mlab-staging")
+	st := NewStatus(s, &fakeLoader{}).WithProjects(other)
+
+	rec := httptest.NewRecorder()
+	st.ServeHTTP(rec, httptest.NewRequest("GET", "/statusz", nil))
+	var got statusResponse
+	rtx.Must(json.Unmarshal(rec.Body.Bytes(), &got), "Could not unmarshal response")
+	want := map[string]maintenancestate.Counts{
+		"mlab-oti":     {Machines: 2, Sites: 1},
+		"mlab-staging": {Machines: 1},
+	}
+	if len(got.Projects) != len(want) {
+		t.Fatalf("ServeHTTP() returned projects %+v; want %v", got.Projects, want)
+	}
+	for project, counts := range want {
+		if got.Projects[project].Entities != counts {
+			t.Errorf("ServeHTTP() returned entities %+v for %s; want %+v", got.Projects[project].Entities, project, counts)
+		}
+	}
+}
+
+func TestReadyAndLive(t *testing.T) {
+	loader := &fakeLoader{}
+	st := NewStatus(newTestState(t), loader)
+	get := func(h http.HandlerFunc, path string) int {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+	if code := get(st.Ready, "/ready"); code != http.StatusServiceUnavailable {
+		t.Errorf("Ready() before siteinfo is loaded returned status %d; want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := get(st.Live, "/live"); code != http.StatusOK {
+		t.Errorf("Live() returned status %d; want %d", code, http.StatusOK)
+	}
+	loader.loaded = time.Now()
+	if code := get(st.Ready, "/ready"); code != http.StatusOK {
+		t.Errorf("Ready() after siteinfo is loaded returned status %d; want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,425 @@
+// Package audit keeps a tamper-evident log of changes to the maintenance
+// state. Every record includes the hash of the record before it, so that
+// altering or removing a record breaks the chain, and segments of the log may
+// be signed with a key that the exporter cannot read.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+const (
+	// queueSize is how many transitions may be waiting to be logged before
+	// new ones must wait for room.
+	queueSize   = 1000
+	signTimeout = 10 * time.Second
+	// mirrorInterval is how often the log is copied to the mirror, if
+	// records were appended since it was last copied.
+	mirrorInterval = 30 * time.Second
+)
+
+// Record is a single entry in the audit log.
+type Record struct {
+	Time time.Time
+	// Kind is "machine", "site", "experiment" or "switch".
+	Kind string
+	Name string
+	// Action is either "enter" or "leave".
+	Action string
+	Issue  string `json:",omitempty"`
+	// Cause, if set, is why the change was made other than for an issue,
+	// e.g. "rollback".
+	Cause string `json:",omitempty"`
+	// Project is the project whose state was changed.
+	Project string `json:",omitempty"`
+	// Sender is the GitHub login that sent the webhook causing the change.
+	Sender string `json:",omitempty"`
+	// Delivery is the ID of the webhook delivery causing the change.
+	Delivery string `json:",omitempty"`
+	// Prev is the hash of the previous record, or empty for the first one.
+	Prev string
+	// Hash is the hex-encoded SHA-256 hash of the record without its Hash
+	// and Signature.
+	Hash string
+	// Signature, if set, is the base64-encoded signature of Hash. Since each
+	// hash covers the previous one, it vouches for every earlier record.
+	Signature string `json:",omitempty"`
+}
+
+// computeHash returns the hash of the record's contents and of Prev.
+func (r Record) computeHash() string {
+	r.Hash = ""
+	r.Signature = ""
+	data, _ := json.Marshal(r)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Signer signs the SHA-256 digest of a segment of the log.
+type Signer interface {
+	Sign(ctx context.Context, digest []byte) ([]byte, error)
+}
+
+// Log is an append-only, hash-chained audit log stored in a file.
+type Log struct {
+	// Mirror, if set, periodically receives a copy of the whole log while
+	// Run is running, e.g. a GCS object, so that the log survives the loss
+	// of the disk.
+	Mirror maintenancestate.Storage
+
+	mu        sync.Mutex
+	filename  string
+	file      *os.File
+	prev      string
+	unsigned  int
+	signer    Signer
+	signEvery int
+	queue     chan maintenancestate.Transition
+	// dirty is true if records were appended since the log was mirrored.
+	dirty bool
+	// running is true once Run has started, and done is closed when it has
+	// logged every queued transition and returned.
+	running bool
+	done    chan struct{}
+	// stopped is true once Run no longer takes transitions from the queue,
+	// after which they are appended directly. sendMu is held for reading
+	// while a transition is queued.
+	sendMu  sync.RWMutex
+	stopped bool
+}
+
+// Open opens the audit log in filename, creating it if necessary, verifies
+// the hash chain of any records already in it, and continues it. If signer is
+// not nil, every signEvery records are signed. A final record that is not
+// terminated by a newline was torn by a crash in the middle of an append, and
+// is removed.
+func Open(filename string, signer Signer, signEvery int) (*Log, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{
+		filename:  filename,
+		file:      f,
+		signer:    signer,
+		signEvery: signEvery,
+		queue:     make(chan maintenancestate.Transition, queueSize),
+		done:      make(chan struct{}),
+	}
+	if err = l.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("corrupt audit log %s: %w", filename, err)
+	}
+	return l, nil
+}
+
+// load reads and verifies the records in the file, truncating a torn final
+// record.
+func (l *Log) load() error {
+	data, err := io.ReadAll(l.file)
+	if err != nil {
+		return err
+	}
+	for n, offset := 1, 0; offset < len(data); n++ {
+		line, _, terminated := bytes.Cut(data[offset:], []byte("\n"))
+		var r Record
+		err := json.Unmarshal(line, &r)
+		if err == nil && r.Prev != l.prev {
+			err = errors.New("does not follow the previous record")
+		} else if err == nil && r.Hash != r.computeHash() {
+			err = errors.New("hash does not match its contents")
+		}
+		if err != nil && terminated {
+			return fmt.Errorf("record %d: %v", n, err)
+		}
+		if err != nil {
+			slog.Warn("Removing a torn record from the end of the audit log", "file", l.filename, "record", n, "err", err)
+			metrics.CountError("torn", "audit.Open")
+			return l.file.Truncate(int64(offset))
+		}
+		if !terminated {
+			// The record was written whole, but not its newline.
+			if _, err := l.file.Write([]byte("\n")); err != nil {
+				return err
+			}
+		}
+		l.prev = r.Hash
+		l.unsigned++
+		if r.Signature != "" {
+			l.unsigned = 0
+		}
+		offset += len(line) + 1
+	}
+	return nil
+}
+
+// Append adds a record to the log, filling in its Prev and Hash and signing
+// it if a segment is complete.
+func (l *Log) Append(ctx context.Context, r Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r.Prev = l.prev
+	r.Hash = r.computeHash()
+	r.Signature = ""
+	if l.signer != nil && l.signEvery > 0 && l.unsigned+1 >= l.signEvery {
+		digest, _ := hex.DecodeString(r.Hash)
+		sig, err := l.signer.Sign(ctx, digest)
+		if err != nil {
+			// The record is still written; the next one will be signed.
+			slog.Error("Failed to sign audit log segment", "err", err)
+			metrics.CountError("sign", "audit.Append")
+		} else {
+			r.Signature = base64.StdEncoding.EncodeToString(sig)
+		}
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	l.prev = r.Hash
+	l.unsigned++
+	if r.Signature != "" {
+		l.unsigned = 0
+	}
+	l.dirty = true
+	return nil
+}
+
+// mirror copies the log to l.Mirror if records were appended since it was
+// last copied. The copy is uploaded without holding l.mu, so that appends are
+// not held up. Failures are only logged, since the records are already
+// safely in the file, and the copy is retried next time.
+func (l *Log) mirror() {
+	l.mu.Lock()
+	if l.Mirror == nil || !l.dirty {
+		l.mu.Unlock()
+		return
+	}
+	data, err := os.ReadFile(l.filename)
+	if err == nil {
+		l.dirty = false
+	}
+	l.mu.Unlock()
+
+	if err == nil {
+		err = l.Mirror.Save(data)
+		if err != nil {
+			l.mu.Lock()
+			l.dirty = true
+			l.mu.Unlock()
+		}
+	}
+	if err != nil {
+		slog.Error("Failed to mirror audit log", "err", err)
+		metrics.CountError("mirror", "audit.mirror")
+	}
+}
+
+// Transition queues a record of a transition. If the queue is full, it waits
+// for room rather than drop the record, which holds up the change to the
+// state. Once Run has stopped taking transitions from the queue, the record
+// is appended directly.
+func (l *Log) Transition(t maintenancestate.Transition) {
+	l.sendMu.RLock()
+	defer l.sendMu.RUnlock()
+	if l.stopped {
+		l.record(context.Background(), t)
+		return
+	}
+	select {
+	case l.queue <- t:
+		return
+	default:
+	}
+	slog.Warn("Audit log queue is full, waiting for room", "entity", t.Name, "issue", t.Issue)
+	metrics.CountError("queuefull", "audit.Transition")
+	l.queue <- t
+}
+
+// Run appends queued transitions to the log, and copies it to the mirror
+// every mirrorInterval, until ctx is canceled. It then appends the
+// transitions still queued and copies the log to the mirror one last time.
+func (l *Log) Run(ctx context.Context) {
+	l.mu.Lock()
+	l.running = true
+	l.mu.Unlock()
+	defer close(l.done)
+	ticker := time.NewTicker(mirrorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			l.stop()
+			l.mirror()
+			return
+		case t := <-l.queue:
+			l.record(ctx, t)
+		case <-ticker.C:
+			l.mirror()
+		}
+	}
+}
+
+// stop appends the transitions still queued, including those of senders
+// waiting for room, after which Transition appends directly.
+func (l *Log) stop() {
+	stopped := make(chan struct{})
+	go func() {
+		// Taking sendMu waits for every sender already queueing.
+		l.sendMu.Lock()
+		l.stopped = true
+		l.sendMu.Unlock()
+		close(stopped)
+	}()
+	for {
+		select {
+		case t := <-l.queue:
+			l.record(context.Background(), t)
+		case <-stopped:
+			for {
+				select {
+				case t := <-l.queue:
+					l.record(context.Background(), t)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// record appends the record of a transition to the log.
+func (l *Log) record(ctx context.Context, t maintenancestate.Transition) {
+	ctx, cancel := context.WithTimeout(ctx, signTimeout)
+	defer cancel()
+	err := l.Append(ctx, Record{
+		Time:     t.Time.UTC(),
+		Kind:     t.Kind,
+		Name:     t.Name,
+		Action:   t.Action.String(),
+		Issue:    t.Issue,
+		Cause:    t.Cause,
+		Project:  t.Project,
+		Sender:   t.Sender,
+		Delivery: t.Delivery,
+	})
+	if err != nil {
+		slog.Error("Failed to write audit record", "entity", t.Name, "issue", t.Issue, "err", err)
+		metrics.CountError("writefile", "audit.Run")
+	}
+}
+
+// ServeHTTP returns the records of the log as a JSON array, oldest first. The
+// optional "since" and "until" parameters give RFC3339 times bounding the
+// records returned, and "name" and "issue" restrict them to one entity or
+// issue.
+func (l *Log) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	var since, until time.Time
+	var err error
+	if v := query.Get("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(resp, "since must be an RFC3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("until"); v != "" {
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(resp, "until must be an RFC3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	name := query.Get("name")
+	issue := query.Get("issue")
+
+	l.mu.Lock()
+	data, err := os.ReadFile(l.filename)
+	l.mu.Unlock()
+	if err != nil {
+		slog.Error("Failed to read audit log", "err", err)
+		metrics.CountError("readfile", "audit.ServeHTTP")
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	records := []Record{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var r Record
+		if json.Unmarshal(scanner.Bytes(), &r) != nil {
+			continue
+		}
+		if (!since.IsZero() && r.Time.Before(since)) || (!until.IsZero() && r.Time.After(until)) ||
+			(name != "" && r.Name != name) || (issue != "" && r.Issue != issue) {
+			continue
+		}
+		records = append(records, r)
+	}
+	data, _ = json.Marshal(records)
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(data)
+}
+
+// Close closes the file of the log. If Run was started, it first waits for
+// it to return, having logged every queued transition.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	running := l.running
+	l.mu.Unlock()
+	if running {
+		<-l.done
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Verify checks the hash chain of the audit log read from r, returning the
+// number of records. It does not check signatures, which requires the public
+// key of the signer.
+func Verify(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	prev := ""
+	n := 0
+	for scanner.Scan() {
+		n++
+		var rec Record
+		err := json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			return n, fmt.Errorf("record %d: %v", n, err)
+		}
+		if rec.Prev != prev {
+			return n, fmt.Errorf("record %d: does not follow the previous record", n)
+		}
+		if rec.Hash != rec.computeHash() {
+			return n, fmt.Errorf("record %d: hash does not match its contents", n)
+		}
+		prev = rec.Hash
+	}
+	return n, scanner.Err()
+}
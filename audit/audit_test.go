@@ -0,0 +1,298 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/go/rtx"
+)
+
+type fakeSigner struct {
+	err error
+}
+
+func (f *fakeSigner) Sign(ctx context.Context, digest []byte) ([]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return append([]byte("sig:"), digest[:4]...), nil
+}
+
+func readRecords(t *testing.T, filename string) []string {
+	data, err := os.ReadFile(filename)
+	rtx.Must(err, "Could not read audit log")
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestLog(t *testing.T) {
+	filename := t.TempDir() + "/audit.log"
+	signer := &fakeSigner{}
+	l, err := Open(filename, signer, 2)
+	rtx.Must(err, "Could not open audit log")
+
+	ctx := context.Background()
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	rtx.Must(l.Append(ctx, Record{Time: now, Kind: "site", Name: "abc01", Action: "enter", Issue: "1"}), "Could not append")
+	rtx.Must(l.Append(ctx, Record{Time: now, Kind: "machine", Name: "mlab1-abc01", Action: "enter", Issue: "1"}), "Could not append")
+	rtx.Must(l.Close(), "Could not close audit log")
+
+	// Reopening the log must continue the chain and the signing segments.
+	l, err = Open(filename, signer, 2)
+	rtx.Must(err, "Could not reopen audit log")
+	rtx.Must(l.Append(ctx, Record{Time: now, Kind: "site", Name: "abc01", Action: "leave", Issue: "1"}), "Could not append")
+	signer.err = errors.New("signing failed")
+	rtx.Must(l.Append(ctx, Record{Time: now, Kind: "site", Name: "abc02", Action: "enter"}), "Could not append")
+	rtx.Must(l.Close(), "Could not close audit log")
+
+	records := readRecords(t, filename)
+	if len(records) != 4 {
+		t.Fatalf("audit log has %d records; want 4", len(records))
+	}
+	for i, want := range []bool{false, true, false, false} {
+		if got := strings.Contains(records[i], `"Signature"`); got != want {
+			t.Errorf("record %d signed = %t; want %t", i, got, want)
+		}
+	}
+
+	data, _ := os.ReadFile(filename)
+	n, err := Verify(bytes.NewReader(data))
+	if err != nil || n != 4 {
+		t.Errorf("Verify() = %d, %v; want 4, nil", n, err)
+	}
+
+	// Altering a record must be detected.
+	tampered := strings.Replace(string(data), "abc02", "xyz02", 1)
+	if _, err := Verify(strings.NewReader(tampered)); err == nil {
+		t.Error("Verify() returned nil error for an altered record")
+	}
+	// So must removing one.
+	removed := strings.Join(append(records[:1:1], records[2:]...), "\n")
+	if _, err := Verify(strings.NewReader(removed)); err == nil {
+		t.Error("Verify() returned nil error for a removed record")
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	filename := t.TempDir() + "/audit.log"
+	rtx.Must(os.WriteFile(filename, []byte("not json\n"), 0644), "Could not write audit log")
+	if _, err := Open(filename, nil, 0); err == nil {
+		t.Error("Open() returned nil error for a corrupt audit log")
+	}
+
+	// A broken chain is refused, even in the last record.
+	l, err := Open(filename+"2", nil, 0)
+	rtx.Must(err, "Could not open audit log")
+	ctx := context.Background()
+	rtx.Must(l.Append(ctx, Record{Kind: "site", Name: "abc01", Action: "enter"}), "Could not append")
+	rtx.Must(l.Append(ctx, Record{Kind: "site", Name: "abc02", Action: "enter"}), "Could not append")
+	rtx.Must(l.Close(), "Could not close audit log")
+	data, err := os.ReadFile(filename + "2")
+	rtx.Must(err, "Could not read audit log")
+	rtx.Must(os.WriteFile(filename, bytes.Replace(data, []byte("abc02"), []byte("xyz02"), 1), 0644), "Could not write audit log")
+	if _, err := Open(filename, nil, 0); err == nil {
+		t.Error("Open() returned nil error for an altered audit log")
+	}
+}
+
+func TestOpenTorn(t *testing.T) {
+	filename := t.TempDir() + "/audit.log"
+	l, err := Open(filename, nil, 0)
+	rtx.Must(err, "Could not open audit log")
+	ctx := context.Background()
+	rtx.Must(l.Append(ctx, Record{Kind: "site", Name: "abc01", Action: "enter"}), "Could not append")
+	rtx.Must(l.Append(ctx, Record{Kind: "site", Name: "abc02", Action: "enter"}), "Could not append")
+	rtx.Must(l.Close(), "Could not close audit log")
+	data, err := os.ReadFile(filename)
+	rtx.Must(err, "Could not read audit log")
+
+	for name, contents := range map[string][]byte{
+		// A crash in the middle of the second record.
+		"torn": data[:len(data)-10],
+		// A crash after the second record, but before its newline.
+		"unterminated": data[:len(data)-1],
+	} {
+		t.Run(name, func(t *testing.T) {
+			rtx.Must(os.WriteFile(filename, contents, 0644), "Could not write audit log")
+			l, err := Open(filename, nil, 0)
+			if err != nil {
+				t.Fatalf("Open() returned an error for a torn audit log: %v", err)
+			}
+			rtx.Must(l.Append(ctx, Record{Kind: "site", Name: "abc03", Action: "enter"}), "Could not append")
+			rtx.Must(l.Close(), "Could not close audit log")
+			got, _ := os.ReadFile(filename)
+			want := 3
+			if name == "torn" {
+				want = 2
+			}
+			if n, err := Verify(bytes.NewReader(got)); err != nil || n != want {
+				t.Errorf("Verify() = %d, %v; want %d, nil", n, err, want)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	filename := t.TempDir() + "/audit.log"
+	l, err := Open(filename, nil, 0)
+	rtx.Must(err, "Could not open audit log")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go l.Run(ctx)
+	l.Transition(maintenancestate.Transition{
+		Kind:    "site",
+		Name:    "abc01",
+		Action:  maintenancestate.EnterMaintenance,
+		Issue:   "1",
+		Time:    time.Now(),
+		Project: "mlab-oti",
+		Origin:  maintenancestate.Origin{Cause: "rollback", Sender: "octocat", Delivery: "abc-123"},
+	})
+	for i := 0; i < 100; i++ {
+		if data, _ := os.ReadFile(filename); len(data) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	rtx.Must(l.Close(), "Could not close audit log")
+
+	records := readRecords(t, filename)
+	if len(records) != 1 || !strings.Contains(records[0], `"Action":"enter"`) || !strings.Contains(records[0], `"Cause":"rollback"`) ||
+		!strings.Contains(records[0], `"Project":"mlab-oti","Sender":"octocat","Delivery":"abc-123"`) {
+		t.Errorf("unexpected audit log: %v", records)
+	}
+}
+
+func TestRunDrains(t *testing.T) {
+	filename := t.TempDir() + "/audit.log"
+	l, err := Open(filename, nil, 0)
+	rtx.Must(err, "Could not open audit log")
+
+	mirror := &fakeMirror{}
+	l.Mirror = mirror
+
+	// Transitions still queued on shutdown are logged before Run returns,
+	// and the log is mirrored.
+	for _, name := range []string{"abc01", "abc02", "abc03"} {
+		l.Transition(maintenancestate.Transition{Kind: "site", Name: name, Action: maintenancestate.EnterMaintenance, Time: time.Now()})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.Run(ctx)
+	// Later transitions are appended directly.
+	l.Transition(maintenancestate.Transition{Kind: "site", Name: "abc04", Action: maintenancestate.EnterMaintenance, Time: time.Now()})
+	rtx.Must(l.Close(), "Could not close audit log")
+	if records := readRecords(t, filename); len(records) != 4 {
+		t.Errorf("audit log has %d records; want 4", len(records))
+	}
+	if n, err := Verify(bytes.NewReader(mirror.data)); err != nil || n != 3 {
+		t.Errorf("Verify() of the mirror = %d, %v; want 3, nil", n, err)
+	}
+}
+
+func TestTransitionFull(t *testing.T) {
+	filename := t.TempDir() + "/audit.log"
+	l, err := Open(filename, nil, 0)
+	rtx.Must(err, "Could not open audit log")
+
+	// A full queue holds up new transitions until Run makes room, instead of
+	// dropping them.
+	for i := 0; i < queueSize+10; i++ {
+		if i == queueSize {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go l.Run(ctx)
+		}
+		l.Transition(maintenancestate.Transition{Kind: "site", Name: fmt.Sprintf("s%04d", i), Action: maintenancestate.EnterMaintenance, Time: time.Now()})
+	}
+	for i := 0; i < 200; i++ {
+		if len(readRecords(t, filename)) == queueSize+10 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(readRecords(t, filename)); n != queueSize+10 {
+		t.Errorf("audit log has %d records; want %d", n, queueSize+10)
+	}
+}
+
+type fakeMirror struct {
+	data []byte
+}
+
+func (f *fakeMirror) Load() ([]byte, error) { return f.data, nil }
+func (f *fakeMirror) Save(data []byte) error {
+	f.data = data
+	return nil
+}
+
+func TestServeHTTP(t *testing.T) {
+	filename := t.TempDir() + "/audit.log"
+	l, err := Open(filename, nil, 0)
+	rtx.Must(err, "Could not open audit log")
+	defer l.Close()
+	mirror := &fakeMirror{}
+	l.Mirror = mirror
+
+	ctx := context.Background()
+	start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range []string{"abc01", "abc02", "abc01"} {
+		rec := Record{Time: start.Add(time.Duration(i) * time.Hour), Kind: "site", Name: name, Action: "enter", Issue: "1"}
+		rtx.Must(l.Append(ctx, rec), "Could not append")
+	}
+	if mirror.data != nil {
+		t.Error("The log should not be mirrored after every append")
+	}
+	l.mirror()
+	if data, _ := os.ReadFile(filename); !bytes.Equal(mirror.data, data) {
+		t.Errorf("mirror has %q; want %q", mirror.data, data)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		status int
+		want   int
+	}{
+		{name: "all", query: "", status: http.StatusOK, want: 3},
+		{name: "since", query: "?since=2030-01-01T01:00:00Z", status: http.StatusOK, want: 2},
+		{name: "since-until", query: "?since=2030-01-01T01:00:00Z&until=2030-01-01T01:30:00Z", status: http.StatusOK, want: 1},
+		{name: "name", query: "?name=abc01", status: http.StatusOK, want: 2},
+		{name: "issue", query: "?issue=2", status: http.StatusOK, want: 0},
+		{name: "bad-since", query: "?since=yesterday", status: http.StatusBadRequest},
+		{name: "bad-until", query: "?until=tomorrow", status: http.StatusBadRequest},
+		{name: "post", method: http.MethodPost, status: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			rec := httptest.NewRecorder()
+			l.ServeHTTP(rec, httptest.NewRequest(method, "/audit"+tt.query, nil))
+			if rec.Code != tt.status {
+				t.Fatalf("ServeHTTP() status = %d; want %d", rec.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var records []Record
+			rtx.Must(json.Unmarshal(rec.Body.Bytes(), &records), "Could not parse response")
+			if len(records) != tt.want {
+				t.Errorf("ServeHTTP() returned %d records; want %d", len(records), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/gcp"
+)
+
+// KMS signs digests with an asymmetric Cloud KMS key.
+type KMS struct {
+	// key is the resource name of a key version, i.e.
+	// projects/P/locations/L/keyRings/R/cryptoKeys/K/cryptoKeyVersions/V.
+	key    string
+	url    string
+	client *http.Client
+}
+
+// Sign signs a SHA-256 digest with the key.
+func (k *KMS) Sign(ctx context.Context, digest []byte) ([]byte, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"digest": map[string]string{"sha256": base64.StdEncoding.EncodeToString(digest)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s/v1/%s:asymmetricSign", k.url, k.key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from Cloud KMS: %s", resp.Status)
+	}
+	var signed struct {
+		Signature string `json:"signature"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&signed)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(signed.Signature)
+}
+
+// NewKMS creates a KMS signer for the given key version, authenticated as
+// the default service account.
+func NewKMS(key string) *KMS {
+	return &KMS{
+		key:    key,
+		url:    "https://cloudkms.googleapis.com",
+		client: gcp.NewClient(10 * time.Second),
+	}
+}
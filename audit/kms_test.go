@@ -0,0 +1,41 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKMSSign(t *testing.T) {
+	key := "projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/"+key+":asymmetricSign" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var req struct {
+			Digest struct {
+				SHA256 string `json:"sha256"`
+			} `json:"digest"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Digest.SHA256 != "AQID" {
+			t.Errorf("digest = %q; want %q", req.Digest.SHA256, "AQID")
+		}
+		w.Write([]byte(`{"signature": "c2lnbmVk"}`))
+	}))
+	defer srv.Close()
+
+	k := &KMS{key: key, url: srv.URL, client: srv.Client()}
+	sig, err := k.Sign(context.Background(), []byte{1, 2, 3})
+	if err != nil || string(sig) != "signed" {
+		t.Errorf("Sign() = %q, %v; want %q, nil", sig, err, "signed")
+	}
+
+	k.key = "missing"
+	if _, err := k.Sign(context.Background(), []byte{1, 2, 3}); err == nil {
+		t.Error("Sign() returned nil error for an error response")
+	}
+}
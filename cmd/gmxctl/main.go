@@ -0,0 +1,309 @@
+// gmxctl inspects and modifies the maintenance state of the exporter, either
+// by editing its state file directly (-state) or by calling the API of a
+// running instance (-url), so that operators do not have to hand-edit JSON.
+//
+// The state file should only be edited while the exporter is stopped, since a
+// running exporter overwrites it on its next write; use -url instead.
+//
+// Usage:
+//
+//	gmxctl [flags] list
+//	gmxctl [flags] add machine|site NAME [-issue ISSUE] [-reason REASON]
+//	gmxctl [flags] remove machine|site NAME [-issue ISSUE]
+//	gmxctl [flags] close-issue ISSUE
+//	gmxctl [flags] prune
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/admin"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/sites"
+)
+
+// manualIssue is the issue on whose behalf changes are made by default, as
+// for the admin API.
+const manualIssue = "manual"
+
+// ctl holds the settings shared by every command.
+type ctl struct {
+	stateFile string
+	url       string
+	token     string
+	project   string
+	client    *http.Client
+	out       io.Writer
+}
+
+// newSites returns the sites of a project. It is replaced in tests.
+var newSites = func(project string) (maintenancestate.Sites, error) {
+	s := sites.New(project)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return s, s.Reload(ctx)
+}
+
+// noSites is used when a command does not need siteinfo.
+type noSites struct{}
+
+func (noSites) Reload(ctx context.Context) error { return nil }
+
+func (noSites) Machines(site string) ([]string, error) {
+	return nil, errors.New("siteinfo is not loaded")
+}
+
+// openState opens the state file, loading siteinfo if withSites is true.
+func (c *ctl) openState(withSites bool) (*maintenancestate.MaintenanceState, error) {
+	var s maintenancestate.Sites = noSites{}
+	if withSites {
+		var err error
+		if s, err = newSites(c.project); err != nil {
+			return nil, fmt.Errorf("could not load siteinfo for %s: %v", c.project, err)
+		}
+	}
+	// Refuse to overwrite a state that could not be read.
+	return maintenancestate.New(c.stateFile, s, c.project)
+}
+
+// call sends a request to the API of a running instance and decodes its JSON
+// response into v.
+func (c *ctl) call(method, path string, body interface{}, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.url, "/")+path, r)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// list prints every machine, site, experiment and switch in maintenance, with
+// the issues for which it is in maintenance.
+func (c *ctl) list(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: list")
+	}
+	var snapshot maintenancestate.Snapshot
+	if c.url != "" {
+		if err := c.call(http.MethodGet, "/api/v1/state", nil, &snapshot); err != nil {
+			return err
+		}
+	} else {
+		state, err := c.openState(false)
+		if err != nil {
+			return err
+		}
+		snapshot = state.Snapshot()
+	}
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAME\tISSUES")
+	for _, k := range []struct {
+		kind     string
+		entities map[string][]string
+	}{
+		{"site", snapshot.Sites},
+		{"machine", snapshot.Machines},
+		{"experiment", snapshot.Experiments},
+		{"switch", snapshot.Switches},
+	} {
+		names := make([]string, 0, len(k.entities))
+		for name := range k.entities {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", k.kind, name, strings.Join(k.entities[name], ","))
+		}
+	}
+	return w.Flush()
+}
+
+// parseArgs parses args with fs, allowing flags to follow the positional
+// arguments, which are returned.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// change implements add and remove, which put a machine or site into
+// maintenance or take it out of maintenance.
+func (c *ctl) change(command string, args []string) error {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.SetOutput(c.out)
+	issue := fs.String("issue", manualIssue, "Issue on whose behalf the change is made.")
+	reason := fs.String("reason", "", "Why the machine or site enters maintenance.")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 || (args[0] != "machine" && args[0] != "site") {
+		return fmt.Errorf("usage: %s machine|site NAME [-issue ISSUE]", command)
+	}
+	kind, name := args[0], args[1]
+	action, actionName := maintenancestate.EnterMaintenance, "enter"
+	if command == "remove" {
+		action, actionName = maintenancestate.LeaveMaintenance, "leave"
+	}
+
+	var mods int
+	if c.url != "" {
+		req := admin.MaintenanceRequest{Kind: kind, Name: name, Action: actionName, Issue: *issue, Reason: *reason}
+		var result admin.MaintenanceResponse
+		if err := c.call(http.MethodPost, "/admin/maintenance", req, &result); err != nil {
+			return err
+		}
+		mods = result.Modifications
+	} else {
+		state, err := c.openState(kind == "site")
+		if err != nil {
+			return err
+		}
+		change := maintenancestate.Change{Kind: kind, Name: name, Action: action, Reason: *reason,
+			Origin: maintenancestate.Origin{Cause: "manual"}}
+		mods = state.Apply(change, *issue, c.project)
+		if mods > 0 {
+			if err := state.Write(); err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Fprintf(c.out, "%d modifications\n", mods)
+	return nil
+}
+
+// closeIssue removes all maintenance of an issue.
+func (c *ctl) closeIssue(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: close-issue ISSUE")
+	}
+	if c.url != "" {
+		var result admin.MaintenanceResponse
+		if err := c.call(http.MethodPost, "/admin/close-issue?issue="+url.QueryEscape(args[0]), nil, &result); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "%d modifications\n", result.Modifications)
+		return nil
+	}
+	state, err := c.openState(false)
+	if err != nil {
+		return err
+	}
+	mods := state.CloseIssueFrom(args[0], c.project, maintenancestate.Origin{Cause: "manual"})
+	if mods > 0 {
+		if err := state.Write(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(c.out, "%d modifications\n", mods)
+	return nil
+}
+
+// prune removes the sites and machines that no longer exist in siteinfo, and
+// puts machines added to sites in maintenance into maintenance.
+func (c *ctl) prune(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: prune")
+	}
+	if c.url != "" {
+		return errors.New("prune is only supported with -state")
+	}
+	state, err := c.openState(true)
+	if err != nil {
+		return err
+	}
+	before := state.Counts()
+	state.Prune(c.project)
+	after := state.Counts()
+	fmt.Fprintf(c.out, "%d machines and %d sites in maintenance; were %d and %d\n",
+		after.Machines, after.Sites, before.Machines, before.Sites)
+	return nil
+}
+
+// run runs the command in args, writing its output to out.
+func run(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("gmxctl", flag.ContinueOnError)
+	fs.SetOutput(out)
+	c := &ctl{out: out, client: &http.Client{Timeout: time.Minute}}
+	fs.StringVar(&c.stateFile, "state", "", "Filesystem path of the state file to edit. The exporter must not be running.")
+	fs.StringVar(&c.url, "url", "", "URL of a running exporter (e.g. http://localhost:9999) whose API to call instead of editing -state.")
+	tokenFile := fs.String("token-file", "", "Filesystem path of a file containing the bearer token sent with -url.")
+	fs.StringVar(&c.project, "project", "mlab-oti", "GCP project of the state.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (c.stateFile == "") == (c.url == "") {
+		return errors.New("exactly one of -state and -url is required")
+	}
+	if *tokenFile != "" {
+		data, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			return err
+		}
+		c.token = string(bytes.TrimSpace(data))
+	}
+	if fs.NArg() == 0 {
+		return errors.New("a command is required: list, add, remove, close-issue or prune")
+	}
+	command, rest := fs.Arg(0), fs.Args()[1:]
+	switch command {
+	case "list":
+		return c.list(rest)
+	case "add", "remove":
+		return c.change(command, rest)
+	case "close-issue":
+		return c.closeIssue(rest)
+	case "prune":
+		return c.prune(rest)
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+func main() {
+	log.SetFlags(0)
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/github-maintenance-exporter/admin"
+	"github.com/m-lab/github-maintenance-exporter/gmxtest"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/go/rtx"
+)
+
+func TestRunStateFile(t *testing.T) {
+	defer func(f func(string) (maintenancestate.Sites, error)) { newSites = f }(newSites)
+	newSites = func(project string) (maintenancestate.Sites, error) {
+		return gmxtest.Sites{"abc01": {"mlab1", "mlab2"}}, nil
+	}
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	rtx.Must(os.WriteFile(stateFile, []byte(`{"Machines": {"mlab1-xyz01": ["7"]}}`), 0644), "Could not write state")
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"add", "machine", "mlab1-abc01", "-issue", "123"}, "1 modifications"},
+		{[]string{"add", "site", "abc01"}, "3 modifications"},
+		{[]string{"list"}, "mlab1-abc01  123,manual"},
+		{[]string{"remove", "site", "abc01"}, "3 modifications"},
+		{[]string{"close-issue", "123"}, "1 modifications"},
+		{[]string{"prune"}, "0 machines and 0 sites in maintenance; were 1 and 0"},
+		{[]string{"list"}, "KIND  NAME  ISSUES\n"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := run(append([]string{"-state", stateFile}, tt.args...), &out); err != nil {
+			t.Fatalf("run(%v) = %v", tt.args, err)
+		}
+		if !strings.Contains(out.String(), tt.want) {
+			t.Errorf("run(%v) output = %q; want %q", tt.args, out.String(), tt.want)
+		}
+	}
+}
+
+func TestRunAPI(t *testing.T) {
+	var got admin.MaintenanceRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/state":
+			json.NewEncoder(w).Encode(maintenancestate.Snapshot{Sites: map[string][]string{"abc01": {"5"}}})
+		case "/admin/maintenance":
+			json.NewDecoder(r.Body).Decode(&got)
+			json.NewEncoder(w).Encode(admin.MaintenanceResponse{Modifications: 2})
+		case "/admin/close-issue":
+			if r.URL.Query().Get("issue") != "m-lab/ops#7" {
+				http.Error(w, "wrong issue", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(admin.MaintenanceResponse{Modifications: 3})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	rtx.Must(os.WriteFile(tokenFile, []byte("token\n"), 0600), "Could not write token")
+	flags := []string{"-url", srv.URL, "-token-file", tokenFile}
+
+	var out bytes.Buffer
+	if err := run(append(flags, "list"), &out); err != nil || !strings.Contains(out.String(), "site  abc01  5") {
+		t.Errorf("list = %v, output %q", err, out.String())
+	}
+	out.Reset()
+	if err := run(append(flags, "remove", "machine", "mlab1-abc01"), &out); err != nil || out.String() != "2 modifications\n" {
+		t.Errorf("remove = %v, output %q", err, out.String())
+	}
+	want := admin.MaintenanceRequest{Kind: "machine", Name: "mlab1-abc01", Action: "leave", Issue: "manual"}
+	if got != want {
+		t.Errorf("request = %+v; want %+v", got, want)
+	}
+	out.Reset()
+	if err := run(append(flags, "close-issue", "m-lab/ops#7"), &out); err != nil || out.String() != "3 modifications\n" {
+		t.Errorf("close-issue = %v, output %q", err, out.String())
+	}
+	if err := run([]string{"-url", srv.URL, "list"}, &out); err == nil {
+		t.Error("list without a token = nil error")
+	}
+	if err := run(append(flags, "prune"), &out); err == nil {
+		t.Error("prune with -url = nil error")
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"list"},
+		{"-state", "a", "-url", "b", "list"},
+		{"-state", "a"},
+		{"-state", "a", "unknown"},
+		{"-state", "a", "add", "switch", "s1"},
+		{"-state", "a", "close-issue"},
+	} {
+		if err := run(args, &bytes.Buffer{}); err == nil {
+			t.Errorf("run(%v) = nil error", args)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Package config reads the values of command-line flags from a YAML file, so
+// that a deployment can be configured without a long list of flags. The keys
+// of the file are the names of flags, either in full or nested at their dots:
+//
+//	project: mlab-oti
+//	web:
+//	  listen-address: ":9999"
+//	storage.state-file: /var/lib/gmx/state
+//	notify.webhook-url:
+//	  - https://example.com/hook1
+//	  - https://example.com/hook2
+//
+// Lists set repeatable flags once per element. Flags given on the command
+// line override the file.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// flatten adds the values of m to values, keyed by their dotted path below
+// prefix.
+func flatten(prefix string, m map[string]interface{}, values map[string]interface{}) {
+	for k, v := range m {
+		if prefix != "" {
+			k = prefix + "." + k
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			flatten(k, nested, values)
+			continue
+		}
+		values[k] = v
+	}
+}
+
+// Apply sets the flags of fs to the values in data, a YAML document, unless
+// they were set on the command line. It must be called after fs is parsed.
+// Keys that are not flags of fs are an error, so that typos are noticed.
+func Apply(fs *flag.FlagSet, data []byte) error {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	values := make(map[string]interface{})
+	flatten("", doc, values)
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	// Apply the values in a stable order, so that errors are reproducible.
+	sort.Strings(names)
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown flag %q", name)
+		}
+		if set[name] {
+			continue
+		}
+		elems, ok := values[name].([]interface{})
+		if !ok {
+			elems = []interface{}{values[name]}
+		}
+		for _, elem := range elems {
+			if _, nested := elem.(map[string]interface{}); nested || elem == nil {
+				return fmt.Errorf("invalid value for flag %q", name)
+			}
+			if err := fs.Set(name, fmt.Sprint(elem)); err != nil {
+				return fmt.Errorf("invalid value for flag %q: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyFile sets the flags of fs from the YAML file at path, as Apply does.
+func ApplyFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := Apply(fs, data); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/rtx"
+)
+
+type flags struct {
+	fs      *flag.FlagSet
+	listen  *string
+	project *string
+	reload  *time.Duration
+	burst   *int
+	verbose *bool
+	urls    flagx.StringArray
+}
+
+func newFlags() *flags {
+	f := &flags{fs: flag.NewFlagSet("test", flag.ContinueOnError)}
+	f.listen = f.fs.String("web.listen-address", ":9999", "")
+	f.project = f.fs.String("project", "", "")
+	f.reload = f.fs.Duration("reloadmin", time.Hour, "")
+	f.burst = f.fs.Int("log.burst", 20, "")
+	f.verbose = f.fs.Bool("metrics.node-label", true, "")
+	f.fs.Var(&f.urls, "notify.webhook-url", "")
+	return f
+}
+
+func TestApply(t *testing.T) {
+	f := newFlags()
+	rtx.Must(f.fs.Parse([]string{"-project=mlab-sandbox"}), "Could not parse flags")
+	err := Apply(f.fs, []byte(`
+project: mlab-oti
+web:
+  listen-address: ":8080"
+reloadmin: 5m
+log.burst: 3
+metrics:
+  node-label: false
+notify.webhook-url:
+  - https://example.com/1
+  - https://example.com/2
+`))
+	rtx.Must(err, "Could not apply config")
+	if *f.project != "mlab-sandbox" {
+		t.Errorf("project = %q; want the command-line value", *f.project)
+	}
+	if *f.listen != ":8080" || *f.reload != 5*time.Minute || *f.burst != 3 || *f.verbose {
+		t.Errorf("flags = %q, %s, %d, %t; want the values of the file", *f.listen, *f.reload, *f.burst, *f.verbose)
+	}
+	want := flagx.StringArray{"https://example.com/1", "https://example.com/2"}
+	if !reflect.DeepEqual(f.urls, want) {
+		t.Errorf("notify.webhook-url = %v; want %v", f.urls, want)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "unknown flag", data: "web.listen: :80"},
+		{name: "invalid value", data: "log.burst: many"},
+		{name: "nested list", data: "notify.webhook-url: [{a: b}]"},
+		{name: "invalid yaml", data: "project: [mlab-oti"},
+	}
+	for _, tt := range tests {
+		f := newFlags()
+		rtx.Must(f.fs.Parse(nil), "Could not parse flags")
+		if err := Apply(f.fs, []byte(tt.data)); err == nil {
+			t.Errorf("Apply(%s) = nil; want an error", tt.name)
+		}
+	}
+}
+
+func TestApplyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gmx.yaml")
+	rtx.Must(os.WriteFile(path, []byte("project: mlab-staging\n"), 0644), "Could not write config")
+	f := newFlags()
+	rtx.Must(f.fs.Parse(nil), "Could not parse flags")
+	rtx.Must(ApplyFile(f.fs, path), "Could not apply config file")
+	if *f.project != "mlab-staging" {
+		t.Errorf("project = %q; want mlab-staging", *f.project)
+	}
+	if err := ApplyFile(f.fs, filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("ApplyFile() of a missing file = nil; want an error")
+	}
+}
@@ -0,0 +1,93 @@
+package errorreport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/gcp"
+)
+
+// CloudErrorReporting sends reports to Cloud Error Reporting.
+type CloudErrorReporting struct {
+	url    string
+	client *http.Client
+}
+
+// cloudEvent is a Cloud Error Reporting ReportedErrorEvent.
+type cloudEvent struct {
+	EventTime      string `json:"eventTime"`
+	ServiceContext struct {
+		Service string `json:"service"`
+	} `json:"serviceContext"`
+	Message string             `json:"message"`
+	Context *cloudErrorContext `json:"context,omitempty"`
+}
+
+// cloudErrorContext is a Cloud Error Reporting ErrorContext.
+type cloudErrorContext struct {
+	ReportLocation struct {
+		FunctionName string `json:"functionName"`
+	} `json:"reportLocation"`
+}
+
+// Send sends a report to Cloud Error Reporting.
+func (c *CloudErrorReporting) Send(ctx context.Context, r Report) error {
+	var event cloudEvent
+	event.EventTime = r.Time.UTC().Format(time.RFC3339Nano)
+	event.ServiceContext.Service = "github-maintenance-exporter"
+	// Events have no fields for arbitrary context, so it is prepended to the
+	// message.
+	keys := make([]string, 0, len(r.Context))
+	for k := range r.Context {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var msg strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&msg, "%s=%s ", k, r.Context[k])
+	}
+	msg.WriteString(r.Message)
+	if r.Stack != "" {
+		msg.WriteString("\n" + r.Stack)
+	} else {
+		// Messages without a stack trace must say where they came from.
+		event.Context = &cloudErrorContext{}
+		event.Context.ReportLocation.FunctionName = "log"
+	}
+	event.Message = msg.String()
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from Cloud Error Reporting: %s", resp.Status)
+	}
+	return nil
+}
+
+// NewCloudErrorReporting creates a backend that reports errors to Cloud Error
+// Reporting in the given GCP project, authenticated as the default service
+// account.
+func NewCloudErrorReporting(project string) *CloudErrorReporting {
+	return &CloudErrorReporting{
+		url:    fmt.Sprintf("https://clouderrorreporting.googleapis.com/v1beta1/projects/%s/events:report", project),
+		client: gcp.NewClient(reportTimeout),
+	}
+}
@@ -0,0 +1,45 @@
+package errorreport
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCloudErrorReporting(t *testing.T) {
+	events := make(chan cloudEvent, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e cloudEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	defer srv.Close()
+
+	c := &CloudErrorReporting{url: srv.URL, client: srv.Client()}
+	err := c.Send(context.Background(), Report{
+		Time:    time.Now(),
+		Message: "state write failed",
+		Context: map[string]string{"issue": "12", "delivery": "abc"},
+	})
+	if err != nil {
+		t.Fatalf("Send() returned error: %v", err)
+	}
+	e := <-events
+	if e.Message != "delivery=abc issue=12 state write failed" || e.Context == nil {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	if e.ServiceContext.Service != "github-maintenance-exporter" {
+		t.Errorf("unexpected service: %q", e.ServiceContext.Service)
+	}
+
+	err = c.Send(context.Background(), Report{Time: time.Now(), Message: "panic: boom", Stack: "goroutine 1"})
+	if err != nil {
+		t.Fatalf("Send() returned error: %v", err)
+	}
+	if e := <-events; e.Context != nil || e.Message != "panic: boom\ngoroutine 1" {
+		t.Errorf("unexpected event for a panic: %+v", e)
+	}
+}
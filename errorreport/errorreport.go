@@ -0,0 +1,183 @@
+// Package errorreport sends panics and ERROR-level log lines to an error
+// reporting service, such as Sentry or Cloud Error Reporting, so that crashes
+// and repeated failures are noticed without tailing logs.
+package errorreport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	// queueSize is how many reports may be waiting to be sent before new
+	// ones are dropped.
+	queueSize     = 100
+	reportTimeout = 10 * time.Second
+)
+
+// Report describes a single error.
+type Report struct {
+	Time    time.Time
+	Message string
+	// Stack is the stack trace of a panic, if any.
+	Stack string
+	// Context holds information about the request during which the error
+	// occurred, such as the webhook delivery ID and issue number.
+	Context map[string]string
+}
+
+// Backend sends reports to an error reporting service.
+type Backend interface {
+	Send(ctx context.Context, r Report) error
+}
+
+// Reporter queues reports and sends them to a Backend.
+type Reporter struct {
+	backend Backend
+	queue   chan Report
+}
+
+// New creates a Reporter for the given backend.
+func New(backend Backend) *Reporter {
+	return &Reporter{
+		backend: backend,
+		queue:   make(chan Report, queueSize),
+	}
+}
+
+// Report queues a report. It never blocks; if the queue is full, the report
+// is dropped.
+func (r *Reporter) Report(rep Report) {
+	if rep.Time.IsZero() {
+		rep.Time = time.Now()
+	}
+	select {
+	case r.queue <- rep:
+	default:
+	}
+}
+
+// Run sends queued reports until ctx is canceled.
+func (r *Reporter) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case rep := <-r.queue:
+			sctx, cancel := context.WithTimeout(ctx, reportTimeout)
+			err := r.backend.Send(sctx, rep)
+			cancel()
+			if err != nil {
+				// Not logged as an ERROR, which would be reported again.
+				log.Printf("WARNING: Failed to send error report: %v", err)
+			}
+		}
+	}
+}
+
+// Writer returns an io.Writer, for use as the output of a log.Logger or a
+// slog handler, that writes to w and reports every line containing "ERROR:"
+// or logged by slog at the error level.
+func (r *Reporter) Writer(w io.Writer) io.Writer {
+	return &writer{w: w, reporter: r}
+}
+
+type writer struct {
+	w        io.Writer
+	reporter *Reporter
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		if msg, ok := errorMessage(line); ok {
+			w.reporter.Report(Report{Message: msg})
+		}
+	}
+	return w.w.Write(p)
+}
+
+// errorMessage returns the message of a log line logged at the error level.
+func errorMessage(line []byte) (string, bool) {
+	if i := bytes.Index(line, []byte("ERROR:")); i >= 0 {
+		return string(bytes.TrimSpace(line[i+len("ERROR:"):])), true
+	}
+	if bytes.Contains(line, []byte("level=ERROR")) {
+		return string(bytes.TrimSpace(line)), true
+	}
+	if bytes.Contains(line, []byte(`"level":"ERROR"`)) {
+		var entry struct {
+			Msg string `json:"msg"`
+			Err string `json:"err"`
+		}
+		if err := json.Unmarshal(line, &entry); err != nil || entry.Msg == "" {
+			return string(bytes.TrimSpace(line)), true
+		}
+		if entry.Err != "" {
+			return entry.Msg + ": " + entry.Err, true
+		}
+		return entry.Msg, true
+	}
+	return "", false
+}
+
+// requestContext holds information about a request that is attached to any
+// report of a panic while handling it.
+type requestContext struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+type contextKey struct{}
+
+// Annotate records information about the request carried by ctx, such as the
+// issue number, to be included in any report of a panic while handling it. It
+// does nothing if ctx did not come from a request wrapped by Middleware.
+func Annotate(ctx context.Context, key, value string) {
+	rc, ok := ctx.Value(contextKey{}).(*requestContext)
+	if !ok {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.values[key] = value
+}
+
+// Middleware recovers from panics in h, reporting them along with the
+// webhook delivery ID and any annotations of the request, and responds with
+// an internal server error. If r is nil, panics are only recovered and
+// logged.
+func Middleware(r *Reporter, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		rc := &requestContext{values: make(map[string]string)}
+		if id := req.Header.Get("X-GitHub-Delivery"); id != "" {
+			rc.values["delivery"] = id
+		}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			stack := string(debug.Stack())
+			log.Printf("PANIC: %v\n%s", p, stack)
+			if r != nil {
+				rc.mu.Lock()
+				r.Report(Report{
+					Message: fmt.Sprintf("panic: %v", p),
+					Stack:   stack,
+					Context: rc.values,
+				})
+				rc.mu.Unlock()
+			}
+			resp.WriteHeader(http.StatusInternalServerError)
+		}()
+		h.ServeHTTP(resp, req.WithContext(context.WithValue(req.Context(), contextKey{}, rc)))
+	})
+}
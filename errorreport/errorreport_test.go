@@ -0,0 +1,119 @@
+package errorreport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeBackend records the reports sent to it.
+type fakeBackend struct {
+	reports chan Report
+	err     error
+}
+
+func (f *fakeBackend) Send(ctx context.Context, r Report) error {
+	f.reports <- r
+	return f.err
+}
+
+func TestWriter(t *testing.T) {
+	r := New(nil)
+	var buf bytes.Buffer
+	logger := log.New(r.Writer(&buf), "", log.LstdFlags)
+	logger.Printf("INFO: all is well")
+	logger.Printf("ERROR: Failed to write state file: %s", "disk full")
+
+	if !bytes.Contains(buf.Bytes(), []byte("disk full")) {
+		t.Errorf("Writer() did not pass lines through: %q", buf.String())
+	}
+	if len(r.queue) != 1 {
+		t.Fatalf("%d reports were queued; want 1", len(r.queue))
+	}
+	if rep := <-r.queue; rep.Message != "Failed to write state file: disk full" {
+		t.Errorf("report message = %q", rep.Message)
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+		ok   bool
+	}{
+		{line: "2030/01/01 00:00:00 INFO: all is well"},
+		{line: "ERROR: disk full", want: "disk full", ok: true},
+		{line: `time=2030-01-01T00:00:00Z level=ERROR msg="Failed to write state" err="disk full"`,
+			want: `time=2030-01-01T00:00:00Z level=ERROR msg="Failed to write state" err="disk full"`, ok: true},
+		{line: `{"time":"2030-01-01T00:00:00Z","level":"ERROR","msg":"Failed to write state","err":"disk full"}`,
+			want: "Failed to write state: disk full", ok: true},
+		{line: `{"time":"2030-01-01T00:00:00Z","level":"ERROR","msg":"Failed to write state"}`,
+			want: "Failed to write state", ok: true},
+		{line: `{"time":"2030-01-01T00:00:00Z","level":"INFO","msg":"All is well"}`},
+	}
+	for _, tt := range tests {
+		got, ok := errorMessage([]byte(tt.line))
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("errorMessage(%q) = %q, %t; want %q, %t", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestReportQueueFull(t *testing.T) {
+	r := New(nil)
+	for i := 0; i < queueSize+1; i++ {
+		r.Report(Report{Message: "x"})
+	}
+	if len(r.queue) != queueSize {
+		t.Errorf("queue length = %d; want %d", len(r.queue), queueSize)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	backend := &fakeBackend{reports: make(chan Report, 1), err: errors.New("unavailable")}
+	r := New(backend)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	h := Middleware(r, http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		Annotate(req.Context(), "issue", "12")
+		panic("boom")
+	}))
+	req := httptest.NewRequest("POST", "/webhook", nil)
+	req.Header.Set("X-GitHub-Delivery", "abc-123")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d; want %d", rec.Code, http.StatusInternalServerError)
+	}
+
+	select {
+	case rep := <-backend.reports:
+		if rep.Message != "panic: boom" || rep.Stack == "" {
+			t.Errorf("unexpected report: %+v", rep)
+		}
+		if rep.Context["delivery"] != "abc-123" || rep.Context["issue"] != "12" {
+			t.Errorf("report context = %v", rep.Context)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for report")
+	}
+
+	// Requests that do not panic are untouched, and Annotate without
+	// Middleware does nothing.
+	Annotate(context.Background(), "issue", "1")
+	h = Middleware(nil, http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusTeapot)
+	}))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTeapot {
+		t.Errorf("status = %d; want %d", rec.Code, http.StatusTeapot)
+	}
+}
@@ -0,0 +1,90 @@
+package errorreport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Sentry sends reports to a Sentry project.
+type Sentry struct {
+	storeURL string
+	key      string
+	client   *http.Client
+}
+
+// sentryEvent is the subset of a Sentry event that is sent.
+type sentryEvent struct {
+	EventID   string            `json:"event_id"`
+	Timestamp string            `json:"timestamp"`
+	Level     string            `json:"level"`
+	Platform  string            `json:"platform"`
+	Logger    string            `json:"logger"`
+	Message   string            `json:"message"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Extra     map[string]string `json:"extra,omitempty"`
+}
+
+// Send sends a report to Sentry as an event.
+func (s *Sentry) Send(ctx context.Context, r Report) error {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return err
+	}
+	event := sentryEvent{
+		EventID:   hex.EncodeToString(id),
+		Timestamp: r.Time.UTC().Format("2006-01-02T15:04:05"),
+		Level:     "error",
+		Platform:  "go",
+		Logger:    "github-maintenance-exporter",
+		Message:   r.Message,
+		Tags:      r.Context,
+	}
+	if r.Stack != "" {
+		event.Extra = map[string]string{"stack": r.Stack}
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.storeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=github-maintenance-exporter/1.0", s.key))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from Sentry: %s", resp.Status)
+	}
+	return nil
+}
+
+// NewSentry creates a Sentry backend from a DSN of the form
+// https://KEY@HOST/PROJECT.
+func NewSentry(dsn string) (*Sentry, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	project := strings.Trim(u.Path, "/")
+	if u.User == nil || u.User.Username() == "" || project == "" {
+		return nil, fmt.Errorf("invalid Sentry DSN: %q", dsn)
+	}
+	return &Sentry{
+		storeURL: fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project),
+		key:      u.User.Username(),
+		client:   &http.Client{Timeout: reportTimeout},
+	}, nil
+}
@@ -0,0 +1,49 @@
+package errorreport
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSentry(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/42/store/" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		if !strings.Contains(r.Header.Get("X-Sentry-Auth"), "sentry_key=public") {
+			t.Errorf("unexpected X-Sentry-Auth: %q", r.Header.Get("X-Sentry-Auth"))
+		}
+		var e sentryEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		if e.Message != "state write failed" || e.Tags["issue"] != "12" || len(e.EventID) != 32 {
+			t.Errorf("unexpected event: %+v", e)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := NewSentry(strings.Replace(srv.URL, "://", "://public@", 1) + "/42")
+	if err != nil {
+		t.Fatalf("NewSentry() returned error: %v", err)
+	}
+	err = s.Send(context.Background(), Report{
+		Time:    time.Now(),
+		Message: "state write failed",
+		Context: map[string]string{"issue": "12"},
+	})
+	if err != nil {
+		t.Errorf("Send() returned error: %v", err)
+	}
+}
+
+func TestNewSentryBadDSN(t *testing.T) {
+	for _, dsn := range []string{"https://sentry.io/42", "https://key@sentry.io/", ":"} {
+		if _, err := NewSentry(dsn); err == nil {
+			t.Errorf("NewSentry(%q) returned nil error", dsn)
+		}
+	}
+}
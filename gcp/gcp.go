@@ -0,0 +1,83 @@
+// Package gcp provides an HTTP client authenticated as the default service
+// account of the GCE instance or GKE pod that the exporter runs on, for use
+// with Google Cloud REST APIs.
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenURL is where the metadata server provides access tokens for the
+// default service account.
+var tokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// tokenMargin is how long before it expires a token is refreshed.
+const tokenMargin = time.Minute
+
+// transport adds an access token to every outgoing request.
+type transport struct {
+	base    http.RoundTripper
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// fetch returns a valid access token, getting a new one from the metadata
+// server if necessary.
+func (t *transport) fetch(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && time.Now().Add(tokenMargin).Before(t.expires) {
+		return t.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status from metadata server: %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", err
+	}
+	t.token = token.AccessToken
+	t.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return t.token, nil
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.fetch(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	// RoundTrippers must not modify the passed-in request.
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(r)
+}
+
+// NewClient returns an HTTP client whose requests are authenticated as the
+// default service account.
+func NewClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &transport{base: http.DefaultTransport},
+	}
+}
@@ -0,0 +1,57 @@
+package gcp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewClient(t *testing.T) {
+	fetches := 0
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			t.Error("request to the metadata server is missing Metadata-Flavor")
+		}
+		fetches++
+		fmt.Fprintf(w, `{"access_token": "token%d", "expires_in": 3600}`, fetches)
+	}))
+	defer metadata.Close()
+	defer func(u string) { tokenURL = u }(tokenURL)
+	tokenURL = metadata.URL
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer token1" {
+			t.Errorf("Authorization = %q; want %q", got, "Bearer token1")
+		}
+	}))
+	defer api.Close()
+
+	c := NewClient(time.Second)
+	for i := 0; i < 2; i++ {
+		resp, err := c.Get(api.URL)
+		if err != nil {
+			t.Fatalf("Get() returned error: %v", err)
+		}
+		resp.Body.Close()
+	}
+	// The token must be cached until it is close to expiring.
+	if fetches != 1 {
+		t.Errorf("token was fetched %d times; want 1", fetches)
+	}
+}
+
+func TestNewClientMetadataError(t *testing.T) {
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer metadata.Close()
+	defer func(u string) { tokenURL = u }(tokenURL)
+	tokenURL = metadata.URL
+
+	_, err := NewClient(time.Second).Get(metadata.URL)
+	if err == nil {
+		t.Error("Get() returned nil error when no token was available")
+	}
+}
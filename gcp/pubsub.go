@@ -0,0 +1,113 @@
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// pubsubTimeout bounds every request to Pub/Sub.
+const pubsubTimeout = 30 * time.Second
+
+// PubSub publishes messages to Cloud Pub/Sub topics and pulls them from
+// subscriptions.
+type PubSub struct {
+	project string
+	url     string
+	client  *http.Client
+}
+
+// Message is a Pub/Sub message.
+type Message struct {
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// MessageID is set by Pub/Sub on messages that are received.
+	MessageID string `json:"messageId,omitempty"`
+}
+
+// ReceivedMessage is a message pulled from a subscription.
+type ReceivedMessage struct {
+	// AckID acknowledges the message, so that it is not redelivered.
+	AckID   string  `json:"ackId"`
+	Message Message `json:"message"`
+}
+
+// NewPubSub creates a PubSub for the topics of a GCP project, authenticated
+// as the default service account.
+func NewPubSub(project string) *PubSub {
+	return &PubSub{
+		project: project,
+		url:     "https://pubsub.googleapis.com/v1",
+		client:  NewClient(pubsubTimeout),
+	}
+}
+
+// resource returns the resource name of a topic or subscription, given
+// either its name in the project (e.g. maintenance) or its full resource name
+// (e.g. projects/P/topics/maintenance). kind is "topics" or "subscriptions".
+func (p *PubSub) resource(kind string, name string) string {
+	if strings.HasPrefix(name, "projects/") {
+		return name
+	}
+	return "projects/" + p.project + "/" + kind + "/" + name
+}
+
+// post sends a request to Pub/Sub and decodes its response into v, if not
+// nil.
+func (p *PubSub) post(ctx context.Context, path string, body interface{}, v interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+"/"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from Pub/Sub for %s: %s", path, resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Publish publishes messages to a topic.
+func (p *PubSub) Publish(ctx context.Context, topic string, messages []Message) error {
+	body := struct {
+		Messages []Message `json:"messages"`
+	}{messages}
+	return p.post(ctx, p.resource("topics", topic)+":publish", body, nil)
+}
+
+// Pull returns up to max messages from a subscription. It may wait for
+// messages to arrive, and returns none if there are none.
+func (p *PubSub) Pull(ctx context.Context, subscription string, max int) ([]ReceivedMessage, error) {
+	body := struct {
+		MaxMessages int `json:"maxMessages"`
+	}{max}
+	var result struct {
+		ReceivedMessages []ReceivedMessage `json:"receivedMessages"`
+	}
+	err := p.post(ctx, p.resource("subscriptions", subscription)+":pull", body, &result)
+	return result.ReceivedMessages, err
+}
+
+// Acknowledge acknowledges messages received from a subscription. Messages
+// that are not acknowledged before their deadline are redelivered.
+func (p *PubSub) Acknowledge(ctx context.Context, subscription string, ackIDs []string) error {
+	body := struct {
+		AckIDs []string `json:"ackIds"`
+	}{ackIDs}
+	return p.post(ctx, p.resource("subscriptions", subscription)+":acknowledge", body, nil)
+}
@@ -0,0 +1,88 @@
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPubSubPublish(t *testing.T) {
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "token", "expires_in": 3600}`))
+	}))
+	defer metadata.Close()
+	defer func(u string) { tokenURL = u }(tokenURL)
+	tokenURL = metadata.URL
+
+	var got []Message
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/mlab-oti/topics/maintenance:publish" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var body struct{ Messages []Message }
+		json.NewDecoder(r.Body).Decode(&body)
+		got = body.Messages
+		w.Write([]byte(`{"messageIds": ["1"]}`))
+	}))
+	defer api.Close()
+
+	p := NewPubSub("mlab-oti")
+	p.url = api.URL + "/v1"
+	msg := Message{Data: []byte("hello"), Attributes: map[string]string{"kind": "site"}}
+	for _, topic := range []string{"maintenance", "projects/mlab-oti/topics/maintenance"} {
+		if err := p.Publish(context.Background(), topic, []Message{msg}); err != nil {
+			t.Errorf("Publish(%s) returned error: %v", topic, err)
+		}
+		if len(got) != 1 || string(got[0].Data) != "hello" || got[0].Attributes["kind"] != "site" {
+			t.Errorf("Publish(%s) sent %+v", topic, got)
+		}
+	}
+	if err := p.Publish(context.Background(), "missing", []Message{msg}); err == nil {
+		t.Error("Publish() to a missing topic = nil error")
+	}
+}
+
+func TestPubSubPull(t *testing.T) {
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "token", "expires_in": 3600}`))
+	}))
+	defer metadata.Close()
+	defer func(u string) { tokenURL = u }(tokenURL)
+	tokenURL = metadata.URL
+
+	var acked []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/projects/mlab-oti/subscriptions/webhooks:pull":
+			// "aGVsbG8=" is "hello" in base64.
+			w.Write([]byte(`{"receivedMessages": [{"ackId": "a1", "message": {"data": "aGVsbG8=", "attributes": {"X-GitHub-Event": "issues"}, "messageId": "7"}}]}`))
+		case "/v1/projects/mlab-oti/subscriptions/webhooks:acknowledge":
+			var body struct{ AckIDs []string }
+			json.NewDecoder(r.Body).Decode(&body)
+			acked = body.AckIDs
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer api.Close()
+
+	p := NewPubSub("mlab-oti")
+	p.url = api.URL + "/v1"
+	msgs, err := p.Pull(context.Background(), "webhooks", 10)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Pull() = %+v, %v; want one message", msgs, err)
+	}
+	if m := msgs[0]; m.AckID != "a1" || string(m.Message.Data) != "hello" || m.Message.Attributes["X-GitHub-Event"] != "issues" || m.Message.MessageID != "7" {
+		t.Errorf("Pull() = %+v", m)
+	}
+	if err := p.Acknowledge(context.Background(), "webhooks", []string{"a1"}); err != nil || len(acked) != 1 || acked[0] != "a1" {
+		t.Errorf("Acknowledge() = %v; acknowledged %v", err, acked)
+	}
+	if _, err := p.Pull(context.Background(), "missing", 10); err == nil {
+		t.Error("Pull() from a missing subscription = nil error")
+	}
+}
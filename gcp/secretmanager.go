@@ -0,0 +1,72 @@
+package gcp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// secretManagerTimeout bounds every request to Secret Manager.
+const secretManagerTimeout = 30 * time.Second
+
+// SecretManager reads secrets from Secret Manager.
+type SecretManager struct {
+	project string
+	url     string
+	client  *http.Client
+}
+
+// NewSecretManager creates a SecretManager for the secrets of a GCP project,
+// authenticated as the default service account.
+func NewSecretManager(project string) *SecretManager {
+	return &SecretManager{
+		project: project,
+		url:     "https://secretmanager.googleapis.com/v1",
+		client:  NewClient(secretManagerTimeout),
+	}
+}
+
+// version returns the resource name of the secret version that name refers
+// to. The name of a secret (e.g. github-webhook-secret) refers to its latest
+// version in the project, while a full resource name (e.g.
+// projects/P/secrets/S or projects/P/secrets/S/versions/3) is used as is,
+// with the latest version if none is given.
+func (s *SecretManager) version(name string) string {
+	if !strings.HasPrefix(name, "projects/") {
+		name = "projects/" + s.project + "/secrets/" + name
+	}
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	return name
+}
+
+// Access returns the value of a secret.
+func (s *SecretManager) Access(ctx context.Context, name string) ([]byte, error) {
+	version := s.version(name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url+"/"+version+":access", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from Secret Manager reading %s: %s", version, resp.Status)
+	}
+	var body struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(body.Payload.Data)
+}
@@ -0,0 +1,42 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSecretManager(t *testing.T) {
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token": "token", "expires_in": 3600}`)
+	}))
+	defer metadata.Close()
+	defer func(u string) { tokenURL = u }(tokenURL)
+	tokenURL = metadata.URL
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/projects/mlab-oti/secrets/webhook/versions/latest:access",
+			"/v1/projects/other/secrets/webhook/versions/2:access":
+			// "c2VjcmV0" is "secret" in base64.
+			fmt.Fprint(w, `{"name": "x", "payload": {"data": "c2VjcmV0"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer api.Close()
+
+	s := NewSecretManager("mlab-oti")
+	s.url = api.URL + "/v1"
+	for _, name := range []string{"webhook", "projects/mlab-oti/secrets/webhook", "projects/other/secrets/webhook/versions/2"} {
+		got, err := s.Access(context.Background(), name)
+		if err != nil || string(got) != "secret" {
+			t.Errorf("Access(%q) = %q, %v; want secret", name, got, err)
+		}
+	}
+	if _, err := s.Access(context.Background(), "missing"); err == nil {
+		t.Error("Access() of a missing secret = nil error")
+	}
+}
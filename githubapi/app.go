@@ -0,0 +1,152 @@
+package githubapi
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// appTransport authenticates every outgoing request with an installation token
+// of a GitHub App, which it obtains with a JWT signed by the app's private key
+// and renews shortly before it expires.
+type appTransport struct {
+	appID          int64
+	installationID int64
+	key            *rsa.PrivateKey
+	// url is the base URL of the GitHub API, without a trailing slash.
+	url  string
+	base http.RoundTripper
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// ParsePrivateKey parses the PEM-encoded private key of a GitHub App, as
+// downloaded from the app's settings.
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("private key is not PEM-encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// jwt returns a JSON Web Token identifying the app, valid for ten minutes.
+func (t *appTransport) jwt(now time.Time) (string, error) {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		// Allow for clock drift, as GitHub recommends.
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(t.appID, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, t.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// installationToken returns a valid installation token, requesting a new one
+// if it is about to expire.
+func (t *appTransport) installationToken(req *http.Request) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.token != "" && now.Add(time.Minute).Before(t.expires) {
+		return t.token, nil
+	}
+
+	jwt, err := t.jwt(now)
+	if err != nil {
+		return "", err
+	}
+	u := fmt.Sprintf("%s/app/installations/%d/access_tokens", t.url, t.installationID)
+	tokenReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, u, nil)
+	if err != nil {
+		return "", err
+	}
+	tokenReq.Header.Set("Authorization", "Bearer "+jwt)
+	tokenReq.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := t.base.RoundTrip(tokenReq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("unexpected status requesting a token for installation %d: %s", t.installationID, resp.Status)
+	}
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	t.token, t.expires = token.Token, token.ExpiresAt
+	return t.token, nil
+}
+
+func (t *appTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.installationToken(req)
+	if err != nil {
+		return nil, err
+	}
+	// RoundTrippers must not modify the passed-in request.
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", "token "+token)
+	return t.base.RoundTrip(r)
+}
+
+// NewApp creates a Client that authenticates to the GitHub API as an
+// installation of a GitHub App.
+func NewApp(appID int64, installationID int64, key *rsa.PrivateKey) *Client {
+	return newApp(appID, installationID, key, "https://api.github.com")
+}
+
+// newApp is like NewApp, but for the GitHub API at apiURL.
+func newApp(appID int64, installationID int64, key *rsa.PrivateKey, apiURL string) *Client {
+	transport := &appTransport{
+		appID:          appID,
+		installationID: installationID,
+		key:            key,
+		url:            strings.TrimSuffix(apiURL, "/"),
+		base:           http.DefaultTransport,
+	}
+	client := github.NewClient(&http.Client{Transport: transport})
+	client.BaseURL, _ = url.Parse(transport.url + "/")
+	return &Client{client: client}
+}
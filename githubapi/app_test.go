@@ -0,0 +1,99 @@
+package githubapi
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	for _, data := range [][]byte{pkcs1, pkcs8} {
+		got, err := ParsePrivateKey(data)
+		if err != nil || !got.Equal(key) {
+			t.Errorf("ParsePrivateKey() = %v; want the generated key", err)
+		}
+	}
+	if _, err := ParsePrivateKey([]byte("not a key")); err == nil {
+		t.Error("ParsePrivateKey() should have failed for data that is not PEM")
+	}
+}
+
+func TestNewApp(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := 0
+	var gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/app/installations/7/access_tokens" {
+			// Check that the JWT is signed by the app's key.
+			parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+			if len(parts) != 3 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			var c struct{ Iss string }
+			json.Unmarshal(claims, &c)
+			if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig) != nil || c.Iss != "42" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			tokens++
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"token":      "installation-token",
+				"expires_at": time.Now().Add(time.Hour),
+			})
+			return
+		}
+		gotAuth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	c := newApp(42, 7, key, srv.URL)
+
+	for i := 0; i < 2; i++ {
+		if err := c.CreateComment(context.Background(), "m-lab/ops-tracker", 12, "hello"); err != nil {
+			t.Fatalf("CreateComment() returned an error: %v", err)
+		}
+	}
+	if gotAuth != "token installation-token" {
+		t.Errorf("CreateComment() used the wrong Authorization header: %s", gotAuth)
+	}
+	if tokens != 1 {
+		t.Errorf("requested %d installation tokens; want 1", tokens)
+	}
+
+	// A token that cannot be obtained fails the request.
+	c = newApp(43, 7, key, srv.URL)
+	if err := c.CreateComment(context.Background(), "m-lab/ops-tracker", 12, "hello"); err == nil {
+		t.Error("CreateComment() should have failed without an installation token")
+	}
+}
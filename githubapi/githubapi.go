@@ -0,0 +1,151 @@
+// Package githubapi provides a small client for the parts of the GitHub API
+// that the exporter uses to report back on issues.
+package githubapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// Client wraps a go-github client authenticated with an API token.
+type Client struct {
+	client *github.Client
+}
+
+// tokenTransport adds a GitHub API token to every outgoing request.
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the passed-in request.
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", "token "+t.token)
+	return t.base.RoundTrip(r)
+}
+
+// splitRepo splits a repository's full name (e.g. m-lab/ops-tracker) into its
+// owner and name.
+func splitRepo(repo string) (string, string, error) {
+	fields := strings.Split(repo, "/")
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return "", "", fmt.Errorf("invalid repository name: %q", repo)
+	}
+	return fields[0], fields[1], nil
+}
+
+// CreateComment posts a comment with the given body on an issue in repo, where
+// repo is the full name of the repository (e.g. m-lab/ops-tracker).
+func (c *Client) CreateComment(ctx context.Context, repo string, issue int, body string) error {
+	owner, name, err := splitRepo(repo)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.client.Issues.CreateComment(ctx, owner, name, issue, &github.IssueComment{Body: &body})
+	return err
+}
+
+// CloseIssue closes an issue in repo, where repo is the full name of the
+// repository.
+func (c *Client) CloseIssue(ctx context.Context, repo string, issue int) error {
+	owner, name, err := splitRepo(repo)
+	if err != nil {
+		return err
+	}
+	closed := "closed"
+	_, _, err = c.client.Issues.Edit(ctx, owner, name, issue, &github.IssueRequest{State: &closed})
+	return err
+}
+
+// Issue is the part of a GitHub issue that the exporter reconciles against
+// its state.
+type Issue struct {
+	Number int
+	// State is either "open" or "closed".
+	State     string
+	Body      string
+	Comments  int
+	CreatedAt time.Time
+}
+
+// ListIssues returns every open or closed issue in repo that was updated at
+// or after since. Pull requests are skipped.
+func (c *Client) ListIssues(ctx context.Context, repo string, since time.Time) ([]Issue, error) {
+	owner, name, err := splitRepo(repo)
+	if err != nil {
+		return nil, err
+	}
+	opt := &github.IssueListByRepoOptions{
+		State:       "all",
+		Since:       since,
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	var issues []Issue
+	for {
+		page, resp, err := c.client.Issues.ListByRepo(ctx, owner, name, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range page {
+			if i.IsPullRequest() {
+				continue
+			}
+			issues = append(issues, Issue{
+				Number:    i.GetNumber(),
+				State:     i.GetState(),
+				Body:      i.GetBody(),
+				Comments:  i.GetComments(),
+				CreatedAt: i.GetCreatedAt(),
+			})
+		}
+		if resp.NextPage == 0 {
+			return issues, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// Comment is the part of a comment on a GitHub issue that the exporter
+// parses for flags.
+type Comment struct {
+	ID   int64
+	User string
+	Body string
+}
+
+// ListComments returns every comment on an issue in repo, oldest first.
+func (c *Client) ListComments(ctx context.Context, repo string, issue int) ([]Comment, error) {
+	owner, name, err := splitRepo(repo)
+	if err != nil {
+		return nil, err
+	}
+	opt := &github.IssueListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	var comments []Comment
+	for {
+		page, resp, err := c.client.Issues.ListComments(ctx, owner, name, issue, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range page {
+			comments = append(comments, Comment{ID: c.GetID(), User: c.GetUser().GetLogin(), Body: c.GetBody()})
+		}
+		if resp.NextPage == 0 {
+			return comments, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// New creates a Client that authenticates to the GitHub API with token.
+func New(token string) *Client {
+	httpClient := &http.Client{
+		Transport: &tokenTransport{token: token, base: http.DefaultTransport},
+	}
+	return &Client{client: github.NewClient(httpClient)}
+}
@@ -0,0 +1,157 @@
+package githubapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, h http.HandlerFunc) (*Client, func()) {
+	srv := httptest.NewServer(h)
+	c := New("testtoken")
+	u, err := url.Parse(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.client.BaseURL = u
+	return c, srv.Close
+}
+
+func TestCreateComment(t *testing.T) {
+	var gotPath, gotAuth, gotBody string
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		comment := struct{ Body string }{}
+		json.NewDecoder(r.Body).Decode(&comment)
+		gotBody = comment.Body
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	})
+	defer done()
+
+	err := c.CreateComment(context.Background(), "m-lab/ops-tracker", 12, "hello")
+	if err != nil {
+		t.Fatalf("CreateComment() returned an error: %v", err)
+	}
+	if gotPath != "/repos/m-lab/ops-tracker/issues/12/comments" {
+		t.Errorf("CreateComment() used the wrong path: %s", gotPath)
+	}
+	if gotAuth != "token testtoken" {
+		t.Errorf("CreateComment() used the wrong Authorization header: %s", gotAuth)
+	}
+	if gotBody != "hello" {
+		t.Errorf("CreateComment() sent the wrong body: %s", gotBody)
+	}
+
+	err = c.CreateComment(context.Background(), "not-a-repo", 12, "hello")
+	if err == nil {
+		t.Error("CreateComment() should have failed for a malformed repository name")
+	}
+}
+
+func TestCloseIssue(t *testing.T) {
+	var gotMethod, gotPath, gotState string
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotPath = r.URL.Path
+		issue := struct{ State string }{}
+		json.NewDecoder(r.Body).Decode(&issue)
+		gotState = issue.State
+		w.Write([]byte(`{}`))
+	})
+	defer done()
+
+	err := c.CloseIssue(context.Background(), "m-lab/ops-tracker", 12)
+	if err != nil {
+		t.Fatalf("CloseIssue() returned an error: %v", err)
+	}
+	if gotMethod != "PATCH" || gotPath != "/repos/m-lab/ops-tracker/issues/12" || gotState != "closed" {
+		t.Errorf("CloseIssue() sent the wrong request: %s %s state=%s", gotMethod, gotPath, gotState)
+	}
+
+	err = c.CloseIssue(context.Background(), "not-a-repo", 12)
+	if err == nil {
+		t.Error("CloseIssue() should have failed for a malformed repository name")
+	}
+}
+
+func TestListIssues(t *testing.T) {
+	var gotQueries []url.Values
+	var srvURL string
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		gotQueries = append(gotQueries, r.URL.Query())
+		if r.URL.Query().Get("page") == "" {
+			w.Header().Set("Link", `<`+srvURL+`/repos/m-lab/ops-tracker/issues?page=2>; rel="next"`)
+			w.Write([]byte(`[{"number": 1, "state": "closed", "body": "/site abc01", "created_at": "2020-01-01T00:00:00Z"},
+				{"number": 2, "state": "open", "pull_request": {"url": "x"}}]`))
+			return
+		}
+		w.Write([]byte(`[{"number": 3, "state": "open", "comments": 4}]`))
+	})
+	defer done()
+	srvURL = c.client.BaseURL.String()
+	srvURL = srvURL[:len(srvURL)-1]
+
+	since := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	issues, err := c.ListIssues(context.Background(), "m-lab/ops-tracker", since)
+	if err != nil {
+		t.Fatalf("ListIssues() returned an error: %v", err)
+	}
+	want := []Issue{
+		{Number: 1, State: "closed", Body: "/site abc01", CreatedAt: since},
+		{Number: 3, State: "open", Comments: 4},
+	}
+	if len(issues) != len(want) {
+		t.Fatalf("ListIssues() = %+v; want %+v", issues, want)
+	}
+	for i := range want {
+		if issues[i] != want[i] {
+			t.Errorf("ListIssues()[%d] = %+v; want %+v", i, issues[i], want[i])
+		}
+	}
+	if len(gotQueries) != 2 || gotQueries[0].Get("state") != "all" || gotQueries[0].Get("since") != "2020-01-01T00:00:00Z" {
+		t.Errorf("ListIssues() sent the wrong queries: %v", gotQueries)
+	}
+
+	if _, err := c.ListIssues(context.Background(), "not-a-repo", since); err == nil {
+		t.Error("ListIssues() should have failed for a malformed repository name")
+	}
+}
+
+func TestListComments(t *testing.T) {
+	var gotPaths []string
+	var srvURL string
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		gotPaths = append(gotPaths, r.URL.Path)
+		if r.URL.Query().Get("page") == "" {
+			w.Header().Set("Link", `<`+srvURL+`/repos/m-lab/ops-tracker/issues/7/comments?page=2>; rel="next"`)
+			w.Write([]byte(`[{"id": 1, "user": {"login": "ops"}, "body": "/site abc01"}]`))
+			return
+		}
+		w.Write([]byte(`[{"id": 2, "user": {"login": "ops"}, "body": "/site abc01 del"}]`))
+	})
+	defer done()
+	srvURL = c.client.BaseURL.String()
+	srvURL = srvURL[:len(srvURL)-1]
+
+	comments, err := c.ListComments(context.Background(), "m-lab/ops-tracker", 7)
+	if err != nil {
+		t.Fatalf("ListComments() returned an error: %v", err)
+	}
+	want := []Comment{{ID: 1, User: "ops", Body: "/site abc01"}, {ID: 2, User: "ops", Body: "/site abc01 del"}}
+	if len(comments) != len(want) || comments[0] != want[0] || comments[1] != want[1] {
+		t.Errorf("ListComments() = %+v; want %+v", comments, want)
+	}
+	if len(gotPaths) != 2 || gotPaths[0] != "/repos/m-lab/ops-tracker/issues/7/comments" {
+		t.Errorf("ListComments() requested the wrong paths: %v", gotPaths)
+	}
+
+	if _, err := c.ListComments(context.Background(), "not-a-repo", 7); err == nil {
+		t.Error("ListComments() should have failed for a malformed repository name")
+	}
+}
@@ -6,29 +6,139 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/m-lab/github-maintenance-exporter/admin"
+	"github.com/m-lab/github-maintenance-exporter/api"
+	"github.com/m-lab/github-maintenance-exporter/audit"
+	"github.com/m-lab/github-maintenance-exporter/config"
+	"github.com/m-lab/github-maintenance-exporter/errorreport"
+	"github.com/m-lab/github-maintenance-exporter/gcp"
+	"github.com/m-lab/github-maintenance-exporter/githubapi"
 	"github.com/m-lab/github-maintenance-exporter/handler"
+	"github.com/m-lab/github-maintenance-exporter/history"
+	"github.com/m-lab/github-maintenance-exporter/kube"
+	"github.com/m-lab/github-maintenance-exporter/leader"
+	"github.com/m-lab/github-maintenance-exporter/logging"
 	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+	"github.com/m-lab/github-maintenance-exporter/notify"
+	"github.com/m-lab/github-maintenance-exporter/ratelog"
 	"github.com/m-lab/github-maintenance-exporter/sites"
+	"github.com/m-lab/github-maintenance-exporter/ui"
+	"github.com/m-lab/go/flagx"
 	"github.com/m-lab/go/memoryless"
 	"github.com/m-lab/go/rtx"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
+	fConfigFile       = flag.String("config", "", "Filesystem path of a YAML file setting any of these flags, keyed by their names (e.g. \"project: mlab-oti\"), which may be nested at their dots. Lists set repeatable flags. Flags on the command line override the file.")
 	fListenAddress    = flag.String("web.listen-address", ":9999", "Address to listen on for telemetry.")
 	fStateFilePath    = flag.String("storage.state-file", "/tmp/gmx-state", "Filesystem path for the state file.")
-	fGitHubSecretPath = flag.String("storage.github-secret", "", "Filesystem path of file containing the shared Github webhook secret.")
+	fGitHubSecretPath = flag.String("storage.github-secret", "", "Filesystem path of file containing the shared Github webhook secret. The file may hold several secrets, one per line, any of which is accepted, so that the secret can be rotated with an overlap.")
+	fSecretReload     = flag.Duration("storage.github-secret-reload", time.Minute, "How often to reread the webhook secret files, so that secrets can be rotated without a restart. They are also reread on SIGHUP. Zero disables the periodic reread.")
 	fProject          = flag.String("project", "", "GCP project where this instance is running.")
 	fReloadMin        = flag.Duration("reloadmin", time.Hour, "Minimum time to wait between reloads of backing data")
 	fReloadTime       = flag.Duration("reloadtime", 5*time.Hour, "Expected time to wait between reloads of backing data")
 	fReloadMax        = flag.Duration("reloadmax", 24*time.Hour, "Maximum time to wait between reloads of backing data")
+	fMaxFlags         = flag.Int("webhook.max-flags", 100, "Maximum number of flags processed from a single issue or comment. Zero means no limit.")
+	fApprovalLimit    = flag.Int("approval.threshold", 0, "Number of machines and sites a single message may affect before its changes require an /approve reply. Zero disables approval.")
+	fApprovers        flagx.StringArray
+	fBlackouts        handler.Windows
+	fSources          flagx.StringArray
+	fPeers            flagx.StringArray
+	fNotifyURLs       flagx.StringArray
+	fGitHubTokenPath  = flag.String("github.token-file", "", "Filesystem path of file containing a GitHub API token used to comment on issues and to list the comments of reopened issues, whose flags are applied again. Commenting is disabled if empty.")
+	fGracePeriod      = flag.Duration("maintenance.grace-period", 0, "Default delay between accepting a flag and entering maintenance.")
+	fDefaultTTL       = flag.Duration("maintenance.default-ttl", 0, "How long maintenance lasts when its flag does not say (with \"for\", \"until\" or \"ttl=\"), after which it is removed. Zero means such maintenance lasts until it is removed.")
+	fScheduleInterval = flag.Duration("maintenance.schedule-interval", time.Minute, "How often to apply scheduled changes that are due, remove expired maintenance, and update the maintenance age metrics.")
+	fAutoClose        = flag.Bool("github.autoclose", false, "Close every issue once all of its maintenance has been removed. Requires -github.token-file.")
+	fResyncInterval   = flag.Duration("metrics.resync-interval", time.Hour, "How often to rebuild the maintenance metrics from the state. Zero disables the resync.")
+	fHostnames        = flagx.Enum{Options: []string{"v1", "v2"}, Value: "v2"}
+	fNodeLabel        = flag.Bool("metrics.node-label", true, "Include the legacy node label on the machine maintenance metric.")
+	fSiteProjectLabel = flag.Bool("metrics.site-project-label", false, "Include a project label on the site maintenance metric, which tells apart the sites of the same name in the projects that -webhook.repos routes to.")
+	fIssueRepo        = flag.String("metrics.issue-repo", "", "Full name of the GitHub repository (e.g. m-lab/ops-tracker) of issues that are not qualified with a repository, used to link to them from gmx_maintenance_issue_info.")
+	fLegacyErrors     = flag.Bool("metrics.legacy-error-count", true, "Also export errors under the deprecated gmx_error_count name, alongside gmx_error_total.")
+	fK8sEvents        = flag.Bool("kubernetes.events", false, "Record a Kubernetes Event for every machine or site entering or leaving maintenance. Requires running in-cluster.")
+	fK8sNamespace     = flag.String("kubernetes.namespace", "", "Namespace in which to record Kubernetes Events. Defaults to the namespace of the pod.")
+	fSlackFile        = flag.String("slack.webhook-file", "", "Filesystem path of a file containing a Slack incoming webhook URL. If set, a message is posted for every machine or site entering or leaving maintenance.")
+	fSlackRepo        = flag.String("slack.repo", "", "Full name of the GitHub repository (e.g. m-lab/ops-tracker) of issues in Slack messages that are not qualified with a repository, so that they can be linked to.")
+	fPubSubTopic      = flag.String("notify.pubsub-topic", "", "Cloud Pub/Sub topic, as a name in -project or projects/P/topics/T, to which the JSON of -notify.webhook-url is published for every machine or site entering or leaving maintenance. Disabled if empty.")
+	fAlertmanagerURL  = flag.String("alertmanager.url", "", "URL of an Alertmanager (e.g. http://alertmanager:9093) in which a silence is created for every machine or site in maintenance, and expired when the maintenance ends. Silences are renewed while the maintenance lasts, and lapse within an hour if the exporter stops.")
+	fAuditFile        = flag.String("audit.file", "", "Filesystem path of a hash-chained audit log of maintenance transitions. Disabled if empty.")
+	fAuditKMSKey      = flag.String("audit.kms-key", "", "Cloud KMS asymmetric signing key version used to sign segments of the audit log. Signing is disabled if empty.")
+	fAuditSignEvery   = flag.Int("audit.sign-every", 100, "Number of audit records in each signed segment.")
+	fAuditMirror      = flag.String("audit.mirror", "", "Storage, as a file path or gs://BUCKET/OBJECT, to which the audit log is copied every 30s and on shutdown. Disabled if empty.")
+	fMigrateTo        = flag.String("storage.migrate-to", "", "Storage to migrate the state to, as a file path or gs://BUCKET/OBJECT. If set, the state is written to both the current storage and this storage, but only read from the former.")
+	fLogBurst         = flag.Int("log.burst", 20, "Number of similar high-volume log lines (e.g. per-machine changes) logged per -log.interval before the rest are summarized. Zero disables the limit.")
+	fLogInterval      = flag.Duration("log.interval", time.Minute, "Interval over which -log.burst applies.")
+	fLogLevel         = flag.String("log.level", "info", "Lowest level of log lines that are written: debug, info, warn or error.")
+	fLogFormat        = flagx.Enum{Options: []string{"text", "json"}, Value: "text"}
+	fSecretsSource    = flagx.Enum{Options: []string{"file", "gsm"}, Value: "file"}
+	fErrorBackend     = flagx.Enum{Options: []string{"none", "sentry", "cloud"}, Value: "none"}
+	fTransfers        = flagx.Enum{Options: []string{handler.TransferCarry, handler.TransferClose}, Value: handler.TransferCarry}
+	fSentryDSN        = flag.String("errors.sentry-dsn", "", "Sentry DSN to report errors to when -errors.backend=sentry.")
+	fDegradedAfter    = flag.Int("storage.degraded-after", 3, "Number of consecutive failed state writes after which state-changing webhooks are refused with a 503 until a write succeeds. Zero disables degraded mode.")
+	fReposFile        = flag.String("webhook.repos", "", "Filesystem path of a JSON list of additional GitHub repositories whose webhooks are sent to /webhook, each with its own secret_file and optional settings (max_flags, approval_threshold, approvers, grace_period, autoclose) and project. Issues from them are recorded as REPO#NUMBER. A repository routed to another project uses that project's state, kept next to this instance's state with \".PROJECT\" appended.")
+	fMilestones       = flag.Bool("metrics.milestones", false, "Record the milestone of every issue with maintenance and export it as the milestone label of gmx_issue_info, so that maintenance campaigns can be grouped.")
+	fHistoryFile      = flag.String("history.file", "", "Filesystem path of a history of every machine and site entering and leaving maintenance, used to answer /api/v1/state?at=TIME and /history?entity=NAME&at=TIME. Disabled if empty.")
+	fHistoryMaxAge    = flag.Duration("history.max-age", 0, "Forget machines and sites in -history.file that left maintenance longer ago than this. Zero keeps them forever.")
+	fHistoryMaxBytes  = flag.Int64("history.max-bytes", 0, "Forget the machines and sites in -history.file that left maintenance longest ago until it fits in this many bytes. Zero means no limit.")
+	fHistoryCompact   = flag.Duration("history.compact-interval", time.Hour, "How often to compact -history.file and apply its retention policy.")
+	fWALPath          = flag.String("storage.wal", "", "Filesystem path of a write-ahead log to which every change to the state is appended, with the transitions it caused and their origin, before it is acknowledged. On startup, the changes logged after the last snapshot of the state are replayed, so that a crash loses nothing. The log is never truncated, so it also serves as an audit trail. States of other projects use the path with \".PROJECT\" appended. Disabled if empty.")
+	fSnapshotEvery    = flag.Int("storage.snapshot-every", 100, "Number of changes appended to -storage.wal between snapshots of the state. The state is also saved on shutdown.")
+	fBackups          = flag.Int("storage.backups", 0, "Number of timestamped backups of -storage.state-file to keep, made before each overwrite. Backups can be restored with /admin/rollback, and the newest valid one is restored automatically if the state file is corrupt.")
+	fAPITokens        = flag.String("api.token-file", "", "Filesystem path of a file of bearer tokens, one per line, that are required to read the state, history, schedule and audit log. The tokens of -admin.token-file are accepted too. The endpoints are open to anyone if empty.")
+	fFederationToken  = flag.String("federation.token-file", "", "Filesystem path of a file containing the bearer token sent to each -federation.peer, for peers that set -api.token-file.")
+	fAdminTokens      = flag.String("admin.token-file", "", "Filesystem path of a file of bearer tokens, one per line, that may use the /admin endpoints. The endpoints are disabled if empty.")
+	fEmitFormat       = flagx.Enum{Options: []string{"none", "statsd", "graphite"}, Value: "none"}
+	fEmitAddress      = flag.String("emit.address", "", "HOST:PORT of the statsd (UDP) or Graphite (TCP) server that -emit.format sends to.")
+	fEmitPrefix       = flag.String("emit.prefix", "gmx", "Prefix of the names of the metrics sent by -emit.format.")
+	fEmitInterval     = flag.Duration("emit.interval", time.Minute, "How often to send metrics when -emit.format is set.")
+	fPendingWebhooks  = flag.Int("siteinfo.pending-webhooks", 100, "Number of webhooks held while the initial siteinfo load is retried, and processed once it succeeds. Further webhooks are refused with a 503 until then.")
+	fSiteinfoRetry    = flag.Duration("siteinfo.retry-interval", 30*time.Second, "How often to retry the initial siteinfo load until it succeeds.")
+	fProjectsFile     = flag.String("webhook.projects", "", "Filesystem path of a JSON object mapping each project to the patterns that the names of its sites and machines (e.g. {\"mlab-oti\": {\"site\": \"[a-z]{3}[0-9c]{2}\", \"machine\": \"mlab[1-3]\"}}) must match, replacing the built-in rules.")
+	fAliasesFile      = flag.String("webhook.aliases", "", "Filesystem path of a JSON object mapping aliases of sites and machines (e.g. \"nyc-east\": \"lga03\") to their real names, which are substituted in /site and /machine flags. Aliases are case-insensitive.")
+	fStorageBackend   = flagx.Enum{Options: []string{"file", "gcs", "firestore"}, Value: "file"}
+	fGCSBucket        = flag.String("storage.gcs-bucket", "", "Cloud Storage bucket holding the state when -storage.backend=gcs.")
+	fGCSObject        = flag.String("storage.gcs-object", "gmx-state", "Name of the Cloud Storage object holding the state when -storage.backend=gcs.")
+	fFirestoreDoc     = flag.String("storage.firestore-document", "gmx/state", "Path of the Firestore document, in the default database of -project, holding the state when -storage.backend=firestore. Replicas sharing the document do not overwrite each other's changes.")
+	fAppID            = flag.Int64("github.app-id", 0, "ID of the GitHub App that GMX runs as. If set, webhooks are only accepted if they were delivered for the app's installation, and GitHub API calls are made as the installation instead of with -github.token-file. The app's webhook secret is read like the shared secret.")
+	fAppInstallation  = flag.Int64("github.app-installation-id", 0, "ID of the installation of -github.app-id.")
+	fAppKeyPath       = flag.String("github.app-private-key", "", "Filesystem path of the PEM-encoded private key of -github.app-id.")
+	fPollRepo         = flag.String("github.poll-repo", "", "Full name of the GitHub repository (e.g. m-lab/ops-tracker) whose webhooks are sent to /webhook. If set, its issues and those of -webhook.repos are polled every -github.poll-interval to catch missed webhooks. Requires -github.token-file.")
+	fPollInterval     = flag.Duration("github.poll-interval", 15*time.Minute, "Expected time between polls of the issues of -github.poll-repo.")
+	fPollLookback     = flag.Duration("github.poll-lookback", 24*time.Hour, "How far back the first poll of -github.poll-repo looks for updated issues.")
+	fDedupeSize       = flag.Int("webhook.dedupe-size", 1000, "Number of recent GitHub webhook deliveries remembered by their X-GitHub-Delivery ID, so that redeliveries are ignored. Zero disables deduplication.")
+	fShutdownTimeout  = flag.Duration("shutdown.timeout", 30*time.Second, "How long to wait for webhooks being processed to finish when shutting down, before the state is saved one last time.")
+	fIPAllowlist      = flag.Bool("webhook.github-ip-allowlist", false, "Refuse /webhook requests that are not sent from the webhook IP ranges published by the GitHub meta API.")
+	fAllowlistRefresh = flag.Duration("webhook.github-ip-refresh", time.Hour, "How often to refresh the IP ranges of -webhook.github-ip-allowlist.")
+	fTrustedProxies   = flag.Int("webhook.trusted-proxies", 0, "Number of proxies in front of the exporter that append to X-Forwarded-For. If positive, -webhook.github-ip-allowlist checks the address they report instead of that of the connection.")
+	fSubscription     = flag.String("webhook.pubsub-subscription", "", "Cloud Pub/Sub subscription, as a name in -project or projects/P/subscriptions/S, from which webhooks are pulled and processed as if received at /webhook. The data of each message is the body of a webhook, and its attributes are the headers of the delivery. Disabled if empty.")
+	fRateLimit        = flag.Float64("webhook.rate-limit", 0, "Average number of webhooks per second accepted; more are refused with 429 Too Many Requests. Zero disables the limit.")
+	fRateBurst        = flag.Int("webhook.rate-burst", 20, "Number of webhooks that may arrive at once despite -webhook.rate-limit.")
+	fMaxBody          = flag.Int64("webhook.max-body-bytes", 25<<20, "Largest webhook payload accepted; larger ones are refused with 413 Request Entity Too Large. Zero disables the limit.")
+	fDryRun           = flag.Bool("dry-run", false, "Validate and parse webhooks, and log and count in gmx_dryrun_mods_total the modifications they would make, without changing the state or its metrics, commenting on or closing issues, or applying scheduled changes, expiry and pruning.")
+	fLeaderLease      = flag.String("leader.lease", "", "Name of a Kubernetes Lease, in -kubernetes.namespace, that replicas compete for. Only the replica holding it processes webhooks, admin requests and scheduled changes, and writes the state; the others forward those requests to it and reload the state every -maintenance.schedule-interval to serve /state and /metrics. Requires running in-cluster and -storage.backend=gcs or firestore, so that the replicas share the state. Disabled if empty.")
+	fLeaderDuration   = flag.Duration("leader.lease-duration", 15*time.Second, "How long the leader may fail to renew -leader.lease before another replica takes over.")
+	fLeaderAddress    = flag.String("leader.address", "", "HOST:PORT at which the other replicas forward requests to this one while it holds -leader.lease. Defaults to the POD_IP environment variable and the port of -web.listen-address.")
+	fMassChange       = flag.Int("alert.mass-change-threshold", 50, "Number of entities a single webhook may modify before it is counted as a mass change. Zero disables the check.")
 
 	// Variables to aid in the testing of main()
 	mainCtx, mainCancel = context.WithCancel(context.Background())
@@ -36,6 +146,21 @@ var (
 	logFatal            = log.Fatal
 )
 
+func init() {
+	flag.Var(&fApprovers, "approval.approvers", "GitHub users allowed to approve large changes. May be repeated or comma separated.")
+	flag.Var(&fHostnames, "metrics.hostnames", "Hostname scheme for machine metric labels: v1 (mlab1.abc01.measurement-lab.org) or v2 (mlab1-abc01.<project>.measurement-lab.org).")
+	flag.Var(&fSources, "webhook.source", "An additional webhook source, as NAME=PROVIDER:SECRETFILE[:REPO] (e.g. lab=gitlab:/secrets/lab), served at /webhook/NAME. Issues from the source are recorded as NAME#NUMBER, and are linked to if the provider is github and the full name of their repository (e.g. m-lab/lab-tracker) is given. May be repeated.")
+	flag.Var(&fPeers, "federation.peer", "Another instance whose state is merged into /api/v1/federated, as PROJECT=URL (e.g. mlab-staging=https://gmx.mlab-staging.measurementlab.net). May be repeated.")
+	flag.Var(&fNotifyURLs, "notify.webhook-url", "URL to which a JSON description (kind, entity, action, issue, project, cause and timestamp) of every machine or site entering or leaving maintenance is POSTed. May be repeated.")
+	flag.Var(&fStorageBackend, "storage.backend", "Where to keep the state: file (-storage.state-file), gcs (-storage.gcs-bucket and -storage.gcs-object) or firestore (-storage.firestore-document).")
+	flag.Var(&fLogFormat, "log.format", "Format of log lines: text (key=value pairs) or json, e.g. for Stackdriver.")
+	flag.Var(&fSecretsSource, "secrets.source", "Where to read -storage.github-secret, -github.token-file, -github.app-private-key and the webhook secrets of -webhook.repos and -webhook.source from: file, or gsm (Secret Manager), in which case they are the names of secrets in -project (e.g. github-webhook-secret) or full resource names (projects/P/secrets/S[/versions/V]).")
+	flag.Var(&fErrorBackend, "errors.backend", "Where to report panics and ERROR log lines: none, sentry, or cloud (Cloud Error Reporting in -project).")
+	flag.Var(&fEmitFormat, "emit.format", "Also push transition counts and the number of machines and sites in maintenance, totaled over every project, to a server without Prometheus: none, statsd or graphite.")
+	flag.Var(&fTransfers, "webhook.transfers", "What happens to the maintenance of an issue transferred to another repository: carry, to move it to the new issue if the new repository is -github.poll-repo (or -metrics.issue-repo) or in -webhook.repos and shares the state, or otherwise close, to remove it.")
+	flag.Var(&fBlackouts, "maintenance.blackout", "A START/END pair of RFC3339 times during which changes are refused unless overridden. May be repeated, or given as a comma-separated list.")
+}
+
 // rootHandler implements the simplest possible handler for root requests,
 // simply printing the name of the utility and returning a 200 status. This
 // could be used by, for example, kubernetes aliveness checks.
@@ -44,6 +169,146 @@ func rootHandler(resp http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(resp, "GitHub Maintenance Exporter")
 }
 
+// webhookSource is an additional source of webhooks.
+type webhookSource struct {
+	name         string
+	providerName string
+	provider     handler.Provider
+	secretFile   string
+	// repo is the full name of the GitHub repository of the source's issues,
+	// if known.
+	repo string
+}
+
+// issueBaseURL returns the URL to which the numbers of the source's issues
+// are appended to link to them, or "" if they cannot be linked.
+func (s webhookSource) issueBaseURL() string {
+	if s.providerName != "github" || s.repo == "" {
+		return ""
+	}
+	return "https://github.com/" + s.repo + "/issues/"
+}
+
+// sourceNameRegExp matches valid names of webhook sources.
+var sourceNameRegExp = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// parseWebhookSource parses the value of a -webhook.source flag, which has the
+// form NAME=PROVIDER:SECRETFILE[:REPO].
+func parseWebhookSource(s string) (webhookSource, error) {
+	name, rest, ok := strings.Cut(s, "=")
+	if !ok || !sourceNameRegExp.MatchString(name) {
+		return webhookSource{}, fmt.Errorf("invalid webhook source name in %q", s)
+	}
+	providerName, secretFile, ok := strings.Cut(rest, ":")
+	if !ok || secretFile == "" {
+		return webhookSource{}, fmt.Errorf("missing secret file in webhook source %q", s)
+	}
+	secretFile, repo, _ := strings.Cut(secretFile, ":")
+	if repo != "" && strings.Count(repo, "/") != 1 {
+		return webhookSource{}, fmt.Errorf("invalid repository in webhook source %q", s)
+	}
+	provider, ok := handler.ProviderByName(providerName)
+	if !ok {
+		return webhookSource{}, fmt.Errorf("unknown webhook provider %q", providerName)
+	}
+	return webhookSource{name: name, providerName: providerName, provider: provider, secretFile: secretFile, repo: repo}, nil
+}
+
+// parsePeer parses the value of a -federation.peer flag, which has the form
+// PROJECT=URL.
+func parsePeer(s string) (api.Peer, error) {
+	project, rawURL, ok := strings.Cut(s, "=")
+	if !ok || project == "" {
+		return api.Peer{}, fmt.Errorf("missing project in federation peer %q", s)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return api.Peer{}, fmt.Errorf("invalid URL in federation peer %q", s)
+	}
+	return api.Peer{Project: project, URL: rawURL}, nil
+}
+
+// transferKeys returns a handler.Config.TransferKey for the repositories whose
+// webhooks are received: defaultRepo, whose issues are recorded by number in
+// the state of defaultProject, and those of repos, recorded as REPO#NUMBER.
+func transferKeys(defaultRepo string, defaultProject string, repos []handler.RepoConfig) func(string, string, int) (string, bool) {
+	return func(project string, repo string, issue int) (string, bool) {
+		if repo != "" && repo == defaultRepo && project == defaultProject {
+			return strconv.Itoa(issue), true
+		}
+		for _, rc := range repos {
+			p := rc.Project
+			if p == "" {
+				p = defaultProject
+			}
+			if rc.Repo == repo && p == project {
+				return repo + "#" + strconv.Itoa(issue), true
+			}
+		}
+		return "", false
+	}
+}
+
+// projectState is the maintenance state of one project.
+type projectState struct {
+	project string
+	state   *maintenancestate.MaintenanceState
+	sites   *sites.CachingClient
+}
+
+// findProject returns the state of project, or nil if there is none.
+func findProject(projects []*projectState, project string) *projectState {
+	for _, p := range projects {
+		if p.project == project {
+			return p
+		}
+	}
+	return nil
+}
+
+// stateLocation returns the location of the state of project, in the form
+// accepted by maintenancestate.OpenStorage. The states of projects other than
+// the instance's own are kept next to its state, with the project name
+// appended.
+func stateLocation(project string) string {
+	location := *fStateFilePath
+	switch fStorageBackend.Value {
+	case "gcs":
+		location = "gs://" + *fGCSBucket + "/" + *fGCSObject
+	case "firestore":
+		location = "firestore://" + *fProject + "/" + *fFirestoreDoc
+	}
+	if project != *fProject {
+		location += "." + project
+	}
+	return location
+}
+
+// mustOpenProject loads the siteinfo data and state of a project that
+// repositories are routed to.
+func mustOpenProject(project string) *projectState {
+	sites := sites.New(project)
+	sites.Locations = http.DefaultClient
+	rtx.Must(sites.Reload(mainCtx), "could not load siteinfo data for %s", project)
+	storage, err := maintenancestate.OpenStorage(stateLocation(project))
+	rtx.Must(err, "invalid state location for %s", project)
+	state, err := maintenancestate.NewWithStorage(storage, sites, project)
+	if err != nil {
+		slog.Warn("Failed to open state", "storage", storage, "err", err)
+	}
+	return &projectState{project: project, state: state, sites: sites}
+}
+
+// handleState registers the endpoints that serve the current and past state
+// of stateAPI on mux, each wrapped by protect.
+func handleState(mux *http.ServeMux, stateAPI *api.API, protect func(http.HandlerFunc) http.Handler) {
+	mux.Handle("/api/v1/state", protect(stateAPI.State))
+	// /state is a shorter name for the same state, served alongside /metrics.
+	mux.Handle("/state", protect(stateAPI.State))
+	mux.Handle("/api/v1/history", protect(stateAPI.History))
+	mux.Handle("/history", protect(stateAPI.History))
+}
+
 // MustReadGithubSecret reads the GitHub shared webhook secret from a file (if a
 // filename is provided) or retrieves it from the environment. It exits with a
 // fatal error if the secret is not found or is bad for any reason.
@@ -66,9 +331,73 @@ func MustReadGithubSecret(filename string) []byte {
 	return secretTrimmed
 }
 
+// updater returns the StateUpdater through which webhooks change state. With
+// -dry-run, it only logs and counts the changes.
+func updater(state *maintenancestate.MaintenanceState) handler.StateUpdater {
+	if *fDryRun {
+		return handler.NewDryRun(state)
+	}
+	return state
+}
+
+// secretManager reads secrets when -secrets.source=gsm.
+var secretManager *gcp.SecretManager
+
+// readSecret reads a secret from the file at path or, if -secrets.source=gsm,
+// from the Secret Manager secret that path names.
+func readSecret(path string) ([]byte, error) {
+	if fSecretsSource.Value != "gsm" {
+		return os.ReadFile(path)
+	}
+	if secretManager == nil {
+		secretManager = gcp.NewSecretManager(*fProject)
+	}
+	return secretManager.Access(mainCtx, path)
+}
+
+// webhookSecrets are the webhook secrets read by readSecret, which are reread
+// every -storage.github-secret-reload and on SIGHUP.
+var webhookSecrets []*handler.RotatingSecret
+
+// mustWebhookSecret reads a webhook secret like MustReadGithubSecret. If it is
+// read with readSecret, config.Secrets is set so that it can be rotated.
+func mustWebhookSecret(path string, config *handler.Config) []byte {
+	config.Secrets = nil
+	if path == "" {
+		return MustReadGithubSecret("")
+	}
+	s, err := handler.NewRotatingSecret(path, func() ([]byte, error) { return readSecret(path) })
+	rtx.Must(err, "ERROR: Could not read secret %s", path)
+	webhookSecrets = append(webhookSecrets, s)
+	config.Secrets = s.Secrets
+	return bytes.Join(s.Secrets(), []byte("\n"))
+}
+
+// reloadSecrets rereads every webhook secret.
+func reloadSecrets() {
+	for _, f := range webhookSecrets {
+		if err := f.Reload(); err != nil {
+			slog.Error("Failed to reload a webhook secret", "err", err)
+			metrics.CountError("reloadsecret", "main")
+		}
+	}
+}
+
 func main() {
 	defer mainCancel()
+	if len(os.Args) > 1 && os.Args[1] == "send-test-hook" {
+		if err := sendTestHook(os.Args[2:], os.Stdout); err != nil {
+			logFatal(err)
+		}
+		return
+	}
 	flag.Parse()
+	if *fConfigFile != "" {
+		rtx.Must(config.ApplyFile(flag.CommandLine, *fConfigFile), "invalid -config")
+	}
+
+	ratelog.Default.SetLimit(*fLogBurst, *fLogInterval)
+	go ratelog.Default.Run(mainCtx)
 
 	// Exit if an invalid/unknown project is passed.
 	var isValidProject = false
@@ -82,28 +411,440 @@ func main() {
 		logFatal("Unknown project: ", *fProject)
 	}
 
+	var reporter *errorreport.Reporter
+	switch fErrorBackend.Value {
+	case "sentry":
+		sentry, err := errorreport.NewSentry(*fSentryDSN)
+		rtx.Must(err, "invalid -errors.sentry-dsn")
+		reporter = errorreport.New(sentry)
+	case "cloud":
+		reporter = errorreport.New(errorreport.NewCloudErrorReporting(*fProject))
+	}
+	logOutput := io.Writer(os.Stderr)
+	if reporter != nil {
+		logOutput = reporter.Writer(os.Stderr)
+		go reporter.Run(mainCtx)
+	}
+	rtx.Must(logging.Setup(logOutput, *fLogLevel, fLogFormat.Value), "invalid -log.level")
+
 	// Create a new sites.CachingClient, and load data from the siteinfo API
-	// for the first time. An error on the initial load of the siteinfo data is
-	// fatal.
+	// for the first time, retrying until it succeeds. Webhooks are held until
+	// then, so that the sites they mention can be found.
 	sites := sites.New(*fProject)
-	rtx.Must(sites.Reload(mainCtx), "could not load siteinfo data")
+	sites.Locations = http.DefaultClient
+	pending := handler.NewBuffer(*fPendingWebhooks)
+	go func() {
+		for {
+			err := sites.Reload(mainCtx)
+			if err == nil {
+				break
+			}
+			slog.Error("Failed to load the siteinfo data", "retry", *fSiteinfoRetry, "err", err)
+			metrics.CountError("siteinfo", "main")
+			select {
+			case <-mainCtx.Done():
+				return
+			case <-time.After(*fSiteinfoRetry):
+			}
+		}
+		if n := pending.Release(); n > 0 {
+			slog.Info("Processed webhooks held until the siteinfo data was loaded", "count", n)
+		}
+	}()
+
+	rtx.Must(maintenancestate.SetLabelScheme(maintenancestate.LabelScheme{
+		Hostnames:   fHostnames.Value,
+		NodeLabel:   *fNodeLabel,
+		SiteProject: *fSiteProjectLabel,
+	}), "invalid metric label scheme")
+	metrics.SetLegacyErrorMetric(*fLegacyErrors)
+	maintenancestate.SetIssueRepo(*fIssueRepo)
+	var sources []webhookSource
+	for _, s := range fSources {
+		source, err := parseWebhookSource(s)
+		rtx.Must(err, "invalid -webhook.source")
+		maintenancestate.SetIssueSource(source.name, source.providerName, source.issueBaseURL())
+		sources = append(sources, source)
+	}
+
+	if *fProjectsFile != "" {
+		f, err := os.Open(*fProjectsFile)
+		rtx.Must(err, "could not open -webhook.projects file")
+		rules, err := handler.ReadProjectRules(f)
+		f.Close()
+		rtx.Must(err, "invalid -webhook.projects file %s", *fProjectsFile)
+		handler.SetProjectRules(rules)
+	}
 
 	// Read state and secrets off the disk.
-	state, err := maintenancestate.New(*fStateFilePath, sites, *fProject)
+	storage, err := maintenancestate.OpenStorage(stateLocation(*fProject))
+	rtx.Must(err, "invalid -storage.%s location", fStorageBackend.Value)
+	if fs, ok := storage.(*maintenancestate.FileStorage); ok {
+		fs.KeepBackups = *fBackups
+	}
+	if *fMigrateTo != "" {
+		newStorage, err := maintenancestate.OpenStorage(*fMigrateTo)
+		rtx.Must(err, "invalid -storage.migrate-to")
+		storage = &maintenancestate.DualWrite{Old: storage, New: newStorage, Project: *fProject}
+	}
+	state, err := maintenancestate.NewWithStorage(storage, sites, *fProject)
 	if err != nil {
 		// TODO: Should this be a fatal error, or is this okay?
-		log.Printf("WARNING: Failed to open state file %s: %s", *fStateFilePath, err)
+		slog.Warn("Failed to open state", "storage", storage, "err", err)
+	}
+	projects := []*projectState{{project: *fProject, state: state, sites: sites}}
+
+	// Repositories may be routed to other projects, each of which has its
+	// own state.
+	var repos []handler.RepoConfig
+	if *fReposFile != "" {
+		f, err := os.Open(*fReposFile)
+		rtx.Must(err, "could not open -webhook.repos file")
+		repos, err = handler.ReadRepoConfigs(f)
+		f.Close()
+		rtx.Must(err, "invalid -webhook.repos file %s", *fReposFile)
+		for _, rc := range repos {
+			if rc.Project != "" && findProject(projects, rc.Project) == nil {
+				projects = append(projects, mustOpenProject(rc.Project))
+			}
+		}
+	}
+
+	if *fWALPath != "" {
+		for _, p := range projects {
+			path := *fWALPath
+			if p.project != *fProject {
+				path += "." + p.project
+			}
+			wal, err := maintenancestate.OpenWAL(path)
+			rtx.Must(err, "could not open -storage.wal %s", path)
+			defer wal.Close()
+			rtx.Must(p.state.UseWAL(wal, *fSnapshotEvery), "could not replay -storage.wal %s", path)
+		}
 	}
 
-	// Prune the loaded statefile of state for sites/machine that no longer exist.
-	state.Prune(*fProject)
+	// With -leader.lease, only the leader among the replicas changes the
+	// state.
+	var elector *leader.Elector
+	if *fLeaderLease != "" {
+		if fStorageBackend.Value == "file" {
+			logFatal("-leader.lease requires -storage.backend=gcs or firestore")
+		}
+		client, err := kube.InCluster(*fK8sNamespace, 10*time.Second)
+		rtx.Must(err, "-leader.lease requires running in a Kubernetes cluster")
+		address := *fLeaderAddress
+		if address == "" {
+			_, port, err := net.SplitHostPort(*fListenAddress)
+			rtx.Must(err, "invalid -web.listen-address")
+			if os.Getenv("POD_IP") == "" {
+				logFatal("-leader.lease requires -leader.address or the POD_IP environment variable")
+			}
+			address = net.JoinHostPort(os.Getenv("POD_IP"), port)
+		}
+		elector = leader.New(client, *fLeaderLease, address, *fLeaderDuration)
+	}
+	leads := func() bool { return elector == nil || elector.Leading() }
+	forward := func(h http.Handler) http.Handler {
+		if elector == nil {
+			return h
+		}
+		return elector.Forward(h)
+	}
 
-	githubSecret := MustReadGithubSecret(*fGitHubSecretPath)
+	var listeners []interface {
+		maintenancestate.Listener
+		Run(context.Context)
+	}
+	if *fK8sEvents {
+		k8s, err := notify.NewKubernetes(*fK8sNamespace)
+		rtx.Must(err, "could not configure Kubernetes events")
+		listeners = append(listeners, k8s)
+	}
+
+	// Only the leader manages the silences in Alertmanager, from when it is
+	// elected, with the state it reloads then.
+	var am *notify.Alertmanager
+	seedSilences := func() {
+		var snapshots []maintenancestate.Snapshot
+		for _, p := range projects {
+			snapshots = append(snapshots, p.state.Snapshot())
+		}
+		am.Seed(snapshots...)
+	}
+	if *fAlertmanagerURL != "" {
+		am = notify.NewAlertmanager(*fAlertmanagerURL)
+		if elector == nil {
+			seedSilences()
+		}
+		listeners = append(listeners, am)
+	}
+
+	if len(fNotifyURLs) > 0 {
+		listeners = append(listeners, notify.NewWebhook(fNotifyURLs))
+	}
+
+	if *fPubSubTopic != "" {
+		listeners = append(listeners, notify.NewPubSub(*fProject, *fPubSubTopic))
+	}
+
+	if *fSlackFile != "" {
+		data, err := os.ReadFile(*fSlackFile)
+		rtx.Must(err, "ERROR: Could not read file %s", *fSlackFile)
+		listeners = append(listeners, notify.NewSlack(strings.TrimSpace(string(data)), *fSlackRepo))
+	}
+
+	var auditLog *audit.Log
+	if *fAuditFile != "" {
+		var signer audit.Signer
+		if *fAuditKMSKey != "" {
+			signer = audit.NewKMS(*fAuditKMSKey)
+		}
+		auditLog, err = audit.Open(*fAuditFile, signer, *fAuditSignEvery)
+		rtx.Must(err, "could not open audit log %s", *fAuditFile)
+		defer auditLog.Close()
+		if *fAuditMirror != "" {
+			auditLog.Mirror, err = maintenancestate.OpenStorage(*fAuditMirror)
+			rtx.Must(err, "could not open audit log mirror %s", *fAuditMirror)
+		}
+		listeners = append(listeners, auditLog)
+	}
+
+	// The emitter counts the transitions of every project, so its gauges
+	// are the totals of every project too.
+	var counters notify.Counters
+	for _, p := range projects {
+		counters = append(counters, p.state)
+	}
+	switch fEmitFormat.Value {
+	case "statsd":
+		listeners = append(listeners, notify.NewStatsd(*fEmitAddress, *fEmitPrefix, *fEmitInterval, counters))
+	case "graphite":
+		listeners = append(listeners, notify.NewGraphite(*fEmitAddress, *fEmitPrefix, *fEmitInterval, counters))
+	}
+
+	var hist *history.Store
+	if *fHistoryFile != "" {
+		hist, err = history.Open(*fHistoryFile, *fProject)
+		rtx.Must(err, "could not open history %s", *fHistoryFile)
+		defer hist.Close()
+		now := time.Now()
+		for _, p := range projects {
+			rtx.Must(hist.Seed(p.project, p.state.Snapshot(), now), "could not seed history %s", *fHistoryFile)
+		}
+		listeners = append(listeners, hist)
+	}
+
+	for _, l := range listeners {
+		var listener maintenancestate.Listener = l
+		if elector != nil {
+			// Followers see the leader's transitions when they reload the
+			// state, which the leader has already reported.
+			listener = elector.Listener(l)
+		}
+		for _, p := range projects {
+			p.state.AddListener(listener)
+		}
+		go l.Run(mainCtx)
+	}
+
+	for _, p := range projects {
+		p.state.SetDegradedThreshold(*fDegradedAfter)
+		// Prune the loaded statefile of state for sites/machine that no
+		// longer exist. With -leader.lease, the leader prunes it once elected.
+		if !*fDryRun && elector == nil {
+			p.state.Prune(p.project)
+		}
+	}
+
+	status := api.NewStatus(state, sites)
+	for _, p := range projects[1:] {
+		status.WithProjects(p.state)
+	}
+	config := handler.Config{
+		MassChangeThreshold: *fMassChange,
+		MaxFlags:            *fMaxFlags,
+		ApprovalThreshold:   *fApprovalLimit,
+		GracePeriod:         *fGracePeriod,
+		DefaultTTL:          *fDefaultTTL,
+		Blackouts:           fBlackouts,
+		Approvers:           fApprovers,
+		AutoClose:           *fAutoClose,
+		Milestones:          *fMilestones,
+		Tracker:             status,
+		Transfer:            fTransfers.Value,
+	}
+	defaultRepo := *fPollRepo
+	if defaultRepo == "" {
+		defaultRepo = *fIssueRepo
+	}
+	config.TransferKey = transferKeys(defaultRepo, *fProject, repos)
+	if *fAliasesFile != "" {
+		f, err := os.Open(*fAliasesFile)
+		rtx.Must(err, "could not open -webhook.aliases file")
+		config.Aliases, err = handler.ReadAliases(f)
+		f.Close()
+		rtx.Must(err, "invalid -webhook.aliases file %s", *fAliasesFile)
+	}
+	var client *githubapi.Client
+	switch {
+	case *fAppID != 0:
+		if *fGitHubTokenPath != "" || *fAppInstallation == 0 || *fAppKeyPath == "" {
+			logFatal("-github.app-id requires -github.app-installation-id and -github.app-private-key, and excludes -github.token-file")
+		}
+		data, err := readSecret(*fAppKeyPath)
+		rtx.Must(err, "ERROR: Could not read secret %s", *fAppKeyPath)
+		key, err := githubapi.ParsePrivateKey(data)
+		rtx.Must(err, "invalid -github.app-private-key %s", *fAppKeyPath)
+		client = githubapi.NewApp(*fAppID, *fAppInstallation, key)
+		config.Provider = handler.GitHubApp{AppID: *fAppID, InstallationID: *fAppInstallation}
+	case *fGitHubTokenPath != "":
+		token, err := readSecret(*fGitHubTokenPath)
+		rtx.Must(err, "ERROR: Could not read secret %s", *fGitHubTokenPath)
+		client = githubapi.New(string(bytes.TrimSpace(token)))
+	}
+	if client != nil {
+		config.Comments = client
+	}
+	if client != nil && !*fDryRun {
+		config.Commenter = client
+		config.Closer = client
+	}
+	var pollers []*handler.Poller
+	if *fPollRepo != "" {
+		if client == nil {
+			logFatal("-github.poll-repo requires -github.token-file or -github.app-id")
+		}
+		pollers = append(pollers, handler.NewPoller(updater(state), client, *fPollRepo, *fProject, config, *fPollLookback))
+	}
 
 	// Add handlers to the default handler.
 	http.HandleFunc("/", rootHandler)
-	http.Handle("/webhook", handler.New(state, githubSecret, *fProject))
+	webhookConfig := config
+	webhook := handler.New(updater(state), mustWebhookSecret(*fGitHubSecretPath, &webhookConfig), *fProject, webhookConfig)
+	if len(repos) > 0 {
+		router := &handler.Router{Default: webhook, Repos: map[string]http.Handler{}}
+		for _, rc := range repos {
+			repoConfig, err := rc.Apply(config)
+			rtx.Must(err, "invalid -webhook.repos file %s", *fReposFile)
+			p := projects[0]
+			if rc.Project != "" {
+				p = findProject(projects, rc.Project)
+			}
+			secret := mustWebhookSecret(rc.SecretFile, &repoConfig)
+			router.Repos[rc.Repo] = handler.New(updater(p.state), secret, p.project, repoConfig)
+			if len(pollers) > 0 {
+				pollers = append(pollers, handler.NewPoller(updater(p.state), client, rc.Repo, p.project, repoConfig, *fPollLookback))
+			}
+		}
+		webhook = router
+	}
+	wrap := pending.Wrap
+	if *fDedupeSize > 0 {
+		dedupe := handler.NewDeduper(*fDedupeSize)
+		wrap = func(h http.Handler) http.Handler { return pending.Wrap(dedupe.Wrap(h)) }
+	}
+	var subscriber *handler.Subscriber
+	if *fSubscription != "" {
+		// Webhooks are pulled as fast as they are processed, so they are not
+		// rate limited.
+		subscriber = handler.NewSubscriber(gcp.NewPubSub(*fProject), *fSubscription, errorreport.Middleware(reporter, wrap(webhook)))
+		if elector == nil {
+			// Otherwise, the leader pulls them once elected.
+			go subscriber.Run(mainCtx)
+		}
+	}
+	// Every webhook endpoint shares the same limits.
+	limiter := handler.NewLimiter(*fRateLimit, *fRateBurst, *fMaxBody)
+	buffered := wrap
+	wrap = func(h http.Handler) http.Handler { return limiter.Wrap(buffered(h)) }
+	webhookHandler := wrap(webhook)
+	if *fIPAllowlist {
+		allowlist := handler.NewAllowlist(handler.GitHubMetaURL)
+		allowlist.TrustedProxies = *fTrustedProxies
+		if elector != nil {
+			allowlist.Forwarded = elector.Forwarded
+		}
+		if err := allowlist.Refresh(mainCtx); err != nil {
+			// Webhooks are refused until a later refresh succeeds.
+			slog.Error("Failed to load the GitHub webhook IP ranges", "err", err)
+			metrics.CountError("refresh", "main")
+		}
+		go allowlist.Run(mainCtx, *fAllowlistRefresh)
+		webhookHandler = allowlist.Wrap(webhookHandler)
+	}
+	http.Handle("/webhook", errorreport.Middleware(reporter, forward(webhookHandler)))
+	for _, source := range sources {
+		sourceConfig := config
+		sourceConfig.Provider = source.provider
+		sourceConfig.Source = source.name
+		if _, ok := source.provider.(handler.GitHub); !ok {
+			// The GitHub API client can only report back on GitHub issues.
+			sourceConfig.Commenter = nil
+			sourceConfig.Closer = nil
+			sourceConfig.Comments = nil
+		}
+		secret := mustWebhookSecret(source.secretFile, &sourceConfig)
+		http.Handle("/webhook/"+source.name, errorreport.Middleware(reporter, forward(wrap(handler.New(updater(state), secret, *fProject, sourceConfig)))))
+	}
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/selftest", handler.NewSelfTest(state, *fProject, config))
+	// /parse previews the changes a message would make, e.g. before filing
+	// an issue.
+	http.Handle("/parse", handler.NewPreview(state, *fProject, config))
+
+	// The endpoints that expose the state require a bearer token if
+	// -api.token-file is set.
+	protect := func(h http.HandlerFunc) http.Handler { return h }
+	if *fAPITokens != "" {
+		tokens, err := admin.ReadTokens(*fAPITokens)
+		rtx.Must(err, "could not read -api.token-file")
+		if *fAdminTokens != "" {
+			adminTokens, err := admin.ReadTokens(*fAdminTokens)
+			rtx.Must(err, "could not read -admin.token-file")
+			tokens = append(tokens, adminTokens...)
+		}
+		protect = func(h http.HandlerFunc) http.Handler { return admin.RequireToken(tokens, h) }
+	}
+	http.Handle("/api/v1/schedule", protect(api.New(state).Schedule))
+	// /ui renders the state served by /api/v1/state, so it is protected
+	// like it.
+	http.Handle("/ui", protect(ui.New(state, *fProject).ServeHTTP))
+	stateAPI := api.New(state)
+	if hist != nil {
+		stateAPI.WithHistory(hist)
+	}
+	handleState(http.DefaultServeMux, stateAPI, protect)
+	if len(fPeers) > 0 {
+		var token string
+		if *fFederationToken != "" {
+			data, err := os.ReadFile(*fFederationToken)
+			rtx.Must(err, "could not read -federation.token-file")
+			token = strings.TrimSpace(string(data))
+		}
+		var peers []api.Peer
+		for _, p := range fPeers {
+			peer, err := parsePeer(p)
+			rtx.Must(err, "invalid -federation.peer")
+			peer.Token = token
+			peers = append(peers, peer)
+		}
+		http.Handle("/api/v1/federated", protect(api.NewFederation(*fProject, state, peers).Federated))
+	}
+	http.Handle("/statusz", status)
+	http.HandleFunc("/ready", status.Ready)
+	http.HandleFunc("/live", status.Live)
+	if auditLog != nil {
+		http.Handle("/audit", protect(auditLog.ServeHTTP))
+	}
+	if *fAdminTokens != "" {
+		tokens, err := admin.ReadTokens(*fAdminTokens)
+		rtx.Must(err, "could not read -admin.token-file")
+		a := admin.New(state, sites, *fProject)
+		http.Handle("/admin/v1/pattern", forward(admin.RequireToken(tokens, http.HandlerFunc(a.Pattern))))
+		http.Handle("/admin/rollback", forward(admin.RequireToken(tokens, http.HandlerFunc(a.Rollback))))
+		http.Handle("/admin/maintenance", forward(admin.RequireToken(tokens, http.HandlerFunc(a.Maintenance))))
+		http.Handle("/admin/close-issue", forward(admin.RequireToken(tokens, http.HandlerFunc(a.CloseIssue))))
+	}
 
 	// Set up the server
 	srv := http.Server{
@@ -111,6 +852,47 @@ func main() {
 		Handler: http.DefaultServeMux,
 	}
 
+	// Compete for -leader.lease. A new leader first reloads the state, which
+	// the previous leader may have changed since the last reload. A leader
+	// that stops leading, including before it releases the lease on
+	// shutdown, first saves the changes that are only in -storage.wal, so
+	// that the next leader sees them.
+	if elector != nil {
+		var stopSubscriber context.CancelFunc
+		elector.OnChange = func(leading bool) {
+			if !leading {
+				if stopSubscriber != nil {
+					stopSubscriber()
+				}
+				if am != nil {
+					am.Release()
+				}
+				for _, p := range projects {
+					if err := p.state.Checkpoint(); err != nil {
+						slog.Error("Failed to save the state on losing the lease", "project", p.project, "err", err)
+						metrics.CountError("checkpoint", "main")
+					}
+				}
+				return
+			}
+			for _, p := range projects {
+				if err := p.state.Reload(); err != nil {
+					slog.Error("Failed to reload the state", "project", p.project, "err", err)
+					metrics.CountError("reload", "main")
+				}
+			}
+			if am != nil {
+				seedSilences()
+			}
+			if subscriber != nil {
+				var ctx context.Context
+				ctx, stopSubscriber = context.WithCancel(mainCtx)
+				go subscriber.Run(ctx)
+			}
+		}
+		go elector.Run(mainCtx)
+	}
+
 	// Reload the siteinfo data periodically.
 	go func() {
 		reloadConfig := memoryless.Config{
@@ -121,20 +903,202 @@ func main() {
 		tick, err := memoryless.NewTicker(mainCtx, reloadConfig)
 		rtx.Must(err, "could not create ticker for reloading siteinfo")
 		for range tick.C {
-			err = sites.Reload(mainCtx)
-			if err != nil {
-				log.Printf("Failed to reload the siteinfo data: %v", err)
+			for _, p := range projects {
+				err = p.sites.Reload(mainCtx)
+				if err != nil {
+					slog.Error("Failed to reload the siteinfo data", "project", p.project, "err", err)
+				}
+				if p.sites.Loaded().IsZero() {
+					// Without any siteinfo data, every site would look retired.
+					continue
+				}
+				if !*fDryRun && leads() {
+					p.state.Prune(p.project)
+				}
 			}
-			state.Prune(*fProject)
 		}
 	}()
 
-	// When the context is canceled, stop serving.
+	// Apply scheduled changes once they are due, end expired maintenance, and
+	// update how long maintenance has lasted.
 	go func() {
+		tick := time.NewTicker(*fScheduleInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-mainCtx.Done():
+				return
+			case now := <-tick.C:
+				states := map[string]*maintenancestate.MaintenanceState{}
+				for _, p := range projects {
+					states[p.project] = p.state
+				}
+				if !leads() {
+					// Follow the changes made by the leader, reloading every
+					// project before correcting their shared metrics once.
+					for _, p := range projects {
+						if err := p.state.Reload(); err != nil {
+							slog.Error("Failed to reload the state", "project", p.project, "err", err)
+							metrics.CountError("reload", "main")
+						}
+					}
+					maintenancestate.ResyncAll(states)
+					maintenancestate.UpdateAges(states, now)
+					continue
+				}
+				for _, p := range projects {
+					if p.state.Degraded() {
+						// Probe whether writes are succeeding again.
+						p.state.Write()
+					}
+					if p.sites.Loaded().IsZero() || *fDryRun {
+						// Due site changes would fail without siteinfo data,
+						// and the state must not change in dry-run mode.
+						continue
+					}
+					p.state.ApplyDue(now, p.project)
+					p.state.ExpireEntries(now, p.project)
+				}
+				maintenancestate.UpdateAges(states, now)
+			}
+		}
+	}()
+
+	// Periodically compact the history.
+	if hist != nil && *fHistoryCompact > 0 {
+		go func() {
+			tick := time.NewTicker(*fHistoryCompact)
+			defer tick.Stop()
+			for {
+				select {
+				case <-mainCtx.Done():
+					return
+				case now := <-tick.C:
+					n, err := hist.Compact(now, *fHistoryMaxAge, *fHistoryMaxBytes)
+					if err != nil {
+						slog.Error("Failed to compact history", "err", err)
+						metrics.CountError("compact", "main")
+					} else if n > 0 {
+						slog.Info("Removed events from the history", "count", n)
+					}
+				}
+			}
+		}()
+	}
+
+	// Poll the issues of the repositories for missed webhooks.
+	if len(pollers) > 0 {
+		go func() {
+			pollConfig := memoryless.Config{
+				Min:      *fPollInterval / 2,
+				Max:      *fPollInterval * 2,
+				Expected: *fPollInterval,
+			}
+			tick, err := memoryless.NewTicker(mainCtx, pollConfig)
+			rtx.Must(err, "could not create ticker for polling GitHub issues")
+			for range tick.C {
+				if sites.Loaded().IsZero() || !leads() {
+					// Sites cannot be expanded into their machines yet, or
+					// the leader polls instead.
+					continue
+				}
+				for _, p := range pollers {
+					p.Poll(mainCtx)
+				}
+			}
+		}()
+	}
+
+	// Periodically rebuild the maintenance metrics from the state.
+	if *fResyncInterval > 0 {
+		go func() {
+			tick := time.NewTicker(*fResyncInterval)
+			defer tick.Stop()
+			for {
+				select {
+				case <-mainCtx.Done():
+					return
+				case <-tick.C:
+					states := map[string]*maintenancestate.MaintenanceState{}
+					for _, p := range projects {
+						states[p.project] = p.state
+					}
+					maintenancestate.ResyncAll(states)
+				}
+			}
+		}()
+	}
+
+	// Reread the webhook secrets periodically and on SIGHUP, so that they can
+	// be rotated without a restart.
+	for _, f := range webhookSecrets {
+		if *fSecretReload > 0 {
+			go f.Run(mainCtx, *fSecretReload)
+		}
+	}
+	go func() {
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		defer signal.Stop(hangups)
+		for {
+			select {
+			case <-hangups:
+				slog.Info("Received SIGHUP, rereading the webhook secrets")
+				reloadSecrets()
+			case <-mainCtx.Done():
+				return
+			}
+		}
+	}()
+
+	// Cancel the context on SIGTERM, as sent by Kubernetes before it kills
+	// the pod, or on an interrupt.
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			slog.Info("Shutting down", "signal", sig)
+			mainCancel()
+		case <-mainCtx.Done():
+		}
+	}()
+
+	// When the context is canceled, stop accepting webhooks and wait for the
+	// ones in flight to finish, so that none is interrupted between changing
+	// the state and saving it.
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
 		<-mainCtx.Done()
-		srv.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), *fShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("Webhooks were still being processed at shutdown", "timeout", *fShutdownTimeout, "err", err)
+			metrics.CountError("shutdown", "main")
+			srv.Close()
+		}
 	}()
 
-	// Listen forever, or until the context is closed.
-	logFatal(srv.ListenAndServe())
+	// Listen until the context is canceled.
+	err = srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		logFatal(err)
+		return
+	}
+	<-shutdown
+
+	// Save the state one last time, in case a previous write failed or the
+	// latest changes are only in -storage.wal. With -leader.lease, that was
+	// done before the lease was released, and the state may already be
+	// another replica's to write.
+	if elector == nil {
+		for _, p := range projects {
+			if err := p.state.Checkpoint(); err != nil {
+				slog.Error("Failed to save the state on shutdown", "project", p.project, "err", err)
+			}
+		}
+	}
+	slog.Info("Shut down")
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -11,6 +12,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/m-lab/github-maintenance-exporter/api"
+	"github.com/m-lab/github-maintenance-exporter/handler"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
 	"github.com/m-lab/go/osx"
 
 	"github.com/m-lab/go/rtx"
@@ -60,6 +64,28 @@ func TestGithubSecretFromEnv(t *testing.T) {
 	}
 }
 
+func TestMustWebhookSecret(t *testing.T) {
+	dir := t.TempDir()
+	rtx.Must(os.WriteFile(dir+"/secret", []byte("old"), 0644), "Could not create test secret")
+	config := handler.Config{}
+	b := mustWebhookSecret(dir+"/secret", &config)
+	if string(b) != "old" || config.Secrets == nil || string(config.Secrets()[0]) != "old" {
+		t.Fatalf("mustWebhookSecret() = %q; want old and a rotatable secret", b)
+	}
+	rtx.Must(os.WriteFile(dir+"/secret", []byte("new"), 0644), "Could not rotate test secret")
+	reloadSecrets()
+	if got := config.Secrets(); len(got) != 1 || string(got[0]) != "new" {
+		t.Errorf("Secrets() after reloadSecrets() = %q; want new", got)
+	}
+
+	revert := osx.MustSetenv("GITHUB_WEBHOOK_SECRET", "env")
+	defer revert()
+	b = mustWebhookSecret("", &config)
+	if string(b) != "env" || config.Secrets != nil {
+		t.Errorf("mustWebhookSecret() from the environment = %q with a rotatable secret; want env without", b)
+	}
+}
+
 func TestGithubSecretFromEmptyFile(t *testing.T) {
 	dir, err := os.MkdirTemp("", "TestGithubSecretFromEmptyFile")
 	rtx.Must(err, "Could not create tempdir")
@@ -98,12 +124,6 @@ func TestMainViaSmokeTest(t *testing.T) {
 	rtx.Must(os.WriteFile(dir+"/secret", []byte("test"), 0644), "Could not create test secret")
 
 	logFatal = func(...interface{}) { panic("testerror") }
-	defer func() {
-		r := recover()
-		if r == nil {
-			t.Error("Should have had a panic but did not")
-		}
-	}()
 
 	*fGitHubSecretPath = dir + "/secret"
 	*fStateFilePath = dir + "/state.json"
@@ -116,4 +136,132 @@ func TestMainViaSmokeTest(t *testing.T) {
 	}()
 
 	main() // No crash and no freeze and full coverage of main() == success
+
+	// The state is saved when shutting down.
+	if _, err := os.Stat(dir + "/state.json"); err != nil {
+		t.Errorf("The state was not saved on shutdown: %v", err)
+	}
+}
+
+func TestParseWebhookSource(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    webhookSource
+		wantErr bool
+	}{
+		{in: "lab=gitlab:/secrets/lab", want: webhookSource{name: "lab", providerName: "gitlab", provider: handler.GitLab{}, secretFile: "/secrets/lab"}},
+		{in: "ops-b=github:/secrets/ops", want: webhookSource{name: "ops-b", providerName: "github", provider: handler.GitHub{}, secretFile: "/secrets/ops"}},
+		{in: "ops-b=github:/secrets/ops:m-lab/ops-b", want: webhookSource{name: "ops-b", providerName: "github", provider: handler.GitHub{}, secretFile: "/secrets/ops", repo: "m-lab/ops-b"}},
+		{in: "ops-b=github:/secrets/ops:ops-b", wantErr: true},
+		{in: "lab=gitlab", wantErr: true},
+		{in: "lab=gitlab:", wantErr: true},
+		{in: "Lab/1=gitlab:/secrets/lab", wantErr: true},
+		{in: "lab=bitbucket:/secrets/lab", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseWebhookSource(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseWebhookSource(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseWebhookSource(%q) = %+v; want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	lab := webhookSource{providerName: "gitlab", repo: "m-lab/lab"}
+	ops := webhookSource{providerName: "github", repo: "m-lab/ops-b"}
+	if lab.issueBaseURL() != "" || ops.issueBaseURL() != "https://github.com/m-lab/ops-b/issues/" {
+		t.Errorf("issueBaseURL() = %q, %q; want only GitHub issues to be linked", lab.issueBaseURL(), ops.issueBaseURL())
+	}
+}
+
+func TestTransferKeys(t *testing.T) {
+	keys := transferKeys("m-lab/ops-tracker", "mlab-oti", []handler.RepoConfig{
+		{Repo: "m-lab/ops"},
+		{Repo: "m-lab/staging-ops", Project: "mlab-staging"},
+	})
+	tests := []struct {
+		project, repo string
+		want          string
+		wantOK        bool
+	}{
+		{project: "mlab-oti", repo: "m-lab/ops-tracker", want: "7", wantOK: true},
+		{project: "mlab-oti", repo: "m-lab/ops", want: "m-lab/ops#7", wantOK: true},
+		{project: "mlab-staging", repo: "m-lab/staging-ops", want: "m-lab/staging-ops#7", wantOK: true},
+		// The states of other projects are not shared.
+		{project: "mlab-oti", repo: "m-lab/staging-ops"},
+		{project: "mlab-oti", repo: "m-lab/unknown"},
+	}
+	for _, tt := range tests {
+		got, ok := keys(tt.project, tt.repo, 7)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("transferKeys()(%q, %q, 7) = %q, %v; want %q, %v", tt.project, tt.repo, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestParsePeer(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    api.Peer
+		wantErr bool
+	}{
+		{in: "mlab-staging=https://gmx.example.net", want: api.Peer{Project: "mlab-staging", URL: "https://gmx.example.net"}},
+		{in: "mlab-oti=http://localhost:9999/", want: api.Peer{Project: "mlab-oti", URL: "http://localhost:9999/"}},
+		{in: "https://gmx.example.net", wantErr: true},
+		{in: "=https://gmx.example.net", wantErr: true},
+		{in: "mlab-oti=gmx.example.net", wantErr: true},
+		{in: "mlab-oti=ftp://gmx.example.net", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePeer(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePeer(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parsePeer(%q) = %+v; want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// fakeSites lists two machines at every site.
+type fakeSites struct{}
+
+func (fakeSites) Machines(site string) ([]string, error) {
+	return []string{"mlab1", "mlab2"}, nil
+}
+
+func (fakeSites) Reload(ctx context.Context) error {
+	return nil
+}
+
+func TestHandleState(t *testing.T) {
+	// The state file does not exist yet, so the error is expected.
+	state, _ := maintenancestate.New(t.TempDir()+"/state.json", fakeSites{}, "mlab-oti")
+	state.UpdateMachine("mlab1-xyz01", maintenancestate.EnterMaintenance, "1", "mlab-oti")
+	state.UpdateMachine("mlab1-xyz01", maintenancestate.EnterMaintenance, "2", "mlab-oti")
+	state.UpdateSite("abc01", maintenancestate.EnterMaintenance, "3", "mlab-oti")
+	mux := http.NewServeMux()
+	handleState(mux, api.New(state), func(h http.HandlerFunc) http.Handler { return h })
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/state", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/state returned status %d", rec.Code)
+	}
+	var got maintenancestate.Snapshot
+	rtx.Must(json.Unmarshal(rec.Body.Bytes(), &got), "Could not unmarshal /state")
+	// Every machine and site is listed with the issues that put it in
+	// maintenance.
+	wantMachines := map[string][]string{
+		"mlab1-xyz01": {"1", "2"},
+		"mlab1-abc01": {"3"},
+		"mlab2-abc01": {"3"},
+	}
+	wantSites := map[string][]string{"abc01": {"3"}}
+	if !reflect.DeepEqual(got.Machines, wantMachines) || !reflect.DeepEqual(got.Sites, wantSites) {
+		t.Errorf("/state = machines %v and sites %v; want %v and %v", got.Machines, got.Sites, wantMachines, wantSites)
+	}
 }
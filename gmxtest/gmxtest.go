@@ -0,0 +1,267 @@
+// Package gmxtest provides helpers for testing code that sends webhooks to, or
+// embeds, the exporter: signed GitHub webhooks, sent to a handler in-process
+// or to a running instance, a fake siteinfo client, and a state backend that
+// is kept in memory.
+package gmxtest
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Signature returns the value of the X-Hub-Signature header that GitHub sends
+// with payload when the webhook is configured with secret.
+func Signature(secret, payload []byte) string {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(payload)
+	return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Signature256 returns the value of the X-Hub-Signature-256 header that GitHub
+// sends with payload when the webhook is configured with secret.
+func Signature256(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// setHeaders sets the headers that GitHub sends with a webhook of eventType
+// carrying payload, signed with secret.
+func setHeaders(h http.Header, secret []byte, eventType string, payload string) {
+	h.Set("Content-Type", "application/json")
+	h.Set("X-GitHub-Event", eventType)
+	h.Set("X-Hub-Signature", Signature(secret, []byte(payload)))
+	h.Set("X-Hub-Signature-256", Signature256(secret, []byte(payload)))
+}
+
+// NewWebhook returns a request carrying a GitHub webhook of eventType (e.g.
+// "issues" or "issue_comment") with payload, signed with secret.
+func NewWebhook(secret []byte, eventType string, payload string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(payload))
+	setHeaders(req.Header, secret, eventType, payload)
+	return req
+}
+
+// NewDelivery returns a new random delivery ID, like those GitHub sends in
+// the X-GitHub-Delivery header.
+func NewDelivery() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("gmxtest: could not generate a delivery ID: %v", err))
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Post sends a signed GitHub webhook to a running instance at url (e.g.
+// http://localhost:9999/webhook), as GitHub would, with a new delivery ID.
+func Post(ctx context.Context, client *http.Client, url string, secret []byte, eventType string, payload string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	setHeaders(req.Header, secret, eventType, payload)
+	req.Header.Set("X-GitHub-Delivery", NewDelivery())
+	return client.Do(req)
+}
+
+// Send sends a signed GitHub webhook to h and returns the response.
+func Send(h http.Handler, secret []byte, eventType string, payload string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, NewWebhook(secret, eventType, payload))
+	return rec
+}
+
+// Issue describes the issue that a webhook payload is about.
+type Issue struct {
+	Repo   string
+	Number int
+	// State is "open" or "closed". It defaults to "open".
+	State     string
+	Body      string
+	Milestone string
+}
+
+// payload builds the parts of a webhook payload that are common to issues and
+// issue_comment events.
+func (i Issue) payload(action, sender string) map[string]interface{} {
+	state := i.State
+	if state == "" {
+		state = "open"
+	}
+	issue := map[string]interface{}{
+		"number": i.Number,
+		"state":  state,
+		"body":   i.Body,
+	}
+	if i.Milestone != "" {
+		issue["milestone"] = map[string]interface{}{"title": i.Milestone}
+	}
+	p := map[string]interface{}{
+		"action": action,
+		"issue":  issue,
+		"sender": map[string]interface{}{"login": sender},
+	}
+	if i.Repo != "" {
+		p["repository"] = map[string]interface{}{"full_name": i.Repo}
+	}
+	return p
+}
+
+func mustMarshal(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("gmxtest: could not marshal payload: %v", err))
+	}
+	return string(data)
+}
+
+// IssuePayload returns the payload of an "issues" webhook, where action is
+// e.g. "opened", "edited" or "closed".
+func IssuePayload(action string, issue Issue) string {
+	return mustMarshal(issue.payload(action, ""))
+}
+
+// IssueEditPayload returns the payload of an "issues" webhook for an edit of
+// the body of issue, which was previously previous.
+func IssueEditPayload(issue Issue, previous string) string {
+	p := issue.payload("edited", "")
+	p["changes"] = editChanges(previous)
+	return mustMarshal(p)
+}
+
+// TransferPayload returns the payload of an "issues" webhook for the transfer
+// of issue to the issue number of the repository repo.
+func TransferPayload(issue Issue, repo string, number int) string {
+	p := issue.payload("transferred", "")
+	p["changes"] = map[string]interface{}{
+		"new_issue":      map[string]interface{}{"number": number},
+		"new_repository": map[string]interface{}{"full_name": repo},
+	}
+	return mustMarshal(p)
+}
+
+// CommentPayload returns the payload of an "issue_comment" webhook for a new
+// comment with body, posted by sender.
+func CommentPayload(issue Issue, sender string, body string) string {
+	return CommentEventPayload("created", issue, sender, body)
+}
+
+// CommentEventPayload is like CommentPayload, but for any action, e.g.
+// "edited" or "deleted".
+func CommentEventPayload(action string, issue Issue, sender string, body string) string {
+	return CommentIDPayload(action, issue, 0, sender, body)
+}
+
+// CommentIDPayload is like CommentEventPayload, for the comment with the given
+// ID.
+func CommentIDPayload(action string, issue Issue, id int64, sender string, body string) string {
+	p := issue.payload(action, sender)
+	comment := map[string]interface{}{"body": body}
+	if id != 0 {
+		comment["id"] = id
+	}
+	p["comment"] = comment
+	return mustMarshal(p)
+}
+
+// CommentEditPayload returns the payload of an "issue_comment" webhook for an
+// edit by sender of a comment, from previous to body.
+func CommentEditPayload(issue Issue, sender string, previous string, body string) string {
+	p := issue.payload("edited", sender)
+	p["comment"] = map[string]interface{}{"body": body}
+	p["changes"] = editChanges(previous)
+	return mustMarshal(p)
+}
+
+// editChanges returns the "changes" of an edit of a body that was previous.
+func editChanges(previous string) map[string]interface{} {
+	return map[string]interface{}{"body": map[string]interface{}{"from": previous}}
+}
+
+// PingPayload returns the payload of a "ping" webhook for a hook that sends
+// events.
+func PingPayload(events ...string) string {
+	return mustMarshal(map[string]interface{}{
+		"hook": map[string]interface{}{"events": events},
+	})
+}
+
+// Sites is a fake siteinfo client, mapping the name of each site (e.g. abc01)
+// to its machines (e.g. mlab1). It implements maintenancestate.Sites.
+type Sites map[string][]string
+
+// Machines returns the machines at a site.
+func (s Sites) Machines(site string) ([]string, error) {
+	machines, ok := s[site]
+	if !ok {
+		return []string{}, errors.New("site not found")
+	}
+	return machines, nil
+}
+
+// Reload does nothing.
+func (s Sites) Reload(ctx context.Context) error {
+	return nil
+}
+
+// MachineNames returns the sorted full names (e.g. mlab1-abc01) of every
+// machine.
+func (s Sites) MachineNames() []string {
+	var names []string
+	for site, machines := range s {
+		for _, m := range machines {
+			names = append(names, m+"-"+site)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MemoryStorage keeps the state in memory. It implements
+// maintenancestate.Storage.
+type MemoryStorage struct {
+	mu   sync.Mutex
+	data []byte
+	// Err, if not nil, is returned by every Load and Save.
+	Err error
+}
+
+// Load returns the last state that was saved.
+func (m *MemoryStorage) Load() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	if m.data == nil {
+		return nil, errors.New("no state has been saved")
+	}
+	return append([]byte(nil), m.data...), nil
+}
+
+func (m *MemoryStorage) String() string {
+	return "memory"
+}
+
+// Save keeps a copy of data.
+func (m *MemoryStorage) Save(data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return m.Err
+	}
+	m.data = append([]byte(nil), data...)
+	return nil
+}
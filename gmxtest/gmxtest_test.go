@@ -0,0 +1,99 @@
+package gmxtest_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/github-maintenance-exporter/gmxtest"
+	"github.com/m-lab/github-maintenance-exporter/handler"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+func TestWebhooks(t *testing.T) {
+	secret := []byte("secret")
+	sites := gmxtest.Sites{"abc01": {"mlab1", "mlab2"}}
+	storage := &gmxtest.MemoryStorage{}
+	s, _ := maintenancestate.NewWithStorage(storage, sites, "mlab-oti")
+	h := handler.New(s, secret, "mlab-oti", handler.Config{})
+
+	issue := gmxtest.Issue{Repo: "m-lab/ops-tracker", Number: 1, Body: "/site abc01"}
+	if rec := gmxtest.Send(h, secret, "issues", gmxtest.IssuePayload("opened", issue)); rec.Code != http.StatusOK {
+		t.Fatalf("issues webhook returned status %d", rec.Code)
+	}
+	comment := gmxtest.CommentPayload(issue, "alice", "/machine mlab1.abc01 del")
+	if rec := gmxtest.Send(h, secret, "issue_comment", comment); rec.Code != http.StatusOK {
+		t.Fatalf("issue_comment webhook returned status %d", rec.Code)
+	}
+	if rec := gmxtest.Send(h, []byte("wrong"), "issue_comment", comment); rec.Code != http.StatusUnauthorized {
+		t.Errorf("webhook with the wrong secret returned status %d", rec.Code)
+	}
+	ping := gmxtest.PingPayload("issues", "issue_comment")
+	if rec := gmxtest.Send(h, secret, "ping", ping); rec.Code != http.StatusOK {
+		t.Errorf("ping webhook returned status %d", rec.Code)
+	}
+
+	// The state written to storage can be restored.
+	s2, err := maintenancestate.NewWithStorage(storage, sites, "mlab-oti")
+	if err != nil {
+		t.Fatalf("Could not restore state: %v", err)
+	}
+	want := map[string][]string{"mlab2-abc01": {"1"}}
+	if got := s2.Snapshot().Machines; !reflect.DeepEqual(got, want) {
+		t.Errorf("Machines = %v; want %v", got, want)
+	}
+}
+
+func TestPost(t *testing.T) {
+	secret := []byte("secret")
+	sites := gmxtest.Sites{"abc01": {"mlab1"}}
+	s, _ := maintenancestate.NewWithStorage(&gmxtest.MemoryStorage{}, sites, "mlab-oti")
+	var delivery string
+	h := handler.New(s, secret, "mlab-oti", handler.Config{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivery = r.Header.Get("X-GitHub-Delivery")
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	issue := gmxtest.Issue{Number: 2}
+	payload := gmxtest.CommentEventPayload("edited", issue, "alice", "/machine mlab1-abc01")
+	resp, err := gmxtest.Post(context.Background(), srv.Client(), srv.URL, secret, "issue_comment", payload)
+	if err != nil {
+		t.Fatalf("Post() returned error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Post() returned status %d", resp.StatusCode)
+	}
+	if len(delivery) != 36 || delivery == gmxtest.NewDelivery() {
+		t.Errorf("delivery ID %q is not a new UUID", delivery)
+	}
+	if n := s.IssueEntities("2"); n != 1 {
+		t.Errorf("edited comment put %d entities into maintenance; want 1", n)
+	}
+}
+
+func TestSites(t *testing.T) {
+	sites := gmxtest.Sites{"xyz01": {"mlab2", "mlab1"}, "abc01": {"mlab1"}}
+	if got, want := sites.MachineNames(), []string{"mlab1-abc01", "mlab1-xyz01", "mlab2-xyz01"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MachineNames() = %v; want %v", got, want)
+	}
+	if _, err := sites.Machines("def01"); err == nil {
+		t.Error("Machines() of an unknown site should fail")
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	m := &gmxtest.MemoryStorage{}
+	if _, err := m.Load(); err == nil {
+		t.Error("Load() before Save() should fail")
+	}
+	m.Err = errors.New("unavailable")
+	if err := m.Save([]byte("x")); err == nil {
+		t.Error("Save() should return Err")
+	}
+}
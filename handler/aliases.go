@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// flagNameRegExp matches the name given to any site or machine flag, whether
+// or not it is a valid name.
+var flagNameRegExp = regexp.MustCompile(`(\/(?:site|machine)\s+)(\S+)`)
+
+// Aliases maps colloquial names of sites and machines (e.g. nyc-east, rack
+// names or asset tags) to their real names (e.g. lga03 or mlab1-lga03).
+type Aliases map[string]string
+
+// ReadAliases reads a JSON object mapping each alias to a real name. Aliases
+// are case-insensitive.
+func ReadAliases(r io.Reader) (Aliases, error) {
+	var raw map[string]string
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	aliases := make(Aliases, len(raw))
+	for alias, name := range raw {
+		if alias == "" || strings.ContainsAny(alias, " \t\r\n") {
+			return nil, fmt.Errorf("invalid alias %q", alias)
+		}
+		if name == "" || strings.ContainsAny(name, " \t\r\n") {
+			return nil, fmt.Errorf("invalid name %q for alias %q", name, alias)
+		}
+		key := strings.ToLower(alias)
+		if _, ok := aliases[key]; ok {
+			return nil, fmt.Errorf("alias %q is defined more than once", alias)
+		}
+		aliases[key] = name
+	}
+	return aliases, nil
+}
+
+// Resolve replaces every alias given to a site or machine flag in msg with
+// the real name, so that the flag can then be validated as usual.
+func (a Aliases) Resolve(msg string) string {
+	if len(a) == 0 {
+		return msg
+	}
+	return flagNameRegExp.ReplaceAllStringFunc(msg, func(flag string) string {
+		m := flagNameRegExp.FindStringSubmatch(flag)
+		if name, ok := a[strings.ToLower(m[2])]; ok {
+			return m[1] + name
+		}
+		return flag
+	})
+}
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/m-lab/github-maintenance-exporter/gmxtest"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+func TestReadAliases(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    Aliases
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			in:   `{"NYC-East": "lga03", "rack-12": "mlab2-lga03"}`,
+			want: Aliases{"nyc-east": "lga03", "rack-12": "mlab2-lga03"},
+		},
+		{name: "not-json", in: `nyc-east=lga03`, wantErr: true},
+		{name: "space-in-alias", in: `{"nyc east": "lga03"}`, wantErr: true},
+		{name: "empty-name", in: `{"nyc-east": ""}`, wantErr: true},
+		{name: "duplicate", in: `{"nyc-east": "lga03", "NYC-EAST": "lga04"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadAliases(strings.NewReader(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadAliases() error = %v; wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ReadAliases() = %v; want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("ReadAliases()[%q] = %q; want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestAliasesResolve(t *testing.T) {
+	a := Aliases{"nyc-east": "lga03", "rack-12": "mlab2-lga03"}
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "/site NYC-East del", want: "/site lga03 del"},
+		{in: "/machine rack-12 for 2h\n/site abc01", want: "/machine mlab2-lga03 for 2h\n/site abc01"},
+		{in: "nyc-east is down", want: "nyc-east is down"},
+		{in: "/site nyc-west", want: "/site nyc-west"},
+	}
+	for _, tt := range tests {
+		if got := a.Resolve(tt.in); got != tt.want {
+			t.Errorf("Resolve(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+	if got := Aliases(nil).Resolve("/site nyc-east"); got != "/site nyc-east" {
+		t.Errorf("nil Aliases resolved %q", got)
+	}
+}
+
+func TestAliasedFlags(t *testing.T) {
+	secret := []byte("goodsecret")
+	state := &fakeState{}
+	h := New(state, secret, "mlab-oti", Config{Aliases: Aliases{"nyc-east": "lga03"}})
+	gmxtest.Send(h, secret, "issues", gmxtest.IssuePayload("opened", gmxtest.Issue{Number: 1, Body: "/site nyc-east"}))
+	if len(state.applied) != 1 || state.applied[0].Kind != "site" || state.applied[0].Name != "lga03" ||
+		state.applied[0].Action != maintenancestate.EnterMaintenance {
+		t.Errorf("applied changes %+v; want site lga03 to enter maintenance", state.applied)
+	}
+}
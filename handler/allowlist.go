@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+// GitHubMetaURL is the GitHub API endpoint that publishes, among others, the
+// IP ranges from which webhooks are sent.
+const GitHubMetaURL = "https://api.github.com/meta"
+
+// Allowlist refuses webhooks that were not sent from one of the IP ranges
+// that GitHub publishes for its webhooks, so that a leaked secret is not
+// enough to change the state.
+type Allowlist struct {
+	// TrustedProxies is the number of proxies, such as load balancers, in
+	// front of the exporter. If positive, the sender is taken from that many
+	// entries from the end of the X-Forwarded-For header instead of from
+	// the address of the connection.
+	TrustedProxies int
+	// Forwarded, if not nil, reports whether a request was forwarded by
+	// another replica, which appended the address from which it received
+	// the request to X-Forwarded-For. That replica counts as one more
+	// trusted proxy.
+	Forwarded func(req *http.Request) bool
+
+	url    string
+	client *http.Client
+
+	mu       sync.Mutex
+	prefixes []netip.Prefix
+}
+
+// NewAllowlist creates an Allowlist of the webhook IP ranges published at
+// url, usually GitHubMetaURL. It refuses every webhook until it is refreshed.
+func NewAllowlist(url string) *Allowlist {
+	return &Allowlist{
+		url:    url,
+		client: &http.Client{Timeout: time.Minute},
+	}
+}
+
+// Refresh fetches the current webhook IP ranges.
+func (a *Allowlist) Refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from %s: %s", a.url, resp.Status)
+	}
+	var meta struct {
+		Hooks []string `json:"hooks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return err
+	}
+	if len(meta.Hooks) == 0 {
+		return fmt.Errorf("no webhook IP ranges found at %s", a.url)
+	}
+	prefixes := make([]netip.Prefix, 0, len(meta.Hooks))
+	for _, cidr := range meta.Hooks {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid IP range %q at %s: %v", cidr, a.url, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.prefixes = prefixes
+	return nil
+}
+
+// Run refreshes the IP ranges every interval until ctx is canceled. Failures
+// are logged, and the previous ranges are kept.
+func (a *Allowlist) Run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			if err := a.Refresh(ctx); err != nil {
+				slog.Error("Failed to refresh the GitHub webhook IP ranges", "url", a.url, "err", err)
+				metrics.CountError("refresh", "handler.Allowlist")
+			}
+		}
+	}
+}
+
+// sender returns the address from which a request was sent.
+func (a *Allowlist) sender(req *http.Request) (netip.Addr, error) {
+	host := req.RemoteAddr
+	proxies := a.TrustedProxies
+	if a.Forwarded != nil && a.Forwarded(req) {
+		proxies++
+	}
+	if proxies > 0 {
+		var hops []string
+		for _, header := range req.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(header, ",")...)
+		}
+		if len(hops) < proxies {
+			return netip.Addr{}, fmt.Errorf("X-Forwarded-For has %d entries; want at least %d", len(hops), proxies)
+		}
+		host = strings.TrimSpace(hops[len(hops)-proxies])
+	} else if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	addr, err := netip.ParseAddr(host)
+	return addr.Unmap(), err
+}
+
+// allowed reports whether addr is in one of the IP ranges.
+func (a *Allowlist) allowed(addr netip.Addr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, prefix := range a.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap returns a handler that passes requests to h only if they were sent
+// from one of the IP ranges.
+func (a *Allowlist) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		addr, err := a.sender(req)
+		switch {
+		case err != nil:
+			slog.Warn("Refusing webhook with an unknown sender", "remote", req.RemoteAddr, "err", err)
+		case !a.allowed(addr):
+			slog.Warn("Refusing webhook that was not sent from a GitHub webhook address", "remote", addr.String())
+		default:
+			h.ServeHTTP(resp, req)
+			return
+		}
+		metrics.CountError("forbidden", "handler.Allowlist")
+		resp.WriteHeader(http.StatusForbidden)
+	})
+}
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowlist(t *testing.T) {
+	hooks := `{"hooks": ["192.30.252.0/22", "2a0a:a440::/29"]}`
+	meta := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(hooks))
+	}))
+	defer meta.Close()
+
+	a := NewAllowlist(meta.URL)
+	h := a.Wrap(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusOK)
+	}))
+	send := func(remote string, forwarded string) int {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+		req.RemoteAddr = remote
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Nothing is allowed before the ranges are known.
+	if code := send("192.30.252.1:1234", ""); code != http.StatusForbidden {
+		t.Errorf("webhook before refresh returned status %d; want %d", code, http.StatusForbidden)
+	}
+	if err := a.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		proxies   int
+		replica   bool
+		remote    string
+		forwarded string
+		want      int
+	}{
+		{name: "ipv4", remote: "192.30.252.1:1234", want: http.StatusOK},
+		{name: "ipv6", remote: "[2a0a:a440::1]:1234", want: http.StatusOK},
+		{name: "outside", remote: "10.0.0.1:1234", want: http.StatusForbidden},
+		{name: "forwarded-ignored", remote: "10.0.0.1:1234", forwarded: "192.30.252.1", want: http.StatusForbidden},
+		{name: "proxy", proxies: 1, remote: "10.0.0.1:1234", forwarded: "192.30.252.1", want: http.StatusOK},
+		{name: "proxy-spoofed", proxies: 1, remote: "10.0.0.1:1234", forwarded: "192.30.252.1, 10.1.1.1", want: http.StatusForbidden},
+		{name: "two-proxies", proxies: 2, remote: "10.0.0.1:1234", forwarded: "1.2.3.4, 192.30.252.1, 10.1.1.1", want: http.StatusOK},
+		{name: "proxy-missing-header", proxies: 1, remote: "192.30.252.1:1234", want: http.StatusForbidden},
+		{name: "replica", replica: true, remote: "10.0.0.2:1234", forwarded: "192.30.252.1", want: http.StatusOK},
+		{name: "replica-behind-proxy", proxies: 1, replica: true, remote: "10.0.0.2:1234", forwarded: "192.30.252.1, 10.1.1.1", want: http.StatusOK},
+		{name: "replica-spoofed", proxies: 1, replica: true, remote: "10.0.0.2:1234", forwarded: "192.30.252.1, 10.1.1.1, 10.1.1.2", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a.TrustedProxies = tt.proxies
+			a.Forwarded = func(*http.Request) bool { return tt.replica }
+			if code := send(tt.remote, tt.forwarded); code != tt.want {
+				t.Errorf("webhook returned status %d; want %d", code, tt.want)
+			}
+		})
+	}
+
+	// A failed refresh keeps the previous ranges.
+	hooks = `{"hooks": ["not a range"]}`
+	a.TrustedProxies = 0
+	a.Forwarded = nil
+	if err := a.Refresh(context.Background()); err == nil {
+		t.Error("Refresh() with an invalid range returned nil error")
+	}
+	if code := send("192.30.252.1:1234", ""); code != http.StatusOK {
+		t.Errorf("webhook after a failed refresh returned status %d; want %d", code, http.StatusOK)
+	}
+}
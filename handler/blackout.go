@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a period of time during which maintenance changes are refused
+// unless they are explicitly overridden.
+type Window struct {
+	Start, End time.Time
+}
+
+// Contains reports whether t falls within the window.
+func (w Window) Contains(t time.Time) bool {
+	return !t.Before(w.Start) && t.Before(w.End)
+}
+
+// Windows is a flag.Value that accumulates blackout windows, each specified
+// as two RFC3339 timestamps separated by a slash, e.g.
+// "2024-08-01T00:00:00Z/2024-08-15T00:00:00Z". Several windows may be given
+// at once, separated by commas.
+type Windows []Window
+
+// parseWindow parses a single START/END window.
+func parseWindow(s string) (Window, error) {
+	fields := strings.Split(s, "/")
+	if len(fields) != 2 {
+		return Window{}, fmt.Errorf("invalid window %q: must be START/END", s)
+	}
+	start, err := time.Parse(time.RFC3339, fields[0])
+	if err != nil {
+		return Window{}, err
+	}
+	end, err := time.Parse(time.RFC3339, fields[1])
+	if err != nil {
+		return Window{}, err
+	}
+	if !end.After(start) {
+		return Window{}, fmt.Errorf("invalid window %q: end must be after start", s)
+	}
+	return Window{Start: start, End: end}, nil
+}
+
+// Set parses a comma-separated list of windows and appends them to the list.
+// Nothing is appended if any of them is invalid.
+func (ws *Windows) Set(s string) error {
+	var parsed []Window
+	for _, spec := range strings.Split(s, ",") {
+		w, err := parseWindow(spec)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, w)
+	}
+	*ws = append(*ws, parsed...)
+	return nil
+}
+
+// String returns the windows in the same form that Set accepts.
+func (ws Windows) String() string {
+	var s []string
+	for _, w := range ws {
+		s = append(s, w.Start.Format(time.RFC3339)+"/"+w.End.Format(time.RFC3339))
+	}
+	return strings.Join(s, ",")
+}
+
+// Active returns the window containing t, if there is one.
+func (ws Windows) Active(t time.Time) (Window, bool) {
+	for _, w := range ws {
+		if w.Contains(t) {
+			return w, true
+		}
+	}
+	return Window{}, false
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindows(t *testing.T) {
+	var ws Windows
+	for _, bad := range []string{
+		"2024-08-01T00:00:00Z",
+		"yesterday/today",
+		"2024-08-01T00:00:00Z/tomorrow",
+		"2024-08-15T00:00:00Z/2024-08-01T00:00:00Z",
+		"2024-08-01T00:00:00Z/2024-08-15T00:00:00Z,",
+	} {
+		if err := ws.Set(bad); err == nil {
+			t.Errorf("Set(%q) should have failed", bad)
+		}
+	}
+
+	spec := "2024-08-01T00:00:00Z/2024-08-15T00:00:00Z"
+	if err := ws.Set(spec); err != nil {
+		t.Fatalf("Set(%q) returned an error: %v", spec, err)
+	}
+	if ws.String() != spec {
+		t.Errorf("String() = %q; want %q", ws.String(), spec)
+	}
+
+	// String must be accepted by Set, even with several windows.
+	var several Windows
+	if err := several.Set(spec + ",2024-09-01T00:00:00Z/2024-09-02T00:00:00Z"); err != nil {
+		t.Fatalf("Set() of several windows returned an error: %v", err)
+	}
+	var again Windows
+	if err := again.Set(several.String()); err != nil || len(again) != 2 || again.String() != several.String() {
+		t.Errorf("Set(%q) = %v, %q; want the same windows", several.String(), err, again.String())
+	}
+
+	tests := []struct {
+		when   string
+		active bool
+	}{
+		{"2024-07-31T23:59:59Z", false},
+		{"2024-08-01T00:00:00Z", true},
+		{"2024-08-14T23:59:59Z", true},
+		{"2024-08-15T00:00:00Z", false},
+	}
+	for _, tt := range tests {
+		when, _ := time.Parse(time.RFC3339, tt.when)
+		if _, active := ws.Active(when); active != tt.active {
+			t.Errorf("Active(%s) = %t; want %t", tt.when, active, tt.active)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+// pendingRequest is a webhook that was received before the Buffer was
+// released, along with the handler it was sent to.
+type pendingRequest struct {
+	h    http.Handler
+	req  *http.Request
+	body []byte
+}
+
+// Buffer holds webhooks that arrive before the data needed to process them is
+// available, such as while the initial siteinfo load is being retried, and
+// processes them in the order they arrived once it is released.
+type Buffer struct {
+	mu       sync.Mutex
+	size     int
+	released bool
+	pending  []pendingRequest
+}
+
+// NewBuffer creates a Buffer that holds at most size webhooks. Webhooks that
+// arrive when it is full are refused with a 503, so that the sender records
+// them as failed.
+func NewBuffer(size int) *Buffer {
+	return &Buffer{size: size}
+}
+
+// Wrap returns a handler that passes requests to h once the Buffer has been
+// released, and holds them until then.
+func (b *Buffer) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		b.mu.Lock()
+		if b.released {
+			b.mu.Unlock()
+			h.ServeHTTP(resp, req)
+			return
+		}
+		defer b.mu.Unlock()
+		if len(b.pending) >= b.size {
+			slog.Error("Webhook buffer is full, refusing webhook", "remote", req.RemoteAddr, "delivery", req.Header.Get(deliveryHeader))
+			metrics.CountError("bufferfull", "handler.Buffer")
+			http.Error(resp, "not ready to process webhooks yet", http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxPayloadSize))
+		if err != nil {
+			slog.Error("Failed to read webhook body", "remote", req.RemoteAddr, "err", err)
+			metrics.CountError("readbody", "handler.Buffer")
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b.pending = append(b.pending, pendingRequest{
+			h:    h,
+			req:  req.Clone(context.Background()),
+			body: body,
+		})
+		resp.WriteHeader(http.StatusAccepted)
+		resp.Write([]byte("Webhook queued until siteinfo data is available.\n"))
+	})
+}
+
+// Release processes every held webhook, and passes every later one straight
+// through. It returns the number of webhooks that were processed.
+func (b *Buffer) Release() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.released {
+		return 0
+	}
+	// New webhooks wait on the lock, so that they are processed after the
+	// held ones.
+	for _, p := range b.pending {
+		p.req.Body = io.NopCloser(bytes.NewReader(p.body))
+		rec := &discardResponse{header: http.Header{}, code: http.StatusOK}
+		p.h.ServeHTTP(rec, p.req)
+		if rec.code != http.StatusOK {
+			slog.Warn("Held webhook was processed with an error", "status", rec.code, "delivery", p.req.Header.Get(deliveryHeader))
+		}
+	}
+	n := len(b.pending)
+	b.pending = nil
+	b.released = true
+	return n
+}
+
+// discardResponse is a ResponseWriter that only records the status code.
+type discardResponse struct {
+	header http.Header
+	code   int
+}
+
+func (d *discardResponse) Header() http.Header         { return d.header }
+func (d *discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardResponse) WriteHeader(code int)        { d.code = code }
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBuffer(t *testing.T) {
+	var got []string
+	h := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		got = append(got, req.Header.Get("X-GitHub-Event")+":"+string(body))
+	})
+	b := NewBuffer(2)
+	wrapped := b.Wrap(h)
+	send := func(event, body string) int {
+		req := httptest.NewRequest("POST", "/webhook", strings.NewReader(body))
+		req.Header.Set("X-GitHub-Event", event)
+		rec := httptest.NewRecorder()
+		wrapped.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := send("issues", "one"); code != http.StatusAccepted {
+		t.Errorf("held webhook returned status %d; want %d", code, http.StatusAccepted)
+	}
+	if code := send("issue_comment", "two"); code != http.StatusAccepted {
+		t.Errorf("held webhook returned status %d; want %d", code, http.StatusAccepted)
+	}
+	if code := send("issues", "three"); code != http.StatusServiceUnavailable {
+		t.Errorf("webhook to a full buffer returned status %d; want %d", code, http.StatusServiceUnavailable)
+	}
+	if len(got) != 0 {
+		t.Fatalf("webhooks were processed before Release(): %v", got)
+	}
+
+	if n := b.Release(); n != 2 {
+		t.Errorf("Release() = %d; want 2", n)
+	}
+	if code := send("issues", "four"); code != http.StatusOK {
+		t.Errorf("webhook after Release() returned status %d; want %d", code, http.StatusOK)
+	}
+	want := []string{"issues:one", "issue_comment:two", "issues:four"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("processed webhooks %v; want %v", got, want)
+	}
+	if n := b.Release(); n != 0 {
+		t.Errorf("second Release() = %d; want 0", n)
+	}
+}
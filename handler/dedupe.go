@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"container/list"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+// deliveryHeader carries the unique ID of each delivery of a GitHub webhook.
+// Redeliveries of the same event carry the same ID.
+const deliveryHeader = "X-GitHub-Delivery"
+
+// Deduper refuses to process a GitHub webhook delivery more than once, so that
+// redelivered events neither apply their changes twice nor are counted twice.
+// It remembers a bounded number of the most recent deliveries.
+type Deduper struct {
+	mu   sync.Mutex
+	size int
+	// seen holds the IDs of the deliveries that were processed, most recent
+	// first, and index holds their elements.
+	seen  *list.List
+	index map[string]*list.Element
+	// inFlight holds the IDs of the deliveries being processed.
+	inFlight map[string]bool
+}
+
+// NewDeduper creates a Deduper that remembers the last size deliveries.
+func NewDeduper(size int) *Deduper {
+	return &Deduper{
+		size:     size,
+		seen:     list.New(),
+		index:    make(map[string]*list.Element),
+		inFlight: make(map[string]bool),
+	}
+}
+
+// start reports whether the delivery should be processed, and if so, marks
+// it as being processed.
+func (d *Deduper) start(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.index[id]; ok {
+		d.seen.MoveToFront(e)
+		return false
+	}
+	if d.inFlight[id] {
+		return false
+	}
+	d.inFlight[id] = true
+	return true
+}
+
+// finish records the end of processing a delivery. It is only remembered if
+// it succeeded, so that a failed delivery can be redelivered.
+func (d *Deduper) finish(id string, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.inFlight, id)
+	if !ok {
+		return
+	}
+	d.index[id] = d.seen.PushFront(id)
+	for d.seen.Len() > d.size {
+		oldest := d.seen.Back()
+		d.seen.Remove(oldest)
+		delete(d.index, oldest.Value.(string))
+	}
+}
+
+// statusRecorder is a ResponseWriter that records the status code written
+// through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Wrap returns a handler that passes each delivery to h unless it has already
+// been processed. Requests without a delivery ID are always passed on.
+func (d *Deduper) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(deliveryHeader)
+		if id == "" {
+			h.ServeHTTP(resp, req)
+			return
+		}
+		if !d.start(id) {
+			slog.Info("Ignoring duplicate delivery", "delivery", id)
+			metrics.WebhookDuplicates.Inc()
+			resp.WriteHeader(http.StatusOK)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: resp, code: http.StatusOK}
+		h.ServeHTTP(rec, req)
+		// Deliveries that were refused, e.g. for a bad signature, must not
+		// prevent a valid delivery with the same ID.
+		d.finish(id, rec.code < http.StatusMultipleChoices)
+	})
+}
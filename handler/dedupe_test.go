@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDeduper(t *testing.T) {
+	calls := 0
+	status := http.StatusOK
+	d := NewDeduper(2)
+	h := d.Wrap(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		calls++
+		resp.WriteHeader(status)
+	}))
+	send := func(id string) int {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+		if id != "" {
+			req.Header.Set(deliveryHeader, id)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	before := testutil.ToFloat64(metrics.WebhookDuplicates)
+	for _, id := range []string{"a", "a", "b", "a", "", ""} {
+		if code := send(id); code != http.StatusOK {
+			t.Errorf("delivery %q returned status %d", id, code)
+		}
+	}
+	if calls != 4 {
+		t.Errorf("handler was called %d times; want 4", calls)
+	}
+	if got := testutil.ToFloat64(metrics.WebhookDuplicates) - before; got != 2 {
+		t.Errorf("counted %v duplicates; want 2", got)
+	}
+
+	// Only the most recent deliveries are remembered. "a" was seen more
+	// recently than "b", so "b" is forgotten first.
+	calls = 0
+	send("c")
+	send("a")
+	send("b")
+	if calls != 2 {
+		t.Errorf("handler was called %d times; want 2", calls)
+	}
+
+	// Failed deliveries may be redelivered.
+	calls = 0
+	status = http.StatusInternalServerError
+	send("d")
+	status = http.StatusOK
+	send("d")
+	send("d")
+	if calls != 2 {
+		t.Errorf("handler was called %d times; want 2", calls)
+	}
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"log/slog"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+// DryRun is a StateUpdater that works out the modifications each change would
+// make to a state, and logs and counts them, without modifying the state or
+// its metrics. It allows changes to the parser to be tried against real
+// webhooks.
+type DryRun struct {
+	*maintenancestate.MaintenanceState
+}
+
+// NewDryRun creates a DryRun of state.
+func NewDryRun(state *maintenancestate.MaintenanceState) *DryRun {
+	return &DryRun{MaintenanceState: state}
+}
+
+// Apply returns the number of modifications that c would make.
+func (d *DryRun) Apply(c maintenancestate.Change, issue string, project string) int {
+	mods := d.Scratch().Apply(c, issue, project)
+	slog.Info("Dry run: change not applied", "issue", issue, "kind", c.Kind, "entity", c.Name,
+		"action", c.Action.String(), "project", project, "mods", mods)
+	metrics.DryRunMods.WithLabelValues(c.Kind, c.Action.String(), project).Add(float64(mods))
+	return mods
+}
+
+// UpdateMachine returns the number of modifications that changing machine
+// would make.
+func (d *DryRun) UpdateMachine(machine string, action maintenancestate.Action, issue string, project string) int {
+	return d.Apply(maintenancestate.Change{Kind: "machine", Name: machine, Action: action}, issue, project)
+}
+
+// UpdateSite returns the number of modifications that changing site would
+// make.
+func (d *DryRun) UpdateSite(site string, action maintenancestate.Action, issue string, project string) int {
+	return d.Apply(maintenancestate.Change{Kind: "site", Name: site, Action: action}, issue, project)
+}
+
+// CloseIssue returns the number of modifications that closing issue would
+// make.
+func (d *DryRun) CloseIssue(issue string, project string) int {
+	return d.CloseIssueFrom(issue, project, maintenancestate.Origin{})
+}
+
+// CloseIssueFrom returns the number of modifications that closing issue
+// would make.
+func (d *DryRun) CloseIssueFrom(issue string, project string, origin maintenancestate.Origin) int {
+	mods := d.Scratch().CloseIssueFrom(issue, project, origin)
+	slog.Info("Dry run: issue not closed", "issue", issue, "project", project, "mods", mods)
+	metrics.DryRunMods.WithLabelValues("issue", "close", project).Add(float64(mods))
+	return mods
+}
+
+// Schedule logs the changes that would be scheduled.
+func (d *DryRun) Schedule(changes []maintenancestate.ScheduledChange) error {
+	for _, sc := range changes {
+		slog.Info("Dry run: change not scheduled", "issue", sc.Issue, "kind", sc.Kind, "entity", sc.Name,
+			"action", sc.Action.String(), "at", sc.At)
+	}
+	return nil
+}
+
+// Unschedule returns the number of scheduled changes that would be canceled.
+func (d *DryRun) Unschedule(issue string, name string) int {
+	return d.Scratch().Unschedule(issue, name)
+}
+
+// MoveIssue returns the number of modifications that moving an issue would
+// make.
+func (d *DryRun) MoveIssue(from string, to string, project string) int {
+	mods := d.Scratch().MoveIssue(from, to, project)
+	slog.Info("Dry run: issue not moved", "from", from, "to", to, "project", project, "mods", mods)
+	metrics.DryRunMods.WithLabelValues("issue", "move", project).Add(float64(mods))
+	return mods
+}
+
+// RevertComment returns the number of modifications that reverting a deleted
+// comment would make.
+func (d *DryRun) RevertComment(issue string, comment int64, project string, origin maintenancestate.Origin) int {
+	mods := d.Scratch().RevertComment(issue, comment, project, origin)
+	slog.Info("Dry run: comment not reverted", "issue", issue, "comment", comment, "project", project, "mods", mods)
+	metrics.DryRunMods.WithLabelValues("comment", "revert", project).Add(float64(mods))
+	return mods
+}
+
+// Propose logs the changes that would require approval.
+func (d *DryRun) Propose(issue string, changes []maintenancestate.Change) error {
+	slog.Info("Dry run: proposal not recorded", "issue", issue, "changes", len(changes))
+	return nil
+}
+
+// TakeProposal returns the pending proposal for issue without removing it.
+func (d *DryRun) TakeProposal(issue string) ([]maintenancestate.Change, bool) {
+	return d.Scratch().TakeProposal(issue)
+}
+
+// TakeUndo returns the changes to undo for issue without removing them.
+func (d *DryRun) TakeUndo(issue string) ([]maintenancestate.Change, bool) {
+	return d.Scratch().TakeUndo(issue)
+}
+
+// SetUndo does nothing.
+func (d *DryRun) SetUndo(issue string, changes []maintenancestate.Change) error {
+	return nil
+}
+
+// SetAutoClose does nothing.
+func (d *DryRun) SetAutoClose(issue string) error {
+	return nil
+}
+
+// SetMilestone does nothing.
+func (d *DryRun) SetMilestone(issue string, milestone string) error {
+	return nil
+}
+
+// Write does nothing, since the state is never modified.
+func (d *DryRun) Write() error {
+	return nil
+}
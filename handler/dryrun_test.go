@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/m-lab/github-maintenance-exporter/gmxtest"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDryRun(t *testing.T) {
+	storage := &gmxtest.MemoryStorage{}
+	sites := gmxtest.Sites{"dry01": {"mlab1", "mlab2"}}
+	state, err := maintenancestate.NewWithStorage(storage, sites, "mlab-oti")
+	if err == nil {
+		t.Fatal("NewWithStorage() of empty storage = nil error")
+	}
+	rtx.Must(state.Write(), "Could not write the initial state")
+	saved, _ := storage.Load()
+
+	secret := []byte("goodsecret")
+	h := New(NewDryRun(state), secret, "mlab-oti", Config{})
+	before := testutil.ToFloat64(metrics.DryRunMods.WithLabelValues("site", "enter", "mlab-oti"))
+	payload := gmxtest.IssuePayload("opened", gmxtest.Issue{Number: 1, Body: "/site dry01 /machine mlab1-dry01"})
+	if rec := gmxtest.Send(h, secret, "issues", payload); rec.Code != http.StatusOK {
+		t.Fatalf("webhook returned status %d", rec.Code)
+	}
+	// The site and its two machines.
+	if got := testutil.ToFloat64(metrics.DryRunMods.WithLabelValues("site", "enter", "mlab-oti")) - before; got != 3 {
+		t.Errorf("site modifications counted = %v; want 3", got)
+	}
+	if n := state.IssueEntities("1"); n != 0 {
+		t.Errorf("%d entities entered maintenance in dry-run mode", n)
+	}
+	if v := testutil.ToFloat64(metrics.Site.WithLabelValues("dry01")); v != 0 {
+		t.Errorf("site metric = %v in dry-run mode", v)
+	}
+	if now, _ := storage.Load(); string(now) != string(saved) {
+		t.Errorf("state was saved in dry-run mode: %s", now)
+	}
+}
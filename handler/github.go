@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/github"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+const (
+	// signatureHeader carries the sha1 signature of a GitHub webhook.
+	signatureHeader = "X-Hub-Signature"
+	// signature256Header carries the sha256 signature of a GitHub webhook,
+	// which GitHub recommends validating instead.
+	signature256Header = "X-Hub-Signature-256"
+	// appIDHeader carries the ID of the GitHub App that a webhook was
+	// delivered for.
+	appIDHeader = "X-GitHub-Hook-Installation-Target-ID"
+)
+
+// GitHub is the Provider for GitHub webhooks.
+type GitHub struct{}
+
+// Parse validates the signature of a GitHub webhook and parses its payload.
+// The sha256 signature is validated if it is present, and the sha1 signature
+// otherwise.
+func (GitHub) Parse(req *http.Request, secret []byte) (*Event, error) {
+	scheme := "sha1"
+	if sig := req.Header.Get(signature256Header); sig != "" {
+		if !strings.HasPrefix(sig, "sha256=") {
+			return nil, fmt.Errorf("%w: %s is not a sha256 signature", ErrInvalidSignature, signature256Header)
+		}
+		// ValidatePayload only reads the sha1 header, but validates any
+		// signature that it holds.
+		req = req.Clone(req.Context())
+		req.Header.Set(signatureHeader, sig)
+		scheme = "sha256"
+	}
+	payload, err := github.ValidatePayload(req, secret)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	metrics.WebhookSignatures.WithLabelValues(scheme).Inc()
+
+	event, err := github.ParseWebHook(github.WebHookType(req), payload)
+	if err != nil {
+		return nil, err
+	}
+
+	switch event := event.(type) {
+	case *github.IssuesEvent:
+		e := &Event{
+			Type:         IssueEvent,
+			Action:       event.GetAction(),
+			Issue:        event.Issue.GetNumber(),
+			Repo:         event.Repo.GetFullName(),
+			State:        event.Issue.GetState(),
+			Body:         event.Issue.GetBody(),
+			PreviousBody: previousBody(event.Changes),
+			Sender:       event.Sender.GetLogin(),
+			Milestone:    event.Issue.GetMilestone().GetTitle(),
+			Installation: event.Installation.GetID(),
+		}
+		if e.Action == "transferred" {
+			// The changes of a transfer are not parsed by go-github.
+			var transfer struct {
+				Changes struct {
+					NewIssue struct {
+						Number int `json:"number"`
+					} `json:"new_issue"`
+					NewRepository struct {
+						FullName string `json:"full_name"`
+					} `json:"new_repository"`
+				} `json:"changes"`
+			}
+			json.Unmarshal(payload, &transfer)
+			e.NewRepo = transfer.Changes.NewRepository.FullName
+			e.NewIssue = transfer.Changes.NewIssue.Number
+		}
+		return e, nil
+	case *github.IssueCommentEvent:
+		return &Event{
+			Type:         CommentEvent,
+			Action:       event.GetAction(),
+			Issue:        event.Issue.GetNumber(),
+			Repo:         event.Repo.GetFullName(),
+			State:        event.Issue.GetState(),
+			Body:         event.Comment.GetBody(),
+			PreviousBody: previousBody(event.Changes),
+			Comment:      event.Comment.GetID(),
+			Sender:       event.Sender.GetLogin(),
+			Milestone:    event.Issue.GetMilestone().GetTitle(),
+			Installation: event.Installation.GetID(),
+		}, nil
+	case *github.PingEvent:
+		var cnt = 0
+		// Since this exporter only processes "issues" and "issue_comment" Github
+		// webhook events, be sure that at least these two events are enabled for the
+		// webhook.
+		for _, v := range event.Hook.Events {
+			if v == "issues" || v == "issue_comment" {
+				cnt++
+			}
+		}
+		return &Event{Type: PingEvent, PingOK: cnt == 2}, nil
+	default:
+		return nil, ErrUnsupportedEvent
+	}
+}
+
+// previousBody returns the body of an issue or comment before an edit, or ""
+// if the edit did not change it.
+func previousBody(c *github.EditChange) string {
+	if c == nil || c.Body == nil || c.Body.From == nil {
+		return ""
+	}
+	return *c.Body.From
+}
+
+// GitHubApp is the Provider for the webhooks of a GitHub App, which are signed
+// with the app's webhook secret. Deliveries for other apps, or for other
+// installations of the app, are refused.
+type GitHubApp struct {
+	AppID          int64
+	InstallationID int64
+}
+
+// Parse validates that a webhook was delivered for the app, then parses it
+// as a GitHub webhook.
+func (a GitHubApp) Parse(req *http.Request, secret []byte) (*Event, error) {
+	if id := req.Header.Get(appIDHeader); id != strconv.FormatInt(a.AppID, 10) {
+		return nil, fmt.Errorf("%w: webhook was delivered for app %q, not %d", ErrInvalidSignature, id, a.AppID)
+	}
+	event, err := GitHub{}.Parse(req, secret)
+	if err != nil {
+		return nil, err
+	}
+	if event.Type != PingEvent && event.Installation != a.InstallationID {
+		return nil, fmt.Errorf("%w: webhook was delivered for installation %d, not %d", ErrInvalidSignature, event.Installation, a.InstallationID)
+	}
+	return event, nil
+}
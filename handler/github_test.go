@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/m-lab/github-maintenance-exporter/gmxtest"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGitHubSignatures(t *testing.T) {
+	secret := []byte("goodsecret")
+	payload := gmxtest.IssuePayload("opened", gmxtest.Issue{Number: 1, Body: "/site abc01"})
+	tests := []struct {
+		name      string
+		sha1      string
+		sha256    string
+		wantErr   bool
+		wantCount string
+	}{
+		{name: "both", sha1: gmxtest.Signature(secret, []byte(payload)), sha256: gmxtest.Signature256(secret, []byte(payload)), wantCount: "sha256"},
+		{name: "sha256", sha256: gmxtest.Signature256(secret, []byte(payload)), wantCount: "sha256"},
+		{name: "sha1", sha1: gmxtest.Signature(secret, []byte(payload)), wantCount: "sha1"},
+		{name: "bad-sha256", sha1: gmxtest.Signature(secret, []byte(payload)), sha256: gmxtest.Signature256([]byte("bad"), []byte(payload)), wantErr: true},
+		{name: "sha1-as-sha256", sha256: gmxtest.Signature(secret, []byte(payload)), wantErr: true},
+		{name: "none", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := gmxtest.NewWebhook(secret, "issues", payload)
+			req.Header.Del(signatureHeader)
+			req.Header.Del(signature256Header)
+			if tt.sha1 != "" {
+				req.Header.Set(signatureHeader, tt.sha1)
+			}
+			if tt.sha256 != "" {
+				req.Header.Set(signature256Header, tt.sha256)
+			}
+			before := map[string]float64{
+				"sha1":   testutil.ToFloat64(metrics.WebhookSignatures.WithLabelValues("sha1")),
+				"sha256": testutil.ToFloat64(metrics.WebhookSignatures.WithLabelValues("sha256")),
+			}
+
+			event, err := GitHub{}.Parse(req, secret)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidSignature) {
+					t.Fatalf("Parse() error = %v; want ErrInvalidSignature", err)
+				}
+				return
+			}
+			if err != nil || event.Issue != 1 {
+				t.Fatalf("Parse() = %+v, %v", event, err)
+			}
+			for scheme, n := range before {
+				want := n
+				if scheme == tt.wantCount {
+					want++
+				}
+				if got := testutil.ToFloat64(metrics.WebhookSignatures.WithLabelValues(scheme)); got != want {
+					t.Errorf("%s signatures counted = %v; want %v", scheme, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGitHubApp(t *testing.T) {
+	secret := []byte("appsecret")
+	var p map[string]interface{}
+	json.Unmarshal([]byte(gmxtest.IssuePayload("opened", gmxtest.Issue{Number: 1})), &p)
+	p["installation"] = map[string]interface{}{"id": 7}
+	payload, _ := json.Marshal(p)
+
+	tests := []struct {
+		name    string
+		app     GitHubApp
+		appID   string
+		payload string
+		wantErr bool
+	}{
+		{name: "valid", app: GitHubApp{AppID: 42, InstallationID: 7}, appID: "42", payload: string(payload)},
+		{name: "other-app", app: GitHubApp{AppID: 42, InstallationID: 7}, appID: "43", payload: string(payload), wantErr: true},
+		{name: "no-app", app: GitHubApp{AppID: 42, InstallationID: 7}, payload: string(payload), wantErr: true},
+		{name: "other-installation", app: GitHubApp{AppID: 42, InstallationID: 8}, appID: "42", payload: string(payload), wantErr: true},
+		{name: "ping", app: GitHubApp{AppID: 42, InstallationID: 7}, appID: "42", payload: gmxtest.PingPayload("issues", "issue_comment")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eventType := "issues"
+			if tt.name == "ping" {
+				eventType = "ping"
+			}
+			req := gmxtest.NewWebhook(secret, eventType, tt.payload)
+			if tt.appID != "" {
+				req.Header.Set(appIDHeader, tt.appID)
+			}
+			event, err := tt.app.Parse(req, secret)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidSignature) {
+					t.Errorf("Parse() error = %v; want ErrInvalidSignature", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() returned an error: %v", err)
+			}
+			if tt.name == "valid" && event.Installation != 7 {
+				t.Errorf("Parse() = %+v; want installation 7", event)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// GitLab is the Provider for GitLab webhooks.
+type GitLab struct{}
+
+// gitlabHook is the subset of a GitLab issue or note webhook that the exporter
+// uses.
+type gitlabHook struct {
+	User struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+	ObjectAttributes struct {
+		ID           int64  `json:"id"`
+		IID          int    `json:"iid"`
+		Action       string `json:"action"`
+		State        string `json:"state"`
+		Description  string `json:"description"`
+		Note         string `json:"note"`
+		NoteableType string `json:"noteable_type"`
+	} `json:"object_attributes"`
+	Issue struct {
+		IID   int    `json:"iid"`
+		State string `json:"state"`
+	} `json:"issue"`
+	Changes struct {
+		Description struct {
+			Previous string `json:"previous"`
+		} `json:"description"`
+	} `json:"changes"`
+}
+
+// gitlabActions maps the actions of GitLab issue hooks to their GitHub
+// equivalents.
+var gitlabActions = map[string]string{
+	"open":   "opened",
+	"reopen": "reopened",
+	"update": "edited",
+	"close":  "closed",
+}
+
+// gitlabState converts a GitLab issue state to its GitHub equivalent.
+func gitlabState(state string) string {
+	if state == "opened" {
+		return "open"
+	}
+	return state
+}
+
+// Parse validates the secret token of a GitLab webhook and parses its payload.
+func (GitLab) Parse(req *http.Request, secret []byte) (*Event, error) {
+	token := []byte(req.Header.Get("X-Gitlab-Token"))
+	if len(secret) == 0 || subtle.ConstantTimeCompare(token, secret) != 1 {
+		return nil, ErrInvalidSignature
+	}
+
+	payload, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	var hook gitlabHook
+	err = json.Unmarshal(payload, &hook)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := hook.ObjectAttributes
+	switch req.Header.Get("X-Gitlab-Event") {
+	case "Issue Hook":
+		return &Event{
+			Type:         IssueEvent,
+			Action:       gitlabActions[attrs.Action],
+			Issue:        attrs.IID,
+			Repo:         hook.Project.PathWithNamespace,
+			State:        gitlabState(attrs.State),
+			Body:         attrs.Description,
+			PreviousBody: hook.Changes.Description.Previous,
+			Sender:       hook.User.Username,
+		}, nil
+	case "Note Hook":
+		if attrs.NoteableType != "Issue" {
+			return nil, ErrUnsupportedEvent
+		}
+		return &Event{
+			Type:    CommentEvent,
+			Action:  "created",
+			Issue:   hook.Issue.IID,
+			Repo:    hook.Project.PathWithNamespace,
+			State:   gitlabState(hook.Issue.State),
+			Body:    attrs.Note,
+			Comment: attrs.ID,
+			Sender:  hook.User.Username,
+		}, nil
+	default:
+		return nil, ErrUnsupportedEvent
+	}
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGitLabParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   string
+		token   string
+		payload string
+		want    *Event
+		wantErr error
+	}{
+		{
+			name:  "issue",
+			event: "Issue Hook",
+			token: "goodsecret",
+			payload: `{
+				"user": {"username": "alice"},
+				"project": {"path_with_namespace": "m-lab/ops"},
+				"object_attributes": {"iid": 3, "action": "open", "state": "opened", "description": "/site abc01"}
+			}`,
+			want: &Event{Type: IssueEvent, Action: "opened", Issue: 3, Repo: "m-lab/ops", State: "open", Body: "/site abc01", Sender: "alice"},
+		},
+		{
+			name:  "issue-update",
+			event: "Issue Hook",
+			token: "goodsecret",
+			payload: `{
+				"user": {"username": "alice"},
+				"project": {"path_with_namespace": "m-lab/ops"},
+				"object_attributes": {"iid": 3, "action": "update", "state": "opened", "description": "/site abc01"},
+				"changes": {"description": {"previous": "/site abc01 /site xyz02"}}
+			}`,
+			want: &Event{Type: IssueEvent, Action: "edited", Issue: 3, Repo: "m-lab/ops", State: "open", Body: "/site abc01",
+				PreviousBody: "/site abc01 /site xyz02", Sender: "alice"},
+		},
+		{
+			name:  "note",
+			event: "Note Hook",
+			token: "goodsecret",
+			payload: `{
+				"user": {"username": "bob"},
+				"project": {"path_with_namespace": "m-lab/ops"},
+				"object_attributes": {"id": 42, "note": "/approve", "noteable_type": "Issue"},
+				"issue": {"iid": 3, "state": "closed"}
+			}`,
+			want: &Event{Type: CommentEvent, Action: "created", Issue: 3, Repo: "m-lab/ops", State: "closed", Body: "/approve", Comment: 42, Sender: "bob"},
+		},
+		{
+			name:    "merge-request-note",
+			event:   "Note Hook",
+			token:   "goodsecret",
+			payload: `{"object_attributes": {"note": "/site abc01", "noteable_type": "MergeRequest"}}`,
+			wantErr: ErrUnsupportedEvent,
+		},
+		{
+			name:    "push",
+			event:   "Push Hook",
+			token:   "goodsecret",
+			payload: `{}`,
+			wantErr: ErrUnsupportedEvent,
+		},
+		{
+			name:    "bad-token",
+			event:   "Issue Hook",
+			token:   "badsecret",
+			payload: `{}`,
+			wantErr: ErrInvalidSignature,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/webhook/lab", strings.NewReader(tt.payload))
+			req.Header.Set("X-Gitlab-Event", tt.event)
+			req.Header.Set("X-Gitlab-Token", tt.token)
+			got, err := GitLab{}.Parse(req, []byte("goodsecret"))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Parse() error = %v; want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
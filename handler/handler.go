@@ -3,72 +3,783 @@
 package handler
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/google/go-github/github"
+	"github.com/m-lab/github-maintenance-exporter/errorreport"
+	"github.com/m-lab/github-maintenance-exporter/githubapi"
 	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
 	"github.com/m-lab/github-maintenance-exporter/metrics"
+	"github.com/m-lab/github-maintenance-exporter/parser"
 )
 
 var (
-	machineRegExps = map[string]*regexp.Regexp{
-		"mlab-sandbox": regexp.MustCompile(`\/machine\s+(mlab[1-4][.-][a-z]{3}[0-9]t)(\s+del)?`),
-		"mlab-staging": regexp.MustCompile(`\/machine\s+(mlab[4][.-][a-z]{3}[0-9c]{2})(\s+del)?`),
-		"mlab-oti":     regexp.MustCompile(`\/machine\s+(mlab[1-3][.-][a-z]{3}[0-9c]{2})(\s+del)?`),
-	}
+	approveRegExp = regexp.MustCompile(`(^|\s)\/approve\b`)
+	cancelRegExp  = regexp.MustCompile(`(^|\s)\/cancel\b`)
+	undoRegExp    = regexp.MustCompile(`(^|\s)\/undo\b`)
+	statusRegExp  = regexp.MustCompile(`(^|\s)\/status\b`)
+	// closeIssueRegExp matches the command that removes the maintenance of
+	// another issue, capturing its number.
+	closeIssueRegExp = regexp.MustCompile(`(^|\s)\/close-issue\s+#?([0-9]+)\b`)
+	// autoCloseRegExp matches the flag requesting that an issue be closed
+	// once all of its maintenance has been removed.
+	autoCloseRegExp = regexp.MustCompile(`(^|\s)\/autoclose\b`)
+)
 
-	siteRegExps = map[string]*regexp.Regexp{
-		"mlab-sandbox": regexp.MustCompile(`\/site\s+([a-z]{3}[0-9]t)(\s+del)?`),
-		"mlab-staging": regexp.MustCompile(`\/site\s+([a-z]{3}[0-9c]{2})(\s+del)?`),
-		"mlab-oti":     regexp.MustCompile(`\/site\s+([a-z]{3}[0-9c]{2})(\s+del)?`),
-	}
+// commentMarker is included in every comment that GMX posts, so that the
+// resulting issue_comment webhooks can be recognized and ignored.
+const commentMarker = "<!-- github-maintenance-exporter -->"
+
+// commentTimeout bounds how long the handler waits to comment on an issue.
+const commentTimeout = 5 * time.Second
+
+// What happens to the maintenance of an issue that is transferred to another
+// repository.
+const (
+	// TransferCarry moves the maintenance to the new issue.
+	TransferCarry = "carry"
+	// TransferClose removes the maintenance, as when the issue is closed.
+	TransferClose = "close"
 )
 
+// Commenter posts comments on GitHub issues.
+type Commenter interface {
+	CreateComment(ctx context.Context, repo string, issue int, body string) error
+}
+
+// IssueCloser closes GitHub issues.
+type IssueCloser interface {
+	CloseIssue(ctx context.Context, repo string, issue int) error
+}
+
+// CommentLister lists the comments on GitHub issues.
+type CommentLister interface {
+	ListComments(ctx context.Context, repo string, issue int) ([]githubapi.Comment, error)
+}
+
+// Config holds optional settings for the webhook handler.
+type Config struct {
+	// MassChangeThreshold is the number of entities a single event may modify
+	// before it is counted as a mass change. Zero disables the check.
+	MassChangeThreshold int
+	// MaxFlags is the maximum number of flags processed from a single issue
+	// body or comment. Zero means there is no limit.
+	MaxFlags int
+	// ApprovalThreshold is the number of machines and sites a single message
+	// may affect before its changes require approval. Zero disables approval.
+	ApprovalThreshold int
+	// GracePeriod is how long to wait before entering maintenance when a flag
+	// does not specify its own delay.
+	GracePeriod time.Duration
+	// DefaultTTL, if not zero, is how long maintenance lasts when a flag does
+	// not say when it ends, so that forgotten maintenance expires.
+	DefaultTTL time.Duration
+	// Blackouts are the windows during which changes are refused unless they
+	// are overridden.
+	Blackouts Windows
+	// Approvers are the GitHub users allowed to approve proposed changes.
+	Approvers []string
+	// Commenter, if not nil, is used to report notes back on the issue.
+	Commenter Commenter
+	// AutoClose causes every issue to be closed once all of its maintenance
+	// has been removed. Issues may also opt in individually with /autoclose.
+	AutoClose bool
+	// Closer, if not nil, is used to close issues automatically.
+	Closer IssueCloser
+	// Comments, if not nil, is used to list the comments of reopened issues,
+	// whose flags are applied again along with those of the issue.
+	Comments CommentLister
+	// Transfer is TransferCarry or TransferClose. Maintenance is only
+	// carried over to issues whose key TransferKey returns, and is removed
+	// otherwise.
+	Transfer string
+	// TransferKey, if not nil, returns the key under which the issues of
+	// repo are recorded in the state of project, if its webhooks are
+	// received.
+	TransferKey func(project string, repo string, issue int) (string, bool)
+	// Tracker, if not nil, is told when webhooks are received and processed.
+	Tracker Tracker
+	// Provider validates and parses webhooks. If nil, GitHub is used.
+	Provider Provider
+	// Milestones causes the milestone of each issue with maintenance to be
+	// recorded in the state and exported as a metric.
+	Milestones bool
+	// Aliases are resolved to the real names of sites and machines before
+	// flags are validated.
+	Aliases Aliases
+	// Secrets, if not nil, returns the current webhook secrets, replacing
+	// those given to New, so that they can be rotated.
+	Secrets func() [][]byte
+	// Source, if not empty, names the source of the webhooks. It qualifies
+	// the issues recorded in the state, so that several sources can share
+	// the same state.
+	Source string
+}
+
+// Tracker is notified as each webhook is received and once it has been
+// successfully validated and processed.
+type Tracker interface {
+	WebhookReceived()
+	WebhookProcessed()
+}
+
 type handler struct {
-	state        *maintenancestate.MaintenanceState
-	githubSecret []byte
-	project      string
+	state     StateUpdater
+	secrets   [][]byte
+	project   string
+	config    Config
+	provider  Provider
+	parser    func(project string, text string) []parser.Target
+	clock     func() time.Time
+	notifiers []Notifier
+}
+
+// now returns the current time.
+func (h *handler) now() time.Time {
+	if h.clock != nil {
+		return h.clock()
+	}
+	return time.Now()
+}
+
+// parse returns the flags in text.
+func (h *handler) parse(text string) []parser.Target {
+	if h.parser != nil {
+		return h.parser(h.project, text)
+	}
+	return parser.Parse(h.project, text)
+}
+
+// findFlags returns all of the site, machine, experiment, switch and country
+// flags in msg as changes, in the order in which they appear. A country flag
+// becomes a site change for every site in the country.
+func (h *handler) findFlags(msg string) []maintenancestate.Change {
+	changes, _ := h.parseFlags(msg)
+	return changes
+}
+
+// parseFlags is like findFlags, but also explains every flag that was
+// rejected, because it could not be parsed or names something that does not
+// belong to the project.
+func (h *handler) parseFlags(msg string) ([]maintenancestate.Change, []string) {
+	targets := h.parse(h.config.Aliases.Resolve(msg))
+	changes := make([]maintenancestate.Change, 0, len(targets))
+	var rejected []string
+	for _, t := range targets {
+		if t.Err == parser.ErrNoName {
+			rejected = append(rejected, fmt.Sprintf("Ignored a %s flag that is not followed by a valid name.", t.Kind))
+			continue
+		}
+		if t.Kind == "country" {
+			var sites []string
+			err := t.Err
+			if err == nil {
+				sites, err = h.countrySites(t.Name)
+			}
+			if err != nil {
+				rejected = append(rejected, fmt.Sprintf("Ignored the country flag for %s: %s.", t.Name, err))
+				continue
+			}
+			// Every site in the country is flagged at the position of the flag.
+			for _, site := range sites {
+				changes = append(changes, newChange("site", site, t))
+			}
+			continue
+		}
+
+		entity := t.Name
+		if t.Kind == "experiment" {
+			entity = t.Machine
+		}
+		err := t.Err
+		if err == nil {
+			switch t.Kind {
+			case "site", "switch":
+				err = h.checkSite(entity, t.Action)
+			default:
+				err = h.checkMachine(entity, t.Action)
+			}
+		}
+		if err != nil {
+			rejected = append(rejected, fmt.Sprintf("Ignored the %s flag for %s: %s.", t.Kind, entity, err))
+			continue
+		}
+		name := t.Name
+		switch t.Kind {
+		case "switch":
+			name = maintenancestate.SwitchKey(t.Name)
+		case "experiment":
+			name = maintenancestate.ExperimentKey(t.Name, t.Machine)
+		}
+		changes = append(changes, newChange(t.Kind, name, t))
+	}
+	return changes, rejected
+}
+
+// newChange returns the change that a flag makes to the named entity.
+func newChange(kind string, name string, t parser.Target) maintenancestate.Change {
+	return maintenancestate.Change{
+		Kind:     kind,
+		Name:     name,
+		Action:   t.Action,
+		Delay:    t.Delay,
+		Override: t.Override,
+		Expires:  t.Expires,
+		Duration: t.Duration,
+		Reason:   t.Reason,
+	}
+}
+
+// describe formats a change for reporting back to the sender. The flag
+// prefix is deliberately omitted so that GMX's own comments never match the
+// flag patterns.
+func describe(c maintenancestate.Change) string {
+	if c.Action == maintenancestate.LeaveMaintenance {
+		return fmt.Sprintf("remove %s %s from maintenance", c.Kind, c.Name)
+	}
+	switch {
+	case c.Duration > 0:
+		return fmt.Sprintf("put %s %s into maintenance for %s", c.Kind, c.Name, c.Duration)
+	case !c.Expires.IsZero():
+		return fmt.Sprintf("put %s %s into maintenance until %s", c.Kind, c.Name, c.Expires.UTC().Format(time.RFC3339))
+	}
+	return fmt.Sprintf("put %s %s into maintenance", c.Kind, c.Name)
+}
+
+// blastRadius returns the number of machines and sites affected by changes.
+func (h *handler) blastRadius(changes []maintenancestate.Change) int {
+	n := 0
+	for _, c := range changes {
+		n++
+		if r, ok := h.state.(SiteResolver); ok && c.Kind == "site" {
+			machines, _ := r.SiteMachines(c.Name)
+			n += len(machines)
+		}
+	}
+	return n
+}
+
+// applyChanges applies changes to the maintenance state on behalf of an issue.
+// Changes that enter maintenance after a delay are scheduled instead. The
+// return value is the number of modifications that were made, along with notes
+// describing any scheduled or expiring changes.
+func (h *handler) applyChanges(changes []maintenancestate.Change, issueNumber string, origin maintenancestate.Origin) (int, []string) {
+	var mods = 0
+	var notes []string
+	var scheduled []maintenancestate.ScheduledChange
+	window, blackout := h.config.Blackouts.Active(h.now())
+	scheduler, canSchedule := h.state.(Scheduler)
+	for _, c := range changes {
+		c.Sender, c.Delivery, c.Comment = origin.Sender, origin.Delivery, origin.Comment
+		if c.Cause == "" {
+			c.Cause = origin.Cause
+		}
+		if blackout && !c.Override {
+			slog.Warn("Refusing change during blackout window", "issue", issueNumber, "change", describe(c), "kind", c.Kind, "entity", c.Name)
+			metrics.BlackoutRefusals.Inc()
+			notes = append(notes, fmt.Sprintf("Refused to %s: changes are blocked until %s. Add \"override\" after the flag to apply it anyway.",
+				describe(c), window.End.UTC().Format(time.RFC3339)))
+			continue
+		}
+		slog.Info("Flag found", "issue", issueNumber, "kind", c.Kind, "entity", c.Name, "action", c.Action.String(), "delivery", origin.Delivery)
+		if c.Action == maintenancestate.EnterMaintenance && c.Delay == 0 {
+			c.Delay = h.config.GracePeriod
+		}
+		if c.Action == maintenancestate.EnterMaintenance && c.Duration == 0 && c.Expires.IsZero() {
+			c.Duration = h.config.DefaultTTL
+		}
+		if !canSchedule && c.Action == maintenancestate.EnterMaintenance && c.Delay > 0 {
+			notes = append(notes, fmt.Sprintf("Refused to %s: the state cannot schedule changes.", describe(c)))
+			continue
+		}
+		if c.Action == maintenancestate.EnterMaintenance && c.Delay > 0 {
+			sc := maintenancestate.ScheduledChange{Change: c, Issue: issueNumber, At: h.now().Add(c.Delay)}
+			scheduled = append(scheduled, sc)
+			notes = append(notes, fmt.Sprintf("Scheduled: %s at %s.", describe(c), sc.At.UTC().Format(time.RFC3339)))
+			continue
+		}
+		if c.Action == maintenancestate.LeaveMaintenance {
+			// Leaving maintenance also cancels maintenance that has not started yet.
+			mods += h.unschedule(issueNumber, c.Name)
+		}
+		if c.Action == maintenancestate.EnterMaintenance && (c.Duration > 0 || !c.Expires.IsZero()) {
+			notes = append(notes, fmt.Sprintf("Applied: %s.", describe(c)))
+		}
+		m := h.apply(c, issueNumber)
+		if c.Kind == "machine" {
+			// Every machine flag counts as a modification.
+			m = 1
+		}
+		mods += m
+	}
+	if len(scheduled) > 0 {
+		err := scheduler.Schedule(scheduled)
+		if err != nil {
+			slog.Error("Failed to write scheduled changes", "issue", issueNumber, "err", err)
+			metrics.CountError("schedule", "applyChanges")
+		}
+	}
+	return mods, notes
 }
 
 // parseMessage scans the body of an issue or comment looking for special flags
 // that match predefined patterns indicating that machine or site should be
 // added to or removed from maintenance mode. If any matches are found, it
-// updates the state for the item. The return value is the number of
-// modifications that were made to the machine and site maintenance state.
-func (h *handler) parseMessage(msg string, issueNumber string) int {
-	var mods = 0
-	siteMatches := siteRegExps[h.project].FindAllStringSubmatch(msg, -1)
-	if len(siteMatches) > 0 {
-		for _, site := range siteMatches {
-			log.Printf("INFO: Flag found for site: %s", site[1])
-			if strings.TrimSpace(site[2]) == "del" {
-				mods += h.state.UpdateSite(site[1], maintenancestate.LeaveMaintenance, issueNumber, h.project)
-			} else {
-				mods += h.state.UpdateSite(site[1], maintenancestate.EnterMaintenance, issueNumber, h.project)
-			}
+// updates the state for the item, unless the changes are large enough to
+// require approval, in which case they are recorded as a proposal. The return
+// value is the number of modifications that were made to the machine and site
+// maintenance state, along with any notes that should be reported back to the
+// sender.
+func (h *handler) parseMessage(msg string, issueNumber string, origin maintenancestate.Origin) (int, []string) {
+	var notes []string
+
+	if a, ok := h.state.(AutoCloser); ok && autoCloseRegExp.MatchString(msg) && !a.AutoClose(issueNumber) {
+		err := a.SetAutoClose(issueNumber)
+		if err != nil {
+			slog.Error("Failed to record autoclose", "issue", issueNumber, "err", err)
+			metrics.CountError("autoclose", "parseMessage")
 		}
+		notes = append(notes, "This issue will be closed once all of its maintenance has been removed.")
 	}
 
-	machineMatches := machineRegExps[h.project].FindAllStringSubmatch(msg, -1)
-	if len(machineMatches) > 0 {
-		for _, machine := range machineMatches {
-			log.Printf("INFO: Flag found for machine: %s", machine[1])
-			label := strings.Replace(machine[1], ".", "-", 1)
-			if strings.TrimSpace(machine[2]) == "del" {
-				h.state.UpdateMachine(label, maintenancestate.LeaveMaintenance, issueNumber, h.project)
-				mods++
-			} else {
-				h.state.UpdateMachine(label, maintenancestate.EnterMaintenance, issueNumber, h.project)
-				mods++
-			}
+	changes, rejected := h.parseFlags(msg)
+	for _, r := range rejected {
+		slog.Warn("Rejected flag", "issue", issueNumber, "reason", r)
+		metrics.CountError("badflag", "parseMessage")
+	}
+	notes = append(notes, rejected...)
+	if h.config.MaxFlags > 0 && len(changes) > h.config.MaxFlags {
+		slog.Warn("Message contains too many flags; only processing the first of them",
+			"issue", issueNumber, "flags", len(changes), "max_flags", h.config.MaxFlags)
+		metrics.CountError("toomanyflags", "parseMessage")
+		var ignored []string
+		for _, c := range changes[h.config.MaxFlags:] {
+			ignored = append(ignored, c.Kind+" "+c.Name)
+		}
+		notes = append(notes, fmt.Sprintf("Only the first %d of %d flags were processed. Ignored: %s",
+			h.config.MaxFlags, len(changes), strings.Join(ignored, ", ")))
+		changes = changes[:h.config.MaxFlags]
+	}
+
+	if radius, ok := h.needsApproval(changes); ok {
+		return 0, append(notes, h.propose(issueNumber, changes, radius))
+	}
+
+	mods, scheduled := h.applyChanges(changes, issueNumber, origin)
+	return mods, append(notes, scheduled...)
+}
+
+// needsApproval returns the number of machines and sites affected by changes,
+// and whether that is more than the approval threshold.
+func (h *handler) needsApproval(changes []maintenancestate.Change) (int, bool) {
+	if h.config.ApprovalThreshold <= 0 {
+		return 0, false
+	}
+	radius := h.blastRadius(changes)
+	return radius, radius > h.config.ApprovalThreshold
+}
+
+// propose records changes affecting radius machines and sites as the
+// proposal of an issue, to be applied once approved, and returns a note
+// describing them.
+func (h *handler) propose(issueNumber string, changes []maintenancestate.Change, radius int) string {
+	p, ok := h.state.(Proposer)
+	if !ok {
+		slog.Warn("Refusing changes that require approval", "issue", issueNumber, "entities", radius)
+		return fmt.Sprintf("These changes affect %d machines and sites, which is more than the approval threshold of %d, "+
+			"and the state cannot hold them for approval.", radius, h.config.ApprovalThreshold)
+	}
+	slog.Info("Changes are waiting for approval", "issue", issueNumber, "entities", radius)
+	err := p.Propose(issueNumber, changes)
+	if err != nil {
+		slog.Error("Failed to record proposal", "issue", issueNumber, "err", err)
+		metrics.CountError("propose", "propose")
+	}
+	proposal := []string{fmt.Sprintf(
+		"These changes affect %d machines and sites, which is more than the approval threshold of %d. "+
+			"They will be applied when an authorized user replies with /approve.", radius, h.config.ApprovalThreshold)}
+	for _, c := range changes {
+		proposal = append(proposal, "* "+describe(c))
+	}
+	return strings.Join(proposal, "\n")
+}
+
+// unflag removes the maintenance of the machines and sites that were flagged
+// by previous, the text of an issue or comment before an edit, but are no
+// longer flagged by body, so that deleting a flag takes effect.
+func (h *handler) unflag(previous string, body string, issueNumber string, origin maintenancestate.Origin) (int, []string) {
+	if previous == "" {
+		return 0, nil
+	}
+	kept := map[string]bool{}
+	for _, c := range h.findFlags(body) {
+		if c.Action == maintenancestate.EnterMaintenance {
+			kept[c.Kind+" "+c.Name] = true
+		}
+	}
+	var changes []maintenancestate.Change
+	var removed []string
+	for _, c := range h.findFlags(previous) {
+		key := c.Kind + " " + c.Name
+		if c.Action != maintenancestate.EnterMaintenance || kept[key] {
+			continue
+		}
+		kept[key] = true
+		changes = append(changes, maintenancestate.Change{Kind: c.Kind, Name: c.Name, Action: maintenancestate.LeaveMaintenance, Override: c.Override})
+		removed = append(removed, key)
+	}
+	if len(changes) == 0 {
+		return 0, nil
+	}
+	slog.Info("Flags were deleted by an edit", "issue", issueNumber, "flags", removed)
+	origin.Cause = "edited"
+	mods, notes := h.applyChanges(changes, issueNumber, origin)
+	return mods, append([]string{fmt.Sprintf("Removing maintenance for the flags deleted by the edit: %s.", strings.Join(removed, ", "))}, notes...)
+}
+
+// reopen applies again the flags of a reopened issue, whose maintenance was
+// removed when it was closed: those of its body, followed by those of its
+// comments if they can be listed.
+func (h *handler) reopen(ctx context.Context, event *Event, issueNumber string, origin maintenancestate.Origin) (int, []string) {
+	origin.Cause = "reopened"
+	mods, notes := h.parseMessage(event.Body, issueNumber, origin)
+	if h.config.Comments == nil || event.Repo == "" {
+		return mods, notes
+	}
+	ctx, cancel := context.WithTimeout(ctx, commentTimeout)
+	defer cancel()
+	comments, err := h.config.Comments.ListComments(ctx, event.Repo, event.Issue)
+	if err != nil {
+		slog.Error("Failed to list the comments of a reopened issue", "repo", event.Repo, "issue", issueNumber, "err", err)
+		metrics.CountError("listcomments", "reopen")
+		return mods, append(notes, "The flags of the comments on this issue could not be applied again; repeat them if needed.")
+	}
+	for _, c := range comments {
+		if strings.Contains(c.Body, commentMarker) || approveRegExp.MatchString(c.Body) || cancelRegExp.MatchString(c.Body) || undoRegExp.MatchString(c.Body) {
+			// Approvals, cancellations and undos only apply to what was
+			// pending when they were made.
+			continue
+		}
+		origin.Sender, origin.Comment = c.User, c.ID
+		n, cnotes := h.parseMessage(c.Body, issueNumber, origin)
+		mods += n
+		notes = append(notes, cnotes...)
+	}
+	return mods, notes
+}
+
+// transfer carries the maintenance of an issue that was transferred to
+// another repository over to the new issue, or removes it, as configured.
+func (h *handler) transfer(event *Event, issueNumber string, origin maintenancestate.Origin) int {
+	m, ok := h.state.(Mover)
+	if ok && h.config.Transfer == TransferCarry && h.config.TransferKey != nil {
+		if key, ok := h.config.TransferKey(h.project, event.NewRepo, event.NewIssue); ok {
+			slog.Info("Issue was transferred; moving its maintenance", "issue", issueNumber, "to", key)
+			return m.MoveIssue(issueNumber, key, h.project)
+		}
+	}
+	slog.Info("Issue was transferred; removing its maintenance", "issue", issueNumber, "repo", event.NewRepo)
+	origin.Cause = "transferred"
+	return h.closeFrom(issueNumber, origin)
+}
+
+// authorized reports whether sender is one of the approvers.
+func (h *handler) authorized(sender string) bool {
+	for _, a := range h.config.Approvers {
+		if strings.EqualFold(a, sender) {
+			return true
+		}
+	}
+	return false
+}
+
+// closeByNumber removes all maintenance of the issue with the given number,
+// e.g. one that was closed while the exporter was down, if sender is
+// authorized to approve changes.
+func (h *handler) closeByNumber(number int, origin maintenancestate.Origin) (int, []string) {
+	if !h.authorized(origin.Sender) {
+		slog.Warn("Ignoring /close-issue from unauthorized user", "target", number, "sender", origin.Sender)
+		return 0, []string{fmt.Sprintf("@%s is not authorized to close issues.", origin.Sender)}
+	}
+	key := h.issueKey(number)
+	origin.Cause = "manual"
+	mods := h.closeFrom(key, origin)
+	slog.Info("Closed an issue by command", "target", key, "sender", origin.Sender, "mods", mods)
+	return mods, []string{fmt.Sprintf("Removed all maintenance for issue %d (%d modifications).", number, mods)}
+}
+
+// approve applies the pending proposal for an issue if sender is authorized
+// to approve it.
+func (h *handler) approve(issueNumber string, origin maintenancestate.Origin) (int, []string) {
+	sender := origin.Sender
+	if !h.authorized(sender) {
+		slog.Warn("Ignoring /approve from unauthorized user", "issue", issueNumber, "sender", sender)
+		return 0, []string{fmt.Sprintf("@%s is not authorized to approve changes.", sender)}
+	}
+	p, ok := h.state.(Proposer)
+	if !ok {
+		return 0, []string{"There are no pending changes to approve."}
+	}
+	changes, ok := p.TakeProposal(issueNumber)
+	if !ok {
+		return 0, []string{"There are no pending changes to approve."}
+	}
+	if window, blackout := h.config.Blackouts.Active(h.now()); blackout && !overridden(changes) {
+		// Keep the proposal, so that it may be approved once the blackout
+		// ends, rather than losing it to applyChanges' refusals.
+		slog.Warn("Refusing approval during blackout window", "issue", issueNumber, "sender", sender, "changes", len(changes))
+		metrics.BlackoutRefusals.Inc()
+		if err := p.Propose(issueNumber, changes); err != nil {
+			slog.Error("Failed to restore proposal", "issue", issueNumber, "err", err)
+			metrics.CountError("propose", "approve")
+		}
+		return 0, []string{fmt.Sprintf("Refused to approve the pending changes: changes are blocked until %s. Approve them again once the blackout ends.",
+			window.End.UTC().Format(time.RFC3339))}
+	}
+	slog.Info("Changes approved", "issue", issueNumber, "sender", sender, "changes", len(changes))
+	mods, notes := h.applyChanges(changes, issueNumber, origin)
+	return mods, append([]string{fmt.Sprintf("Approved by @%s.", sender)}, notes...)
+}
+
+// overridden reports whether every change overrides blackout windows.
+func overridden(changes []maintenancestate.Change) bool {
+	for _, c := range changes {
+		if !c.Override {
+			return false
+		}
+	}
+	return true
+}
+
+// cancel cancels all scheduled changes for an issue.
+func (h *handler) cancel(issueNumber string) (int, []string) {
+	canceled := h.unschedule(issueNumber, "")
+	if canceled == 0 {
+		return 0, []string{"There are no scheduled changes to cancel."}
+	}
+	return canceled, []string{fmt.Sprintf("Canceled %d scheduled changes.", canceled)}
+}
+
+// issueState is what an issue has in maintenance and scheduled, from which
+// the changes made by a message are worked out.
+type issueState struct {
+	entities  map[string]bool
+	scheduled map[string]bool
+}
+
+// snapshotIssue returns the current issueState of an issue.
+func (h *handler) snapshotIssue(issueNumber string) issueState {
+	s := issueState{entities: map[string]bool{}, scheduled: map[string]bool{}}
+	for _, name := range h.issueEntityNames(issueNumber) {
+		s.entities[name] = true
+	}
+	for _, sc := range h.scheduled() {
+		if sc.Issue == issueNumber {
+			s.scheduled[sc.Name] = true
+		}
+	}
+	return s
+}
+
+// recordUndo records the changes that revert those made to an issue since it
+// was in the state before, so that /undo can apply them. Nothing is recorded
+// if the issue did not change.
+func (h *handler) recordUndo(issueNumber string, before issueState) {
+	u, ok := h.state.(Undoer)
+	if !ok {
+		return
+	}
+	after := h.snapshotIssue(issueNumber)
+	undo := map[string]maintenancestate.Action{}
+	for name := range after.entities {
+		if !before.entities[name] {
+			undo[name] = maintenancestate.LeaveMaintenance
+		}
+	}
+	for name := range after.scheduled {
+		if !before.scheduled[name] {
+			// Leaving maintenance also cancels scheduled maintenance.
+			undo[name] = maintenancestate.LeaveMaintenance
+		}
+	}
+	for name := range before.entities {
+		if !after.entities[name] {
+			undo[name] = maintenancestate.EnterMaintenance
+		}
+	}
+	if len(undo) == 0 {
+		return
+	}
+	changes := make([]maintenancestate.Change, 0, len(undo))
+	for name, action := range undo {
+		changes = append(changes, maintenancestate.Change{Kind: maintenancestate.KindOf(name), Name: name, Action: action})
+	}
+	// Sites are changed before their machines, which they take with them.
+	sort.Slice(changes, func(i, j int) bool {
+		if si, sj := changes[i].Kind == "site", changes[j].Kind == "site"; si != sj {
+			return si
+		}
+		return changes[i].Name < changes[j].Name
+	})
+	if err := u.SetUndo(issueNumber, changes); err != nil {
+		slog.Error("Failed to record the changes to undo", "issue", issueNumber, "err", err)
+		metrics.CountError("undo", "recordUndo")
+	}
+}
+
+// undo reverts the changes made by the last comment or edit of an issue that
+// changed its maintenance. They take effect at once, without a grace period,
+// unless a blackout window is active, in which case they are kept to be
+// undone later, or they require approval, in which case they are proposed
+// instead.
+func (h *handler) undo(issueNumber string, origin maintenancestate.Origin) (int, []string) {
+	u, ok := h.state.(Undoer)
+	if !ok {
+		return 0, []string{"There are no changes to undo."}
+	}
+	changes, ok := u.TakeUndo(issueNumber)
+	if !ok {
+		return 0, []string{"There are no changes to undo."}
+	}
+	if window, blackout := h.config.Blackouts.Active(h.now()); blackout && !overridden(changes) {
+		slog.Warn("Refusing undo during blackout window", "issue", issueNumber, "sender", origin.Sender, "changes", len(changes))
+		metrics.BlackoutRefusals.Inc()
+		if err := u.SetUndo(issueNumber, changes); err != nil {
+			slog.Error("Failed to restore the changes to undo", "issue", issueNumber, "err", err)
+			metrics.CountError("undo", "undo")
+		}
+		return 0, []string{fmt.Sprintf("Refused to undo the last changes to this issue: changes are blocked until %s. Undo them again once the blackout ends.",
+			window.End.UTC().Format(time.RFC3339))}
+	}
+	origin.Cause = "undo"
+	if radius, ok := h.needsApproval(changes); ok {
+		for i := range changes {
+			changes[i].Cause = origin.Cause
+		}
+		return 0, []string{h.propose(issueNumber, changes, radius)}
+	}
+	mods := 0
+	undone := []string{"Undid the last changes to this issue:"}
+	for _, c := range changes {
+		c.Origin = origin
+		if c.Action == maintenancestate.LeaveMaintenance {
+			mods += h.unschedule(issueNumber, c.Name)
+		}
+		mods += h.apply(c, issueNumber)
+		undone = append(undone, "* "+describe(c))
+	}
+	slog.Info("Changes undone", "issue", issueNumber, "sender", origin.Sender, "changes", len(changes))
+	return mods, []string{strings.Join(undone, "\n")}
+}
+
+// status describes what is in maintenance for an issue, and what is
+// scheduled to enter maintenance for it.
+func (h *handler) status(issueNumber string) []string {
+	names := h.issueEntityNames(issueNumber)
+	var scheduled []maintenancestate.ScheduledChange
+	for _, sc := range h.scheduled() {
+		if sc.Issue == issueNumber {
+			scheduled = append(scheduled, sc)
+		}
+	}
+	if len(names) == 0 && len(scheduled) == 0 {
+		return []string{"Nothing is in maintenance for this issue."}
+	}
+	lines := []string{fmt.Sprintf("%d machines and sites are in maintenance for this issue:", len(names))}
+	for _, name := range names {
+		lines = append(lines, "* "+maintenancestate.KindOf(name)+" "+name)
+	}
+	if len(scheduled) > 0 {
+		lines = append(lines, "", "Scheduled:")
+		for _, sc := range scheduled {
+			lines = append(lines, fmt.Sprintf("* %s at %s", describe(sc.Change), sc.At.UTC().Format(time.RFC3339)))
 		}
 	}
+	return []string{strings.Join(lines, "\n")}
+}
+
+// shouldClose reports whether an issue should be closed automatically because
+// all of its maintenance has been removed.
+func (h *handler) shouldClose(issueNumber string) bool {
+	if h.config.Closer == nil || !(h.config.AutoClose || h.autoClose(issueNumber)) {
+		return false
+	}
+	return h.issueEntities(issueNumber) == 0
+}
+
+// closeIssue closes an issue on GitHub.
+func (h *handler) closeIssue(ctx context.Context, repo string, issue int) {
+	if repo == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, commentTimeout)
+	defer cancel()
+	slog.Info("Closing issue because all of its maintenance has been removed", "repo", repo, "issue", issue)
+	err := h.config.Closer.CloseIssue(ctx, repo, issue)
+	if err != nil {
+		slog.Error("Failed to close issue", "repo", repo, "issue", issue, "err", err)
+		metrics.CountError("closeissue", "closeIssue")
+	}
+}
+
+// reply reports notes back to the sender by commenting on the issue.
+func (h *handler) reply(ctx context.Context, repo string, issue int, notes []string) {
+	if h.config.Commenter == nil || len(notes) == 0 || repo == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, commentTimeout)
+	defer cancel()
+	err := h.config.Commenter.CreateComment(ctx, repo, issue, commentMarker+"\n"+strings.Join(notes, "\n\n"))
+	if err != nil {
+		slog.Error("Failed to comment on issue", "repo", repo, "issue", issue, "err", err)
+		metrics.CountError("comment", "reply")
+	}
+}
+
+// recordMods exports the number of modifications made by a single event, and
+// counts the event as a mass change if it exceeds the configured threshold.
+func (h *handler) recordMods(mods int) {
+	metrics.LastEventModifications.Set(float64(mods))
+	if h.config.MassChangeThreshold > 0 && mods > h.config.MassChangeThreshold {
+		slog.Warn("A single event modified many entities", "mods", mods, "threshold", h.config.MassChangeThreshold)
+		metrics.MassChangeEvents.Inc()
+	}
+}
+
+// recordMilestone records the milestone of an issue that has maintenance, if
+// milestones are enabled.
+func (h *handler) recordMilestone(issueNumber string, milestone string) {
+	m, ok := h.state.(Milestoner)
+	if !ok || !h.config.Milestones {
+		return
+	}
+	if h.issueEntities(issueNumber) == 0 && m.Milestone(issueNumber) == "" {
+		return
+	}
+	err := m.SetMilestone(issueNumber, milestone)
+	if err != nil {
+		slog.Error("Failed to record milestone", "issue", issueNumber, "err", err)
+		metrics.CountError("milestone", "recordMilestone")
+	}
+}
 
-	return mods
+// issueKey returns the key under which the maintenance of an issue is
+// recorded in the state. Issues from a named source are qualified with the
+// name of the source, so that issues with the same number from different
+// sources are kept apart.
+func (h *handler) issueKey(issue int) string {
+	if h.config.Source == "" {
+		return strconv.Itoa(issue)
+	}
+	return h.config.Source + "#" + strconv.Itoa(issue)
 }
 
 // ServeHTTP is the handler function for received webhooks. It validates the
@@ -78,88 +789,203 @@ func (h *handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	var issueNumber string
 	var mods = 0 // Number of modifications made to current state by webhook.
 	var status = http.StatusOK
+	var notes []string // Feedback to report back to the sender.
+	var before = 0     // Entities in maintenance for the issue before a message is parsed.
+	var event *Event
 
-	log.Println("INFO: Received a webhook.")
+	start := time.Now()
+	defer func() {
+		recordEvent(event, status, time.Since(start))
+	}()
 
-	payload, err := github.ValidatePayload(req, h.githubSecret)
-	if err != nil {
-		log.Printf("ERROR: Validation of Webhook failed: %s", err)
-		metrics.Error.WithLabelValues("validatehook", "receiveHook").Add(1)
-		resp.WriteHeader(http.StatusUnauthorized)
+	logger := slog.With("delivery", req.Header.Get(deliveryHeader))
+	logger.Info("Received a webhook")
+	if h.config.Tracker != nil {
+		h.config.Tracker.WebhookReceived()
+	}
+
+	secrets := h.secrets
+	if h.config.Secrets != nil {
+		secrets = h.config.Secrets()
+	}
+	event, err := parse(h.provider, req, secrets)
+	switch {
+	case errors.Is(err, ErrInvalidSignature):
+		logger.Error("Validation of webhook failed", "err", err)
+		metrics.CountError("validatehook", "receiveHook")
+		status = http.StatusUnauthorized
+		resp.WriteHeader(status)
+		return
+	case errors.Is(err, ErrUnsupportedEvent):
+		logger.Warn("Received unimplemented webhook event type")
+		event = &Event{}
+		status = http.StatusNotImplemented
+	case err != nil:
+		logger.Error("Failed to parse webhook", "err", err)
+		metrics.CountError("parsehook", "receiveHook")
+		status = http.StatusBadRequest
+		resp.WriteHeader(status)
 		return
 	}
 
-	event, err := github.ParseWebHook(github.WebHookType(req), payload)
-	if err != nil {
-		log.Printf("ERROR: Failed to parse webhook with error: %s", err)
-		metrics.Error.WithLabelValues("parsehook", "receiveHook").Add(1)
-		resp.WriteHeader(http.StatusBadRequest)
+	if (event.Type == IssueEvent || event.Type == CommentEvent) && h.degraded() {
+		// Changes could not be saved, so ask the sender to retry later.
+		logger.Warn("Refusing webhook because state writes are failing")
+		status = http.StatusServiceUnavailable
+		resp.WriteHeader(status)
 		return
 	}
 
-	switch event := event.(type) {
-	case *github.IssuesEvent:
-		log.Println("INFO: Webhook is an Issues event.")
-		issueNumber = strconv.Itoa(event.Issue.GetNumber())
-		eventAction := event.GetAction()
-		switch eventAction {
+	origin := maintenancestate.Origin{Sender: event.Sender, Delivery: req.Header.Get(deliveryHeader)}
+	switch event.Type {
+	case IssueEvent:
+		issueNumber = h.issueKey(event.Issue)
+		logger = logger.With("issue", issueNumber)
+		logger.Info("Webhook is an Issues event", "action", event.Action)
+		errorreport.Annotate(req.Context(), "issue", issueNumber)
+		switch event.Action {
 		case "closed", "deleted":
-			log.Printf("INFO: Issue #%s was %s.", issueNumber, eventAction)
-			mods = h.state.CloseIssue(issueNumber, h.project)
+			logger.Info("Issue was closed or deleted", "action", event.Action)
+			mods = h.closeFrom(issueNumber, origin)
 		case "opened", "edited":
-			mods = h.parseMessage(event.Issue.GetBody(), issueNumber)
+			before = h.issueEntities(issueNumber)
+			snapshot := h.snapshotIssue(issueNumber)
+			mods, notes = h.unflag(event.PreviousBody, event.Body, issueNumber, origin)
+			n, flagNotes := h.parseMessage(event.Body, issueNumber, origin)
+			mods += n
+			notes = append(notes, flagNotes...)
+			h.recordUndo(issueNumber, snapshot)
+			h.recordMilestone(issueNumber, event.Milestone)
+		case "reopened":
+			logger.Info("Issue was reopened; applying its flags again")
+			before = h.issueEntities(issueNumber)
+			mods, notes = h.reopen(req.Context(), event, issueNumber, origin)
+			h.recordMilestone(issueNumber, event.Milestone)
+		case "transferred":
+			mods = h.transfer(event, issueNumber, origin)
+		case "milestoned", "demilestoned":
+			h.recordMilestone(issueNumber, event.Milestone)
 		default:
-			log.Printf("INFO: Unsupported IssueEvent action: %s.", eventAction)
+			logger.Info("Unsupported IssueEvent action", "action", event.Action)
 			status = http.StatusNotImplemented
 		}
-	case *github.IssueCommentEvent:
-		log.Println("INFO: Webhook is an IssueComment event.")
-		issueNumber = strconv.Itoa(event.Issue.GetNumber())
-		issueState := event.Issue.GetState()
-		if issueState == "open" {
-			mods = h.parseMessage(event.Comment.GetBody(), issueNumber)
-		} else {
-			log.Printf("INFO: Ignoring IssueComment event on closed issue #%s.", issueNumber)
+	case CommentEvent:
+		issueNumber = h.issueKey(event.Issue)
+		logger = logger.With("issue", issueNumber)
+		logger.Info("Webhook is an IssueComment event", "action", event.Action)
+		errorreport.Annotate(req.Context(), "issue", issueNumber)
+		origin.Comment = event.Comment
+		switch {
+		case strings.Contains(event.Body, commentMarker):
+			logger.Info("Ignoring our own comment")
+		case event.State != "open":
+			logger.Info("Ignoring IssueComment event on closed issue")
 			status = http.StatusExpectationFailed
-		}
-	case *github.PingEvent:
-		log.Println("INFO: Webhook is a Ping event.")
-		var cnt = 0
-		// Since this exporter only processes "issues" and "issue_comment" Github
-		// webhook events, be sure that at least these two events are enabled for the
-		// webhook.
-		for _, v := range event.Hook.Events {
-			if v == "issues" || v == "issue_comment" {
-				cnt++
+		case event.Action == "deleted":
+			before = h.issueEntities(issueNumber)
+			origin.Cause = "deleted"
+			if r, ok := h.state.(Reverter); ok {
+				mods = r.RevertComment(issueNumber, event.Comment, h.project, origin)
+			}
+			if mods > 0 {
+				logger.Info("Removed the maintenance added by a deleted comment", "comment", event.Comment)
+				notes = append(notes, "Removed the maintenance added by a deleted comment.")
 			}
+		case approveRegExp.MatchString(event.Body):
+			mods, notes = h.approve(issueNumber, origin)
+		case cancelRegExp.MatchString(event.Body):
+			mods, notes = h.cancel(issueNumber)
+		case closeIssueRegExp.MatchString(event.Body):
+			// The pattern only matches numbers.
+			number, _ := strconv.Atoi(closeIssueRegExp.FindStringSubmatch(event.Body)[2])
+			before = h.issueEntities(issueNumber)
+			mods, notes = h.closeByNumber(number, origin)
+		case statusRegExp.MatchString(event.Body):
+			notes = h.status(issueNumber)
+		case undoRegExp.MatchString(event.Body):
+			before = h.issueEntities(issueNumber)
+			mods, notes = h.undo(issueNumber, origin)
+		default:
+			before = h.issueEntities(issueNumber)
+			snapshot := h.snapshotIssue(issueNumber)
+			if event.Action == "edited" {
+				mods, notes = h.unflag(event.PreviousBody, event.Body, issueNumber, origin)
+			}
+			n, flagNotes := h.parseMessage(event.Body, issueNumber, origin)
+			mods += n
+			notes = append(notes, flagNotes...)
+			h.recordUndo(issueNumber, snapshot)
+			h.recordMilestone(issueNumber, event.Milestone)
 		}
-		if cnt != 2 {
-			log.Printf("ERROR: Registered webhook events do not include both 'issues' and 'issue_comment'.")
+	case PingEvent:
+		logger.Info("Webhook is a Ping event")
+		if !event.PingOK {
+			logger.Error("Registered webhook events do not include both 'issues' and 'issue_comment'")
 			status = http.StatusExpectationFailed
 		}
-	default:
-		log.Println("WARNING: Received unimplemented webhook event type.")
-		status = http.StatusNotImplemented
 	}
 
+	h.recordMods(mods)
+
 	// Only write state to file if the current state was modified.
 	if mods > 0 {
 		err = h.state.Write()
 		if err != nil {
-			log.Printf("ERROR: failed to write state file: %s", err)
-			metrics.Error.WithLabelValues("writefile", "receiveHook").Add(1)
+			logger.Error("Failed to write state file", "project", h.project, "err", err)
+			metrics.CountError("writefile", "receiveHook")
 			status = http.StatusInternalServerError
 		}
 	}
 
+	// Close the issue if this message removed the last of its maintenance.
+	closeIssue := before > 0 && h.shouldClose(issueNumber)
+	if closeIssue {
+		notes = append(notes, "All maintenance for this issue has been removed, so it is being closed.")
+	}
+	h.reply(req.Context(), event.Repo, event.Issue, notes)
+	if closeIssue {
+		h.closeIssue(req.Context(), event.Repo, event.Issue)
+	}
+
+	for _, n := range h.notifiers {
+		n(event, issueNumber, mods)
+	}
+	if h.config.Tracker != nil {
+		h.config.Tracker.WebhookProcessed()
+	}
+
 	resp.WriteHeader(status)
+	for _, note := range notes {
+		fmt.Fprintln(resp, note)
+	}
+}
+
+// recordEvent updates the metrics of processed webhooks. event is nil if the
+// webhook could not be parsed.
+func recordEvent(event *Event, status int, elapsed time.Duration) {
+	eventType, action := "unknown", ""
+	if event != nil && event.Type != "" {
+		eventType, action = event.Type, event.Action
+	}
+	metrics.WebhookEvents.WithLabelValues(eventType, action, strconv.Itoa(status)).Inc()
+	metrics.WebhookDuration.WithLabelValues(eventType).Observe(elapsed.Seconds())
 }
 
 // New creates an http.Handler for receiving github webhook events to update the maintenance state.
-func New(state *maintenancestate.MaintenanceState, githubSecret []byte, project string) http.Handler {
-	return &handler{
-		state:        state,
-		githubSecret: githubSecret,
-		project:      project,
+// The githubSecret may hold several secrets, one per line, any of which is accepted.
+func New(state StateUpdater, githubSecret []byte, project string, config Config, options ...Option) http.Handler {
+	h := &handler{
+		state:   state,
+		secrets: ParseSecrets(githubSecret),
+		project: project,
+		config:  config,
+	}
+	for _, option := range options {
+		option(h)
+	}
+	h.provider = h.config.Provider
+	if h.provider == nil {
+		h.provider = GitHub{}
 	}
+	return h
 }
@@ -2,17 +2,24 @@ package handler
 
 import (
 	"context"
-	"crypto/hmac"
-	"crypto/sha1"
-	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/m-lab/github-maintenance-exporter/githubapi"
+	"github.com/m-lab/github-maintenance-exporter/gmxtest"
 	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
 	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 // Sample maintenance state as written to disk in JSON format.
@@ -44,6 +51,13 @@ type FakeCachingClient struct {
 	Sites map[string][]string
 }
 
+func (f *FakeCachingClient) CountrySites(country string) ([]string, error) {
+	if country != "US" {
+		return nil, errors.New("no sites found in country")
+	}
+	return []string{"abc01", "xyz02"}, nil
+}
+
 func (f *FakeCachingClient) Machines(site string) ([]string, error) {
 	return []string{
 		"mlab1",
@@ -57,15 +71,6 @@ func (f *FakeCachingClient) Reload(ctx context.Context) error {
 	return nil
 }
 
-// Every Github webhook contains a header field named X-Hub-Signature which
-// contains a hash of the POST body using a predefined secret. This function
-// generates that hash for testing.
-func generateSignature(secret, msg []byte) string {
-	mac := hmac.New(sha1.New, secret)
-	mac.Write(msg)
-	return "sha1=" + hex.EncodeToString(mac.Sum(nil))
-}
-
 func TestReceiveHook(t *testing.T) {
 	dir, err := os.MkdirTemp("", "TestReceiveHook")
 	rtx.Must(err, "Could not make tempfile")
@@ -139,6 +144,9 @@ func TestReceiveHook(t *testing.T) {
 						},
 						"Sites": {
 							"xyz01": ["3"]
+						},
+						"KnownMachines": {
+							"xyz01": ["mlab1", "mlab2", "mlab3", "mlab4"]
 						}
 					}
 				`,
@@ -305,8 +313,8 @@ func TestReceiveHook(t *testing.T) {
 			}
 			os.WriteFile(test.stateFile, []byte(test.initialState), 0644)
 			state, _ := maintenancestate.New(test.stateFile, cachingClient, "mlab-oti")
-			h := New(state, githubSecret, "mlab-oti")
-			sig := generateSignature(test.secretKey, []byte(test.payload))
+			h := New(state, githubSecret, "mlab-oti", Config{})
+			sig := gmxtest.Signature(test.secretKey, []byte(test.payload))
 			req, err := http.NewRequest("POST", "/webhook", strings.NewReader(string(test.payload)))
 			if err != nil {
 				t.Fatal(err)
@@ -327,10 +335,12 @@ func TestReceiveHook(t *testing.T) {
 				savedState, _ := maintenancestate.New(dir+"/expectedstate.json", cachingClient, "mlab-oti")
 				savedState.Write()
 				expectedStateBytes, _ := os.ReadFile(dir + "/expectedstate.json")
-				test.expectedState = string(expectedStateBytes)
+				test.expectedState = withoutMetadata(expectedStateBytes)
 
+				// Entries hold the times at which maintenance began, which
+				// differ on every run.
 				actualStateBytes, _ := os.ReadFile(test.stateFile)
-				actualState := string(actualStateBytes)
+				actualState := withoutMetadata(actualStateBytes)
 				if test.expectedState != actualState {
 					t.Errorf("State was not changed correctly: %s != %s", test.expectedState, actualState)
 				}
@@ -421,6 +431,41 @@ func TestParseMessage(t *testing.T) {
 			project:      `mlab-sandbox`,
 			expectedMods: 5,
 		},
+		{
+			name:         "1-switch-flag",
+			msg:          `The uplink of /switch abc01 is being replaced.`,
+			issue:        "99",
+			project:      `mlab-oti`,
+			expectedMods: 1,
+		},
+		{
+			name:         "1-country-flag",
+			msg:          `All sites in /country us are in maintenance.`,
+			issue:        "99",
+			project:      `mlab-oti`,
+			expectedMods: 10,
+		},
+		{
+			name:         "unknown-country-flag",
+			msg:          `All sites in /country FR are in maintenance.`,
+			issue:        "99",
+			project:      `mlab-oti`,
+			expectedMods: 0,
+		},
+		{
+			name:         "1-experiment-flag",
+			msg:          `Drain /experiment ndt mlab1.abc01 for a redeploy.`,
+			issue:        "99",
+			project:      `mlab-oti`,
+			expectedMods: 1,
+		},
+		{
+			name:         "1-experiment-flag-del",
+			msg:          `Restore /experiment ndt mlab1.abc01 del.`,
+			issue:        "99",
+			project:      `mlab-oti`,
+			expectedMods: 0,
+		},
 	}
 
 	for _, test := range tests {
@@ -432,7 +477,7 @@ func TestParseMessage(t *testing.T) {
 				state:   s,
 				project: test.project,
 			}
-			mods := h.parseMessage(test.msg, test.issue)
+			mods, _ := h.parseMessage(test.msg, test.issue, maintenancestate.Origin{})
 			if mods != test.expectedMods {
 				h.state.Write()
 				newstate, _ := os.ReadFile(dir + "/" + test.name)
@@ -442,3 +487,668 @@ func TestParseMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestRejectedFlags(t *testing.T) {
+	s, _ := maintenancestate.New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+	h := handler{state: s, project: "mlab-oti"}
+	mods, notes := h.parseMessage("Add /machine and /site vw02 and /machine mlab4.abc01 and /country FR.\n/site abc01\n"+
+		"/machine mlab1.xyz01 until 2024-02-30\n/country US for 99999999999 weeks", "99", maintenancestate.Origin{})
+	if mods != 5 {
+		t.Errorf("parseMessage() = %d mods; want 5", mods)
+	}
+	want := []string{
+		"Ignored a machine flag that is not followed by a valid name.",
+		"Ignored the site flag for vw02: it is not a valid name for a site in mlab-oti.",
+		"Ignored the machine flag for mlab4-abc01: it is not a valid name for a machine in mlab-oti.",
+		"Ignored the country flag for FR: no sites found in country.",
+		`Ignored the machine flag for mlab1-xyz01: "2024-02-30" is not a valid date or time.`,
+		"Ignored the country flag for US: 99999999999 weeks is too long a duration.",
+	}
+	if !reflect.DeepEqual(notes, want) {
+		t.Errorf("parseMessage() notes = %q; want %q", notes, want)
+	}
+	// The notes themselves must never be mistaken for flags.
+	if changes, rejected := h.parseFlags(strings.Join(notes, "\n")); len(changes) != 0 || len(rejected) != 0 {
+		t.Errorf("notes were parsed as flags: %v %v", changes, rejected)
+	}
+}
+
+func TestRecordMods(t *testing.T) {
+	h := handler{config: Config{MassChangeThreshold: 10}}
+	before := testutil.ToFloat64(metrics.MassChangeEvents)
+
+	h.recordMods(10)
+	if testutil.ToFloat64(metrics.MassChangeEvents) != before {
+		t.Error("An event at the threshold should not be counted as a mass change")
+	}
+	if testutil.ToFloat64(metrics.LastEventModifications) != 10 {
+		t.Errorf("Expected last event modifications of 10, got %f", testutil.ToFloat64(metrics.LastEventModifications))
+	}
+
+	h.recordMods(11)
+	if testutil.ToFloat64(metrics.MassChangeEvents) != before+1 {
+		t.Error("An event above the threshold should be counted as a mass change")
+	}
+
+	h.config.MassChangeThreshold = 0
+	h.recordMods(1000)
+	if testutil.ToFloat64(metrics.MassChangeEvents) != before+1 {
+		t.Error("A zero threshold should disable the mass change check")
+	}
+}
+
+func TestRecordEvent(t *testing.T) {
+	issues := metrics.WebhookEvents.WithLabelValues(IssueEvent, "opened", "200")
+	unknown := metrics.WebhookEvents.WithLabelValues("unknown", "", "401")
+	beforeIssues, beforeUnknown := testutil.ToFloat64(issues), testutil.ToFloat64(unknown)
+
+	recordEvent(&Event{Type: IssueEvent, Action: "opened"}, http.StatusOK, time.Second)
+	recordEvent(nil, http.StatusUnauthorized, time.Millisecond)
+	if testutil.ToFloat64(issues) != beforeIssues+1 {
+		t.Error("An opened issue event should be counted")
+	}
+	if testutil.ToFloat64(unknown) != beforeUnknown+1 {
+		t.Error("An unparsed event should be counted as unknown")
+	}
+	if n := testutil.CollectAndCount(metrics.WebhookDuration); n < 2 {
+		t.Errorf("Expected durations for at least 2 event types; got %d", n)
+	}
+}
+
+func TestParseMessageMaxFlags(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestParseMessageMaxFlags")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	s, _ := maintenancestate.New(dir+"/state.json", cachingClient, "mlab-oti")
+	h := handler{
+		state:   s,
+		project: "mlab-oti",
+		config:  Config{MaxFlags: 2},
+	}
+	msg := `/machine mlab1.abc01 /site xyz01 /machine mlab2.abc01 /machine mlab3.abc01`
+	mods, notes := h.parseMessage(msg, "1", maintenancestate.Origin{})
+	if mods != 6 {
+		t.Errorf("parseMessage(): expected 6 modifications; got %d", mods)
+	}
+	if len(notes) != 1 || !strings.Contains(notes[0], "machine mlab2-abc01, machine mlab3-abc01") {
+		t.Errorf("parseMessage(): expected a note listing the ignored flags; got %q", notes)
+	}
+}
+
+// fakeCommenter records the comments and closed issues that would have been
+// sent to GitHub.
+type fakeCommenter struct {
+	comments []string
+	closed   []int
+}
+
+func (f *fakeCommenter) CreateComment(ctx context.Context, repo string, issue int, body string) error {
+	f.comments = append(f.comments, body)
+	return nil
+}
+
+func (f *fakeCommenter) CloseIssue(ctx context.Context, repo string, issue int) error {
+	f.closed = append(f.closed, issue)
+	return nil
+}
+
+// fakeComments lists the comments of every issue.
+type fakeComments struct {
+	comments []githubapi.Comment
+	err      error
+}
+
+func (f *fakeComments) ListComments(ctx context.Context, repo string, issue int) ([]githubapi.Comment, error) {
+	return f.comments, f.err
+}
+
+func TestReopened(t *testing.T) {
+	secret := []byte("goodsecret")
+	s, _ := maintenancestate.New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+	comments := &fakeComments{comments: []githubapi.Comment{
+		{ID: 1, User: "ops", Body: "/machine mlab2-abc01 del"},
+		{ID: 2, User: "ops", Body: "/machine mlab3-abc01"},
+		{ID: 3, User: "gmx", Body: commentMarker + "\n/machine mlab1-abc02"},
+		{ID: 4, User: "boss", Body: "/approve /machine mlab2-abc02"},
+	}}
+	h := New(s, secret, "mlab-oti", Config{Comments: comments})
+	issue := gmxtest.Issue{Repo: "m-lab/ops-tracker", Number: 7, Body: "/machine mlab1-abc01 /machine mlab2-abc01"}
+
+	sendHook(h, secret, "issues", gmxtest.IssuePayload("closed", issue))
+	if rec := sendHook(h, secret, "issues", gmxtest.IssuePayload("reopened", issue)); rec.Code != http.StatusOK {
+		t.Fatalf("reopened returned status %d", rec.Code)
+	}
+	// The comments are applied after the body, in order.
+	want := []string{"mlab1-abc01", "mlab3-abc01"}
+	if got := s.IssueEntityNames("7"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("entities of a reopened issue = %v; want %v", got, want)
+	}
+
+	// Without its comments, only the body is applied again.
+	sendHook(h, secret, "issues", gmxtest.IssuePayload("closed", issue))
+	comments.err = errors.New("unavailable")
+	rec := sendHook(h, secret, "issues", gmxtest.IssuePayload("reopened", issue))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "could not be applied again") {
+		t.Errorf("reopened without comments = %d %q; want 200 and a note", rec.Code, rec.Body.String())
+	}
+	if n := s.IssueEntities("7"); n != 2 {
+		t.Errorf("reopened issue without comments has %d entities; want 2", n)
+	}
+}
+
+func TestEditedFlags(t *testing.T) {
+	secret := []byte("goodsecret")
+	s, _ := maintenancestate.New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+	h := New(s, secret, "mlab-oti", Config{})
+	issue := gmxtest.Issue{Number: 8, Body: "/machine mlab1-abc01 /machine mlab2-abc01"}
+	sendHook(h, secret, "issues", gmxtest.IssuePayload("opened", issue))
+	sendHook(h, secret, "issue_comment", gmxtest.CommentPayload(issue, "ops", "/machine mlab3-abc01"))
+
+	// Deleting a flag from the issue removes its maintenance.
+	previous := issue.Body
+	issue.Body = "/machine mlab2-abc01 /machine mlab3-xyz02"
+	rec := sendHook(h, secret, "issues", gmxtest.IssueEditPayload(issue, previous))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "machine mlab1-abc01") {
+		t.Errorf("edited issue = %d %q; want 200 and a note", rec.Code, rec.Body.String())
+	}
+	want := []string{"mlab2-abc01", "mlab3-abc01", "mlab3-xyz02"}
+	if got := s.IssueEntityNames("8"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("entities after editing the issue = %v; want %v", got, want)
+	}
+
+	// So does deleting it from a comment.
+	sendHook(h, secret, "issue_comment", gmxtest.CommentEditPayload(issue, "ops", "/machine mlab3-abc01", "Never mind."))
+	want = []string{"mlab2-abc01", "mlab3-xyz02"}
+	if got := s.IssueEntityNames("8"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("entities after editing the comment = %v; want %v", got, want)
+	}
+
+	// Edits that do not change the body keep every flag.
+	sendHook(h, secret, "issues", gmxtest.IssuePayload("edited", issue))
+	if got := s.IssueEntityNames("8"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("entities after editing the title = %v; want %v", got, want)
+	}
+}
+
+func TestDeletedComment(t *testing.T) {
+	secret := []byte("goodsecret")
+	s, _ := maintenancestate.New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+	h := New(s, secret, "mlab-oti", Config{})
+	issue := gmxtest.Issue{Number: 9, Body: "/machine mlab1-abc01"}
+	sendHook(h, secret, "issues", gmxtest.IssuePayload("opened", issue))
+	sendHook(h, secret, "issue_comment", gmxtest.CommentIDPayload("created", issue, 11, "ops", "/machine mlab1-abc01 /machine mlab2-abc01"))
+	sendHook(h, secret, "issue_comment", gmxtest.CommentIDPayload("created", issue, 12, "ops", "/machine mlab3-abc01"))
+
+	// Deleting a comment removes only the maintenance that it added.
+	rec := sendHook(h, secret, "issue_comment", gmxtest.CommentIDPayload("deleted", issue, 11, "ops", "/machine mlab1-abc01 /machine mlab2-abc01"))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "deleted comment") {
+		t.Errorf("deleted comment = %d %q; want 200 and a note", rec.Code, rec.Body.String())
+	}
+	want := []string{"mlab1-abc01", "mlab3-abc01"}
+	if got := s.IssueEntityNames("9"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("entities after deleting a comment = %v; want %v", got, want)
+	}
+}
+
+func TestTransferred(t *testing.T) {
+	secret := []byte("goodsecret")
+	s, _ := maintenancestate.New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+	keys := func(project string, repo string, issue int) (string, bool) {
+		return repo + "#" + strconv.Itoa(issue), repo == "m-lab/ops"
+	}
+	h := New(s, secret, "mlab-oti", Config{Transfer: TransferCarry, TransferKey: keys})
+	issue := gmxtest.Issue{Repo: "m-lab/ops-tracker", Number: 10, Body: "/machine mlab1-abc01 /machine mlab2-xyz02"}
+	sendHook(h, secret, "issues", gmxtest.IssuePayload("opened", issue))
+
+	// The maintenance follows the issue to a known repository.
+	if rec := sendHook(h, secret, "issues", gmxtest.TransferPayload(issue, "m-lab/ops", 3)); rec.Code != http.StatusOK {
+		t.Fatalf("transferred returned status %d", rec.Code)
+	}
+	if n := s.IssueEntities("10"); n != 0 {
+		t.Errorf("transferred issue still has %d entities", n)
+	}
+	want := []string{"mlab1-abc01", "mlab2-xyz02"}
+	if got := s.IssueEntityNames("m-lab/ops#3"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("entities of the new issue = %v; want %v", got, want)
+	}
+
+	// It is removed when the issue is transferred elsewhere.
+	issue.Number = 11
+	sendHook(h, secret, "issues", gmxtest.IssuePayload("opened", issue))
+	sendHook(h, secret, "issues", gmxtest.TransferPayload(issue, "m-lab/elsewhere", 1))
+	if n := s.IssueEntities("11") + s.IssueEntities("m-lab/elsewhere#1"); n != 0 {
+		t.Errorf("issue transferred to an unknown repository left %d entities", n)
+	}
+}
+
+func TestUndo(t *testing.T) {
+	secret := []byte("goodsecret")
+	s, _ := maintenancestate.New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+	h := New(s, secret, "mlab-oti", Config{})
+	issue := gmxtest.Issue{Number: 12, Body: "/machine mlab1-abc01"}
+	sendHook(h, secret, "issues", gmxtest.IssuePayload("opened", issue))
+	sendHook(h, secret, "issue_comment", gmxtest.CommentPayload(issue, "ops", "/machine mlab1-abc01 del /machine mlab2-abc01 /machine mlab3-abc01 in 1h"))
+	sendHook(h, secret, "issue_comment", gmxtest.CommentPayload(issue, "ops", "Thanks!"))
+
+	// The last comment that changed the issue is reverted, including what it
+	// scheduled.
+	rec := sendHook(h, secret, "issue_comment", gmxtest.CommentPayload(issue, "ops", "/undo"))
+	if !strings.Contains(rec.Body.String(), "Undid") {
+		t.Errorf("/undo = %q; want a note", rec.Body.String())
+	}
+	if got := s.IssueEntityNames("12"); fmt.Sprint(got) != "[mlab1-abc01]" {
+		t.Errorf("entities after /undo = %v; want [mlab1-abc01]", got)
+	}
+	if got := s.Scheduled(); len(got) != 0 {
+		t.Errorf("Scheduled() after /undo = %+v; want none", got)
+	}
+
+	rec = sendHook(h, secret, "issue_comment", gmxtest.CommentPayload(issue, "ops", "/undo"))
+	if !strings.Contains(rec.Body.String(), "no changes to undo") {
+		t.Errorf("second /undo = %q; want nothing to undo", rec.Body.String())
+	}
+}
+
+func TestUndoChecks(t *testing.T) {
+	secret := []byte("goodsecret")
+	s, _ := maintenancestate.New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+	h := New(s, secret, "mlab-oti", Config{})
+	issue := gmxtest.Issue{Number: 12, Body: "/site abc01"}
+	sendHook(h, secret, "issues", gmxtest.IssuePayload("opened", issue))
+	sendHook(h, secret, "issue_comment", gmxtest.CommentPayload(issue, "ops", "/site abc01 del"))
+
+	start := time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+	now := start.Add(time.Hour)
+	config := Config{
+		ApprovalThreshold: 2,
+		Blackouts:         Windows{{Start: start, End: start.Add(2 * time.Hour)}},
+	}
+	h = New(s, secret, "mlab-oti", config, WithClock(func() time.Time { return now }))
+
+	// Undoing is refused during a blackout, and may be tried again later.
+	rec := sendHook(h, secret, "issue_comment", gmxtest.CommentPayload(issue, "ops", "/undo"))
+	if !strings.Contains(rec.Body.String(), "Refused to undo") || s.IssueEntities("12") != 0 {
+		t.Errorf("/undo during a blackout = %q with %d entities; want a refusal", rec.Body.String(), s.IssueEntities("12"))
+	}
+
+	// Undoing that affects more than the approval threshold is proposed.
+	now = start.Add(3 * time.Hour)
+	rec = sendHook(h, secret, "issue_comment", gmxtest.CommentPayload(issue, "ops", "/undo"))
+	if !strings.Contains(rec.Body.String(), "approval threshold") || s.IssueEntities("12") != 0 {
+		t.Errorf("/undo of a site = %q with %d entities; want a proposal", rec.Body.String(), s.IssueEntities("12"))
+	}
+	changes, ok := s.TakeProposal("12")
+	if !ok || len(changes) != 5 || changes[0].Name != "abc01" || changes[0].Cause != "undo" {
+		t.Errorf("TakeProposal() = %+v, %v; want site abc01 and its machines to be undone", changes, ok)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	secret := []byte("goodsecret")
+	s, _ := maintenancestate.New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+	commenter := &fakeCommenter{}
+	h := New(s, secret, "mlab-oti", Config{Commenter: commenter})
+	issue := gmxtest.Issue{Repo: "m-lab/ops-tracker", Number: 13}
+
+	rec := sendHook(h, secret, "issue_comment", gmxtest.CommentPayload(issue, "ops", "/status"))
+	if !strings.Contains(rec.Body.String(), "Nothing is in maintenance") {
+		t.Errorf("/status of an issue without maintenance = %q", rec.Body.String())
+	}
+
+	sendHook(h, secret, "issue_comment", gmxtest.CommentPayload(issue, "ops", "/machine mlab1-abc01 /machine mlab2-abc01 in 1h"))
+	rec = sendHook(h, secret, "issue_comment", gmxtest.CommentPayload(issue, "ops", "/status"))
+	for _, want := range []string{"1 machines and sites", "* machine mlab1-abc01", "put machine mlab2-abc01 into maintenance at"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("/status = %q; want it to contain %q", rec.Body.String(), want)
+		}
+	}
+	if n := s.IssueEntities("13"); n != 2 {
+		t.Errorf("/status changed the maintenance of the issue to %d entities", n)
+	}
+	if last := commenter.comments[len(commenter.comments)-1]; !strings.Contains(last, "* machine mlab1-abc01") {
+		t.Errorf("last comment = %q; want the reply to /status", last)
+	}
+}
+
+func TestCloseIssueCommand(t *testing.T) {
+	secret := []byte("goodsecret")
+	s, _ := maintenancestate.New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+	h := New(s, secret, "mlab-oti", Config{Approvers: []string{"boss"}})
+	s.UpdateMachine("mlab1-abc01", maintenancestate.EnterMaintenance, "14", "mlab-oti")
+	issue := gmxtest.Issue{Number: 15}
+
+	rec := sendHook(h, secret, "issue_comment", gmxtest.CommentPayload(issue, "ops", "/close-issue 14"))
+	if !strings.Contains(rec.Body.String(), "not authorized") || s.IssueEntities("14") != 1 {
+		t.Errorf("/close-issue by an unauthorized user = %q", rec.Body.String())
+	}
+	rec = sendHook(h, secret, "issue_comment", gmxtest.CommentPayload(issue, "boss", "/close-issue #14"))
+	if !strings.Contains(rec.Body.String(), "Removed all maintenance for issue 14") {
+		t.Errorf("/close-issue = %q; want a note", rec.Body.String())
+	}
+	if n := s.IssueEntities("14"); n != 0 {
+		t.Errorf("issue 14 still has %d entities", n)
+	}
+}
+
+// sendHook signs and delivers a webhook payload to h, returning the recorder.
+func sendHook(h http.Handler, secret []byte, eventType, payload string) *httptest.ResponseRecorder {
+	return gmxtest.Send(h, secret, eventType, payload)
+}
+
+// withoutMetadata returns a serialized state without its Entries and the
+// changes to undo.
+func withoutMetadata(data []byte) string {
+	var saved map[string]json.RawMessage
+	json.Unmarshal(data, &saved)
+	delete(saved, "Entries")
+	delete(saved, "Undo")
+	b, _ := json.Marshal(saved)
+	return string(b)
+}
+
+// savedMachines returns the machines in the state file written to disk.
+func savedMachines(filename string) map[string][]string {
+	var saved struct{ Machines map[string][]string }
+	b, _ := os.ReadFile(filename)
+	json.Unmarshal(b, &saved)
+	return saved.Machines
+}
+
+func TestApproval(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestApproval")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	secret := []byte("goodsecret")
+	commenter := &fakeCommenter{}
+	s, _ := maintenancestate.New(dir+"/state.json", cachingClient, "mlab-oti")
+	h := New(s, secret, "mlab-oti", Config{
+		ApprovalThreshold: 4,
+		Approvers:         []string{"boss"},
+		Commenter:         commenter,
+	})
+	comment := func(sender, body string) string {
+		return `{
+			"action": "created",
+			"issue": {"number": 7, "state": "open"},
+			"repository": {"full_name": "m-lab/ops-tracker"},
+			"sender": {"login": "` + sender + `"},
+			"comment": {"body": "` + body + `"}
+		}`
+	}
+
+	// A site has 5 entities, so it requires approval.
+	rec := sendHook(h, secret, "issue_comment", comment("ops", "/site abc01"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Wrong status for proposal: %d", rec.Code)
+	}
+	if _, ok := savedMachines(dir + "/state.json")["mlab1-abc01"]; ok {
+		t.Error("Changes requiring approval should not have been applied")
+	}
+	if len(commenter.comments) != 1 || !strings.Contains(commenter.comments[0], "put site abc01 into maintenance") {
+		t.Errorf("Expected a comment listing the proposed changes; got %q", commenter.comments)
+	}
+
+	// Our own comments are ignored.
+	sendHook(h, secret, "issue_comment", comment("gmx", commentMarker+" /site abc01"))
+	if len(commenter.comments) != 1 {
+		t.Errorf("Our own comment should have been ignored; got %q", commenter.comments)
+	}
+
+	// Only authorized users may approve.
+	sendHook(h, secret, "issue_comment", comment("ops", "/approve"))
+	if _, ok := savedMachines(dir + "/state.json")["mlab1-abc01"]; ok {
+		t.Error("An unauthorized approval should not have applied the changes")
+	}
+
+	// Approvals during a blackout are refused, but keep the proposal.
+	h.(*handler).config.Blackouts = Windows{{Start: time.Now().Add(-time.Hour), End: time.Now().Add(time.Hour)}}
+	rec = sendHook(h, secret, "issue_comment", comment("boss", "/approve"))
+	if _, ok := savedMachines(dir + "/state.json")["mlab1-abc01"]; ok || !strings.Contains(rec.Body.String(), "Refused to approve") {
+		t.Errorf("An approval during a blackout should have been refused; got %q", rec.Body.String())
+	}
+	h.(*handler).config.Blackouts = nil
+
+	sendHook(h, secret, "issue_comment", comment("boss", "/approve"))
+	if _, ok := savedMachines(dir + "/state.json")["mlab1-abc01"]; !ok {
+		t.Error("An authorized approval should have applied the changes")
+	}
+
+	rec = sendHook(h, secret, "issue_comment", comment("boss", "/approve"))
+	if !strings.Contains(rec.Body.String(), "no pending changes") {
+		t.Errorf("A second approval should report that nothing is pending; got %q", rec.Body.String())
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestGracePeriod")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	s, _ := maintenancestate.New(dir+"/state.json", cachingClient, "mlab-oti")
+	h := handler{
+		state:   s,
+		project: "mlab-oti",
+		config:  Config{GracePeriod: time.Hour},
+	}
+
+	mods, notes := h.parseMessage("/site abc01 in 30m and /machine mlab1.xyz01 and /machine mlab2.xyz01 del", "1", maintenancestate.Origin{})
+	if mods != 1 {
+		t.Errorf("parseMessage(): expected 1 modification; got %d", mods)
+	}
+	if len(notes) != 2 {
+		t.Errorf("parseMessage(): expected 2 notes about scheduled changes; got %q", notes)
+	}
+	scheduled := s.Scheduled()
+	if len(scheduled) != 2 || scheduled[0].Name != "abc01" || scheduled[1].Name != "mlab1-xyz01" {
+		t.Fatalf("Expected abc01 and mlab1-xyz01 to be scheduled; got %+v", scheduled)
+	}
+	if d := time.Until(scheduled[0].At); d > 30*time.Minute || d < 29*time.Minute {
+		t.Errorf("abc01 should be scheduled in 30 minutes; got %s", d)
+	}
+
+	// Removing a machine cancels its scheduled maintenance.
+	h.parseMessage("/machine mlab1.xyz01 del", "1", maintenancestate.Origin{})
+	if len(s.Scheduled()) != 1 {
+		t.Errorf("Expected one scheduled change to remain; got %+v", s.Scheduled())
+	}
+
+	mods, _ = h.cancel("1")
+	if mods != 1 || len(s.Scheduled()) != 0 {
+		t.Errorf("cancel() should have canceled the remaining change; got %d, %+v", mods, s.Scheduled())
+	}
+	if _, notes := h.cancel("1"); len(notes) != 1 || !strings.Contains(notes[0], "no scheduled changes") {
+		t.Errorf("cancel() should report there is nothing to cancel; got %q", notes)
+	}
+}
+
+func TestDefaultTTL(t *testing.T) {
+	s, _ := maintenancestate.New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+	h := handler{
+		state:   s,
+		project: "mlab-oti",
+		config:  Config{DefaultTTL: time.Hour},
+	}
+
+	h.parseMessage("/machine mlab1.xyz01 and /machine mlab2.xyz01 ttl=3h", "1", maintenancestate.Origin{})
+	if mods := s.ExpireEntries(time.Now().Add(2*time.Hour), "mlab-oti"); mods != 1 {
+		t.Errorf("ExpireEntries() = %d; want only the machine without a ttl to expire", mods)
+	}
+	if got := s.Snapshot().Machines; len(got) != 1 || got["mlab2-xyz01"] == nil {
+		t.Errorf("machines in maintenance = %v; want only mlab2-xyz01", got)
+	}
+}
+
+func TestBlackout(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestBlackout")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	s, _ := maintenancestate.New(dir+"/state.json", cachingClient, "mlab-oti")
+	now := time.Now()
+	h := handler{
+		state:   s,
+		project: "mlab-oti",
+		config:  Config{Blackouts: Windows{{Start: now.Add(-time.Hour), End: now.Add(time.Hour)}}},
+	}
+	before := testutil.ToFloat64(metrics.BlackoutRefusals)
+
+	mods, notes := h.parseMessage("/machine mlab1.abc01 and /machine mlab2.abc01 in 5m override", "1", maintenancestate.Origin{})
+	if mods != 0 {
+		t.Errorf("parseMessage(): expected no modifications during a blackout; got %d", mods)
+	}
+	if len(notes) != 2 || !strings.Contains(notes[0], "Refused to put machine mlab1-abc01 into maintenance") {
+		t.Errorf("parseMessage(): expected a refusal and a scheduled change; got %q", notes)
+	}
+	if len(s.Scheduled()) != 1 {
+		t.Errorf("The overridden change should have been scheduled; got %+v", s.Scheduled())
+	}
+	if testutil.ToFloat64(metrics.BlackoutRefusals) != before+1 {
+		t.Error("The refusal should have been counted")
+	}
+
+	h.config.Blackouts = Windows{{Start: now.Add(time.Hour), End: now.Add(2 * time.Hour)}}
+	if mods, _ := h.parseMessage("/machine mlab1.abc01", "1", maintenancestate.Origin{}); mods != 1 {
+		t.Errorf("parseMessage(): expected 1 modification outside of a blackout; got %d", mods)
+	}
+}
+
+func TestAutoClose(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestAutoClose")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	secret := []byte("goodsecret")
+	github := &fakeCommenter{}
+	s, _ := maintenancestate.New(dir+"/state.json", cachingClient, "mlab-oti")
+	h := New(s, secret, "mlab-oti", Config{Commenter: github, Closer: github})
+	comment := func(issue, body string) string {
+		return `{
+			"action": "created",
+			"issue": {"number": ` + issue + `, "state": "open"},
+			"repository": {"full_name": "m-lab/ops-tracker"},
+			"comment": {"body": "` + body + `"}
+		}`
+	}
+
+	sendHook(h, secret, "issue_comment", comment("1", "/site abc01 and /machine mlab1.xyz01 /autoclose"))
+	sendHook(h, secret, "issue_comment", comment("2", "/machine mlab2.xyz01"))
+
+	sendHook(h, secret, "issue_comment", comment("1", "/site abc01 del"))
+	if len(github.closed) != 0 {
+		t.Errorf("Issue 1 should not be closed while mlab1-xyz01 is in maintenance; closed %v", github.closed)
+	}
+	sendHook(h, secret, "issue_comment", comment("2", "/machine mlab2.xyz01 del"))
+	if len(github.closed) != 0 {
+		t.Errorf("Issue 2 did not opt in to being closed; closed %v", github.closed)
+	}
+	sendHook(h, secret, "issue_comment", comment("1", "/machine mlab1.xyz01 del"))
+	if !reflect.DeepEqual(github.closed, []int{1}) {
+		t.Errorf("Issue 1 should have been closed; closed %v", github.closed)
+	}
+}
+
+type fakeTracker struct {
+	received, processed int
+}
+
+func (f *fakeTracker) WebhookReceived()  { f.received++ }
+func (f *fakeTracker) WebhookProcessed() { f.processed++ }
+
+func TestTracker(t *testing.T) {
+	dir := t.TempDir()
+	secret := []byte("goodsecret")
+	tracker := &fakeTracker{}
+	s, _ := maintenancestate.New(dir+"/state.json", cachingClient, "mlab-oti")
+	h := New(s, secret, "mlab-oti", Config{Tracker: tracker})
+
+	payload := `{"action": "opened", "issue": {"number": 1, "body": "/machine mlab1.xyz01"}}`
+	sendHook(h, secret, "issues", payload)
+	// A webhook that fails validation is received but not processed.
+	sendHook(h, []byte("badsecret"), "issues", payload)
+	if tracker.received != 2 || tracker.processed != 1 {
+		t.Errorf("tracker received %d and processed %d webhooks; want 2 and 1", tracker.received, tracker.processed)
+	}
+}
+
+func TestSources(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := maintenancestate.New(dir+"/state.json", cachingClient, "mlab-oti")
+	github := New(s, []byte("githubsecret"), "mlab-oti", Config{})
+	gitlab := New(s, []byte("gitlabsecret"), "mlab-oti", Config{Provider: GitLab{}, Source: "lab"})
+
+	sendHook(github, []byte("githubsecret"), "issues", `{"action": "opened", "issue": {"number": 1, "body": "/machine mlab1.xyz01"}}`)
+
+	req := httptest.NewRequest("POST", "/webhook/lab", strings.NewReader(`{
+		"object_attributes": {"iid": 1, "action": "open", "state": "opened", "description": "/machine mlab1.xyz01"}
+	}`))
+	req.Header.Set("X-Gitlab-Event", "Issue Hook")
+	req.Header.Set("X-Gitlab-Token", "gitlabsecret")
+	rec := httptest.NewRecorder()
+	gitlab.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GitLab webhook returned status %d", rec.Code)
+	}
+
+	want := map[string][]string{"mlab1-xyz01": {"1", "lab#1"}}
+	if got := savedMachines(dir + "/state.json"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Machines = %v; want %v", got, want)
+	}
+
+	// Closing the GitHub issue must leave the GitLab issue alone.
+	sendHook(github, []byte("githubsecret"), "issues", `{"action": "closed", "issue": {"number": 1}}`)
+	want = map[string][]string{"mlab1-xyz01": {"lab#1"}}
+	if got := savedMachines(dir + "/state.json"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Machines = %v; want %v", got, want)
+	}
+}
+
+func TestDegraded(t *testing.T) {
+	dir := t.TempDir()
+	secret := []byte("goodsecret")
+	// Writes fail since the directory of the state file does not exist.
+	s, _ := maintenancestate.New(dir+"/missing/state.json", cachingClient, "mlab-oti")
+	s.SetDegradedThreshold(1)
+	h := New(s, secret, "mlab-oti", Config{})
+
+	payload := `{"action": "opened", "issue": {"number": 1, "body": "/machine mlab1.xyz01"}}`
+	if rec := sendHook(h, secret, "issues", payload); rec.Code != http.StatusInternalServerError {
+		t.Errorf("first webhook returned status %d; want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if rec := sendHook(h, secret, "issues", payload); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("webhook while degraded returned status %d; want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	ping := `{"hook": {"events": ["issues", "issue_comment"]}}`
+	if rec := sendHook(h, secret, "ping", ping); rec.Code != http.StatusOK {
+		t.Errorf("ping while degraded returned status %d; want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestMilestones(t *testing.T) {
+	dir := t.TempDir()
+	secret := []byte("goodsecret")
+	s, _ := maintenancestate.New(dir+"/state.json", cachingClient, "mlab-oti")
+	h := New(s, secret, "mlab-oti", Config{Milestones: true})
+
+	issue := func(number, action, milestone string) string {
+		return `{"action": "` + action + `", "issue": {"number": ` + number + `, "body": "/machine mlab1.xyz01",
+			"milestone": {"title": "` + milestone + `"}}}`
+	}
+	sendHook(h, secret, "issues", issue("1", "opened", "Kernel upgrade"))
+	if got := s.Milestone("1"); got != "Kernel upgrade" {
+		t.Errorf("Milestone(1) = %q; want %q", got, "Kernel upgrade")
+	}
+	if rec := sendHook(h, secret, "issues", issue("1", "demilestoned", "")); rec.Code != http.StatusOK {
+		t.Errorf("demilestoned webhook returned status %d", rec.Code)
+	}
+	if got := s.Milestone("1"); got != "" {
+		t.Errorf("Milestone(1) = %q; want none", got)
+	}
+
+	// Issues without maintenance are not recorded.
+	sendHook(h, secret, "issues", `{"action": "milestoned", "issue": {"number": 2, "milestone": {"title": "Kernel upgrade"}}}`)
+	if got := s.Milestone("2"); got != "" {
+		t.Errorf("Milestone(2) = %q; want none", got)
+	}
+}
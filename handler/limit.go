@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+// Limiter refuses webhooks that arrive faster than a configured rate or that
+// are larger than a configured size, so that a misconfigured or malicious
+// sender can neither keep the exporter busy nor exhaust its memory.
+type Limiter struct {
+	rate     float64
+	burst    float64
+	maxBytes int64
+	now      func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates a Limiter that allows rate webhooks per second on
+// average, in bursts of up to burst, each of at most maxBytes. A rate or
+// maxBytes of zero or less disables that limit.
+func NewLimiter(rate float64, burst int, maxBytes int64) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:     rate,
+		burst:    float64(burst),
+		maxBytes: maxBytes,
+		now:      time.Now,
+		tokens:   float64(burst),
+	}
+}
+
+// take reports whether a webhook may be processed now, and if not, how long
+// to wait until it may.
+func (l *Limiter) take() (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// Wrap returns a handler that passes requests to h unless they exceed the
+// rate, which is answered with 429 Too Many Requests, or the size, which is
+// answered with 413 Request Entity Too Large.
+func (l *Limiter) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if ok, wait := l.take(); !ok {
+			slog.Warn("Refusing webhook: rate limit exceeded", "remote", req.RemoteAddr)
+			metrics.CountError("ratelimit", "handler.Limiter")
+			resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			resp.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if l.maxBytes > 0 {
+			if req.ContentLength > l.maxBytes {
+				l.tooLarge(resp, req)
+				return
+			}
+			// The Content-Length may be missing, so the body itself must be
+			// checked too.
+			body, err := io.ReadAll(io.LimitReader(req.Body, l.maxBytes+1))
+			if err != nil {
+				slog.Error("Failed to read webhook body", "remote", req.RemoteAddr, "err", err)
+				metrics.CountError("readbody", "handler.Limiter")
+				resp.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if int64(len(body)) > l.maxBytes {
+				l.tooLarge(resp, req)
+				return
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		h.ServeHTTP(resp, req)
+	})
+}
+
+// tooLarge refuses a webhook whose body is larger than the limit.
+func (l *Limiter) tooLarge(resp http.ResponseWriter, req *http.Request) {
+	slog.Warn("Refusing webhook: body is too large", "remote", req.RemoteAddr, "max_bytes", l.maxBytes)
+	metrics.CountError("toolarge", "handler.Limiter")
+	resp.WriteHeader(http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewLimiter(1, 2, 10)
+	l.now = func() time.Time { return now }
+	var got string
+	h := l.Wrap(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		got = string(body)
+	}))
+	send := func(body string, contentLength int64) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+		req.ContentLength = contentLength
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The burst is allowed, and the next webhook must wait a second.
+	for i := 0; i < 2; i++ {
+		if rec := send("{}", 2); rec.Code != http.StatusOK || got != "{}" {
+			t.Errorf("webhook %d returned status %d and body %q", i, rec.Code, got)
+		}
+	}
+	rec := send("{}", 2)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("webhook over the rate returned status %d and Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	now = now.Add(time.Second)
+	if rec := send("{}", 2); rec.Code != http.StatusOK {
+		t.Errorf("webhook after waiting returned status %d", rec.Code)
+	}
+
+	// Bodies over the limit are refused whether or not their length is
+	// declared. Refused webhooks still count towards the rate.
+	now = now.Add(time.Hour)
+	if rec := send("0123456789a", 11); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large webhook returned status %d; want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	if rec := send("0123456789a", -1); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large webhook of unknown length returned status %d; want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	now = now.Add(time.Hour)
+	if rec := send("0123456789", -1); rec.Code != http.StatusOK || got != "0123456789" {
+		t.Errorf("webhook at the limit returned status %d and body %q", rec.Code, got)
+	}
+
+	// Zero disables both limits.
+	l = NewLimiter(0, 0, 0)
+	h = l.Wrap(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	for i := 0; i < 10; i++ {
+		if rec := send(strings.Repeat("x", 100), 100); rec.Code != http.StatusOK {
+			t.Errorf("unlimited webhook %d returned status %d", i, rec.Code)
+		}
+	}
+}
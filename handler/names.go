@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/parser"
+)
+
+// ProjectRules are the rules that the names of a project's sites and machines
+// follow, in addition to being known to siteinfo.
+type ProjectRules = parser.ProjectRules
+
+// ReadProjectRules reads a JSON object mapping each project to the patterns
+// of its sites and machines, as parser.ReadRules does.
+func ReadProjectRules(r io.Reader) (map[string]ProjectRules, error) {
+	return parser.ReadRules(r)
+}
+
+// SetProjectRules replaces the rules of every project. It must be called
+// before any handlers are created.
+func SetProjectRules(rules map[string]ProjectRules) {
+	parser.SetRules(rules)
+}
+
+// checkSite returns an error unless site belongs to the handler's project.
+// Unless the site is leaving maintenance, it must also be known to siteinfo,
+// so that retired sites can still be removed.
+func (h *handler) checkSite(site string, action maintenancestate.Action) error {
+	if err := parser.CheckSite(h.project, site); err != nil {
+		return err
+	}
+	r, ok := h.state.(SiteResolver)
+	if !ok || action == maintenancestate.LeaveMaintenance {
+		return nil
+	}
+	if _, err := r.SiteMachines(site); err != nil {
+		return fmt.Errorf("the site is not known to siteinfo")
+	}
+	return nil
+}
+
+// checkMachine is like checkSite, but for a machine such as mlab1-abc01.
+func (h *handler) checkMachine(machine string, action maintenancestate.Action) error {
+	if err := parser.CheckMachine(h.project, machine); err != nil {
+		return err
+	}
+	r, ok := h.state.(SiteResolver)
+	if !ok || action == maintenancestate.LeaveMaintenance {
+		return nil
+	}
+	_, site, _ := strings.Cut(machine, "-")
+	machines, err := r.SiteMachines(site)
+	if err != nil {
+		return fmt.Errorf("the site is not known to siteinfo")
+	}
+	for _, m := range machines {
+		if m == machine {
+			return nil
+		}
+	}
+	return fmt.Errorf("the machine is not known to siteinfo")
+}
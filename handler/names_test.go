@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/parser"
+)
+
+// knownSites implements the maintenancestate.Sites interface with fixed data.
+type knownSites map[string][]string
+
+func (k knownSites) Machines(site string) ([]string, error) {
+	machines, ok := k[site]
+	if !ok {
+		return nil, errors.New("site not found")
+	}
+	return machines, nil
+}
+
+func (k knownSites) Reload(ctx context.Context) error {
+	return nil
+}
+
+func TestValidNames(t *testing.T) {
+	sites := knownSites{"abc01": {"mlab1", "mlab2"}, "xyz0t": {"mlab1"}}
+	state, _ := maintenancestate.New(t.TempDir()+"/state.json", sites, "mlab-oti")
+
+	tests := []struct {
+		name    string
+		project string
+		kind    string
+		entity  string
+		action  maintenancestate.Action
+		want    bool
+	}{
+		{"known-site", "mlab-oti", "site", "abc01", maintenancestate.EnterMaintenance, true},
+		{"unknown-site", "mlab-oti", "site", "def01", maintenancestate.EnterMaintenance, false},
+		{"unknown-site-leaving", "mlab-oti", "site", "def01", maintenancestate.LeaveMaintenance, true},
+		{"sandbox-site-in-oti", "mlab-oti", "site", "xyz0t", maintenancestate.EnterMaintenance, false},
+		{"sandbox-site", "mlab-sandbox", "site", "xyz0t", maintenancestate.EnterMaintenance, true},
+		{"unknown-project", "mlab-foo", "site", "abc01", maintenancestate.EnterMaintenance, false},
+		{"known-machine", "mlab-oti", "machine", "mlab2-abc01", maintenancestate.EnterMaintenance, true},
+		{"unknown-machine", "mlab-oti", "machine", "mlab3-abc01", maintenancestate.EnterMaintenance, false},
+		{"unknown-machine-leaving", "mlab-oti", "machine", "mlab3-abc01", maintenancestate.LeaveMaintenance, true},
+		{"staging-machine-in-oti", "mlab-oti", "machine", "mlab4-abc01", maintenancestate.LeaveMaintenance, false},
+		{"malformed-machine", "mlab-oti", "machine", "mlab1abc01", maintenancestate.LeaveMaintenance, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &handler{state: state, project: tt.project}
+			check := h.checkMachine
+			if tt.kind == "site" {
+				check = h.checkSite
+			}
+			if err := check(tt.entity, tt.action); (err == nil) != tt.want {
+				t.Errorf("check %s %s = %v; want valid %t", tt.kind, tt.entity, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadProjectRules(t *testing.T) {
+	rules, err := ReadProjectRules(strings.NewReader(`{"mlab-test": {"site": "[a-z]{3}[0-9]{2}x", "machine": "mlab[15]"}}`))
+	if err != nil {
+		t.Fatalf("ReadProjectRules() returned error: %v", err)
+	}
+	r := rules["mlab-test"]
+	if !r.Site.MatchString("abc01x") || r.Site.MatchString("abc01xy") || !r.Machine.MatchString("mlab5") || r.Machine.MatchString("mlab2") {
+		t.Errorf("ReadProjectRules() rules do not match whole names")
+	}
+
+	defer SetProjectRules(parser.Rules())
+	SetProjectRules(rules)
+	state, _ := maintenancestate.New(t.TempDir()+"/state.json", knownSites{"abc01x": {"mlab5"}}, "mlab-test")
+	h := &handler{state: state, project: "mlab-test"}
+	if err := h.checkMachine("mlab5-abc01x", maintenancestate.EnterMaintenance); err != nil {
+		t.Error("mlab5-abc01x should be valid in mlab-test")
+	}
+	h.project = "mlab-oti"
+	if h.checkSite("abc01", maintenancestate.LeaveMaintenance) == nil {
+		t.Error("mlab-oti should no longer be a known project")
+	}
+
+	for _, bad := range []string{
+		`{}`,
+		`{"mlab-test": {"site": "[a-z"}, "machine": "mlab1"}`,
+		`{"mlab-test": {"site": "[a-z]{5}"}}`,
+		`{"mlab-test": {"site": "[a-z]{5}", "machine": "mlab("}}`,
+		`{"mlab-test": {"site": "[a-z]{5}", "machine": "mlab1", "switch": "s1"}}`,
+	} {
+		if _, err := ReadProjectRules(strings.NewReader(bad)); err == nil {
+			t.Errorf("ReadProjectRules(%s) should have failed", bad)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+	"github.com/m-lab/github-maintenance-exporter/parser"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Option configures a handler created by New, NewPoller, NewPreview or
+// NewSelfTest beyond its Config.
+type Option func(*handler)
+
+// Notifier is called once each webhook has been processed, with the event,
+// the key of its issue, if any, and the number of modifications it made to
+// the state.
+type Notifier func(event *Event, issue string, mods int)
+
+// WithParser finds the flags in messages with parse instead of parser.Parse.
+func WithParser(parse func(project string, text string) []parser.Target) Option {
+	return func(h *handler) {
+		h.parser = parse
+	}
+}
+
+// WithClock returns the current time from now instead of time.Now, e.g. to
+// test blackout windows and scheduled changes.
+func WithClock(now func() time.Time) Option {
+	return func(h *handler) {
+		h.clock = now
+	}
+}
+
+// WithNotifier calls n once each webhook has been processed. It may be given
+// more than once.
+func WithNotifier(n Notifier) Option {
+	return func(h *handler) {
+		h.notifiers = append(h.notifiers, n)
+	}
+}
+
+// WithRegistry registers the metrics of webhooks with reg, e.g. so that they
+// can be served alongside those of a program that embeds the handler. They
+// are always registered with the default registry.
+func WithRegistry(reg prometheus.Registerer) Option {
+	return func(h *handler) {
+		collectors := []prometheus.Collector{
+			metrics.WebhookEvents,
+			metrics.WebhookDuration,
+			metrics.WebhookSignatures,
+			metrics.WebhookSecretMatches,
+			metrics.WebhookDuplicates,
+			metrics.LastEventModifications,
+			metrics.MassChangeEvents,
+			metrics.BlackoutRefusals,
+		}
+		for _, c := range collectors {
+			err := reg.Register(c)
+			var already prometheus.AlreadyRegisteredError
+			if err != nil && !errors.As(err, &already) {
+				slog.Error("Failed to register webhook metrics", "err", err)
+				metrics.CountError("register", "handler.WithRegistry")
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/parser"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParserAndClock(t *testing.T) {
+	secret := []byte("goodsecret")
+	state := &fakeState{}
+	start := time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+	// Every message flags mlab1-abc02, whatever it says.
+	parse := WithParser(func(project string, text string) []parser.Target {
+		return []parser.Target{{Kind: "machine", Name: "mlab1-abc02", Action: maintenancestate.EnterMaintenance}}
+	})
+	config := Config{Blackouts: Windows{{Start: start, End: start.Add(2 * time.Hour)}}}
+	h := New(state, secret, "mlab-oti", config, parse, WithClock(func() time.Time { return start.Add(time.Hour) }))
+	sendHook(h, secret, "issues", `{"action": "opened", "issue": {"number": 1, "body": "/machine mlab2.abc01 override"}}`)
+	if len(state.applied) != 0 {
+		t.Errorf("changes %+v were applied during a blackout window", state.applied)
+	}
+
+	h = New(state, secret, "mlab-oti", config, parse, WithClock(func() time.Time { return start.Add(3 * time.Hour) }))
+	sendHook(h, secret, "issues", `{"action": "opened", "issue": {"number": 1, "body": "nothing"}}`)
+	if len(state.applied) != 1 || state.applied[0].Name != "mlab1-abc02" {
+		t.Errorf("applied changes %+v; want mlab1-abc02 from the custom parser", state.applied)
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	secret := []byte("goodsecret")
+	type call struct {
+		action string
+		issue  string
+		mods   int
+	}
+	var calls []call
+	notify := func(event *Event, issue string, mods int) {
+		calls = append(calls, call{event.Action, issue, mods})
+	}
+	h := New(&fakeState{}, secret, "mlab-oti", Config{}, WithNotifier(notify), WithNotifier(notify))
+	sendHook(h, secret, "issues", `{"action": "opened", "issue": {"number": 3, "body": "/site abc02"}}`)
+	want := call{"opened", "3", 1}
+	if len(calls) != 2 || calls[0] != want || calls[1] != want {
+		t.Errorf("notifiers were called with %+v; want %+v twice", calls, want)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	secret := []byte("goodsecret")
+	h := New(&fakeState{}, secret, "mlab-oti", Config{}, WithRegistry(reg))
+	// Registering the same metrics again is harmless.
+	New(&fakeState{}, secret, "mlab-oti", Config{}, WithRegistry(reg))
+	sendHook(h, secret, "issues", `{"action": "opened", "issue": {"number": 3, "body": "/site abc02"}}`)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	found := false
+	for _, f := range families {
+		if f.GetName() == "gmx_webhook_events_total" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("registry does not serve the webhook events; got %d families", len(families))
+	}
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/githubapi"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+// IssueLister lists the issues of a GitHub repository that were updated at or
+// after a given time.
+type IssueLister interface {
+	ListIssues(ctx context.Context, repo string, since time.Time) ([]githubapi.Issue, error)
+}
+
+// Poller periodically lists the issues of a repository and reconciles them
+// against the state, to catch webhooks that were never delivered. Issues that
+// were closed have all of their maintenance removed, and issues that were
+// opened have their flags applied if nothing has happened on them since.
+// Other issues are left alone, since their flags may have been superseded by
+// comments.
+type Poller struct {
+	h      *handler
+	lister IssueLister
+	repo   string
+	// since is the time of the last successful poll. Only issues updated
+	// since then are reconciled.
+	since time.Time
+}
+
+// NewPoller creates a Poller of repo, whose issues are recorded in state as
+// the handler that New would create with the same config and options records
+// them. The first poll reconciles the issues updated within lookback.
+func NewPoller(state StateUpdater, lister IssueLister, repo string, project string, config Config, lookback time.Duration, options ...Option) *Poller {
+	return &Poller{
+		h:      New(state, nil, project, config, options...).(*handler),
+		lister: lister,
+		repo:   repo,
+		since:  time.Now().Add(-lookback),
+	}
+}
+
+// Poll reconciles the issues updated since the last successful poll and
+// returns the number of modifications it made to the state.
+func (p *Poller) Poll(ctx context.Context) (int, error) {
+	start := time.Now()
+	issues, err := p.lister.ListIssues(ctx, p.repo, p.since)
+	if err != nil {
+		slog.Error("Failed to list issues", "repo", p.repo, "err", err)
+		metrics.CountError("listissues", "handler.Poll")
+		return 0, err
+	}
+
+	mods := 0
+	for _, issue := range issues {
+		issueNumber := p.h.issueKey(issue.Number)
+		switch {
+		case issue.State == "closed" && p.h.issueEntities(issueNumber) > 0:
+			slog.Warn("Issue is closed but still has maintenance; removing it", "issue", issueNumber, "repo", p.repo)
+			mods += p.h.closeFrom(issueNumber, maintenancestate.Origin{Cause: "reconcile"})
+		case issue.State == "open" && issue.CreatedAt.After(p.since) && issue.Comments == 0 &&
+			p.h.issueEntities(issueNumber) == 0 && len(p.h.findFlags(issue.Body)) > 0:
+			n, _ := p.h.parseMessage(issue.Body, issueNumber, maintenancestate.Origin{Cause: "reconcile"})
+			if n > 0 {
+				slog.Warn("Issue was opened with flags that were never applied; applied them", "issue", issueNumber, "repo", p.repo)
+			}
+			mods += n
+		}
+	}
+	p.since = start
+
+	if mods > 0 {
+		metrics.ReconcileCorrections.Add(float64(mods))
+		if err := p.h.state.Write(); err != nil {
+			slog.Error("Failed to write state file", "project", p.h.project, "err", err)
+			metrics.CountError("writefile", "handler.Poll")
+			return mods, err
+		}
+	}
+	return mods, nil
+}
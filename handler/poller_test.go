@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/githubapi"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+type fakeLister struct {
+	issues []githubapi.Issue
+	err    error
+	since  []time.Time
+}
+
+func (f *fakeLister) ListIssues(ctx context.Context, repo string, since time.Time) ([]githubapi.Issue, error) {
+	f.since = append(f.since, since)
+	return f.issues, f.err
+}
+
+func TestPoller(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := maintenancestate.New(dir+"/state.json", cachingClient, "mlab-oti")
+	s.UpdateSite("abc01", maintenancestate.EnterMaintenance, "1", "mlab-oti")
+	s.UpdateSite("abc03", maintenancestate.EnterMaintenance, "3", "mlab-oti")
+
+	now := time.Now()
+	lister := &fakeLister{issues: []githubapi.Issue{
+		// Closed without a webhook.
+		{Number: 1, State: "closed"},
+		// Opened without a webhook.
+		{Number: 2, State: "open", Body: "/site abc02", CreatedAt: now},
+		// Still open.
+		{Number: 3, State: "open", Body: "/site abc03", CreatedAt: now.Add(-time.Hour)},
+		// Opened, but maintenance may have been removed by a comment.
+		{Number: 4, State: "open", Body: "/site abc04", CreatedAt: now, Comments: 1},
+		// Opened before the lookback.
+		{Number: 5, State: "open", Body: "/site abc05", CreatedAt: now.Add(-2 * time.Hour)},
+	}}
+	p := NewPoller(s, lister, "m-lab/ops-tracker", "mlab-oti", Config{}, time.Hour)
+
+	mods, err := p.Poll(context.Background())
+	if err != nil {
+		t.Fatalf("Poll() returned an error: %v", err)
+	}
+	// Each site has four machines, which enter and leave maintenance with it.
+	if mods != 10 {
+		t.Errorf("Poll() = %d modifications; want 10", mods)
+	}
+	for issue, want := range map[string]int{"1": 0, "2": 5, "3": 5, "4": 0, "5": 0} {
+		if got := s.IssueEntities(issue); got != want {
+			t.Errorf("issue #%s has %d entities in maintenance; want %d", issue, got, want)
+		}
+	}
+
+	// Only issues updated since the last successful poll are listed.
+	lister.err = errors.New("unavailable")
+	if _, err := p.Poll(context.Background()); err == nil {
+		t.Error("Poll() did not return the error from ListIssues")
+	}
+	if _, err := p.Poll(context.Background()); err == nil {
+		t.Error("Poll() did not return the error from ListIssues")
+	}
+	if len(lister.since) != 3 || !lister.since[1].After(lister.since[0]) || !lister.since[2].Equal(lister.since[1]) {
+		t.Errorf("ListIssues() was called with since %v", lister.since)
+	}
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// maxPreviewBody bounds the size of a message sent to a Preview.
+const maxPreviewBody = 64 << 10
+
+// PreviewTarget is a machine, site, experiment or switch that a message would
+// change.
+type PreviewTarget struct {
+	Kind   string
+	Name   string
+	Action string
+	// Description is how the change would be reported back on the issue.
+	Description string
+}
+
+// PreviewResult describes what a message would do.
+type PreviewResult struct {
+	Targets []PreviewTarget
+	// Rejected explains every flag that would be ignored.
+	Rejected []string
+	// Entities is the number of machines and sites that would be affected.
+	Entities int
+	// RequiresApproval is true if the changes would wait for /approve.
+	RequiresApproval bool
+}
+
+// Preview parses the body of an issue or comment as the handler that New
+// would create does, and reports the changes it would make, without
+// modifying the state. It lets operators check their flags before filing an
+// issue.
+type Preview struct {
+	h *handler
+}
+
+// NewPreview creates a Preview of the handler that New would create with the
+// same arguments, apart from the secret.
+func NewPreview(state StateUpdater, project string, config Config, options ...Option) *Preview {
+	return &Preview{h: New(state, nil, project, config, options...).(*handler)}
+}
+
+// Parse returns what msg would do.
+func (p *Preview) Parse(msg string) PreviewResult {
+	changes, rejected := p.h.parseFlags(msg)
+	if p.h.config.MaxFlags > 0 && len(changes) > p.h.config.MaxFlags {
+		changes = changes[:p.h.config.MaxFlags]
+	}
+	result := PreviewResult{
+		Targets:  make([]PreviewTarget, 0, len(changes)),
+		Rejected: rejected,
+		Entities: p.h.blastRadius(changes),
+	}
+	for _, c := range changes {
+		result.Targets = append(result.Targets, PreviewTarget{
+			Kind:        c.Kind,
+			Name:        c.Name,
+			Action:      c.Action.String(),
+			Description: describe(c),
+		})
+	}
+	threshold := p.h.config.ApprovalThreshold
+	result.RequiresApproval = threshold > 0 && result.Entities > threshold
+	return result
+}
+
+// ServeHTTP reports what the message in the body of a POST would do.
+func (p *Preview) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(resp, req.Body, maxPreviewBody))
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	data, err := json.MarshalIndent(p.Parse(string(body)), "", "  ")
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(data)
+}
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/go/rtx"
+)
+
+func TestPreview(t *testing.T) {
+	s, _ := maintenancestate.New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+	p := NewPreview(s, "mlab-oti", Config{ApprovalThreshold: 1})
+
+	msg := "/machine mlab1-abc01 for 2h\n/site abc02 del\n/machine mlab1-abc0t"
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("POST", "/parse", strings.NewReader(msg)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ServeHTTP() returned status %d: %s", rec.Code, rec.Body.String())
+	}
+	var result PreviewResult
+	rtx.Must(json.Unmarshal(rec.Body.Bytes(), &result), "Could not unmarshal response")
+	want := []PreviewTarget{
+		{Kind: "machine", Name: "mlab1-abc01", Action: "enter", Description: "put machine mlab1-abc01 into maintenance for 2h0m0s"},
+		{Kind: "site", Name: "abc02", Action: "leave", Description: "remove site abc02 from maintenance"},
+	}
+	if len(result.Targets) != len(want) {
+		t.Fatalf("Targets = %+v; want %+v", result.Targets, want)
+	}
+	for i := range want {
+		if result.Targets[i] != want[i] {
+			t.Errorf("Targets[%d] = %+v; want %+v", i, result.Targets[i], want[i])
+		}
+	}
+	if len(result.Rejected) != 1 || !strings.Contains(result.Rejected[0], "mlab1-abc0t") {
+		t.Errorf("Rejected = %q; want the flag for mlab1-abc0t", result.Rejected)
+	}
+	if !result.RequiresApproval {
+		t.Errorf("RequiresApproval = false for %d entities", result.Entities)
+	}
+	if n := s.IssueEntities("manual"); n != 0 || !s.Written().IsZero() {
+		t.Error("preview modified the state")
+	}
+
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/parse", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET returned status %d; want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
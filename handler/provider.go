@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Types of Event.
+const (
+	IssueEvent   = "issue"
+	CommentEvent = "comment"
+	PingEvent    = "ping"
+)
+
+var (
+	// ErrInvalidSignature is returned by a Provider when a webhook does not
+	// carry a valid signature or token.
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	// ErrUnsupportedEvent is returned by a Provider for events that the
+	// exporter does not handle.
+	ErrUnsupportedEvent = errors.New("unsupported webhook event")
+)
+
+// Event is a webhook event, independent of the source that sent it.
+type Event struct {
+	// Type is one of IssueEvent, CommentEvent or PingEvent.
+	Type string
+	// Action is what happened to an issue: "opened", "edited", "closed",
+	// "reopened", "transferred" or "deleted".
+	Action string
+	Issue  int
+	// NewRepo and NewIssue are the repository and number of the issue that a
+	// transferred issue became.
+	NewRepo  string
+	NewIssue int
+	// Repo is the full name of the repository (e.g. m-lab/ops-tracker).
+	Repo string
+	// State is the state of the issue, either "open" or "closed".
+	State string
+	// Body is the body of the issue or comment.
+	Body string
+	// PreviousBody is the body before it was edited, for "edited" events
+	// that changed it.
+	PreviousBody string
+	// Comment is the ID of the comment, for comment events.
+	Comment int64
+	Sender  string
+	// Milestone is the title of the issue's milestone, if it has one.
+	Milestone string
+	// Installation is the ID of the GitHub App installation that the
+	// webhook was delivered to, if any.
+	Installation int64
+	// PingOK reports whether a ping shows that the webhook is configured to
+	// send every event that the exporter needs.
+	PingOK bool
+}
+
+// Provider validates and parses the webhooks sent by one kind of source, such
+// as GitHub or GitLab.
+type Provider interface {
+	// Parse validates req using secret and returns the event that it carries.
+	// It returns ErrInvalidSignature if validation fails.
+	Parse(req *http.Request, secret []byte) (*Event, error)
+}
+
+// providers holds the known providers, keyed by name.
+var providers = map[string]Provider{
+	"github": GitHub{},
+	"gitlab": GitLab{},
+}
+
+// ProviderByName returns the Provider with the given name.
+func ProviderByName(name string) (Provider, bool) {
+	p, ok := providers[name]
+	return p, ok
+}
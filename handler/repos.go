@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+	"github.com/m-lab/github-maintenance-exporter/parser"
+)
+
+// maxPayloadSize is the largest webhook payload that GitHub sends.
+const maxPayloadSize = 25 << 20
+
+// RepoConfig holds the secret and settings for one additional GitHub
+// repository whose webhooks are sent to the main webhook endpoint. Settings
+// that are not set are inherited from the default Config.
+type RepoConfig struct {
+	// Repo is the full name of the repository (e.g. m-lab/ops-tracker).
+	Repo string `json:"repo"`
+	// SecretFile is the path of a file containing the repository's webhook
+	// secret.
+	SecretFile string `json:"secret_file"`
+	// Project is the project whose state and flag patterns apply to the
+	// repository's issues. If empty, the project of the default handler is
+	// used.
+	Project string `json:"project,omitempty"`
+
+	MaxFlags          *int     `json:"max_flags,omitempty"`
+	ApprovalThreshold *int     `json:"approval_threshold,omitempty"`
+	Approvers         []string `json:"approvers,omitempty"`
+	GracePeriod       string   `json:"grace_period,omitempty"`
+	AutoClose         *bool    `json:"autoclose,omitempty"`
+}
+
+// ReadRepoConfigs reads a JSON list of repository configurations.
+func ReadRepoConfigs(r io.Reader) ([]RepoConfig, error) {
+	var repos []RepoConfig
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&repos); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, rc := range repos {
+		if rc.Repo == "" || rc.SecretFile == "" {
+			return nil, fmt.Errorf("repository %q must have both a repo and a secret_file", rc.Repo)
+		}
+		if seen[rc.Repo] {
+			return nil, fmt.Errorf("repository %q is configured more than once", rc.Repo)
+		}
+		seen[rc.Repo] = true
+		if _, ok := parser.Rules()[rc.Project]; rc.Project != "" && !ok {
+			return nil, fmt.Errorf("unknown project %q for repository %q", rc.Project, rc.Repo)
+		}
+		if _, err := rc.Apply(Config{}); err != nil {
+			return nil, err
+		}
+	}
+	return repos, nil
+}
+
+// Apply returns base with the repository's settings applied. Issues from the
+// repository are recorded as REPO#NUMBER, so that they are kept apart from
+// issues with the same number in other repositories.
+func (rc RepoConfig) Apply(base Config) (Config, error) {
+	c := base
+	c.Provider = GitHub{}
+	c.Source = rc.Repo
+	if rc.MaxFlags != nil {
+		c.MaxFlags = *rc.MaxFlags
+	}
+	if rc.ApprovalThreshold != nil {
+		c.ApprovalThreshold = *rc.ApprovalThreshold
+	}
+	if rc.Approvers != nil {
+		c.Approvers = rc.Approvers
+	}
+	if rc.GracePeriod != "" {
+		d, err := time.ParseDuration(rc.GracePeriod)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid grace_period for repository %q: %w", rc.Repo, err)
+		}
+		c.GracePeriod = d
+	}
+	if rc.AutoClose != nil {
+		c.AutoClose = *rc.AutoClose
+	}
+	return c, nil
+}
+
+// Router dispatches GitHub webhooks to the handler for the repository that
+// sent them, falling back to a default handler for any other repository.
+// Each handler still validates the webhook with its own secret, so a payload
+// that names a repository it was not sent by is rejected.
+type Router struct {
+	Default http.Handler
+	Repos   map[string]http.Handler
+}
+
+// ServeHTTP reads the repository from the payload and passes the request on
+// to the handler for that repository.
+func (r *Router) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxPayloadSize))
+	if err != nil {
+		slog.Error("Failed to read webhook payload", "remote", req.RemoteAddr, "delivery", req.Header.Get(deliveryHeader), "err", err)
+		metrics.CountError("readbody", "Router.ServeHTTP")
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	var payload struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	if req.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+		form, _ := url.ParseQuery(string(body))
+		body = []byte(form.Get("payload"))
+	}
+	// Payloads that cannot be parsed here are left for the default handler
+	// to reject.
+	json.Unmarshal(body, &payload)
+	if h, ok := r.Repos[payload.Repository.FullName]; ok {
+		h.ServeHTTP(resp, req)
+		return
+	}
+	r.Default.ServeHTTP(resp, req)
+}
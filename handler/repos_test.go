@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+func TestReadRepoConfigs(t *testing.T) {
+	repos, err := ReadRepoConfigs(strings.NewReader(`[
+		{"repo": "ops/tracker", "secret_file": "/secrets/ops", "max_flags": 5, "grace_period": "1h", "autoclose": true},
+		{"repo": "lab/issues", "secret_file": "/secrets/lab", "approvers": ["alice"], "project": "mlab-sandbox"}
+	]`))
+	if err != nil {
+		t.Fatalf("ReadRepoConfigs() error = %v", err)
+	}
+	if len(repos) != 2 {
+		t.Fatalf("ReadRepoConfigs() returned %d repos; want 2", len(repos))
+	}
+
+	base := Config{MaxFlags: 100, Approvers: []string{"bob"}}
+	got, err := repos[0].Apply(base)
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	want := Config{
+		MaxFlags:    5,
+		Approvers:   []string{"bob"},
+		GracePeriod: time.Hour,
+		AutoClose:   true,
+		Provider:    GitHub{},
+		Source:      "ops/tracker",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Apply() = %+v; want %+v", got, want)
+	}
+	if repos[1].Project != "mlab-sandbox" {
+		t.Errorf("Project = %q; want mlab-sandbox", repos[1].Project)
+	}
+	got, _ = repos[1].Apply(base)
+	if got.MaxFlags != 100 || !reflect.DeepEqual(got.Approvers, []string{"alice"}) {
+		t.Errorf("Apply() = %+v; want MaxFlags 100 and Approvers [alice]", got)
+	}
+
+	for _, bad := range []string{
+		`{"repo": "ops/tracker"}`,
+		`[{"repo": "ops/tracker"}]`,
+		`[{"repo": "ops/tracker", "secret_file": "/s", "grace_period": "soon"}]`,
+		`[{"repo": "ops/tracker", "secret_file": "/s", "unknown": 1}]`,
+		`[{"repo": "ops/tracker", "secret_file": "/s", "project": "mlab-nope"}]`,
+		`[{"repo": "ops/tracker", "secret_file": "/s"}, {"repo": "ops/tracker", "secret_file": "/t"}]`,
+	} {
+		if _, err := ReadRepoConfigs(strings.NewReader(bad)); err == nil {
+			t.Errorf("ReadRepoConfigs(%s) should have failed", bad)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := maintenancestate.New(dir+"/state.json", cachingClient, "mlab-oti")
+	defaultSecret := []byte("defaultsecret")
+	opsSecret := []byte("opssecret")
+	opsConfig, _ := RepoConfig{Repo: "ops/tracker"}.Apply(Config{})
+	r := &Router{
+		Default: New(s, defaultSecret, "mlab-oti", Config{}),
+		Repos: map[string]http.Handler{
+			"ops/tracker": New(s, opsSecret, "mlab-oti", opsConfig),
+		},
+	}
+
+	primary := `{"action": "opened", "repository": {"full_name": "m-lab/ops-tracker"}, "issue": {"number": 1, "body": "/machine mlab1.xyz01"}}`
+	ops := `{"action": "opened", "repository": {"full_name": "ops/tracker"}, "issue": {"number": 1, "body": "/machine mlab1.xyz01"}}`
+	if rec := sendHook(r, defaultSecret, "issues", primary); rec.Code != http.StatusOK {
+		t.Errorf("default repository webhook returned status %d", rec.Code)
+	}
+	if rec := sendHook(r, opsSecret, "issues", ops); rec.Code != http.StatusOK {
+		t.Errorf("ops/tracker webhook returned status %d", rec.Code)
+	}
+	// Each repository only accepts its own secret.
+	if rec := sendHook(r, defaultSecret, "issues", ops); rec.Code != http.StatusUnauthorized {
+		t.Errorf("ops/tracker webhook with the default secret returned status %d; want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	want := map[string][]string{"mlab1-xyz01": {"1", "ops/tracker#1"}}
+	if got := savedMachines(dir + "/state.json"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Machines = %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+// ParseSecrets splits data into webhook secrets, one per line, ignoring empty
+// lines. Several secrets are accepted at once so that a secret can be rotated
+// with an overlap, during which webhooks signed with either are valid.
+func ParseSecrets(data []byte) [][]byte {
+	var secrets [][]byte
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if secret := bytes.TrimSpace(line); len(secret) > 0 {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// parse validates and parses a webhook with provider, accepting it if it is
+// valid with any of secrets.
+func parse(provider Provider, req *http.Request, secrets [][]byte) (*Event, error) {
+	if len(secrets) <= 1 {
+		var secret []byte
+		if len(secrets) == 1 {
+			secret = secrets[0]
+		}
+		event, err := provider.Parse(req, secret)
+		if err == nil {
+			metrics.WebhookSecretMatches.WithLabelValues("0").Inc()
+		}
+		return event, err
+	}
+	// Each attempt reads the body, so it must be kept for the next.
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	for i, secret := range secrets {
+		attempt := req.Clone(req.Context())
+		attempt.Body = io.NopCloser(bytes.NewReader(body))
+		event, err := provider.Parse(attempt, secret)
+		if errors.Is(err, ErrInvalidSignature) && i < len(secrets)-1 {
+			continue
+		}
+		if err == nil {
+			metrics.WebhookSecretMatches.WithLabelValues(strconv.Itoa(i)).Inc()
+		}
+		return event, err
+	}
+	return nil, ErrInvalidSignature
+}
+
+// RotatingSecret holds webhook secrets, one per line, read from a file or a
+// secret store. They can be reread, so that they can be rotated without
+// restarting the exporter and missing the webhooks sent in the meantime.
+type RotatingSecret struct {
+	name string
+	read func() ([]byte, error)
+
+	mu      sync.Mutex
+	secrets [][]byte
+}
+
+// NewRotatingSecret reads the webhook secrets returned by read. The name
+// identifies them in logs.
+func NewRotatingSecret(name string, read func() ([]byte, error)) (*RotatingSecret, error) {
+	s := &RotatingSecret{name: name, read: read}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSecretFile reads the webhook secrets in the file at path.
+func NewSecretFile(path string) (*RotatingSecret, error) {
+	return NewRotatingSecret(path, func() ([]byte, error) { return os.ReadFile(path) })
+}
+
+// Secrets returns the current secrets.
+func (s *RotatingSecret) Secrets() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.secrets
+}
+
+// Reload rereads the secrets. If they cannot be read or are empty, the
+// previous secrets are kept.
+func (s *RotatingSecret) Reload() error {
+	data, err := s.read()
+	if err != nil {
+		return err
+	}
+	secrets := ParseSecrets(data)
+	if len(secrets) == 0 {
+		return errors.New("webhook secret " + s.name + " is empty")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.secrets != nil && !bytes.Equal(bytes.Join(s.secrets, []byte("\n")), bytes.Join(secrets, []byte("\n"))) {
+		slog.Info("Webhook secrets were rotated", "name", s.name, "secrets", len(secrets))
+	}
+	s.secrets = secrets
+	return nil
+}
+
+// Run rereads the secrets every interval until ctx is canceled. Failures are
+// logged, and the previous secrets are kept.
+func (s *RotatingSecret) Run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			if err := s.Reload(); err != nil {
+				slog.Error("Failed to reload the webhook secret", "name", s.name, "err", err)
+				metrics.CountError("reloadsecret", "handler.RotatingSecret")
+			}
+		}
+	}
+}
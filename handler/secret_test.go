@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/gmxtest"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseSecrets(t *testing.T) {
+	got := ParseSecrets([]byte(" old \n\nnew\n"))
+	want := [][]byte{[]byte("old"), []byte("new")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseSecrets() = %q; want %q", got, want)
+	}
+}
+
+func TestParseWithSecrets(t *testing.T) {
+	payload := gmxtest.PingPayload("issues", "issue_comment")
+	secrets := [][]byte{[]byte("old"), []byte("new")}
+	before := testutil.ToFloat64(metrics.WebhookSecretMatches.WithLabelValues("1"))
+	event, err := parse(GitHub{}, gmxtest.NewWebhook([]byte("new"), "ping", payload), secrets)
+	if err != nil || event.Type != PingEvent {
+		t.Errorf("parse() with the second secret = %v, %v; want a ping", event, err)
+	}
+	if got := testutil.ToFloat64(metrics.WebhookSecretMatches.WithLabelValues("1")) - before; got != 1 {
+		t.Errorf("matches of the second secret increased by %v; want 1", got)
+	}
+	_, err = parse(GitHub{}, gmxtest.NewWebhook([]byte("other"), "ping", payload), secrets)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("parse() with an unknown secret = %v; want ErrInvalidSignature", err)
+	}
+	_, err = parse(GitHub{}, gmxtest.NewWebhook([]byte("old"), "ping", "{"), secrets)
+	if err == nil || errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("parse() of an invalid payload = %v; want a parse error", err)
+	}
+}
+
+func TestSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if _, err := NewSecretFile(path); err == nil {
+		t.Error("NewSecretFile() of a missing file = nil; want an error")
+	}
+	rtx.Must(os.WriteFile(path, []byte("old\n"), 0600), "Could not write secret")
+	s, err := NewSecretFile(path)
+	rtx.Must(err, "Could not read secret")
+
+	// The storage is empty, so the state cannot be restored.
+	state, _ := maintenancestate.NewWithStorage(&gmxtest.MemoryStorage{}, gmxtest.Sites{}, "mlab-oti")
+	h := New(state, []byte("ignored"), "mlab-oti", Config{Secrets: s.Secrets})
+	ping := gmxtest.PingPayload("issues", "issue_comment")
+	if rec := gmxtest.Send(h, []byte("old"), "ping", ping); rec.Code != http.StatusOK {
+		t.Errorf("webhook signed with the current secret returned status %d", rec.Code)
+	}
+
+	// The secret is rotated.
+	rtx.Must(os.WriteFile(path, []byte("new"), 0600), "Could not write secret")
+	rtx.Must(s.Reload(), "Could not reload secret")
+	if rec := gmxtest.Send(h, []byte("old"), "ping", ping); rec.Code != http.StatusUnauthorized {
+		t.Errorf("webhook signed with the old secret returned status %d; want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := gmxtest.Send(h, []byte("new"), "ping", ping); rec.Code != http.StatusOK {
+		t.Errorf("webhook signed with the new secret returned status %d", rec.Code)
+	}
+
+	// During an overlap, either secret is accepted.
+	rtx.Must(os.WriteFile(path, []byte("new\nnewer\n"), 0600), "Could not write secrets")
+	rtx.Must(s.Reload(), "Could not reload secrets")
+	for _, secret := range []string{"new", "newer"} {
+		if rec := gmxtest.Send(h, []byte(secret), "ping", ping); rec.Code != http.StatusOK {
+			t.Errorf("webhook signed with secret %q returned status %d", secret, rec.Code)
+		}
+	}
+	if rec := gmxtest.Send(h, []byte("old"), "ping", ping); rec.Code != http.StatusUnauthorized {
+		t.Errorf("webhook signed with a removed secret returned status %d; want %d", rec.Code, http.StatusUnauthorized)
+	}
+	rtx.Must(os.WriteFile(path, []byte("new"), 0600), "Could not write secret")
+	rtx.Must(s.Reload(), "Could not reload secret")
+
+	// An empty or missing file keeps the previous secret.
+	rtx.Must(os.WriteFile(path, []byte("\n"), 0600), "Could not write secret")
+	if err := s.Reload(); err == nil {
+		t.Error("Reload() of an empty file = nil; want an error")
+	}
+	rtx.Must(os.Remove(path), "Could not remove secret")
+	if err := s.Reload(); err == nil {
+		t.Error("Reload() of a missing file = nil; want an error")
+	}
+	if got := s.Secrets(); len(got) != 1 || string(got[0]) != "new" {
+		t.Errorf("Secrets() = %q; want the previous secret", got)
+	}
+
+	// Run picks up changes.
+	rtx.Must(os.WriteFile(path, []byte("newer"), 0600), "Could not write secret")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx, time.Millisecond)
+	for deadline := time.Now().Add(10 * time.Second); string(s.Secrets()[0]) != "newer"; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Secrets() = %q after Run; want newer", s.Secrets())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/m-lab/github-maintenance-exporter/gmxtest"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+// selfTestMachines are the machines flagged by the canned self-test webhook
+// of each project.
+var selfTestMachines = map[string]string{
+	"mlab-sandbox": "mlab1-abc0t",
+	"mlab-staging": "mlab4-abc01",
+	"mlab-oti":     "mlab1-abc01",
+}
+
+// selfTestIssue is the issue of the canned self-test webhook. It cannot
+// collide with a real issue, since those are numbers.
+const selfTestIssue = "selftest"
+
+// SelfTestStage is the outcome of one stage of a self-test.
+type SelfTestStage struct {
+	Name   string
+	Passed bool
+	Error  string `json:",omitempty"`
+}
+
+// SelfTestResult is the outcome of a self-test.
+type SelfTestResult struct {
+	Passed bool
+	Stages []SelfTestStage
+}
+
+// SelfTest runs a canned webhook through the processing path of a handler:
+// validation, parsing, a scratch copy of the state, and the construction of
+// the metrics. Nothing is persisted or exported.
+type SelfTest struct {
+	state *maintenancestate.MaintenanceState
+	h     *handler
+}
+
+// NewSelfTest creates a SelfTest of the handler that New would create with
+// the same arguments, apart from the secret.
+func NewSelfTest(state *maintenancestate.MaintenanceState, project string, config Config, options ...Option) *SelfTest {
+	return &SelfTest{
+		state: state,
+		h:     New(state, nil, project, config, options...).(*handler),
+	}
+}
+
+// Run runs every stage of the self-test, stopping at the first that fails.
+func (s *SelfTest) Run() SelfTestResult {
+	var result SelfTestResult
+	var event *Event
+	var changes []maintenancestate.Change
+	var scratch *maintenancestate.MaintenanceState
+	stages := []struct {
+		name string
+		run  func() error
+	}{
+		{"validate", func() error {
+			var err error
+			event, err = s.validate()
+			return err
+		}},
+		{"parse", func() error {
+			var err error
+			changes, err = s.parse(event)
+			return err
+		}},
+		{"state", func() error {
+			var err error
+			scratch, err = s.apply(changes)
+			return err
+		}},
+		{"metrics", func() error {
+			return scratch.CheckMetrics(s.h.project)
+		}},
+	}
+	for _, stage := range stages {
+		err := stage.run()
+		if err != nil {
+			result.Stages = append(result.Stages, SelfTestStage{Name: stage.name, Error: err.Error()})
+			return result
+		}
+		result.Stages = append(result.Stages, SelfTestStage{Name: stage.name, Passed: true})
+	}
+	result.Passed = true
+	return result
+}
+
+// validate checks that the canned webhook is accepted with the right secret,
+// and refused with the wrong one.
+func (s *SelfTest) validate() (*Event, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	machine, ok := selfTestMachines[s.h.project]
+	if !ok {
+		return nil, fmt.Errorf("no self-test machine for project %q", s.h.project)
+	}
+	payload := gmxtest.IssuePayload("opened", gmxtest.Issue{Number: 1, Body: "/machine " + machine})
+	_, err := GitHub{}.Parse(gmxtest.NewWebhook([]byte("wrong"+string(secret)), "issues", payload), secret)
+	if !errors.Is(err, ErrInvalidSignature) {
+		return nil, fmt.Errorf("webhook with the wrong signature was not refused: %v", err)
+	}
+	event, err := GitHub{}.Parse(gmxtest.NewWebhook(secret, "issues", payload), secret)
+	if err != nil {
+		return nil, err
+	}
+	if event.Type != IssueEvent || event.Action != "opened" {
+		return nil, fmt.Errorf("webhook was parsed as a %s %s event", event.Action, event.Type)
+	}
+	return event, nil
+}
+
+// parse checks that the flag in the canned webhook is found.
+func (s *SelfTest) parse(event *Event) ([]maintenancestate.Change, error) {
+	changes := s.h.findFlags(event.Body)
+	machine := selfTestMachines[s.h.project]
+	if len(changes) != 1 || changes[0].Name != machine || changes[0].Action != maintenancestate.EnterMaintenance {
+		return nil, fmt.Errorf("found flags %+v; want machine %s to enter maintenance", changes, machine)
+	}
+	return changes, nil
+}
+
+// apply checks that the changes can be applied to a scratch copy of the
+// state, and that it can be serialized.
+func (s *SelfTest) apply(changes []maintenancestate.Change) (*maintenancestate.MaintenanceState, error) {
+	scratch := s.state.Scratch()
+	for _, c := range changes {
+		scratch.Apply(c, selfTestIssue, s.h.project)
+	}
+	if n := scratch.IssueEntities(selfTestIssue); n != len(changes) {
+		return nil, fmt.Errorf("%d entities entered maintenance; want %d", n, len(changes))
+	}
+	return scratch, scratch.Write()
+}
+
+// ServeHTTP runs the self-test and reports the outcome of every stage. The
+// status is 200 if every stage passed, and 500 otherwise.
+func (s *SelfTest) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	result := s.Run()
+	status := http.StatusOK
+	if !result.Passed {
+		slog.Error("Self-test failed", "stages", fmt.Sprintf("%+v", result.Stages))
+		metrics.CountError("selftest", "handler.SelfTest")
+		status = http.StatusInternalServerError
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	resp.Write(data)
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/go/rtx"
+)
+
+func TestSelfTest(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := maintenancestate.New(dir+"/state.json", cachingClient, "mlab-oti")
+	st := NewSelfTest(s, "mlab-oti", Config{})
+
+	rec := httptest.NewRecorder()
+	st.ServeHTTP(rec, httptest.NewRequest("GET", "/selftest", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ServeHTTP() returned status %d: %s", rec.Code, rec.Body.String())
+	}
+	var result SelfTestResult
+	rtx.Must(json.Unmarshal(rec.Body.Bytes(), &result), "Could not unmarshal response")
+	if !result.Passed || len(result.Stages) != 4 {
+		t.Errorf("self-test result %+v; want all four stages to pass", result)
+	}
+	// Nothing may be left in the real state.
+	if n := s.IssueEntities(selfTestIssue); n != 0 {
+		t.Errorf("self-test left %d entities in maintenance", n)
+	}
+	if !s.Written().IsZero() {
+		t.Errorf("self-test wrote the state")
+	}
+
+	// An alias that hides the canned machine breaks parsing.
+	st = NewSelfTest(s, "mlab-oti", Config{Aliases: Aliases{"mlab1-abc01": "nowhere"}})
+	rec = httptest.NewRecorder()
+	st.ServeHTTP(rec, httptest.NewRequest("GET", "/selftest", nil))
+	rtx.Must(json.Unmarshal(rec.Body.Bytes(), &result), "Could not unmarshal response")
+	if rec.Code != http.StatusInternalServerError || result.Passed || len(result.Stages) != 2 || result.Stages[1].Name != "parse" {
+		t.Errorf("self-test with a broken parser returned status %d and %+v", rec.Code, result)
+	}
+
+	rec = httptest.NewRecorder()
+	st.ServeHTTP(rec, httptest.NewRequest("POST", "/selftest", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("ServeHTTP() POST returned status %d; want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+// StateUpdater is the maintenance state that a handler modifies.
+// *maintenancestate.MaintenanceState implements it, but alternatives, such as
+// one shared between projects or kept remotely, may be used instead. A state
+// that also implements the optional interfaces below supports the features
+// that need them; the handler checks for each of them when it is needed.
+type StateUpdater interface {
+	// UpdateMachine puts a machine into or takes it out of maintenance for
+	// an issue and returns the number of modifications it made.
+	UpdateMachine(machine string, action maintenancestate.Action, issue string, project string) int
+	// UpdateSite is like UpdateMachine, but for a whole site.
+	UpdateSite(site string, action maintenancestate.Action, issue string, project string) int
+	// CloseIssue removes all maintenance of an issue and returns the number
+	// of modifications it made.
+	CloseIssue(issue string, project string) int
+	// Write persists the state.
+	Write() error
+}
+
+// Applier is a StateUpdater that can make changes of every kind, with their
+// expiry and origin. Without it, only machine and site changes are made.
+type Applier interface {
+	Apply(c maintenancestate.Change, issue string, project string) int
+}
+
+// OriginCloser is a StateUpdater that records who closed an issue.
+type OriginCloser interface {
+	CloseIssueFrom(issue string, project string, origin maintenancestate.Origin) int
+}
+
+// SiteResolver is a StateUpdater that knows the machines of every site and
+// the sites of every country. Without it, flags are only checked against the
+// names of the project, and country flags are rejected.
+type SiteResolver interface {
+	SiteMachines(site string) ([]string, error)
+	CountrySites(country string) ([]string, error)
+}
+
+// IssueReader is a StateUpdater that reports what is in maintenance for an
+// issue. Without it, issues are never closed automatically and /status and
+// /undo have nothing to report.
+type IssueReader interface {
+	IssueEntities(issue string) int
+	IssueEntityNames(issue string) []string
+}
+
+// Scheduler is a StateUpdater that can enter maintenance later. Without it,
+// changes with a delay, including the grace period, are refused.
+type Scheduler interface {
+	Schedule(changes []maintenancestate.ScheduledChange) error
+	Unschedule(issue string, name string) int
+	Scheduled() []maintenancestate.ScheduledChange
+}
+
+// Mover is a StateUpdater that can record the maintenance of an issue under
+// another issue. Without it, the maintenance of a transferred issue is
+// removed.
+type Mover interface {
+	MoveIssue(from string, to string, project string) int
+}
+
+// Reverter is a StateUpdater that can remove the maintenance that a comment
+// added. Without it, deleting a comment changes nothing.
+type Reverter interface {
+	RevertComment(issue string, comment int64, project string, origin maintenancestate.Origin) int
+}
+
+// Proposer is a StateUpdater that can hold changes until they are approved.
+// Without it, changes that require approval are refused.
+type Proposer interface {
+	Propose(issue string, changes []maintenancestate.Change) error
+	TakeProposal(issue string) ([]maintenancestate.Change, bool)
+}
+
+// Undoer is a StateUpdater that can remember the changes that /undo reverts.
+type Undoer interface {
+	SetUndo(issue string, changes []maintenancestate.Change) error
+	TakeUndo(issue string) ([]maintenancestate.Change, bool)
+}
+
+// AutoCloser is a StateUpdater that can remember which issues asked to be
+// closed once their maintenance is removed.
+type AutoCloser interface {
+	AutoClose(issue string) bool
+	SetAutoClose(issue string) error
+}
+
+// Milestoner is a StateUpdater that can record the milestones of issues.
+type Milestoner interface {
+	Milestone(issue string) string
+	SetMilestone(issue string, milestone string) error
+}
+
+// DegradedReporter is a StateUpdater that reports whether recent writes have
+// failed, in which case changes are refused.
+type DegradedReporter interface {
+	Degraded() bool
+}
+
+// apply makes a change on behalf of an issue and returns the number of
+// modifications it made.
+func (h *handler) apply(c maintenancestate.Change, issueNumber string) int {
+	if a, ok := h.state.(Applier); ok {
+		return a.Apply(c, issueNumber, h.project)
+	}
+	switch c.Kind {
+	case "machine":
+		return h.state.UpdateMachine(c.Name, c.Action, issueNumber, h.project)
+	case "site":
+		return h.state.UpdateSite(c.Name, c.Action, issueNumber, h.project)
+	}
+	return 0
+}
+
+// closeFrom removes all maintenance of an issue on behalf of origin and
+// returns the number of modifications it made.
+func (h *handler) closeFrom(issueNumber string, origin maintenancestate.Origin) int {
+	if c, ok := h.state.(OriginCloser); ok {
+		return c.CloseIssueFrom(issueNumber, h.project, origin)
+	}
+	return h.state.CloseIssue(issueNumber, h.project)
+}
+
+// countrySites returns the sites of a country.
+func (h *handler) countrySites(country string) ([]string, error) {
+	if r, ok := h.state.(SiteResolver); ok {
+		return r.CountrySites(country)
+	}
+	return nil, errors.New("the state cannot list the sites of a country")
+}
+
+// issueEntities returns the number of machines and sites in maintenance for
+// an issue.
+func (h *handler) issueEntities(issueNumber string) int {
+	if r, ok := h.state.(IssueReader); ok {
+		return r.IssueEntities(issueNumber)
+	}
+	return 0
+}
+
+// issueEntityNames returns the machines and sites in maintenance for an
+// issue.
+func (h *handler) issueEntityNames(issueNumber string) []string {
+	if r, ok := h.state.(IssueReader); ok {
+		return r.IssueEntityNames(issueNumber)
+	}
+	return nil
+}
+
+// scheduled returns the changes that are scheduled.
+func (h *handler) scheduled() []maintenancestate.ScheduledChange {
+	if s, ok := h.state.(Scheduler); ok {
+		return s.Scheduled()
+	}
+	return nil
+}
+
+// unschedule cancels the scheduled changes of an issue to the named entity,
+// or all of them if name is empty, and returns how many were canceled.
+func (h *handler) unschedule(issueNumber string, name string) int {
+	if s, ok := h.state.(Scheduler); ok {
+		return s.Unschedule(issueNumber, name)
+	}
+	return 0
+}
+
+// autoClose reports whether an issue asked to be closed once its maintenance
+// is removed.
+func (h *handler) autoClose(issueNumber string) bool {
+	if a, ok := h.state.(AutoCloser); ok {
+		return a.AutoClose(issueNumber)
+	}
+	return false
+}
+
+// degraded reports whether recent writes of the state have failed.
+func (h *handler) degraded() bool {
+	if d, ok := h.state.(DegradedReporter); ok {
+		return d.Degraded()
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+// fakeState is a StateUpdater that records the changes made to it, and
+// implements none of the optional interfaces.
+type fakeState struct {
+	applied []maintenancestate.Change
+	closed  []string
+	writes  int
+}
+
+func (f *fakeState) UpdateMachine(machine string, action maintenancestate.Action, issue string, project string) int {
+	f.applied = append(f.applied, maintenancestate.Change{Kind: "machine", Name: machine, Action: action})
+	return 1
+}
+func (f *fakeState) UpdateSite(site string, action maintenancestate.Action, issue string, project string) int {
+	f.applied = append(f.applied, maintenancestate.Change{Kind: "site", Name: site, Action: action})
+	return 1
+}
+func (f *fakeState) CloseIssue(issue string, project string) int {
+	f.closed = append(f.closed, issue)
+	return 1
+}
+func (f *fakeState) Write() error {
+	f.writes++
+	return nil
+}
+
+func TestStateUpdater(t *testing.T) {
+	secret := []byte("goodsecret")
+	state := &fakeState{}
+	h := New(state, secret, "mlab-oti", Config{})
+
+	rec := sendHook(h, secret, "issues", `{"action": "opened", "issue": {"number": 1, "body": "/machine mlab1.xyz01\n/site abc02\n/country us"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("opened webhook returned status %d", rec.Code)
+	}
+	want := []maintenancestate.Change{
+		{Kind: "machine", Name: "mlab1-xyz01", Action: maintenancestate.EnterMaintenance},
+		{Kind: "site", Name: "abc02", Action: maintenancestate.EnterMaintenance},
+	}
+	if !reflect.DeepEqual(state.applied, want) {
+		t.Errorf("applied changes %+v; want %+v", state.applied, want)
+	}
+	if !strings.Contains(rec.Body.String(), "Ignored the country flag for US: the state cannot list the sites of a country.") {
+		t.Errorf("response %q does not reject the country flag", rec.Body.String())
+	}
+
+	rec = sendHook(h, secret, "issue_comment", `{"action": "created", "issue": {"number": 1, "state": "open"}, "comment": {"id": 2, "body": "/undo"}}`)
+	if !strings.Contains(rec.Body.String(), "There are no changes to undo.") {
+		t.Errorf("/undo responded %q; want nothing to undo", rec.Body.String())
+	}
+
+	sendHook(h, secret, "issues", `{"action": "closed", "issue": {"number": 1, "state": "closed"}}`)
+	if len(state.closed) != 1 || state.closed[0] != "1" {
+		t.Errorf("closed issues %v; want [1]", state.closed)
+	}
+	if state.writes != 2 {
+		t.Errorf("state was written %d times; want 2", state.writes)
+	}
+}
+
+func TestStateUpdaterRefusals(t *testing.T) {
+	secret := []byte("goodsecret")
+	tests := []struct {
+		name   string
+		config Config
+		want   string
+	}{
+		{
+			name:   "grace-period",
+			config: Config{GracePeriod: time.Hour},
+			want:   "Refused to put machine mlab1-xyz01 into maintenance: the state cannot schedule changes.",
+		},
+		{
+			name:   "approval",
+			config: Config{ApprovalThreshold: 1},
+			want:   "and the state cannot hold them for approval.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &fakeState{}
+			h := New(state, secret, "mlab-oti", tt.config)
+			rec := sendHook(h, secret, "issues", `{"action": "opened", "issue": {"number": 1, "body": "/machine mlab1.xyz01\n/machine mlab2.xyz01"}}`)
+			if len(state.applied) != 0 {
+				t.Errorf("applied changes %+v; want none", state.applied)
+			}
+			if !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("response %q does not contain %q", rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/gcp"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+const (
+	// subscriberBatchSize is the most messages pulled at once.
+	subscriberBatchSize = 10
+	// subscriberRetryDelay is how long to wait after failing to pull.
+	subscriberRetryDelay = 10 * time.Second
+)
+
+// puller pulls messages from a subscription. *gcp.PubSub implements it.
+type puller interface {
+	Pull(ctx context.Context, subscription string, max int) ([]gcp.ReceivedMessage, error)
+	Acknowledge(ctx context.Context, subscription string, ackIDs []string) error
+}
+
+// Subscriber receives webhooks from a Pub/Sub subscription instead of over
+// HTTP, so that deliveries made while the exporter is down are not lost. The
+// data of each message is the body of a webhook, and its attributes are the
+// headers of the delivery (e.g. X-GitHub-Event and X-Hub-Signature-256), as
+// published by a frontend that receives the webhooks.
+type Subscriber struct {
+	subscription string
+	puller       puller
+	h            http.Handler
+	retryDelay   time.Duration
+}
+
+// NewSubscriber creates a Subscriber that passes the webhooks received from
+// subscription to h, which is normally the same handler as serves /webhook.
+func NewSubscriber(pubsub *gcp.PubSub, subscription string, h http.Handler) *Subscriber {
+	return &Subscriber{subscription: subscription, puller: pubsub, h: h, retryDelay: subscriberRetryDelay}
+}
+
+// deliver passes a message to the handler as a webhook, and reports whether
+// it should be acknowledged. Messages that failed with a server error are
+// redelivered, as are those that were rate limited, while those that can
+// never succeed, such as ones with an invalid signature, are not.
+func (s *Subscriber) deliver(m gcp.Message) bool {
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(m.Data))
+	for k, v := range m.Attributes {
+		req.Header.Set(k, v)
+	}
+	req.RemoteAddr = "pubsub"
+	rec := httptest.NewRecorder()
+	s.h.ServeHTTP(rec, req)
+	if rec.Code >= 500 || rec.Code == http.StatusTooManyRequests {
+		slog.Error("Failed to process webhook from Pub/Sub; it will be redelivered",
+			"message", m.MessageID, "delivery", req.Header.Get(deliveryHeader), "status", rec.Code)
+		metrics.CountError("pubsubdeliver", "Subscriber.deliver")
+		return false
+	}
+	if rec.Code >= 400 {
+		slog.Warn("Dropping webhook from Pub/Sub that was refused",
+			"message", m.MessageID, "delivery", req.Header.Get(deliveryHeader), "status", rec.Code)
+	}
+	return true
+}
+
+// Run pulls and delivers webhooks until ctx is canceled.
+func (s *Subscriber) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		msgs, err := s.puller.Pull(ctx, s.subscription, subscriberBatchSize)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("Failed to pull webhooks from Pub/Sub", "subscription", s.subscription, "err", err)
+			metrics.CountError("pubsubpull", "Subscriber.Run")
+			select {
+			case <-ctx.Done():
+			case <-time.After(s.retryDelay):
+			}
+			continue
+		}
+		var acks []string
+		for _, m := range msgs {
+			if s.deliver(m.Message) {
+				acks = append(acks, m.AckID)
+			}
+		}
+		if len(acks) == 0 {
+			continue
+		}
+		if err := s.puller.Acknowledge(ctx, s.subscription, acks); err != nil {
+			// The webhooks will be redelivered, and ignored if deduplicated.
+			slog.Error("Failed to acknowledge webhooks from Pub/Sub", "subscription", s.subscription, "err", err)
+			metrics.CountError("pubsuback", "Subscriber.Run")
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/gcp"
+	"github.com/m-lab/github-maintenance-exporter/gmxtest"
+)
+
+// fakePuller returns its messages from the first pull, fails the second, and
+// then cancels the context.
+type fakePuller struct {
+	mu     sync.Mutex
+	msgs   []gcp.ReceivedMessage
+	pulls  int
+	acked  []string
+	cancel context.CancelFunc
+}
+
+func (f *fakePuller) Pull(ctx context.Context, subscription string, max int) ([]gcp.ReceivedMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pulls++
+	switch f.pulls {
+	case 1:
+		return f.msgs, nil
+	case 2:
+		return nil, errors.New("unavailable")
+	}
+	f.cancel()
+	return nil, ctx.Err()
+}
+
+func (f *fakePuller) Acknowledge(ctx context.Context, subscription string, ackIDs []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.acked = append(f.acked, ackIDs...)
+	return nil
+}
+
+func TestSubscriber(t *testing.T) {
+	secret := []byte("goodsecret")
+	state := &fakeState{}
+	h := New(state, secret, "mlab-oti", Config{})
+	message := func(secret []byte, body string) gcp.Message {
+		payload := gmxtest.IssuePayload("opened", gmxtest.Issue{Number: 1, Body: body})
+		m := gcp.Message{Data: []byte(payload), Attributes: map[string]string{}}
+		header := gmxtest.NewWebhook(secret, "issues", payload).Header
+		for k := range header {
+			m.Attributes[k] = header.Get(k)
+		}
+		return m
+	}
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Github-Event") == "fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+	retried := message(secret, "/site abc02")
+	retried.Attributes["X-Github-Event"] = "fail"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := &fakePuller{
+		msgs: []gcp.ReceivedMessage{
+			{AckID: "ok", Message: message(secret, "/machine mlab1.abc01")},
+			{AckID: "badsig", Message: message([]byte("wrong"), "/site abc01")},
+			{AckID: "retried", Message: retried},
+		},
+		cancel: cancel,
+	}
+	s := &Subscriber{subscription: "webhooks", puller: p, h: failing, retryDelay: time.Millisecond}
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return once the context was canceled")
+	}
+
+	if want := []string{"ok", "badsig"}; !reflect.DeepEqual(p.acked, want) {
+		t.Errorf("acknowledged %v; want %v", p.acked, want)
+	}
+	if len(state.applied) != 1 || state.applied[0].Name != "mlab1-abc01" {
+		t.Errorf("applied changes %+v; want only mlab1-abc01", state.applied)
+	}
+}
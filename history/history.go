@@ -0,0 +1,310 @@
+// Package history keeps a record of every machine and site entering and
+// leaving maintenance, so that the maintenance state at any moment in the past
+// can be reconstructed.
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/notify"
+)
+
+// queueSize is how many transitions may be waiting to be recorded before
+// changes to the state wait for room.
+const queueSize = 1000
+
+// Event records a machine, site, experiment or switch entering or leaving
+// maintenance.
+type Event struct {
+	Time time.Time
+	// Project is the project of the state that the entity is in. Events
+	// recorded before histories were kept per project have none, and belong
+	// to the default project of the Store.
+	Project string `json:",omitempty"`
+	// Kind is "machine", "site", "experiment" or "switch".
+	Kind string
+	Name string
+	// Action is either "enter" or "leave".
+	Action string
+	Issue  string `json:",omitempty"`
+}
+
+// Store is an append-only file of Events. Its Queue records the transitions
+// of the states it listens to.
+type Store struct {
+	*notify.Queue
+	mu             sync.Mutex
+	filename       string
+	file           *os.File
+	defaultProject string
+	// projects holds the projects that have events in the history.
+	projects map[string]bool
+}
+
+// Open opens the history in filename, creating it if necessary. Events
+// without a project belong to defaultProject.
+func Open(filename string, defaultProject string) (*Store, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		filename:       filename,
+		file:           f,
+		defaultProject: defaultProject,
+		projects:       make(map[string]bool),
+	}
+	s.Queue = notify.NewQueue("history.Store", queueSize, s.record)
+	// A dropped transition would make At wrong from then on, so the state
+	// waits for room instead.
+	s.Queue.Block = true
+	err = s.scan(func(e Event) {
+		s.projects[e.Project] = true
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// scan calls f for every event in the history, in the order in which they
+// were appended, with the project of each event filled in.
+func (s *Store) scan(f func(e Event)) error {
+	file, err := os.Open(s.filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	n := 0
+	for scanner.Scan() {
+		n++
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("corrupt history %s at line %d: %v", s.filename, n, err)
+		}
+		if e.Project == "" {
+			e.Project = s.defaultProject
+		}
+		f(e)
+	}
+	return scanner.Err()
+}
+
+// Append adds events to the history.
+func (s *Store) Append(events ...Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf []byte
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	_, err := s.file.Write(buf)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		if e.Project == "" {
+			e.Project = s.defaultProject
+		}
+		s.projects[e.Project] = true
+	}
+	return nil
+}
+
+// Seed records every entity in snapshot as having entered maintenance in
+// project at t, if the history has no events of project. It lets a history
+// that is started alongside an existing state account for what is already in
+// maintenance.
+func (s *Store) Seed(project string, snapshot maintenancestate.Snapshot, t time.Time) error {
+	s.mu.Lock()
+	seeded := s.projects[project]
+	s.mu.Unlock()
+	if seeded {
+		return nil
+	}
+	var events []Event
+	for kind, m := range snapshotMaps(snapshot) {
+		for name, issues := range m {
+			events = append(events, Event{Time: t.UTC(), Project: project, Kind: kind, Name: name, Action: "enter", Issue: issues[0]})
+		}
+	}
+	return s.Append(events...)
+}
+
+// record appends the event of a transition to the history.
+func (s *Store) record(ctx context.Context, t maintenancestate.Transition) error {
+	return s.Append(Event{Time: t.Time.UTC(), Project: t.Project, Kind: t.Kind, Name: t.Name, Action: t.Action.String(), Issue: t.Issue})
+}
+
+// snapshotMaps returns the maps of snapshot keyed by the kind of entity they
+// hold.
+func snapshotMaps(snapshot maintenancestate.Snapshot) map[string]map[string][]string {
+	return map[string]map[string][]string{
+		"machine":    snapshot.Machines,
+		"site":       snapshot.Sites,
+		"experiment": snapshot.Experiments,
+		"switch":     snapshot.Switches,
+	}
+}
+
+// At reconstructs the entities that were in maintenance in project at t. Each
+// is listed with the issue for which it entered maintenance.
+func (s *Store) At(project string, t time.Time) (maintenancestate.Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := maintenancestate.Snapshot{
+		Machines:    map[string][]string{},
+		Sites:       map[string][]string{},
+		Experiments: map[string][]string{},
+		Switches:    map[string][]string{},
+	}
+	maps := snapshotMaps(snapshot)
+	err := s.scan(func(e Event) {
+		if e.Project != project || e.Time.After(t) {
+			return
+		}
+		m, ok := maps[e.Kind]
+		if !ok {
+			return
+		}
+		if e.Action == "enter" {
+			m[e.Name] = []string{e.Issue}
+		} else {
+			delete(m, e.Name)
+		}
+	})
+	return snapshot, err
+}
+
+// Compact rewrites the history, dropping events that do not change what was in
+// maintenance, such as an entity entering maintenance while already in it.
+// If maxAge is positive, entities that left maintenance more than maxAge
+// before now are forgotten, and if maxBytes is positive, the entities that
+// left maintenance longest ago are forgotten until the history fits in
+// maxBytes. Entities are forgotten by dropping both the event in which they
+// entered maintenance and the one in which they left it, so queries for any
+// time after the forgotten entities left maintenance are still answered
+// correctly. The return value is the number of events removed.
+func (s *Store) Compact(now time.Time, maxAge time.Duration, maxBytes int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.filename)
+	if err != nil {
+		return 0, err
+	}
+	var events []Event
+	var sizes []int64
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return 0, fmt.Errorf("corrupt history %s at line %d: %v", s.filename, len(events)+1, err)
+		}
+		events = append(events, e)
+		sizes = append(sizes, int64(len(scanner.Bytes())+1))
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	// Find the redundant events, and pair each remaining leave with the
+	// enter before it.
+	type pair struct{ enter, leave int }
+	var pairs []pair
+	drop := make([]bool, len(events))
+	open := make(map[string]int)
+	for i, e := range events {
+		project := e.Project
+		if project == "" {
+			project = s.defaultProject
+		}
+		key := project + "/" + e.Kind + "/" + e.Name
+		enter, ok := open[key]
+		switch {
+		case e.Action == "enter" && !ok:
+			open[key] = i
+		case e.Action != "enter" && ok:
+			pairs = append(pairs, pair{enter: enter, leave: i})
+			delete(open, key)
+		default:
+			drop[i] = true
+		}
+	}
+	size := int64(0)
+	for i := range events {
+		if !drop[i] {
+			size += sizes[i]
+		}
+	}
+
+	// Forget the entities that left maintenance longest ago first.
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return events[pairs[i].leave].Time.Before(events[pairs[j].leave].Time)
+	})
+	for _, p := range pairs {
+		tooOld := maxAge > 0 && now.Sub(events[p.leave].Time) > maxAge
+		tooBig := maxBytes > 0 && size > maxBytes
+		if !tooOld && !tooBig {
+			break
+		}
+		drop[p.enter], drop[p.leave] = true, true
+		size -= sizes[p.enter] + sizes[p.leave]
+	}
+
+	removed := 0
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i, e := range events {
+		if drop[i] {
+			removed++
+			continue
+		}
+		enc.Encode(e)
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	// Replace the file atomically, then continue appending to the new one.
+	tmp := s.filename + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, s.filename); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(s.filename, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	s.file.Close()
+	s.file = f
+	return removed, nil
+}
+
+// Close closes the file of the history. If Run was started, it first waits for
+// it to return, having recorded every queued transition.
+func (s *Store) Close() error {
+	s.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
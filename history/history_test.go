@@ -0,0 +1,228 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/go/rtx"
+)
+
+func TestAt(t *testing.T) {
+	filename := t.TempDir() + "/history.log"
+	s, err := Open(filename, "mlab-oti")
+	rtx.Must(err, "Could not open history")
+	defer s.Close()
+
+	t0 := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	rtx.Must(s.Seed("mlab-oti", maintenancestate.Snapshot{Sites: map[string][]string{"abc01": {"1"}}}, t0), "Could not seed history")
+	rtx.Must(s.Append(
+		Event{Time: t0.Add(time.Hour), Kind: "machine", Name: "mlab1-xyz01", Action: "enter", Issue: "2"},
+		Event{Time: t0.Add(time.Hour), Kind: "switch", Name: "s1-xyz01", Action: "enter", Issue: "2"},
+		Event{Time: t0.Add(2 * time.Hour), Kind: "site", Name: "abc01", Action: "leave", Issue: "1"},
+	), "Could not append")
+	// Seeding a history that is not empty does nothing.
+	rtx.Must(s.Seed("mlab-oti", maintenancestate.Snapshot{Sites: map[string][]string{"def01": {"3"}}}, t0), "Could not seed history")
+
+	tests := []struct {
+		at           time.Time
+		wantMachines map[string][]string
+		wantSites    map[string][]string
+	}{
+		{at: t0.Add(-time.Hour), wantMachines: map[string][]string{}, wantSites: map[string][]string{}},
+		{at: t0, wantMachines: map[string][]string{}, wantSites: map[string][]string{"abc01": {"1"}}},
+		{at: t0.Add(90 * time.Minute), wantMachines: map[string][]string{"mlab1-xyz01": {"2"}}, wantSites: map[string][]string{"abc01": {"1"}}},
+		{at: t0.Add(3 * time.Hour), wantMachines: map[string][]string{"mlab1-xyz01": {"2"}}, wantSites: map[string][]string{}},
+	}
+	for _, tt := range tests {
+		got, err := s.At("mlab-oti", tt.at)
+		if err != nil {
+			t.Fatalf("At(%v) error = %v", tt.at, err)
+		}
+		if !reflect.DeepEqual(got.Machines, tt.wantMachines) || !reflect.DeepEqual(got.Sites, tt.wantSites) {
+			t.Errorf("At(%v) = %+v; want machines %v and sites %v", tt.at, got, tt.wantMachines, tt.wantSites)
+		}
+	}
+
+	got, _ := s.At("mlab-oti", t0.Add(90*time.Minute))
+	if !reflect.DeepEqual(got.Switches, map[string][]string{"s1-xyz01": {"2"}}) || len(got.Experiments) != 0 {
+		t.Errorf("At() = %+v; want switch s1-xyz01 and no experiments", got)
+	}
+
+	rtx.Must(os.WriteFile(filename, []byte("{"), 0644), "Could not corrupt history")
+	if _, err := s.At("mlab-oti", t0); err == nil {
+		t.Error("At() should fail for a corrupt history")
+	}
+}
+
+func TestProjects(t *testing.T) {
+	filename := t.TempDir() + "/history.log"
+	t0 := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	// An event recorded before histories were kept per project.
+	rtx.Must(os.WriteFile(filename, []byte(`{"Time":"2030-01-01T00:00:00Z","Kind":"site","Name":"abc01","Action":"enter","Issue":"1"}`+"\n"), 0644), "Could not write history")
+	s, err := Open(filename, "mlab-oti")
+	rtx.Must(err, "Could not open history")
+	defer s.Close()
+
+	// Only the project without events is seeded.
+	rtx.Must(s.Seed("mlab-oti", maintenancestate.Snapshot{Sites: map[string][]string{"def01": {"2"}}}, t0), "Could not seed history")
+	rtx.Must(s.Seed("mlab-sandbox", maintenancestate.Snapshot{Sites: map[string][]string{"abc01": {"3"}}}, t0), "Could not seed history")
+	rtx.Must(s.Append(
+		Event{Time: t0.Add(time.Hour), Project: "mlab-sandbox", Kind: "site", Name: "abc01", Action: "leave", Issue: "3"},
+	), "Could not append")
+
+	tests := []struct {
+		project string
+		at      time.Time
+		want    map[string][]string
+	}{
+		{project: "mlab-oti", at: t0, want: map[string][]string{"abc01": {"1"}}},
+		{project: "mlab-oti", at: t0.Add(2 * time.Hour), want: map[string][]string{"abc01": {"1"}}},
+		{project: "mlab-sandbox", at: t0, want: map[string][]string{"abc01": {"3"}}},
+		{project: "mlab-sandbox", at: t0.Add(2 * time.Hour), want: map[string][]string{}},
+		{project: "mlab-staging", at: t0, want: map[string][]string{}},
+	}
+	for _, tt := range tests {
+		got, err := s.At(tt.project, tt.at)
+		if err != nil || !reflect.DeepEqual(got.Sites, tt.want) {
+			t.Errorf("At(%s, %v) = %v, %v; want %v", tt.project, tt.at, got.Sites, err, tt.want)
+		}
+	}
+
+	// The same site in two projects is compacted separately.
+	if n, err := s.Compact(t0.Add(2*time.Hour), time.Minute, 0); n != 2 || err != nil {
+		t.Errorf("Compact() = %d, %v; want 2, nil", n, err)
+	}
+	if got, _ := s.At("mlab-oti", t0); !reflect.DeepEqual(got.Sites, map[string][]string{"abc01": {"1"}}) {
+		t.Errorf("At() after compaction = %v; want abc01 in maintenance", got.Sites)
+	}
+}
+
+func TestRun(t *testing.T) {
+	filename := t.TempDir() + "/history.log"
+	s, err := Open(filename, "mlab-oti")
+	rtx.Must(err, "Could not open history")
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	now := time.Now()
+	s.Transition(maintenancestate.Transition{
+		Kind:   "machine",
+		Name:   "mlab1-abc01",
+		Action: maintenancestate.EnterMaintenance,
+		Issue:  "1",
+		Time:   now,
+	})
+	for i := 0; i < 100; i++ {
+		if data, _ := os.ReadFile(filename); len(data) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	got, err := s.At("mlab-oti", now)
+	if err != nil || !reflect.DeepEqual(got.Machines, map[string][]string{"mlab1-abc01": {"1"}}) {
+		t.Errorf("At() = %+v, %v; want mlab1-abc01 in maintenance", got, err)
+	}
+}
+
+func TestRunQueueFull(t *testing.T) {
+	filename := t.TempDir() + "/history.log"
+	s, err := Open(filename, "mlab-oti")
+	rtx.Must(err, "Could not open history")
+	defer s.Close()
+
+	// Queue more transitions than fit; the last ones wait for room.
+	now := time.Now()
+	n := queueSize + 10
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < n; i++ {
+			s.Transition(maintenancestate.Transition{
+				Kind:   "machine",
+				Name:   fmt.Sprintf("mlab1-abc%04d", i),
+				Action: maintenancestate.EnterMaintenance,
+				Issue:  "1",
+				Time:   now,
+			})
+		}
+	}()
+	select {
+	case <-sent:
+		t.Fatal("Transition() did not wait for room in a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Run records everything still queued before it returns.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Run(ctx)
+	<-sent
+	got, err := s.At("mlab-oti", now)
+	if err != nil || len(got.Machines) != n {
+		t.Errorf("At() = %d machines, %v; want %d", len(got.Machines), err, n)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	filename := t.TempDir() + "/history.log"
+	s, err := Open(filename, "mlab-oti")
+	rtx.Must(err, "Could not open history")
+	defer s.Close()
+
+	t0 := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	event := func(hours int, name, action string) Event {
+		return Event{Time: t0.Add(time.Duration(hours) * time.Hour), Kind: "machine", Name: name, Action: action, Issue: "1"}
+	}
+	rtx.Must(s.Append(
+		event(0, "mlab1-abc01", "enter"),
+		event(1, "mlab2-abc01", "enter"),
+		event(2, "mlab1-abc01", "enter"), // Redundant.
+		event(3, "mlab1-abc01", "leave"),
+		event(4, "mlab3-abc01", "enter"),
+		event(5, "mlab3-abc01", "leave"),
+		event(6, "mlab3-abc01", "leave"), // Redundant.
+	), "Could not append")
+
+	// Only the redundant events are removed without a retention policy.
+	if n, err := s.Compact(t0.Add(10*time.Hour), 0, 0); n != 2 || err != nil {
+		t.Errorf("Compact() = %d, %v; want 2, nil", n, err)
+	}
+	if n, err := s.Compact(t0.Add(10*time.Hour), 0, 0); n != 0 || err != nil {
+		t.Errorf("Compact() of a compacted history = %d, %v; want 0, nil", n, err)
+	}
+
+	// mlab1-abc01 left more than 6 hours ago; mlab3-abc01 did not.
+	if n, err := s.Compact(t0.Add(10*time.Hour), 6*time.Hour, 0); n != 2 || err != nil {
+		t.Errorf("Compact() with a maximum age = %d, %v; want 2, nil", n, err)
+	}
+	got, _ := s.At("mlab-oti", t0.Add(6*time.Hour))
+	want := map[string][]string{"mlab2-abc01": {"1"}}
+	if !reflect.DeepEqual(got.Machines, want) {
+		t.Errorf("At() after compaction = %v; want %v", got.Machines, want)
+	}
+
+	// Appending continues after compaction, and an entity that is still in
+	// maintenance is never forgotten to save space.
+	rtx.Must(s.Append(event(7, "mlab4-abc01", "enter")), "Could not append")
+	if n, err := s.Compact(t0.Add(10*time.Hour), 0, 1); n != 2 || err != nil {
+		t.Errorf("Compact() with a maximum size = %d, %v; want 2, nil", n, err)
+	}
+	got, _ = s.At("mlab-oti", t0.Add(10*time.Hour))
+	want = map[string][]string{"mlab2-abc01": {"1"}, "mlab4-abc01": {"1"}}
+	if !reflect.DeepEqual(got.Machines, want) {
+		t.Errorf("At() after compaction = %v; want %v", got.Machines, want)
+	}
+}
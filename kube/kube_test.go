@@ -0,0 +1,61 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInClusterOutsideCluster(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	if _, err := InCluster("default", time.Second); err == nil {
+		t.Error("InCluster() outside of a cluster returned nil error")
+	}
+}
+
+func TestInClusterMissingCredentials(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+	defer func(d string) { serviceAccountDir = d }(serviceAccountDir)
+	serviceAccountDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(serviceAccountDir, "token"), []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InCluster("default", time.Second); err == nil {
+		t.Error("InCluster() without a CA certificate returned nil error")
+	}
+}
+
+func TestDo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("unexpected Authorization header: %q", got)
+		}
+		switch r.URL.Path {
+		case "/echo":
+			var v map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+				t.Errorf("could not decode body: %v", err)
+			}
+			json.NewEncoder(w).Encode(v)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	c := &Client{URL: srv.URL, Token: "secret", HTTP: srv.Client()}
+	var got map[string]string
+	if err := c.Do(context.Background(), http.MethodPost, "/echo", map[string]string{"a": "b"}, &got); err != nil || got["a"] != "b" {
+		t.Errorf("Do() = %v, %v; want map[a:b]", got, err)
+	}
+	err := c.Do(context.Background(), http.MethodGet, "/missing", nil, nil)
+	if !IsStatus(err, http.StatusNotFound) {
+		t.Errorf("Do() of a missing path = %v; want a 404 StatusError", err)
+	}
+}
@@ -0,0 +1,328 @@
+// Package leader elects one of several replicas of the exporter as the leader,
+// which alone processes webhooks and writes the state, by holding a
+// Kubernetes Lease. The other replicas forward webhooks to the leader and
+// serve the state and metrics read-only.
+package leader
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/kube"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+const (
+	// addressAnnotation is the annotation of the lease holding the address
+	// at which the leader accepts forwarded requests.
+	addressAnnotation = "gmx.measurementlab.net/leader-address"
+	// tokenAnnotation is the annotation of the lease holding the token with
+	// which followers mark the requests they forward to the leader.
+	tokenAnnotation = "gmx.measurementlab.net/leader-token"
+	// forwardedHeader marks requests forwarded by a follower, so that they
+	// are never forwarded again. It holds the token of the leader.
+	forwardedHeader = "X-GMX-Forwarded"
+	// microTimeFormat is the format of the times of a Lease.
+	microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// microTime is a time in the format of a Kubernetes MicroTime.
+type microTime struct {
+	time.Time
+}
+
+func (t microTime) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + t.UTC().Format(microTimeFormat) + `"`), nil
+}
+
+type leaseMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string     `json:"holderIdentity"`
+	LeaseDurationSeconds int        `json:"leaseDurationSeconds"`
+	AcquireTime          *microTime `json:"acquireTime,omitempty"`
+	RenewTime            *microTime `json:"renewTime,omitempty"`
+	LeaseTransitions     int        `json:"leaseTransitions"`
+}
+
+// lease is the subset of a Kubernetes coordination.k8s.io/v1 Lease that is
+// used.
+type lease struct {
+	APIVersion string    `json:"apiVersion"`
+	Kind       string    `json:"kind"`
+	Metadata   leaseMeta `json:"metadata"`
+	Spec       leaseSpec `json:"spec"`
+}
+
+// Elector competes for a Lease with the other replicas.
+type Elector struct {
+	// OnChange, if not nil, is called before the replica starts leading,
+	// with true, and after it stops, with false. When Run returns, the lease
+	// is released only after OnChange(false) returns.
+	OnChange func(leading bool)
+
+	client   *kube.Client
+	name     string
+	address  string
+	token    string
+	duration time.Duration
+	now      func() time.Time
+
+	// renewed is when Run last renewed the lease.
+	renewed time.Time
+
+	mu            sync.Mutex
+	leading       bool
+	leaderAddress string
+	leaderToken   string
+}
+
+// New creates an Elector for the Lease called name in the namespace of
+// client. The replica is identified by the name of its pod, and accepts
+// forwarded requests at address (HOST:PORT). A leader that fails to renew the
+// lease within duration loses it to another replica.
+func New(client *kube.Client, name string, address string, duration time.Duration) *Elector {
+	return &Elector{client: client, name: name, address: address, token: newToken(), duration: duration, now: time.Now}
+}
+
+// newToken returns a random token, which only the replicas can read from the
+// lease.
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Leading reports whether the replica is the leader.
+func (e *Elector) Leading() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leading
+}
+
+// LeaderAddress returns the address of the leader, or "" if it is unknown.
+func (e *Elector) LeaderAddress() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leading {
+		return e.address
+	}
+	return e.leaderAddress
+}
+
+// setLeading records whether the replica leads. Only Run calls it.
+func (e *Elector) setLeading(leading bool) {
+	if e.Leading() == leading {
+		return
+	}
+	if leading {
+		slog.Info("Became the leader", "lease", e.name)
+		if e.OnChange != nil {
+			e.OnChange(true)
+		}
+		metrics.Leader.Set(1)
+	} else {
+		slog.Info("Stopped leading", "lease", e.name)
+		metrics.Leader.Set(0)
+	}
+	e.mu.Lock()
+	e.leading = leading
+	e.mu.Unlock()
+	if !leading && e.OnChange != nil {
+		e.OnChange(false)
+	}
+}
+
+func (e *Elector) path() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + e.client.Namespace + "/leases/" + e.name
+}
+
+// tryAcquireOrRenew creates, takes over or renews the lease, and reports
+// whether the replica holds it.
+func (e *Elector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	now := e.now()
+	var l lease
+	err := e.client.Do(ctx, http.MethodGet, e.path(), nil, &l)
+	if kube.IsStatus(err, http.StatusNotFound) {
+		l = lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   leaseMeta{Name: e.name, Namespace: e.client.Namespace},
+		}
+		e.hold(&l, now)
+		err = e.client.Do(ctx, http.MethodPost, "/apis/coordination.k8s.io/v1/namespaces/"+e.client.Namespace+"/leases", l, nil)
+		if kube.IsStatus(err, http.StatusConflict) {
+			// Another replica created it first.
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if l.Spec.HolderIdentity != e.client.Pod && l.Spec.HolderIdentity != "" && l.Spec.RenewTime != nil &&
+		now.Before(l.Spec.RenewTime.Add(time.Duration(l.Spec.LeaseDurationSeconds)*time.Second)) {
+		e.mu.Lock()
+		e.leaderAddress = l.Metadata.Annotations[addressAnnotation]
+		e.leaderToken = l.Metadata.Annotations[tokenAnnotation]
+		e.mu.Unlock()
+		return false, nil
+	}
+	e.hold(&l, now)
+	err = e.client.Do(ctx, http.MethodPut, e.path(), l, nil)
+	if kube.IsStatus(err, http.StatusConflict) {
+		// Another replica updated it first.
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// hold sets l to be held by the replica from now.
+func (e *Elector) hold(l *lease, now time.Time) {
+	if l.Spec.HolderIdentity != e.client.Pod {
+		if l.Spec.HolderIdentity != "" {
+			l.Spec.LeaseTransitions++
+		}
+		l.Spec.HolderIdentity = e.client.Pod
+		l.Spec.AcquireTime = &microTime{now}
+	}
+	l.Spec.RenewTime = &microTime{now}
+	l.Spec.LeaseDurationSeconds = int(e.duration.Round(time.Second) / time.Second)
+	if l.Metadata.Annotations == nil {
+		l.Metadata.Annotations = map[string]string{}
+	}
+	l.Metadata.Annotations[addressAnnotation] = e.address
+	l.Metadata.Annotations[tokenAnnotation] = e.token
+}
+
+// release gives up the lease, so that another replica can take over without
+// waiting for it to expire.
+func (e *Elector) release(ctx context.Context) error {
+	var l lease
+	if err := e.client.Do(ctx, http.MethodGet, e.path(), nil, &l); err != nil {
+		return err
+	}
+	if l.Spec.HolderIdentity != e.client.Pod {
+		return nil
+	}
+	l.Spec.HolderIdentity = ""
+	l.Spec.LeaseDurationSeconds = 1
+	delete(l.Metadata.Annotations, addressAnnotation)
+	delete(l.Metadata.Annotations, tokenAnnotation)
+	return e.client.Do(ctx, http.MethodPut, e.path(), l, nil)
+}
+
+// Run competes for the lease, and renews it while leading, until ctx is
+// canceled, when the lease is released.
+func (e *Elector) Run(ctx context.Context) {
+	tick := time.NewTicker(e.duration / 3)
+	defer tick.Stop()
+	for {
+		held, err := e.tryAcquireOrRenew(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Failed to acquire or renew the lease", "lease", e.name, "err", err)
+			metrics.CountError("lease", "leader.Elector.Run")
+		}
+		now := e.now()
+		switch {
+		case held:
+			e.renewed = now
+			e.setLeading(true)
+		case err == nil || now.Sub(e.renewed) > e.duration*2/3:
+			// Stop leading before the lease can expire and be taken by
+			// another replica.
+			e.setLeading(false)
+		}
+		select {
+		case <-ctx.Done():
+			if e.Leading() {
+				e.setLeading(false)
+				rctx, cancel := context.WithTimeout(context.Background(), e.duration/3)
+				if err := e.release(rctx); err != nil {
+					slog.Error("Failed to release the lease", "lease", e.name, "err", err)
+					metrics.CountError("lease", "leader.Elector.Run")
+				}
+				cancel()
+			}
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// Forward returns a handler that serves requests with h while leading, and
+// otherwise forwards them to the leader. Requests are refused with 503
+// Service Unavailable if the leader is unknown.
+func (e *Elector) Forward(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e.Leading() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		e.mu.Lock()
+		address, token := e.leaderAddress, e.leaderToken
+		e.mu.Unlock()
+		if address == "" || address == e.address || r.Header.Get(forwardedHeader) != "" {
+			http.Error(w, "No leader is available; try again later", http.StatusServiceUnavailable)
+			return
+		}
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(&url.URL{Scheme: "http", Host: address})
+				// The leader sees the address from which the follower
+				// received the request as the last X-Forwarded-For entry.
+				pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+				pr.SetXForwarded()
+				pr.Out.Header.Set(forwardedHeader, token)
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				slog.Error("Failed to forward a request to the leader", "path", r.URL.Path, "leader", address, "err", err)
+				metrics.CountError("forward", "leader.Elector.Forward")
+				http.Error(w, "Could not reach the leader; try again later", http.StatusBadGateway)
+			},
+		}
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// Forwarded reports whether r was forwarded to the leader by a follower,
+// which appended the address from which it received r to X-Forwarded-For.
+func (e *Elector) Forwarded(r *http.Request) bool {
+	header := r.Header.Get(forwardedHeader)
+	return e.token != "" && e.Leading() &&
+		subtle.ConstantTimeCompare([]byte(header), []byte(e.token)) == 1
+}
+
+// leaderListener passes transitions on only while the replica leads.
+type leaderListener struct {
+	e *Elector
+	l maintenancestate.Listener
+}
+
+func (ll leaderListener) Transition(t maintenancestate.Transition) {
+	if ll.e.Leading() {
+		ll.l.Transition(t)
+	}
+}
+
+// Listener returns a listener that passes transitions to l only while the
+// replica leads, so that the transitions followers see when they reload the
+// state are not reported twice.
+func (e *Elector) Listener(l maintenancestate.Listener) maintenancestate.Listener {
+	return leaderListener{e: e, l: l}
+}
@@ -0,0 +1,239 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/kube"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+// fakeAPI is a Kubernetes API server holding a single lease, which rejects
+// updates of stale versions of it.
+type fakeAPI struct {
+	mu      sync.Mutex
+	lease   *lease
+	version int
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	const leases = "/apis/coordination.k8s.io/v1/namespaces/gmx/leases"
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == leases+"/gmx":
+		if f.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(f.lease)
+	case r.Method == http.MethodPost && r.URL.Path == leases:
+		var l lease
+		json.NewDecoder(r.Body).Decode(&l)
+		if f.lease != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.store(l)
+	case r.Method == http.MethodPut && r.URL.Path == leases+"/gmx":
+		var l lease
+		json.NewDecoder(r.Body).Decode(&l)
+		if f.lease == nil || l.Metadata.ResourceVersion != f.lease.Metadata.ResourceVersion {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.store(l)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// store saves l with a new version.
+func (f *fakeAPI) store(l lease) {
+	f.version++
+	l.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.lease = &l
+}
+
+func newElector(srv *httptest.Server, pod, address string) *Elector {
+	client := &kube.Client{URL: srv.URL, Namespace: "gmx", Pod: pod, HTTP: srv.Client()}
+	return New(client, "gmx", address, 15*time.Second)
+}
+
+func TestElection(t *testing.T) {
+	api := &fakeAPI{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	ctx := context.Background()
+
+	a := newElector(srv, "gmx-a", "10.0.0.1:9999")
+	b := newElector(srv, "gmx-b", "10.0.0.2:9999")
+	if held, err := a.tryAcquireOrRenew(ctx); !held || err != nil {
+		t.Fatalf("a.tryAcquireOrRenew() = %v, %v; want true", held, err)
+	}
+	if held, err := b.tryAcquireOrRenew(ctx); held || err != nil {
+		t.Fatalf("b.tryAcquireOrRenew() of a held lease = %v, %v; want false", held, err)
+	}
+	if got := b.LeaderAddress(); got != "10.0.0.1:9999" {
+		t.Errorf("b.LeaderAddress() = %q; want 10.0.0.1:9999", got)
+	}
+	if held, err := a.tryAcquireOrRenew(ctx); !held || err != nil {
+		t.Fatalf("a.tryAcquireOrRenew() renewal = %v, %v; want true", held, err)
+	}
+
+	// Once a stops renewing the lease, b takes it over.
+	b.now = func() time.Time { return time.Now().Add(time.Minute) }
+	if held, err := b.tryAcquireOrRenew(ctx); !held || err != nil {
+		t.Fatalf("b.tryAcquireOrRenew() of an expired lease = %v, %v; want true", held, err)
+	}
+	if api.lease.Spec.HolderIdentity != "gmx-b" || api.lease.Spec.LeaseTransitions != 1 {
+		t.Errorf("lease = %+v; want held by gmx-b after 1 transition", api.lease.Spec)
+	}
+	if held, err := a.tryAcquireOrRenew(ctx); held || err != nil {
+		t.Errorf("a.tryAcquireOrRenew() of a lease taken over = %v, %v; want false", held, err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	api := &fakeAPI{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	e := newElector(srv, "gmx-a", "10.0.0.1:9999")
+	var mu sync.Mutex
+	var changes []bool
+	e.OnChange = func(leading bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		// OnChange(true) is called before the replica leads.
+		if leading && e.Leading() {
+			t.Error("OnChange(true) called while already leading")
+		}
+		// OnChange(false) is called before the lease is released, so that
+		// the state can be saved before another replica takes over.
+		if !leading {
+			api.mu.Lock()
+			if holder := api.lease.Spec.HolderIdentity; holder != "gmx-a" {
+				t.Errorf("OnChange(false) called with the lease held by %q; want gmx-a", holder)
+			}
+			api.mu.Unlock()
+		}
+		changes = append(changes, leading)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx)
+		close(done)
+	}()
+	for start := time.Now(); !e.Leading(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting to lead")
+		}
+	}
+	cancel()
+	<-done
+	if e.Leading() {
+		t.Error("Leading() = true after Run returned")
+	}
+	if got := fmt.Sprint(changes); got != "[true false]" {
+		t.Errorf("OnChange calls = %s; want [true false]", got)
+	}
+	// The lease is released, so that another replica takes over at once.
+	b := newElector(srv, "gmx-b", "10.0.0.2:9999")
+	if held, err := b.tryAcquireOrRenew(context.Background()); !held || err != nil {
+		t.Errorf("b.tryAcquireOrRenew() of a released lease = %v, %v; want true", held, err)
+	}
+}
+
+func TestForward(t *testing.T) {
+	leaderSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "leader %s %s %s", r.URL.Path, r.Header.Get("X-Forwarded-For"), r.Header.Get(forwardedHeader))
+	}))
+	defer leaderSrv.Close()
+
+	e := &Elector{client: &kube.Client{Pod: "gmx-b"}, address: "10.0.0.2:9999", token: "b-token"}
+	h := e.Forward(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "local")
+	}))
+
+	// Without a known leader, requests are refused.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/webhook", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Forward() without a leader returned %d; want 503", rec.Code)
+	}
+
+	// Followers forward requests to the leader.
+	e.leaderAddress = strings.TrimPrefix(leaderSrv.URL, "http://")
+	e.leaderToken = "a-token"
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader("{}"))
+	req.Header.Set("X-Forwarded-For", "192.30.252.1")
+	h.ServeHTTP(rec, req)
+	// The follower appends the address it received the request from.
+	if got := rec.Body.String(); rec.Code != http.StatusOK || got != "leader /webhook 192.30.252.1, 192.0.2.1 a-token" {
+		t.Errorf("Forward() by a follower = %d %q; want the leader's response", rec.Code, got)
+	}
+
+	// Forwarded requests are not forwarded again.
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/webhook", nil)
+	req.Header.Set(forwardedHeader, "gmx-c")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Forward() of a forwarded request returned %d; want 503", rec.Code)
+	}
+
+	// The leader serves requests itself.
+	e.leading = true
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/webhook", nil))
+	if got := rec.Body.String(); got != "local" {
+		t.Errorf("Forward() by the leader = %q; want local", got)
+	}
+}
+
+func TestForwarded(t *testing.T) {
+	e := &Elector{token: "b-token"}
+	req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+	req.Header.Set(forwardedHeader, "b-token")
+	if e.Forwarded(req) {
+		t.Error("Forwarded() = true for a follower")
+	}
+	e.leading = true
+	if !e.Forwarded(req) {
+		t.Error("Forwarded() = false for a request with the leader's token")
+	}
+	req.Header.Set(forwardedHeader, "gmx-a")
+	if e.Forwarded(req) {
+		t.Error("Forwarded() = true for a request with another token")
+	}
+	if e := (&Elector{leading: true}); e.Forwarded(httptest.NewRequest(http.MethodPost, "/webhook", nil)) {
+		t.Error("Forwarded() = true without a token")
+	}
+}
+
+type countingListener struct{ n int }
+
+func (c *countingListener) Transition(maintenancestate.Transition) { c.n++ }
+
+func TestListener(t *testing.T) {
+	e := &Elector{}
+	c := &countingListener{}
+	l := e.Listener(c)
+	l.Transition(maintenancestate.Transition{})
+	e.leading = true
+	l.Transition(maintenancestate.Transition{})
+	if c.n != 1 {
+		t.Errorf("%d transitions passed on; want only the 1 made while leading", c.n)
+	}
+}
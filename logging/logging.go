@@ -0,0 +1,80 @@
+// Package logging sets up structured logging with log/slog, in either text or
+// JSON, so that logs can be queried by their fields. Lines that are still
+// logged with the standard log package are logged through slog too, at the
+// level given by their prefix, e.g. "ERROR: ".
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// prefixes maps the prefixes of lines logged with the standard log package to
+// their levels.
+var prefixes = []struct {
+	prefix string
+	level  slog.Level
+}{
+	{"ERROR:", slog.LevelError},
+	{"WARNING:", slog.LevelWarn},
+	{"INFO:", slog.LevelInfo},
+	{"DEBUG:", slog.LevelDebug},
+}
+
+// legacyWriter logs each line written to it with logger, at the level given
+// by its prefix.
+type legacyWriter struct {
+	logger *slog.Logger
+}
+
+func (w *legacyWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		level := slog.LevelInfo
+		for _, p := range prefixes {
+			if rest, ok := strings.CutPrefix(line, p.prefix); ok {
+				level, line = p.level, rest
+				break
+			}
+		}
+		w.logger.Log(context.Background(), level, strings.TrimSpace(line))
+	}
+	return len(p), nil
+}
+
+// New creates a logger that writes lines of at least level (debug, info, warn
+// or error) to w in format, either text or json.
+func New(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// Setup makes a logger created by New the default for both slog and the
+// standard log package.
+func Setup(w io.Writer, level string, format string) error {
+	logger, err := New(w, level, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	// slog.SetDefault routes the standard logger to slog at a fixed level;
+	// route it through legacyWriter instead, so its prefixes are honored.
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(&legacyWriter{logger: logger})
+	return nil
+}
@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		level   string
+		format  string
+		wantErr bool
+	}{
+		{level: "info", format: "text"},
+		{level: "DEBUG", format: "json"},
+		{level: "warn", format: "text"},
+		{level: "loud", format: "text", wantErr: true},
+		{level: "info", format: "xml", wantErr: true},
+	}
+	for _, tt := range tests {
+		_, err := New(&bytes.Buffer{}, tt.level, tt.format)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("New(%q, %q) error = %v; wantErr %t", tt.level, tt.format, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSetup(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	defer slog.SetDefault(slog.Default())
+	defer log.SetFlags(log.Flags())
+
+	var buf bytes.Buffer
+	rtx.Must(Setup(&buf, "info", "json"), "Could not set up logging")
+	slog.Info("Flag found", "issue", "7", "entity", "mlab1-abc01")
+	log.Printf("ERROR: Failed to write state: %s", "disk full")
+	log.Printf("DEBUG: Not logged")
+	log.Printf("Unprefixed")
+
+	var got []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]interface{}
+		rtx.Must(json.Unmarshal([]byte(line), &m), "Could not parse log line %q", line)
+		got = append(got, m)
+	}
+	if len(got) != 3 {
+		t.Fatalf("logged %d lines; want 3: %s", len(got), buf.String())
+	}
+	want := []struct{ level, msg string }{
+		{"INFO", "Flag found"},
+		{"ERROR", "Failed to write state: disk full"},
+		{"INFO", "Unprefixed"},
+	}
+	for i, w := range want {
+		if got[i]["level"] != w.level || got[i]["msg"] != w.msg {
+			t.Errorf("line %d = %v; want level %s and msg %q", i, got[i], w.level, w.msg)
+		}
+	}
+	if got[0]["issue"] != "7" || got[0]["entity"] != "mlab1-abc01" {
+		t.Errorf("line 0 = %v; want issue and entity fields", got[0])
+	}
+}
@@ -0,0 +1,50 @@
+package maintenancestate
+
+import (
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+// entered returns when each machine or site in stateMap entered maintenance
+// for the earliest of its current issues, keyed by name. Entities for which
+// this is unknown are omitted. The caller must hold the lock.
+func (ms *MaintenanceState) entered(stateMap map[string][]string) map[string]time.Time {
+	times := make(map[string]time.Time)
+	for name, issues := range stateMap {
+		for _, issue := range issues {
+			t := ms.state.Entries[EntryKey(name, issue)].Entered
+			if t.IsZero() {
+				continue
+			}
+			if earliest, ok := times[name]; !ok || t.Before(earliest) {
+				times[name] = t
+			}
+		}
+	}
+	return times
+}
+
+// UpdateAges sets the metrics for how long each machine and site has been in
+// maintenance as of now, for several states keyed by project. Machines and
+// sites whose maintenance began before it was recorded are omitted.
+func UpdateAges(states map[string]*MaintenanceState, now time.Time) {
+	metrics.MachineMaintenanceSeconds.Reset()
+	metrics.SiteMaintenanceSeconds.Reset()
+	for project, ms := range states {
+		ms.mu.Lock()
+		machines := ms.entered(ms.state.Machines)
+		sites := ms.entered(ms.state.Sites)
+		ms.mu.Unlock()
+
+		for machine, t := range machines {
+			// The machine and site labels match those of the machine
+			// maintenance metric.
+			values := labelValues(machine, project)
+			metrics.MachineMaintenanceSeconds.WithLabelValues(values[0], values[len(values)-1]).Set(now.Sub(t).Seconds())
+		}
+		for site, t := range sites {
+			metrics.SiteMaintenanceSeconds.WithLabelValues(project, site).Set(now.Sub(t).Seconds())
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package maintenancestate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestUpdateAges(t *testing.T) {
+	s, _ := New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+	s.UpdateSite("abc01", EnterMaintenance, "1", "mlab-oti")
+	s.UpdateMachine("mlab1-def01", EnterMaintenance, "2", "mlab-oti")
+	// Maintenance recorded before entry times were has no age.
+	s.state.Machines["mlab2-def01"] = []string{"3"}
+
+	// A machine in maintenance for several issues has been in maintenance
+	// since the earliest of them.
+	earlier := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	s.UpdateMachine("mlab1-def01", EnterMaintenance, "4", "mlab-oti")
+	s.state.Entries[EntryKey("mlab1-def01", "4")] = Entry{Entered: earlier}
+
+	now := time.Now().Add(time.Minute)
+	UpdateAges(map[string]*MaintenanceState{"mlab-oti": s}, now)
+	if n := testutil.CollectAndCount(metrics.MachineMaintenanceSeconds); n != 5 {
+		t.Errorf("Expected 5 machine age series; got %d", n)
+	}
+	if n := testutil.CollectAndCount(metrics.SiteMaintenanceSeconds); n != 1 {
+		t.Errorf("Expected 1 site age series; got %d", n)
+	}
+	values := labelValues("mlab1-def01", "mlab-oti")
+	age := testutil.ToFloat64(metrics.MachineMaintenanceSeconds.WithLabelValues(values[0], values[len(values)-1]))
+	if want := now.Sub(earlier).Seconds(); age != want {
+		t.Errorf("age of mlab1-def01 = %v; want %v", age, want)
+	}
+	if age := testutil.ToFloat64(metrics.SiteMaintenanceSeconds.WithLabelValues("mlab-oti", "abc01")); age < 60 || age > 62 {
+		t.Errorf("age of abc01 = %v; want about a minute", age)
+	}
+
+	// Machines that left maintenance lose their age.
+	s.UpdateSite("abc01", LeaveMaintenance, "1", "mlab-oti")
+	UpdateAges(map[string]*MaintenanceState{"mlab-oti": s}, now)
+	if n := testutil.CollectAndCount(metrics.MachineMaintenanceSeconds); n != 1 {
+		t.Errorf("Expected 1 machine age series; got %d", n)
+	}
+}
+
+func TestMaintenanceDuration(t *testing.T) {
+	metrics.MaintenanceDuration.Reset()
+	s, _ := New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+	s.UpdateMachine("mlab1-def01", EnterMaintenance, "1", "mlab-oti")
+	s.UpdateMachine("mlab1-def01", EnterMaintenance, "2", "mlab-oti")
+	s.state.Entries[EntryKey("mlab1-def01", "1")] = Entry{Entered: time.Now().Add(-2 * time.Hour)}
+	s.UpdateSite("abc01", EnterMaintenance, "3", "mlab-oti")
+
+	// Only leaving maintenance for the last issue is observed.
+	s.UpdateMachine("mlab1-def01", LeaveMaintenance, "2", "mlab-oti")
+	if n := testutil.CollectAndCount(metrics.MaintenanceDuration); n != 0 {
+		t.Errorf("Expected no durations while mlab1-def01 is in maintenance; got %d", n)
+	}
+	s.UpdateMachine("mlab1-def01", LeaveMaintenance, "1", "mlab-oti")
+	s.UpdateSite("abc01", LeaveMaintenance, "3", "mlab-oti")
+
+	tests := []struct {
+		kind  string
+		count int
+	}{
+		{kind: "machine", count: 5},
+		{kind: "site", count: 1},
+	}
+	for _, tt := range tests {
+		h := metrics.MaintenanceDuration.WithLabelValues(tt.kind).(prometheus.Histogram)
+		var m dto.Metric
+		h.Write(&m)
+		if got := m.GetHistogram().GetSampleCount(); got != uint64(tt.count) {
+			t.Errorf("%s durations observed = %d; want %d", tt.kind, got, tt.count)
+		}
+	}
+}
+
+func TestMaintenanceDurationSince(t *testing.T) {
+	metrics.MaintenanceDuration.Reset()
+	s, _ := New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+	s.UpdateMachine("mlab1-def01", EnterMaintenance, "1", "mlab-oti")
+	s.UpdateMachine("mlab1-def01", EnterMaintenance, "2", "mlab-oti")
+	now := time.Now()
+	s.state.Entries[EntryKey("mlab1-def01", "1")] = Entry{Entered: now.Add(-3 * time.Hour)}
+	s.state.Entries[EntryKey("mlab1-def01", "2")] = Entry{Entered: now.Add(-time.Hour)}
+
+	// Closing the earlier issue is not observed, since mlab1-def01 is still
+	// in maintenance.
+	s.CloseIssue("1", "mlab-oti")
+	if n := testutil.CollectAndCount(metrics.MaintenanceDuration); n != 0 {
+		t.Errorf("Expected no durations while mlab1-def01 is in maintenance; got %d", n)
+	}
+
+	// Closing the other issue observes the time since the earlier one.
+	s.CloseIssue("2", "mlab-oti")
+	var m dto.Metric
+	metrics.MaintenanceDuration.WithLabelValues("machine").(prometheus.Histogram).Write(&m)
+	h := m.GetHistogram()
+	if h.GetSampleCount() != 1 || h.GetSampleSum() < 3*3600 || h.GetSampleSum() > 3*3600+60 {
+		t.Errorf("observed %d durations totaling %vs; want one of about 3h", h.GetSampleCount(), h.GetSampleSum())
+	}
+}
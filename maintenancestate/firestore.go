@@ -0,0 +1,153 @@
+package maintenancestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/gcp"
+)
+
+// firestoreTimeout bounds every request to Firestore.
+const firestoreTimeout = 30 * time.Second
+
+// FirestoreStorage stores the state in a Firestore document, so that several
+// replicas in the same project share it. Writes use optimistic concurrency: a
+// Save only succeeds if the document has not changed since this storage last
+// loaded or saved it, and otherwise returns ErrConflict. Documents are limited
+// to 1 MiB.
+type FirestoreStorage struct {
+	Project string
+	// Document is the path of the document within the default database,
+	// e.g. gmx/mlab-oti.
+	Document string
+	url      string
+	client   *http.Client
+
+	mu sync.Mutex
+	// updateTime is the update time of the document when it was last loaded
+	// or saved, or empty if it did not exist.
+	updateTime string
+	// loaded reports whether updateTime is known.
+	loaded bool
+}
+
+// firestoreDocument is the part of a Firestore Document that holds the state.
+type firestoreDocument struct {
+	Fields struct {
+		State struct {
+			BytesValue string `json:"bytesValue"`
+		} `json:"state"`
+	} `json:"fields"`
+	UpdateTime string `json:"updateTime,omitempty"`
+}
+
+// NewFirestoreStorage creates a FirestoreStorage for a document in the
+// default database of project, authenticated as the default service account.
+func NewFirestoreStorage(project, document string) *FirestoreStorage {
+	return &FirestoreStorage{
+		Project:  project,
+		Document: document,
+		url:      "https://firestore.googleapis.com",
+		client:   gcp.NewClient(firestoreTimeout),
+	}
+}
+
+func (f *FirestoreStorage) documentURL() string {
+	return fmt.Sprintf("%s/v1/projects/%s/databases/(default)/documents/%s", f.url, url.PathEscape(f.Project), f.Document)
+}
+
+// Load reads the document, and remembers its update time for the next Save.
+func (f *FirestoreStorage) Load() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, f.documentURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		f.updateTime, f.loaded = "", true
+		return nil, fmt.Errorf("%v does not exist", f)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from Firestore reading %v: %s", f, resp.Status)
+	}
+	var doc firestoreDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(doc.Fields.State.BytesValue)
+	if err != nil {
+		return nil, err
+	}
+	f.updateTime, f.loaded = doc.UpdateTime, true
+	return data, nil
+}
+
+// Save writes data to the document, provided that it has not been changed
+// since it was last loaded or saved. If it has, ErrConflict is returned.
+func (f *FirestoreStorage) Save(data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var doc firestoreDocument
+	doc.Fields.State.BytesValue = base64.StdEncoding.EncodeToString(data)
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	u := f.documentURL()
+	switch {
+	case !f.loaded:
+		// Without a Load, there is nothing to compare against.
+	case f.updateTime == "":
+		u += "?currentDocument.exists=false"
+	default:
+		u += "?currentDocument.updateTime=" + url.QueryEscape(f.updateTime)
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPatch, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var status struct {
+			Error struct {
+				Status string `json:"status"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&status)
+		switch status.Error.Status {
+		case "FAILED_PRECONDITION", "ALREADY_EXISTS", "NOT_FOUND":
+			return fmt.Errorf("%w: %v", ErrConflict, f)
+		}
+		return fmt.Errorf("unexpected status from Firestore writing %v: %s", f, resp.Status)
+	}
+	var saved firestoreDocument
+	if err := json.NewDecoder(resp.Body).Decode(&saved); err != nil {
+		return err
+	}
+	f.updateTime, f.loaded = saved.UpdateTime, true
+	return nil
+}
+
+func (f *FirestoreStorage) String() string {
+	return "firestore://" + f.Project + "/" + f.Document
+}
@@ -0,0 +1,133 @@
+package maintenancestate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeFirestore serves a single document, honoring update time preconditions.
+type fakeFirestore struct {
+	mu      sync.Mutex
+	doc     *firestoreDocument
+	version int
+}
+
+func (f *fakeFirestore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path != "/v1/projects/p/databases/(default)/documents/gmx/state" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	fail := func(code int, status string) {
+		w.WriteHeader(code)
+		fmt.Fprintf(w, `{"error": {"status": %q}}`, status)
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if f.doc == nil {
+			fail(http.StatusNotFound, "NOT_FOUND")
+			return
+		}
+		json.NewEncoder(w).Encode(f.doc)
+	case http.MethodPatch:
+		q := r.URL.Query()
+		if q.Get("currentDocument.exists") == "false" && f.doc != nil {
+			fail(http.StatusConflict, "ALREADY_EXISTS")
+			return
+		}
+		if t := q.Get("currentDocument.updateTime"); t != "" && (f.doc == nil || f.doc.UpdateTime != t) {
+			fail(http.StatusBadRequest, "FAILED_PRECONDITION")
+			return
+		}
+		var doc firestoreDocument
+		json.NewDecoder(r.Body).Decode(&doc)
+		f.version++
+		doc.UpdateTime = fmt.Sprintf("2024-01-01T00:00:%02dZ", f.version)
+		f.doc = &doc
+		json.NewEncoder(w).Encode(f.doc)
+	}
+}
+
+func TestFirestoreStorage(t *testing.T) {
+	srv := httptest.NewServer(&fakeFirestore{})
+	defer srv.Close()
+	replica := func() *FirestoreStorage {
+		return &FirestoreStorage{Project: "p", Document: "gmx/state", url: srv.URL, client: srv.Client()}
+	}
+	a, b := replica(), replica()
+
+	if _, err := a.Load(); err == nil {
+		t.Error("Load() of a missing document returned nil error")
+	}
+	if _, err := b.Load(); err == nil {
+		t.Error("Load() of a missing document returned nil error")
+	}
+	if err := a.Save([]byte("one")); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+	// b expects the document not to exist.
+	if err := b.Save([]byte("two")); !errors.Is(err, ErrConflict) {
+		t.Errorf("Save() of a stale replica = %v; want ErrConflict", err)
+	}
+	data, err := b.Load()
+	if err != nil || string(data) != "one" {
+		t.Errorf("Load() = %q, %v; want one", data, err)
+	}
+	if err := b.Save([]byte("two")); err != nil {
+		t.Errorf("Save() after Load() = %v", err)
+	}
+	if err := a.Save([]byte("three")); !errors.Is(err, ErrConflict) {
+		t.Errorf("Save() of a stale replica = %v; want ErrConflict", err)
+	}
+	if a.String() != "firestore://p/gmx/state" {
+		t.Errorf("String() = %q", a.String())
+	}
+}
+
+func TestWriteConflict(t *testing.T) {
+	srv := httptest.NewServer(&fakeFirestore{})
+	defer srv.Close()
+	replica := func() *MaintenanceState {
+		storage := &FirestoreStorage{Project: "p", Document: "gmx/state", url: srv.URL, client: srv.Client()}
+		s, _ := NewWithStorage(storage, cachingClient, "mlab-oti")
+		return s
+	}
+	s1, s2 := replica(), replica()
+	l := &recordingListener{}
+	s2.AddListener(l)
+
+	s1.UpdateMachine("mlab1-abc01", EnterMaintenance, "1", "mlab-oti")
+	if err := s1.Write(); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	s2.UpdateMachine("mlab2-abc01", EnterMaintenance, "2", "mlab-oti")
+	if err := s2.Write(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Write() of a stale replica = %v; want ErrConflict", err)
+	}
+
+	// s2 now holds what s1 wrote, instead of overwriting it.
+	want := map[string][]string{"mlab1-abc01": {"1"}}
+	if got := s2.Snapshot().Machines; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Machines after a conflict = %v; want %v", got, want)
+	}
+	if s2.Degraded() {
+		t.Error("a conflict made the state degraded")
+	}
+	var causes []string
+	for _, tr := range l.transitions {
+		causes = append(causes, tr.Cause)
+	}
+	if len(causes) != 3 || causes[1] != "sync" || causes[2] != "sync" {
+		t.Errorf("transition causes = %q; want a change and two syncs", causes)
+	}
+	s2.UpdateMachine("mlab2-abc01", EnterMaintenance, "2", "mlab-oti")
+	if err := s2.Write(); err != nil {
+		t.Errorf("Write() after reloading = %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package maintenancestate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/gcp"
+)
+
+// gcsTimeout bounds every request to Cloud Storage.
+const gcsTimeout = 30 * time.Second
+
+// GCSStorage stores the state in a Cloud Storage object, so that it survives
+// the exporter being rescheduled onto another node.
+type GCSStorage struct {
+	Bucket string
+	Object string
+	url    string
+	client *http.Client
+}
+
+// NewGCSStorage creates a GCSStorage for an object, authenticated as the
+// default service account.
+func NewGCSStorage(bucket, object string) *GCSStorage {
+	return &GCSStorage{
+		Bucket: bucket,
+		Object: object,
+		url:    "https://storage.googleapis.com",
+		client: gcp.NewClient(gcsTimeout),
+	}
+}
+
+// Load downloads the object.
+func (g *GCSStorage) Load() ([]byte, error) {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", g.url, url.PathEscape(g.Bucket), url.PathEscape(g.Object))
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from Cloud Storage reading %v: %s", g, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Save uploads data as the new content of the object.
+func (g *GCSStorage) Save(data []byte) error {
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s", g.url, url.PathEscape(g.Bucket), url.QueryEscape(g.Object))
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from Cloud Storage writing %v: %s", g, resp.Status)
+	}
+	return nil
+}
+
+func (g *GCSStorage) String() string {
+	return "gs://" + g.Bucket + "/" + g.Object
+}
@@ -0,0 +1,54 @@
+package maintenancestate
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGCSStorage(t *testing.T) {
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Query().Get("alt") == "media":
+			data, ok := objects[r.URL.EscapedPath()]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		case r.Method == http.MethodPost && r.URL.Path == "/upload/storage/v1/b/bucket/o":
+			data, _ := io.ReadAll(r.Body)
+			objects["/storage/v1/b/bucket/o/"+r.URL.Query().Get("name")] = data
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	g := &GCSStorage{Bucket: "bucket", Object: "state", url: srv.URL, client: srv.Client()}
+	if _, err := g.Load(); err == nil {
+		t.Error("Load() of a missing object returned nil error")
+	}
+	if err := g.Save([]byte(savedState)); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+	data, err := g.Load()
+	if err != nil || string(data) != savedState {
+		t.Errorf("Load() = %q, %v; want the saved state", data, err)
+	}
+
+	s, err := NewWithStorage(g, cachingClient, "mlab-oti")
+	if err != nil || len(s.Snapshot().Machines) == 0 {
+		t.Errorf("NewWithStorage() could not restore the state from GCS: %v", err)
+	}
+
+	g.Bucket = "other"
+	if err := g.Save([]byte(savedState)); err == nil {
+		t.Error("Save() returned nil error for an error response")
+	}
+	if g.String() != "gs://other/state" {
+		t.Errorf("String() = %q", g.String())
+	}
+}
@@ -0,0 +1,54 @@
+package maintenancestate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// stateVersion is the version of the format in which the state is written.
+// It must be incremented, and a migration added, whenever the format changes
+// in a way that older states cannot be read as is.
+const stateVersion = 1
+
+// ErrUnsupportedVersion is returned when a state was written in a newer
+// format than this version of the exporter understands.
+var ErrUnsupportedVersion = errors.New("unsupported state version")
+
+// migrations[i] upgrades a state from version i to version i+1. States are
+// migrated as raw JSON objects, so that the old formats do not need to be
+// kept as types.
+var migrations = []func(map[string]json.RawMessage) error{
+	// Version 0 is any state written before the version was recorded. Its
+	// format is otherwise the same as version 1.
+	func(map[string]json.RawMessage) error { return nil },
+}
+
+// unmarshalState decodes data into s, first migrating it from the version in
+// which it was written to stateVersion.
+func unmarshalState(data []byte, s *state) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	version := 0
+	if v, ok := raw["Version"]; ok {
+		if err := json.Unmarshal(v, &version); err != nil {
+			return fmt.Errorf("invalid state version: %w", err)
+		}
+	}
+	if version < 0 || version > stateVersion {
+		return fmt.Errorf("%w: %d (the newest supported is %d)", ErrUnsupportedVersion, version, stateVersion)
+	}
+	for ; version < stateVersion; version++ {
+		if err := migrations[version](raw); err != nil {
+			return fmt.Errorf("failed to migrate the state from version %d: %w", version, err)
+		}
+	}
+	raw["Version"] = json.RawMessage(fmt.Sprint(stateVersion))
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, s)
+}
@@ -0,0 +1,103 @@
+package maintenancestate
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalState(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    map[string][]string
+		wantErr error
+	}{
+		{
+			name: "unversioned",
+			in:   `{"Machines": {"mlab1-abc01": ["1"]}, "Sites": {}}`,
+			want: map[string][]string{"mlab1-abc01": {"1"}},
+		},
+		{
+			name: "current",
+			in:   `{"Version": 1, "Machines": {"mlab1-abc01": ["1"]}, "Sites": {}}`,
+			want: map[string][]string{"mlab1-abc01": {"1"}},
+		},
+		{
+			name:    "newer",
+			in:      `{"Version": 99, "Machines": {}, "Sites": {}}`,
+			wantErr: ErrUnsupportedVersion,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s state
+			err := unmarshalState([]byte(tt.in), &s)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("unmarshalState() error = %v; want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if s.Version != stateVersion {
+				t.Errorf("Version = %d; want %d", s.Version, stateVersion)
+			}
+			if !reflect.DeepEqual(s.Machines, tt.want) {
+				t.Errorf("Machines = %v; want %v", s.Machines, tt.want)
+			}
+		})
+	}
+	var s state
+	if err := unmarshalState([]byte(`{"Version": "one"}`), &s); err == nil {
+		t.Error("unmarshalState() with an invalid version returned nil error")
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	if len(migrations) != stateVersion {
+		t.Fatalf("there are %d migrations; want one per version up to %d", len(migrations), stateVersion)
+	}
+
+	// Migrations are applied in order from the version in the state.
+	defer func(m []func(map[string]json.RawMessage) error) { migrations = m }(migrations)
+	migrations = []func(map[string]json.RawMessage) error{
+		func(raw map[string]json.RawMessage) error {
+			raw["Sites"] = json.RawMessage(`{"abc01": ["2"]}`)
+			return nil
+		},
+	}
+	var s state
+	if err := unmarshalState([]byte(`{"Machines": {}}`), &s); err != nil {
+		t.Fatalf("unmarshalState() = %v", err)
+	}
+	if want := map[string][]string{"abc01": {"2"}}; !reflect.DeepEqual(s.Sites, want) {
+		t.Errorf("Sites = %v; want %v", s.Sites, want)
+	}
+	migrations[0] = func(map[string]json.RawMessage) error { return errors.New("bad") }
+	if err := unmarshalState([]byte(`{}`), &s); err == nil || !strings.Contains(err.Error(), "version 0") {
+		t.Errorf("unmarshalState() with a failing migration = %v", err)
+	}
+}
+
+func TestRestoreNewerVersion(t *testing.T) {
+	storage := &memoryStorage{data: []byte(`{"Version": 99, "Machines": {}, "Sites": {}}`)}
+	if _, err := NewWithStorage(storage, cachingClient, "mlab-oti"); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("NewWithStorage() with a newer state = %v; want ErrUnsupportedVersion", err)
+	}
+
+	// States are written with the current version.
+	storage = &memoryStorage{data: []byte(savedState)}
+	s, err := NewWithStorage(storage, cachingClient, "mlab-oti")
+	if err != nil {
+		t.Fatalf("NewWithStorage() = %v", err)
+	}
+	if err := s.Write(); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	var written state
+	if err := json.Unmarshal(storage.data, &written); err != nil || written.Version != stateVersion {
+		t.Errorf("written state has version %d (%v); want %d", written.Version, err, stateVersion)
+	}
+}
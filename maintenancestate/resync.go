@@ -0,0 +1,110 @@
+package maintenancestate
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// seriesKey identifies a metric series by its label values.
+func seriesKey(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+// currentSeries returns the value of every series of a GaugeVec, keyed by
+// seriesKey. Label values are ordered as the GaugeVec's labels were declared,
+// which is also the order in which Prometheus sorts them.
+func currentSeries(vec *prometheus.GaugeVec) map[string]float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+	series := make(map[string]float64)
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			continue
+		}
+		var values []string
+		for _, l := range pb.GetLabel() {
+			values = append(values, l.GetValue())
+		}
+		series[seriesKey(values)] = pb.GetGauge().GetValue()
+	}
+	return series
+}
+
+// resync resets a GaugeVec and repopulates it with the desired series, keyed
+// by seriesKey. The return value is the number of series whose value had
+// drifted from the state.
+func resync(vec *prometheus.GaugeVec, desired map[string][]string) int {
+	current := currentSeries(vec)
+	corrected := 0
+	for key := range desired {
+		if v, ok := current[key]; !ok || v != EnterMaintenance.StatusValue() {
+			corrected++
+		}
+	}
+	for key, v := range current {
+		if _, ok := desired[key]; !ok && v != LeaveMaintenance.StatusValue() {
+			corrected++
+		}
+	}
+
+	vec.Reset()
+	for _, values := range desired {
+		vec.WithLabelValues(values...).Set(EnterMaintenance.StatusValue())
+	}
+	return corrected
+}
+
+// addDesired adds the series for every entry of a state map to desired.
+func addDesired(desired map[string][]string, stateMap map[string][]string, project string) {
+	for key := range stateMap {
+		values := labelValues(key, project)
+		desired[seriesKey(values)] = values
+	}
+}
+
+// ResyncAll rebuilds the machine, site, experiment and switch maintenance
+// metrics from the states of every project, keyed by project, healing any
+// drift between the two. Series for entities that are not in maintenance are
+// removed. Since the states share the metrics, all of them must be given.
+// The return value is the number of series that were corrected.
+func ResyncAll(states map[string]*MaintenanceState) int {
+	// Lock the states in a fixed order, and hold the locks until the metrics
+	// have been rebuilt so that concurrent updates are not lost.
+	projects := make([]string, 0, len(states))
+	for project := range states {
+		projects = append(projects, project)
+	}
+	sort.Strings(projects)
+	machines := make(map[string][]string)
+	sites := make(map[string][]string)
+	experiments := make(map[string][]string)
+	switches := make(map[string][]string)
+	for _, project := range projects {
+		ms := states[project]
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+		addDesired(machines, ms.state.Machines, project)
+		addDesired(sites, ms.state.Sites, project)
+		addDesired(experiments, ms.state.Experiments, project)
+		addDesired(switches, ms.state.Switches, project)
+	}
+
+	corrected := resync(metrics.Machine, machines)
+	corrected += resync(metrics.Site, sites)
+	corrected += resync(metrics.Experiment, experiments)
+	corrected += resync(metrics.Switch, switches)
+	if corrected > 0 {
+		slog.Warn("Corrected maintenance metric series that had drifted from the state", "series", corrected)
+	}
+	metrics.ResyncCorrections.Add(float64(corrected))
+	return corrected
+}
@@ -0,0 +1,80 @@
+package maintenancestate
+
+import (
+	"os"
+	"testing"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestResyncMetrics(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestResyncMetrics")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	metrics.Machine.Reset()
+	metrics.Site.Reset()
+	s, _ := New(dir+"/state.json", cachingClient, "mlab-oti")
+	s.UpdateSite("abc01", EnterMaintenance, "1", "mlab-oti")
+	s.UpdateMachine("mlab1-def01", EnterMaintenance, "2", "mlab-oti")
+	s.UpdateMachine("mlab1-def01", LeaveMaintenance, "2", "mlab-oti")
+
+	if n := ResyncAll(map[string]*MaintenanceState{"mlab-oti": s}); n != 0 {
+		t.Errorf("ResyncAll() = %d; want 0 when nothing has drifted", n)
+	}
+	if n := testutil.CollectAndCount(metrics.Machine); n != 4 {
+		t.Errorf("Expected 4 machine series after the resync; got %d", n)
+	}
+
+	// Introduce drift: one machine lost its series, one has the wrong value,
+	// and one is in maintenance but not in the state.
+	metrics.Machine.DeleteLabelValues(labelValues("mlab1-abc01", "mlab-oti")...)
+	metrics.Machine.WithLabelValues(labelValues("mlab2-abc01", "mlab-oti")...).Set(0)
+	metrics.Machine.WithLabelValues(labelValues("mlab3-def01", "mlab-oti")...).Set(1)
+	metrics.Site.WithLabelValues("xyz01").Set(0)
+
+	before := testutil.ToFloat64(metrics.ResyncCorrections)
+	if n := ResyncAll(map[string]*MaintenanceState{"mlab-oti": s}); n != 3 {
+		t.Errorf("ResyncAll() = %d; want 3", n)
+	}
+	if testutil.ToFloat64(metrics.ResyncCorrections) != before+3 {
+		t.Error("The corrections should have been counted")
+	}
+	if n := testutil.CollectAndCount(metrics.Machine); n != 4 {
+		t.Errorf("Expected 4 machine series after the resync; got %d", n)
+	}
+	if n := testutil.CollectAndCount(metrics.Site); n != 1 {
+		t.Errorf("Expected 1 site series after the resync; got %d", n)
+	}
+}
+
+func TestResyncAll(t *testing.T) {
+	dir := t.TempDir()
+	rtx.Must(SetLabelScheme(LabelScheme{Hostnames: "v2", NodeLabel: true, SiteProject: true}), "Could not set label scheme")
+	defer SetLabelScheme(LabelScheme{Hostnames: "v2", NodeLabel: true})
+	metrics.Machine.Reset()
+	oti, _ := New(dir+"/oti.json", cachingClient, "mlab-oti")
+	sandbox, _ := New(dir+"/sandbox.json", cachingClient, "mlab-sandbox")
+	oti.UpdateMachine("mlab1-abc01", EnterMaintenance, "1", "mlab-oti")
+	sandbox.UpdateMachine("mlab1-abc0t", EnterMaintenance, "1", "mlab-sandbox")
+	// Both projects have a site named def01.
+	oti.UpdateSite("def01", EnterMaintenance, "2", "mlab-oti")
+	sandbox.UpdateSite("def01", EnterMaintenance, "2", "mlab-sandbox")
+	sandbox.UpdateSite("def01", LeaveMaintenance, "2", "mlab-sandbox")
+	if testutil.ToFloat64(metrics.Site.WithLabelValues("mlab-oti", "def01")) != 1 {
+		t.Error("Leaving maintenance in one project should not affect the site of another")
+	}
+
+	// Resyncing both states together must keep the series of each.
+	if n := ResyncAll(map[string]*MaintenanceState{"mlab-oti": oti, "mlab-sandbox": sandbox}); n != 0 {
+		t.Errorf("ResyncAll() = %d; want 0 when nothing has drifted", n)
+	}
+	if n := testutil.CollectAndCount(metrics.Machine); n != 6 {
+		t.Errorf("Expected 6 machine series after the resync; got %d", n)
+	}
+	if n := testutil.CollectAndCount(metrics.Site); n != 1 {
+		t.Errorf("Expected 1 site series after the resync; got %d", n)
+	}
+}
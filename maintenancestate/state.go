@@ -6,12 +6,17 @@ package maintenancestate
 import (
 	"context"
 	"encoding/json"
-	"log"
-	"os"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/m-lab/github-maintenance-exporter/metrics"
+	"github.com/m-lab/github-maintenance-exporter/ratelog"
 	"github.com/m-lab/go/host"
 	"github.com/m-lab/go/rtx"
 	"github.com/prometheus/client_golang/prometheus"
@@ -35,23 +40,276 @@ func (a Action) StatusValue() float64 {
 	return float64(int(a) - 1)
 }
 
+// String returns "enter" or "leave", as used in the labels of metrics and in
+// logs.
+func (a Action) String() string {
+	switch a {
+	case EnterMaintenance:
+		return "enter"
+	case LeaveMaintenance:
+		return "leave"
+	default:
+		return "unknown"
+	}
+}
+
+// Change is a single requested modification of the maintenance state of a
+// machine or site.
+type Change struct {
+	// Kind is "machine", "site", "experiment" or "switch". The Name of an
+	// experiment or switch change is given by ExperimentKey or SwitchKey.
+	Kind   string
+	Name   string
+	Action Action
+	// Delay is how long to wait before entering maintenance.
+	Delay time.Duration `json:",omitempty"`
+	// Override allows the change to be applied during a blackout window.
+	Override bool `json:",omitempty"`
+	// Expires, if set, is when the maintenance automatically ends.
+	Expires time.Time `json:",omitempty"`
+	// Duration, if set, is how long the maintenance lasts once it begins.
+	Duration time.Duration `json:",omitempty"`
+	// Origin is recorded in the resulting transitions. Its Cause is e.g.
+	// "manual" for changes made directly by an operator.
+	Origin
+	// Reason, if set, is a free-text explanation of the maintenance.
+	Reason string `json:",omitempty"`
+}
+
+// Origin describes why and by whom a change was made.
+type Origin struct {
+	// Cause, if not empty, is why the change was made other than for an
+	// issue, e.g. "rollback".
+	Cause string `json:",omitempty"`
+	// Sender is the user who made the change, if known.
+	Sender string `json:",omitempty"`
+	// Delivery is the ID of the webhook delivery that made the change, if
+	// any.
+	Delivery string `json:",omitempty"`
+	// Comment is the ID of the comment whose flag made the change, if any.
+	Comment int64 `json:",omitempty"`
+}
+
+// Entry holds metadata about a machine or site being in maintenance for a
+// particular issue.
+type Entry struct {
+	// Expires, if set, is when the maintenance automatically ends.
+	Expires time.Time `json:",omitempty"`
+	// Reason, if set, is why the machine or site is in maintenance.
+	Reason string `json:",omitempty"`
+	// Entered is when the machine or site entered maintenance for the
+	// issue, or for an earlier issue that has since ended if it has been in
+	// maintenance ever since. It is unknown for maintenance recorded by older
+	// versions.
+	Entered time.Time `json:",omitempty"`
+	// Comment is the ID of the comment whose flag put the machine or site
+	// into maintenance, if it was not the body of the issue.
+	Comment int64 `json:",omitempty"`
+}
+
+// ExperimentKey returns the name under which an experiment (e.g. ndt) on a
+// machine (e.g. mlab1-abc01) is recorded in the state.
+func ExperimentKey(experiment string, machine string) string {
+	return experiment + "@" + machine
+}
+
+// switchPrefix prefixes the site of a switch, as in its hostname.
+const switchPrefix = "s1-"
+
+// SwitchKey returns the name under which the switch of a site (e.g. abc02) is
+// recorded in the state.
+func SwitchKey(site string) string {
+	return switchPrefix + site
+}
+
+// KindOf returns the kind of entity that mapKey names: "machine", "site",
+// "experiment" or "switch".
+func KindOf(mapKey string) string {
+	switch {
+	case strings.Contains(mapKey, "@"):
+		return "experiment"
+	case strings.HasPrefix(mapKey, switchPrefix):
+		return "switch"
+	case strings.HasPrefix(mapKey, "mlab"):
+		return "machine"
+	default:
+		return "site"
+	}
+}
+
+// EntryKey returns the key for the metadata of a machine or site being in
+// maintenance for an issue.
+func EntryKey(name string, issue string) string {
+	return name + "/" + issue
+}
+
+// ScheduledChange is a change that will be applied on behalf of an issue at a
+// later time.
+type ScheduledChange struct {
+	Change
+	Issue string
+	At    time.Time
+}
+
 // Sites defines a new interface for interacting with the sites package.
 type Sites interface {
 	Reload(ctx context.Context) error
 	Machines(site string) ([]string, error)
 }
 
+// Countries is implemented by Sites that know the country of each site.
+type Countries interface {
+	CountrySites(country string) ([]string, error)
+}
+
 // This is the state that is serialized to disk.
 type state struct {
+	// Version is the version of the format in which the state was written.
+	Version int
+	// Seq is the last record of the write-ahead log that the state includes.
+	Seq             int64 `json:",omitempty"`
 	Machines, Sites map[string][]string
+	// Proposals holds changes awaiting approval, keyed by issue number.
+	Proposals map[string][]Change `json:",omitempty"`
+	// Undo holds the changes that revert those made by the last comment or
+	// edit of each issue that changed its maintenance.
+	Undo map[string][]Change `json:",omitempty"`
+	// Scheduled holds changes that have been accepted but not yet applied.
+	Scheduled []ScheduledChange `json:",omitempty"`
+	// Entries holds metadata for machines and sites in maintenance, keyed by
+	// entryKey.
+	Entries map[string]Entry `json:",omitempty"`
+	// AutoClose holds the issues that should be closed once all of their
+	// maintenance has been removed.
+	AutoClose map[string]bool `json:",omitempty"`
+	// KnownMachines holds the machines (e.g. mlab1) that siteinfo listed for
+	// each site in maintenance when it was last checked.
+	KnownMachines map[string][]string `json:",omitempty"`
+	// Issues holds the machines and sites in maintenance for each issue. It
+	// is the inverse of Machines and Sites, and is rebuilt from them when the
+	// state is restored.
+	Issues map[string][]string `json:",omitempty"`
+	// Milestones holds the title of the milestone of each issue that has
+	// one, if milestones are recorded.
+	Milestones map[string]string `json:",omitempty"`
+	// Experiments holds the experiments on single machines that are in
+	// maintenance, keyed by ExperimentKey.
+	Experiments map[string][]string `json:",omitempty"`
+	// Switches holds the switches that are in maintenance, keyed by
+	// SwitchKey.
+	Switches map[string][]string `json:",omitempty"`
+}
+
+// Transition describes a machine or site entering or leaving maintenance.
+type Transition struct {
+	// Kind is "machine", "site", "experiment" or "switch".
+	Kind   string
+	Name   string
+	Action Action
+	Issue  string
+	Time   time.Time
+	// Origin is why and by whom the transition happened.
+	Origin
+	// Project is the project of the state in which the transition happened.
+	Project string
+}
+
+// Listener is notified of every Transition. Listeners are called
+// synchronously, so they must not block.
+type Listener interface {
+	Transition(t Transition)
 }
 
 // MaintenanceState is a struct for storing both machine and site maintenance states.
 type MaintenanceState struct {
-	mu       sync.Mutex
-	state    state
-	filename string
-	sites    Sites
+	mu        sync.Mutex
+	state     state
+	storage   Storage
+	sites     Sites
+	listeners []Listener
+	// pending holds transitions that have not yet been sent to the listeners.
+	pending []Transition
+	// written is when the state was last successfully written to disk.
+	written time.Time
+	// writeFailures is the number of consecutive failed writes, and
+	// degradedAfter is how many make the state degraded.
+	writeFailures int
+	degradedAfter int
+	// issues indexes the machines and sites in maintenance by issue.
+	issues map[string]map[string]bool
+	// interned holds a single copy of each issue string in the index, so
+	// that the machines and sites of an issue share it.
+	interned map[string]string
+	// scratch states are never persisted and do not update the metrics.
+	scratch bool
+	// project is the project that the state was created for.
+	project string
+	// wal, if not nil, logs every change. logged holds the fields of the
+	// state as of the last record, seq, and snapshotEvery is how many
+	// records are logged between snapshots. walFailed is true if a record
+	// could not be logged since the last snapshot.
+	wal           *WAL
+	logged        map[string]map[string]json.RawMessage
+	seq           int64
+	snapshotEvery int
+	walFailed     bool
+	// loggedPending is how many of the pending transitions were logged.
+	loggedPending int
+}
+
+// AddListener registers a Listener to be notified of every Transition.
+func (ms *MaintenanceState) AddListener(l Listener) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.listeners = append(ms.listeners, l)
+}
+
+// transition records that mapKey entered or left maintenance for an issue,
+// and its origin. The caller must hold the lock.
+func (ms *MaintenanceState) transition(mapKey string, action Action, issue string, origin Origin) {
+	if len(ms.listeners) == 0 && ms.wal == nil {
+		return
+	}
+	ms.pending = append(ms.pending, Transition{
+		Kind:    KindOf(mapKey),
+		Name:    mapKey,
+		Action:  action,
+		Issue:   issue,
+		Time:    time.Now(),
+		Origin:  origin,
+		Project: ms.project,
+	})
+}
+
+// flush updates the totals of entities in maintenance, logs the changes to
+// the write-ahead log, and sends pending transitions to the listeners. It
+// must be called without holding the lock, so that listeners may query the
+// state.
+func (ms *MaintenanceState) flush() {
+	ms.mu.Lock()
+	ms.updateTotals()
+	ms.logChanges()
+	pending := ms.pending
+	ms.pending = nil
+	ms.loggedPending = 0
+	listeners := ms.listeners
+	ms.mu.Unlock()
+
+	for _, t := range pending {
+		for _, l := range listeners {
+			l.Transition(t)
+		}
+	}
+}
+
+// updateTotals sets the metrics of the number of machines and sites in
+// maintenance. The caller must hold the lock.
+func (ms *MaintenanceState) updateTotals() {
+	if ms.scratch {
+		return
+	}
+	metrics.MachinesInMaintenance.WithLabelValues(ms.project).Set(float64(len(ms.state.Machines)))
+	metrics.SitesInMaintenance.WithLabelValues(ms.project).Set(float64(len(ms.state.Sites)))
 }
 
 // Looks for a string a slice.
@@ -64,179 +322,1492 @@ func stringInSlice(s string, list []string) int {
 	return -1
 }
 
+// intern returns the canonical copy of an issue string. The caller must hold
+// the lock.
+func (ms *MaintenanceState) intern(issue string) string {
+	if s, ok := ms.interned[issue]; ok {
+		return s
+	}
+	if ms.interned == nil {
+		ms.interned = make(map[string]string)
+	}
+	ms.interned[issue] = issue
+	return issue
+}
+
+// indexAdd records that mapKey is in maintenance for an issue. The caller must
+// hold the lock.
+func (ms *MaintenanceState) indexAdd(mapKey string, issue string) {
+	if ms.issues == nil {
+		ms.issues = make(map[string]map[string]bool)
+	}
+	if ms.issues[issue] == nil {
+		ms.issues[issue] = make(map[string]bool)
+	}
+	ms.issues[issue][mapKey] = true
+	if !ms.scratch {
+		metrics.MaintenanceIssueInfo.WithLabelValues(issue, IssueURL(issue), mapKey).Set(1)
+	}
+}
+
+// indexRemove records that mapKey is no longer in maintenance for an issue.
+// The caller must hold the lock.
+func (ms *MaintenanceState) indexRemove(mapKey string, issue string) {
+	delete(ms.issues[issue], mapKey)
+	if !ms.scratch {
+		metrics.MaintenanceIssueInfo.DeleteLabelValues(issue, IssueURL(issue), mapKey)
+	}
+	if len(ms.issues[issue]) == 0 {
+		delete(ms.issues, issue)
+		delete(ms.interned, issue)
+	}
+}
+
+// rebuildIndex recreates the issue index from the machine and site maps. The
+// caller must hold the lock.
+func (ms *MaintenanceState) rebuildIndex() {
+	for issue, entities := range ms.issues {
+		for mapKey := range entities {
+			if !ms.scratch {
+				metrics.MaintenanceIssueInfo.DeleteLabelValues(issue, IssueURL(issue), mapKey)
+			}
+		}
+	}
+	ms.issues = make(map[string]map[string]bool)
+	ms.interned = make(map[string]string)
+	for _, m := range []map[string][]string{ms.state.Machines, ms.state.Sites, ms.state.Experiments, ms.state.Switches} {
+		for mapKey, issues := range m {
+			for i, issue := range issues {
+				issues[i] = ms.intern(issue)
+				ms.indexAdd(mapKey, issues[i])
+			}
+		}
+	}
+}
+
+// indexSnapshot returns the issue index in the form in which it is persisted,
+// with the entities of each issue sorted. The caller must hold the lock.
+func (ms *MaintenanceState) indexSnapshot() map[string][]string {
+	if len(ms.issues) == 0 {
+		return nil
+	}
+	snapshot := make(map[string][]string, len(ms.issues))
+	for issue, entities := range ms.issues {
+		names := make([]string, 0, len(entities))
+		for name := range entities {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		snapshot[issue] = names
+	}
+	return snapshot
+}
+
 // Removes a single issue from a site/machine. If the issue was the last one
 // associated with the site/machine, it will also remove the site/machine
 // from maintenance.
-func removeIssue(stateMap map[string][]string, mapKey string, metricState *prometheus.GaugeVec,
-	issueNumber string, project string) int {
+func (ms *MaintenanceState) removeIssue(stateMap map[string][]string, mapKey string, metricState *prometheus.GaugeVec,
+	issueNumber string, project string, origin Origin) int {
 
 	var mods = 0
 	mapElement := stateMap[mapKey]
 
 	issueIndex := stringInSlice(issueNumber, mapElement)
 	if issueIndex >= 0 {
-		mapElement[issueIndex] = mapElement[len(mapElement)-1]
-		mapElement = mapElement[:len(mapElement)-1]
+		ms.indexRemove(mapKey, issueNumber)
+		// Remove the issue in place, clearing the vacated slot so that the
+		// backing array does not keep the string alive.
+		last := len(mapElement) - 1
+		mapElement[issueIndex] = mapElement[last]
+		mapElement[last] = ""
+		mapElement = mapElement[:last]
 		if len(mapElement) == 0 {
 			delete(stateMap, mapKey)
-			updateMetrics(mapKey, project, LeaveMaintenance, metricState)
+			ms.updateMetrics(mapKey, project, LeaveMaintenance, metricState)
+			ms.transition(mapKey, LeaveMaintenance, issueNumber, origin)
 		} else {
 			stateMap[mapKey] = mapElement
 		}
-		log.Printf("INFO: %s was removed from maintenance for issue #%s", mapKey, issueNumber)
+		ratelog.Info("Removed from maintenance", "entity", mapKey, "kind", KindOf(mapKey), "issue", issueNumber, "project", project, "delivery", origin.Delivery)
 		mods++
 	}
 	return mods
 }
 
 // updateMetrics updates the Prometheus metrics for machine or site.
-func updateMetrics(mapKey string, project string, action Action, metricState *prometheus.GaugeVec) {
-	// If this is a machine state, then we need to pass mapKey twice, once for the
-	// "machine" label and once for the "node" label.
-	if strings.HasPrefix(mapKey, "mlab") {
-		// Construct and add labels for the machine.
-		machineLabel := strings.Replace(mapKey, ".", "-", 1) + "." + project + ".measurement-lab.org"
-		// Pick the site name from the full machine name, and use it as the
-		// value of the "site" label for the metric.
-		name, err := host.Parse(machineLabel)
-		rtx.Must(err, "Failed to parse hostname: %s", machineLabel)
-		metricState.WithLabelValues(machineLabel, machineLabel, name.Site).Set(action.StatusValue())
-	} else {
-		metricState.WithLabelValues(mapKey).Set(action.StatusValue())
+func (ms *MaintenanceState) updateMetrics(mapKey string, project string, action Action, metricState *prometheus.GaugeVec) {
+	if ms.scratch {
+		return
 	}
+	metricState.WithLabelValues(labelValues(mapKey, project)...).Set(action.StatusValue())
+}
+
+// LabelScheme controls how the labels of the machine and site maintenance
+// metrics are constructed.
+type LabelScheme struct {
+	// Hostnames is either "v2" (e.g. mlab1-abc01.mlab-oti.measurement-lab.org)
+	// or "v1" (e.g. mlab1.abc01.measurement-lab.org).
+	Hostnames string
+	// NodeLabel controls whether the legacy "node" label is included.
+	NodeLabel bool
+	// SiteProject controls whether sites are labeled with their project,
+	// which tells apart the sites of the same name in different projects.
+	SiteProject bool
+}
+
+var (
+	// labelScheme is the LabelScheme in use.
+	labelScheme = LabelScheme{Hostnames: "v2", NodeLabel: true}
+
+	// labelCache holds the label values of machines, keyed by project and
+	// machine, since parsing hostnames dominates the cost of updating metrics.
+	labelCache   = make(map[string][]string)
+	labelCacheMu sync.Mutex
+)
+
+// issueRepo is the GitHub repository of issues that are not qualified with
+// one.
+var issueRepo string
+
+// SetIssueRepo sets the full name of the GitHub repository (e.g.
+// m-lab/ops-tracker) of issues that are not qualified with one, so that the
+// issue info metric can link to them. It must be called before any state is
+// created or restored.
+func SetIssueRepo(repo string) {
+	issueRepo = repo
+}
+
+// issueSource is the provider of a named webhook source and the base URL of
+// its issues.
+type issueSource struct {
+	provider string
+	baseURL  string
+}
+
+// issueSources holds the named webhook sources, whose issues are recorded as
+// NAME#NUMBER, keyed by name.
+var issueSources = map[string]issueSource{}
+
+// SetIssueSource records the provider (e.g. github or gitlab) of the named
+// webhook source whose issues are recorded as NAME#NUMBER, and the base URL
+// to which their numbers are appended to link to them, e.g.
+// https://github.com/m-lab/lab-tracker/issues/. It must be called before any
+// state is created or restored.
+func SetIssueSource(name string, provider string, baseURL string) {
+	issueSources[name] = issueSource{provider: provider, baseURL: baseURL}
+}
+
+// IssueURL returns the URL of an issue, or an empty string if its repository
+// is not known or is not on GitHub.
+func IssueURL(issue string) string {
+	repo, number, ok := strings.Cut(issue, "#")
+	if !ok {
+		repo, number = issueRepo, issue
+	}
+	if ok && !strings.Contains(repo, "/") {
+		// The issue is from a named webhook source, not a GitHub repository.
+		source := issueSources[repo]
+		if source.provider != "github" || source.baseURL == "" {
+			return ""
+		}
+		return source.baseURL + number
+	}
+	if repo == "" {
+		return ""
+	}
+	return "https://github.com/" + repo + "/issues/" + number
+}
+
+// SetLabelScheme changes how the labels of the machine maintenance metric are
+// constructed. It must be called before any state is created or restored.
+func SetLabelScheme(scheme LabelScheme) error {
+	if scheme.Hostnames != "v1" && scheme.Hostnames != "v2" {
+		return fmt.Errorf("unknown hostname scheme: %q", scheme.Hostnames)
+	}
+	if scheme.NodeLabel != labelScheme.NodeLabel {
+		metrics.SetMachineNodeLabel(scheme.NodeLabel)
+	}
+	if scheme.SiteProject != labelScheme.SiteProject {
+		metrics.SetSiteProjectLabel(scheme.SiteProject)
+	}
+	labelScheme = scheme
+	labelCacheMu.Lock()
+	labelCache = make(map[string][]string)
+	labelCacheMu.Unlock()
+	return nil
+}
+
+// labelValues returns the values of the metric labels for a machine or site.
+// Switches, and sites if the LabelScheme says so, are labeled with the
+// project, since the same site names are used in every project. The returned
+// slice must not be modified.
+func labelValues(mapKey string, project string) []string {
+	switch KindOf(mapKey) {
+	case "site":
+		if !labelScheme.SiteProject {
+			return []string{mapKey}
+		}
+		return []string{project, mapKey}
+	case "switch":
+		return []string{project, strings.TrimPrefix(mapKey, switchPrefix)}
+	}
+	key := project + "/" + mapKey
+	labelCacheMu.Lock()
+	defer labelCacheMu.Unlock()
+	values, ok := labelCache[key]
+	if !ok {
+		if experiment, machine, ok := strings.Cut(mapKey, "@"); ok {
+			machineValues := machineLabelValues(machine, project)
+			values = []string{experiment, machineValues[0], machineValues[len(machineValues)-1]}
+		} else {
+			values = machineLabelValues(mapKey, project)
+		}
+		labelCache[key] = values
+	}
+	return values
+}
+
+// machineLabelValues returns the values of the metric labels for a machine.
+func machineLabelValues(mapKey string, project string) []string {
+	// Construct and add labels for the machine.
+	machineLabel := strings.Replace(mapKey, ".", "-", 1) + "." + project + ".measurement-lab.org"
+	if labelScheme.Hostnames == "v1" {
+		machineLabel = strings.Replace(mapKey, "-", ".", 1) + ".measurement-lab.org"
+	}
+	// Pick the site name from the full machine name, and use it as the
+	// value of the "site" label for the metric.
+	name, err := host.Parse(machineLabel)
+	rtx.Must(err, "Failed to parse hostname: %s", machineLabel)
+	if !labelScheme.NodeLabel {
+		return []string{machineLabel, name.Site}
+	}
+	// We need to pass the hostname twice, once for the "machine" label and
+	// once for the "node" label.
+	return []string{machineLabel, machineLabel, name.Site}
 }
 
 // updateState modifies the maintenance state of a machine or site in the
 // in-memory map as well as updating the Prometheus metric.
 func (ms *MaintenanceState) updateState(stateMap map[string][]string, mapKey string, metricState *prometheus.GaugeVec,
-	issueNumber string, action Action, project string) int {
+	issueNumber string, action Action, project string, origin Origin) int {
 
+	defer ms.flush()
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
 	switch action {
 	case LeaveMaintenance:
-		return removeIssue(stateMap, mapKey, metricState, issueNumber, project)
+		// since is when mapKey first entered maintenance for any of its
+		// issues, if that was recorded.
+		var since time.Time
+		for _, issue := range stateMap[mapKey] {
+			t := ms.state.Entries[EntryKey(mapKey, issue)].Entered
+			if !t.IsZero() && (since.IsZero() || t.Before(since)) {
+				since = t
+			}
+		}
+		ms.deleteEntry(EntryKey(mapKey, issueNumber))
+		mods := ms.removeIssue(stateMap, mapKey, metricState, issueNumber, project, origin)
+		remaining, ok := stateMap[mapKey]
+		if mods > 0 && !ok && !since.IsZero() && !ms.scratch {
+			metrics.MaintenanceDuration.WithLabelValues(KindOf(mapKey)).Observe(time.Since(since).Seconds())
+		}
+		if mods > 0 && ok && !since.IsZero() {
+			// mapKey is still in maintenance, so its remaining issues
+			// carry on since.
+			for _, issue := range remaining {
+				key := EntryKey(mapKey, issue)
+				if entry, ok := ms.state.Entries[key]; ok && (entry.Entered.IsZero() || entry.Entered.After(since)) {
+					entry.Entered = since
+					ms.state.Entries[key] = entry
+				}
+			}
+		}
+		if mods > 0 && !ms.scratch {
+			metrics.StateChanges.WithLabelValues(KindOf(mapKey), "leave", project).Add(float64(mods))
+		}
+		return mods
 	case EnterMaintenance:
 		// Don't enter maintenance more than once for a given issue.
 		issueIndex := stringInSlice(issueNumber, stateMap[mapKey])
 		if issueIndex >= 0 {
-			log.Printf("INFO: %s is already in maintenance for issue #%s", mapKey, issueNumber)
+			ratelog.Info("Already in maintenance", "entity", mapKey, "kind", KindOf(mapKey), "issue", issueNumber, "project", project)
 			return 0
 		}
-		stateMap[mapKey] = append(stateMap[mapKey], issueNumber)
-		updateMetrics(mapKey, project, action, metricState)
-		log.Printf("INFO: %s was added to maintenance for issue #%s", mapKey, issueNumber)
+		issueNumber = ms.intern(issueNumber)
+		issues := stateMap[mapKey]
+		if len(issues) == 0 {
+			ms.transition(mapKey, EnterMaintenance, issueNumber, origin)
+			// Most entities are only in maintenance for a single issue.
+			issues = make([]string, 0, 1)
+		}
+		stateMap[mapKey] = append(issues, issueNumber)
+		ms.indexAdd(mapKey, issueNumber)
+		if ms.state.Entries == nil {
+			ms.state.Entries = make(map[string]Entry)
+		}
+		key := EntryKey(mapKey, issueNumber)
+		entry := ms.state.Entries[key]
+		// Monotonic clock readings do not survive serialization.
+		entry.Entered = time.Now().UTC().Truncate(time.Second)
+		entry.Comment = origin.Comment
+		ms.state.Entries[key] = entry
+		ms.updateMetrics(mapKey, project, action, metricState)
+		if !ms.scratch {
+			metrics.StateChanges.WithLabelValues(KindOf(mapKey), "enter", project).Inc()
+		}
+		ratelog.Info("Added to maintenance", "entity", mapKey, "kind", KindOf(mapKey), "issue", issueNumber, "project", project, "delivery", origin.Delivery)
 		return 1
 	default:
-		log.Printf("WARNING: Unknown action type: %d", action)
+		slog.Warn("Unknown action type", "action", int(action), "entity", mapKey)
 		return 0
 	}
 }
 
-// Restore the maintenance state from disk.
+// newestValidBackup returns the newest backup in the storage that holds a
+// valid state, along with the time at which it was made.
+func (ms *MaintenanceState) newestValidBackup() (state, time.Time, error) {
+	var restored state
+	storage, ok := ms.storage.(BackupStorage)
+	if !ok {
+		return restored, time.Time{}, ErrNoBackup
+	}
+	backups, err := storage.Backups()
+	if err != nil {
+		return restored, time.Time{}, err
+	}
+	for i := len(backups) - 1; i >= 0; i-- {
+		data, err := storage.LoadBackup(backups[i])
+		if err != nil {
+			continue
+		}
+		restored = state{}
+		if unmarshalState(data, &restored) == nil {
+			if restored.Machines == nil {
+				restored.Machines = make(map[string][]string)
+			}
+			if restored.Sites == nil {
+				restored.Sites = make(map[string][]string)
+			}
+			return restored, backups[i], nil
+		}
+		slog.Warn("The backup is also corrupt", "storage", fmt.Sprint(ms.storage), "backup", backups[i].Format(time.RFC3339))
+	}
+	return restored, time.Time{}, ErrNoBackup
+}
+
+// Restore the maintenance state from the storage.
 func (ms *MaintenanceState) Restore(project string) error {
-	data, err := os.ReadFile(ms.filename)
+	data, err := ms.storage.Load()
 	if err != nil {
-		log.Printf("ERROR: Failed to read state data from %s: %s", ms.filename, err)
-		metrics.Error.WithLabelValues("readfile", "maintenancestate.Restore").Inc()
+		slog.Error("Failed to read state data", "storage", fmt.Sprint(ms.storage), "project", project, "err", err)
+		metrics.CountError("readfile", "maintenancestate.Restore")
 		return err
 	}
 
-	err = json.Unmarshal(data, &ms.state)
-	if err != nil {
-		log.Printf("ERROR: Failed to unmarshal JSON: %s", err)
-		metrics.Error.WithLabelValues("unmarshaljson", "maintenancestate.Restore").Inc()
+	err = unmarshalState(data, &ms.state)
+	if errors.Is(err, ErrUnsupportedVersion) {
+		// The state is not corrupt, so it must not be replaced by a backup.
+		slog.Error("Failed to read the state", "storage", fmt.Sprint(ms.storage), "project", project, "err", err)
+		metrics.CountError("version", "maintenancestate.Restore")
 		return err
 	}
+	if err != nil {
+		slog.Error("Failed to unmarshal JSON", "storage", fmt.Sprint(ms.storage), "project", project, "err", err)
+		metrics.CountError("unmarshaljson", "maintenancestate.Restore")
+		restored, backup, berr := ms.newestValidBackup()
+		if berr != nil {
+			return err
+		}
+		slog.Warn("The state is corrupt; restored a backup instead", "storage", fmt.Sprint(ms.storage), "project", project, "backup", backup.Format(time.RFC3339))
+		ms.state = restored
+	}
+
+	ms.mu.Lock()
+	persisted := ms.state.Issues
+	ms.rebuildIndex()
+	if persisted != nil && !reflect.DeepEqual(persisted, ms.indexSnapshot()) {
+		slog.Warn("The issue index is inconsistent; it was rebuilt", "storage", fmt.Sprint(ms.storage), "project", project)
+		metrics.CountError("index", "maintenancestate.Restore")
+	}
+	ms.updateTotals()
+	ms.mu.Unlock()
 
 	// Restore machine maintenance state.
 	for machine := range ms.state.Machines {
-		updateMetrics(machine, project, EnterMaintenance, metrics.Machine)
+		ms.updateMetrics(machine, project, EnterMaintenance, metrics.Machine)
 	}
 
 	// Restore site maintenance state.
 	for site := range ms.state.Sites {
-		updateMetrics(site, project, EnterMaintenance, metrics.Site)
+		ms.updateMetrics(site, project, EnterMaintenance, metrics.Site)
 	}
 
-	log.Printf("INFO: Successfully restored %s from disk.", ms.filename)
+	// Restore experiment maintenance state.
+	for experiment := range ms.state.Experiments {
+		ms.updateMetrics(experiment, project, EnterMaintenance, metrics.Experiment)
+	}
+
+	// Restore switch maintenance state.
+	for sw := range ms.state.Switches {
+		ms.updateMetrics(sw, project, EnterMaintenance, metrics.Switch)
+	}
+
+	for issue, milestone := range ms.state.Milestones {
+		metrics.IssueInfo.WithLabelValues(issue, milestone).Set(1)
+	}
+	ms.mu.Lock()
+	ms.setReasonMetrics(ms.state.Entries, true)
+	ms.mu.Unlock()
+
+	metrics.StateLastRestore.WithLabelValues(ms.project).SetToCurrentTime()
+	slog.Info("Successfully restored the state", "storage", fmt.Sprint(ms.storage), "project", project)
 	return nil
 }
 
 // Write serializes the content of a maintenanceState object into JSON and
-// writes it to a file on disk.
+// saves it to the storage. If the storage reports that another replica saved
+// the state first, the state is replaced with the one in storage, dropping
+// the changes that could not be saved, and ErrConflict is returned. With a
+// write-ahead log, the state is only saved once a snapshot is due, since
+// every change is already logged.
 func (ms *MaintenanceState) Write() error {
+	return ms.save(false)
+}
+
+// Checkpoint saves the state like Write, even if it is logged to a
+// write-ahead log and no snapshot is due.
+func (ms *MaintenanceState) Checkpoint() error {
+	return ms.save(true)
+}
+
+// save implements Write and Checkpoint.
+func (ms *MaintenanceState) save(force bool) error {
+	err := ms.write(force)
+	if errors.Is(err, ErrConflict) {
+		slog.Warn("The state was changed by another replica; reloading it", "storage", fmt.Sprint(ms.storage), "project", ms.project)
+		metrics.CountError("conflict", "maintenancestate.Write")
+		if rerr := ms.Reload(); rerr != nil {
+			slog.Error("Failed to reload the state", "storage", fmt.Sprint(ms.storage), "project", ms.project, "err", rerr)
+			metrics.CountError("reload", "maintenancestate.Write")
+		}
+	}
+	return err
+}
+
+// write saves the state to the storage, unless it is logged to a write-ahead
+// log, no snapshot is due and force is false.
+func (ms *MaintenanceState) write(force bool) error {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
+	// Log any change that was not followed by a flush.
+	ms.logChanges()
+	if !force && !ms.snapshotDue() {
+		return nil
+	}
 
+	ms.state.Version = stateVersion
+	// Until it is saved, the last snapshot includes fewer records.
+	lastSeq := ms.state.Seq
+	ms.state.Seq = ms.seq
+	ms.state.Issues = ms.indexSnapshot()
 	data, err := json.MarshalIndent(ms.state, "", "    ")
 	rtx.Must(err, "Could not marshal MaintenanceState to a buffer.  This should never happen.")
+	if ms.scratch {
+		return nil
+	}
 
-	err = os.WriteFile(ms.filename, data, 0664)
+	err = ms.storage.Save(data)
 	if err != nil {
-		log.Printf("ERROR: Failed to write state to %s: %s", ms.filename, err)
-		metrics.Error.WithLabelValues("writefile", "maintenancestate.Write").Add(1)
+		ms.state.Seq = lastSeq
+	}
+	if errors.Is(err, ErrConflict) {
+		// The storage is working, so this is not a write failure.
+		return err
+	}
+	if err != nil {
+		slog.Error("Failed to write state", "storage", fmt.Sprint(ms.storage), "project", ms.project, "err", err)
+		metrics.CountError("writefile", "maintenancestate.Write")
+		ms.writeFailures++
+		if ms.degraded() {
+			metrics.Degraded.WithLabelValues(ms.project).Set(1)
+		}
 		return err
 	}
 
-	log.Printf("INFO: Successfully wrote state to %s.", ms.filename)
+	if ms.degraded() {
+		slog.Info("State writes are succeeding again; leaving degraded mode", "project", ms.project)
+	}
+	ms.writeFailures = 0
+	ms.walFailed = false
+	metrics.Degraded.WithLabelValues(ms.project).Set(0)
+	ms.written = time.Now()
+	metrics.StateLastWrite.WithLabelValues(ms.project).Set(float64(ms.written.Unix()))
+	slog.Info("Successfully wrote state", "storage", fmt.Sprint(ms.storage), "project", ms.project)
 	return nil
 }
 
+// SetDegradedThreshold sets the number of consecutive failed writes after
+// which the state is degraded. Zero means the state is never degraded.
+func (ms *MaintenanceState) SetDegradedThreshold(n int) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.degradedAfter = n
+}
+
+// degraded reports whether writes have been failing. The caller must hold the
+// lock.
+func (ms *MaintenanceState) degraded() bool {
+	return ms.degradedAfter > 0 && ms.writeFailures >= ms.degradedAfter
+}
+
+// Degraded reports whether writes have failed so many times in a row that
+// changes to the state should be refused, since they would be lost on
+// restart.
+func (ms *MaintenanceState) Degraded() bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.degraded()
+}
+
+// Written returns when the state was last successfully written to disk, or
+// the zero time if it has not been written since the process started.
+func (ms *MaintenanceState) Written() time.Time {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.written
+}
+
 // UpdateMachine causes a single machine to enter or exit maintenance mode.
 func (ms *MaintenanceState) UpdateMachine(machine string, action Action, issue string, project string) int {
-	return ms.updateState(ms.state.Machines, machine, metrics.Machine, issue, action, project)
+	return ms.updateMachine(machine, action, issue, project, Origin{})
+}
+
+func (ms *MaintenanceState) updateMachine(machine string, action Action, issue string, project string, origin Origin) int {
+	return ms.updateState(ms.state.Machines, machine, metrics.Machine, issue, action, project, origin)
 }
 
 // UpdateSite causes a whole site to enter or exit maintenance mode.
 func (ms *MaintenanceState) UpdateSite(site string, action Action, issue string, project string) int {
+	return ms.updateSite(site, action, issue, project, Origin{})
+}
+
+func (ms *MaintenanceState) updateSite(site string, action Action, issue string, project string, origin Origin) int {
 	// Enforce that the site actually exists.
 	machines, err := ms.sites.Machines(site)
 	if err != nil {
-		log.Printf("ERROR: could not update site %s: %v", site, err)
+		slog.Error("Could not update site", "entity", site, "issue", issue, "err", err)
 		return 0
 	}
-	mods := ms.updateState(ms.state.Sites, site, metrics.Site, issue, action, project)
+	mods := ms.updateState(ms.state.Sites, site, metrics.Site, issue, action, project, origin)
 	// If a site is entering or leaving maintenance, automatically add/remove
 	// the site's machines to/from maintenance.
 	for _, m := range machines {
 		machine := m + "-" + site
-		mods += ms.UpdateMachine(machine, action, issue, project)
+		mods += ms.updateMachine(machine, action, issue, project, origin)
+	}
+	ms.recordKnownMachines(site, machines)
+	ratelog.Info("Updated site", "entity", site, "issue", issue, "action", action.String(), "project", project, "mods", mods)
+	return mods
+}
+
+// updateExperiment causes an experiment on a single machine, named by
+// ExperimentKey, to enter or exit maintenance mode.
+func (ms *MaintenanceState) updateExperiment(key string, action Action, issue string, project string, origin Origin) int {
+	ms.mu.Lock()
+	if ms.state.Experiments == nil {
+		ms.state.Experiments = make(map[string][]string)
+	}
+	ms.mu.Unlock()
+	return ms.updateState(ms.state.Experiments, key, metrics.Experiment, issue, action, project, origin)
+}
+
+// updateSwitch causes the switch of a site, named by SwitchKey, to enter or
+// exit maintenance mode.
+func (ms *MaintenanceState) updateSwitch(key string, action Action, issue string, project string, origin Origin) int {
+	ms.mu.Lock()
+	if ms.state.Switches == nil {
+		ms.state.Switches = make(map[string][]string)
+	}
+	ms.mu.Unlock()
+	return ms.updateState(ms.state.Switches, key, metrics.Switch, issue, action, project, origin)
+}
+
+// recordKnownMachines remembers which machines a site had while it is in
+// maintenance, so that machines added to the site later can be detected.
+func (ms *MaintenanceState) recordKnownMachines(site string, machines []string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.state.Sites[site]; !ok {
+		delete(ms.state.KnownMachines, site)
+		return
+	}
+	if ms.state.KnownMachines == nil {
+		ms.state.KnownMachines = make(map[string][]string)
+	}
+	ms.state.KnownMachines[site] = append([]string(nil), machines...)
+}
+
+// Apply applies a change on behalf of an issue, recording any metadata that
+// the change carries. The return value is the number of modifications that
+// were made to the machine and site maintenance state.
+func (ms *MaintenanceState) Apply(c Change, issue string, project string) int {
+	var mods int
+	switch c.Kind {
+	case "site":
+		mods = ms.updateSite(c.Name, c.Action, issue, project, c.Origin)
+	case "machine":
+		mods = ms.updateMachine(c.Name, c.Action, issue, project, c.Origin)
+	case "experiment":
+		mods = ms.updateExperiment(c.Name, c.Action, issue, project, c.Origin)
+	case "switch":
+		mods = ms.updateSwitch(c.Name, c.Action, issue, project, c.Origin)
+	default:
+		slog.Warn("Unknown kind of change", "kind", c.Kind, "entity", c.Name, "issue", issue)
+		return 0
+	}
+	if c.Action != EnterMaintenance {
+		return mods
+	}
+
+	expires := c.Expires
+	if c.Duration > 0 {
+		expires = time.Now().Add(c.Duration)
+	}
+	if !expires.IsZero() || c.Reason != "" {
+		ms.mu.Lock()
+		if ms.state.Entries == nil {
+			ms.state.Entries = make(map[string]Entry)
+		}
+		key := EntryKey(c.Name, issue)
+		if !expires.IsZero() {
+			entry := ms.state.Entries[key]
+			entry.Expires = expires
+			ms.state.Entries[key] = entry
+			ratelog.Info("Maintenance expires", "entity", c.Name, "issue", issue, "project", project, "expires", expires.UTC().Format(time.RFC3339))
+		}
+		if c.Reason != "" {
+			ms.setEntryReason(c.Name, issue, c.Reason)
+		}
+		ms.mu.Unlock()
+		ms.flush()
+		// Recording metadata modifies the state even if the entity was
+		// already in maintenance.
+		if mods == 0 {
+			mods = 1
+		}
 	}
-	log.Println("Mods is", mods)
 	return mods
 }
 
+// ExpireEntries takes machines and sites out of maintenance for any issue
+// whose maintenance has expired, and writes the state to disk if anything
+// changed. The return value is the number of modifications that were made.
+func (ms *MaintenanceState) ExpireEntries(now time.Time, project string) int {
+	type expiredEntry struct {
+		key, name, issue string
+		site             bool
+	}
+	ms.mu.Lock()
+	var expired []expiredEntry
+	for key, entry := range ms.state.Entries {
+		if !entry.Expires.IsZero() && !entry.Expires.After(now) {
+			fields := strings.SplitN(key, "/", 2)
+			_, site := ms.state.Sites[fields[0]]
+			expired = append(expired, expiredEntry{key: key, name: fields[0], issue: fields[1], site: site})
+		}
+	}
+	ms.mu.Unlock()
+
+	if len(expired) == 0 {
+		return 0
+	}
+	mods := 0
+	for _, e := range expired {
+		ratelog.Info("Maintenance has expired", "entity", e.name, "issue", e.issue, "project", project)
+		switch {
+		case e.site:
+			mods += ms.UpdateSite(e.name, LeaveMaintenance, e.issue, project)
+		case KindOf(e.name) == "experiment":
+			mods += ms.updateExperiment(e.name, LeaveMaintenance, e.issue, project, Origin{})
+		case KindOf(e.name) == "switch":
+			mods += ms.updateSwitch(e.name, LeaveMaintenance, e.issue, project, Origin{})
+		default:
+			mods += ms.UpdateMachine(e.name, LeaveMaintenance, e.issue, project)
+		}
+		// Drop the entry even if the entity was already gone.
+		ms.mu.Lock()
+		ms.deleteEntry(e.key)
+		ms.mu.Unlock()
+	}
+	ms.Write()
+	return mods
+}
+
+// deleteEntries removes all metadata for a machine or site. The caller must
+// hold the lock.
+func (ms *MaintenanceState) deleteEntries(name string) {
+	for key := range ms.state.Entries {
+		if strings.HasPrefix(key, name+"/") {
+			ms.deleteEntry(key)
+		}
+	}
+}
+
+// deleteEntry removes the metadata with the given entryKey, along with its
+// reason metric. The caller must hold the lock.
+func (ms *MaintenanceState) deleteEntry(key string) {
+	entry, ok := ms.state.Entries[key]
+	if !ok {
+		return
+	}
+	delete(ms.state.Entries, key)
+	if entry.Reason != "" && !ms.scratch {
+		name, issue, _ := strings.Cut(key, "/")
+		metrics.MaintenanceReason.DeleteLabelValues(name, issue, entry.Reason)
+	}
+}
+
+// setEntryReason records the reason for a machine or site being in
+// maintenance for an issue, and updates its reason metric. The caller must
+// hold the lock.
+func (ms *MaintenanceState) setEntryReason(name string, issue string, reason string) {
+	key := EntryKey(name, issue)
+	entry := ms.state.Entries[key]
+	if entry.Reason == reason {
+		return
+	}
+	if entry.Reason != "" && !ms.scratch {
+		metrics.MaintenanceReason.DeleteLabelValues(name, issue, entry.Reason)
+	}
+	entry.Reason = reason
+	ms.state.Entries[key] = entry
+	if !ms.scratch {
+		metrics.MaintenanceReason.WithLabelValues(name, issue, reason).Set(1)
+	}
+}
+
+// setReasonMetrics sets or deletes the reason metric of every entry in
+// entries. The caller must hold the lock.
+func (ms *MaintenanceState) setReasonMetrics(entries map[string]Entry, set bool) {
+	if ms.scratch {
+		return
+	}
+	for key, entry := range entries {
+		if entry.Reason == "" {
+			continue
+		}
+		name, issue, _ := strings.Cut(key, "/")
+		if set {
+			metrics.MaintenanceReason.WithLabelValues(name, issue, entry.Reason).Set(1)
+		} else {
+			metrics.MaintenanceReason.DeleteLabelValues(name, issue, entry.Reason)
+		}
+	}
+}
+
 // CloseIssue removes any machines and sites from maintenance mode when the
 // issue that added them to maintenance mode is closed. The return value is the
 // number of modifications that were made to the machine and site maintenance
 // state.
 func (ms *MaintenanceState) CloseIssue(issue string, project string) int {
+	return ms.CloseIssueFrom(issue, project, Origin{})
+}
+
+// CloseIssueFrom is like CloseIssue, but records the origin of the closing in
+// the resulting transitions.
+func (ms *MaintenanceState) CloseIssueFrom(issue string, project string, origin Origin) int {
 	var totalMods = 0
-	// Remove any sites from maintenance that were set by this issue.
-	for site := range ms.state.Sites {
-		totalMods += ms.UpdateSite(site, LeaveMaintenance, issue, project)
+	// A closed issue can no longer be approved.
+	if _, ok := ms.TakeProposal(issue); ok {
+		slog.Info("Discarded pending proposal for closed issue", "issue", issue, "project", project)
 	}
+	totalMods += ms.Unschedule(issue, "")
+	ms.mu.Lock()
+	delete(ms.state.AutoClose, issue)
+	delete(ms.state.Undo, issue)
+	ms.setMilestone(issue, "")
+	ms.mu.Unlock()
 
-	// Remove any machines from maintenance that were set by this issue.
-	for machine := range ms.state.Machines {
-		totalMods += ms.UpdateMachine(machine, LeaveMaintenance, issue, project)
+	var sites, machines, experiments, switches []string
+	ms.mu.Lock()
+	for mapKey := range ms.issues[issue] {
+		if _, ok := ms.state.Sites[mapKey]; ok {
+			sites = append(sites, mapKey)
+		} else if KindOf(mapKey) == "experiment" {
+			experiments = append(experiments, mapKey)
+		} else if KindOf(mapKey) == "switch" {
+			switches = append(switches, mapKey)
+		} else {
+			machines = append(machines, mapKey)
+		}
+	}
+	ms.mu.Unlock()
+
+	for _, experiment := range experiments {
+		totalMods += ms.updateExperiment(experiment, LeaveMaintenance, issue, project, origin)
+	}
+	for _, sw := range switches {
+		totalMods += ms.updateSwitch(sw, LeaveMaintenance, issue, project, origin)
+	}
+
+	// Remove any sites from maintenance that were set by this issue, along
+	// with their machines.
+	for _, site := range sites {
+		totalMods += ms.updateSite(site, LeaveMaintenance, issue, project, origin)
+	}
+
+	// Remove any remaining machines from maintenance that were set by this
+	// issue.
+	for _, machine := range machines {
+		totalMods += ms.updateMachine(machine, LeaveMaintenance, issue, project, origin)
 	}
 
 	return totalMods
 }
 
+// RevertComment takes out of maintenance the machines and sites that the
+// comment with the given ID put into maintenance for an issue, and cancels the
+// changes that it scheduled. Those that were already in maintenance for the
+// issue when the comment flagged them are left alone. The return value is the
+// number of modifications that were made.
+func (ms *MaintenanceState) RevertComment(issue string, comment int64, project string, origin Origin) int {
+	ms.mu.Lock()
+	var kept []ScheduledChange
+	for _, sc := range ms.state.Scheduled {
+		if sc.Issue == issue && sc.Comment == comment {
+			ratelog.Info("Canceled scheduled maintenance of a deleted comment", "entity", sc.Name, "issue", issue)
+			continue
+		}
+		kept = append(kept, sc)
+	}
+	mods := len(ms.state.Scheduled) - len(kept)
+	ms.state.Scheduled = kept
+
+	var names []string
+	for key, entry := range ms.state.Entries {
+		name, entryIssue, _ := strings.Cut(key, "/")
+		if entryIssue == issue && entry.Comment == comment {
+			names = append(names, name)
+		}
+	}
+	ms.mu.Unlock()
+	ms.flush()
+
+	// Sites are left before their machines, which they take with them.
+	sort.Slice(names, func(i, j int) bool {
+		if si, sj := KindOf(names[i]) == "site", KindOf(names[j]) == "site"; si != sj {
+			return si
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		mods += ms.Apply(Change{Kind: KindOf(name), Name: name, Action: LeaveMaintenance, Origin: origin}, issue, project)
+	}
+	return mods
+}
+
+// MoveIssue records the maintenance, scheduled changes and other metadata of
+// an issue under the issue to instead, e.g. because the issue was transferred
+// to another repository. The return value is the number of machines, sites
+// and scheduled changes that were moved.
+func (ms *MaintenanceState) MoveIssue(from string, to string, project string) int {
+	if from == to {
+		return 0
+	}
+	defer ms.flush()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	n := 0
+	for mapKey := range ms.issues[from] {
+		for _, m := range []map[string][]string{ms.state.Machines, ms.state.Sites, ms.state.Experiments, ms.state.Switches} {
+			issues, ok := m[mapKey]
+			i := stringInSlice(from, issues)
+			if !ok || i < 0 {
+				continue
+			}
+			n++
+			if stringInSlice(to, issues) >= 0 {
+				m[mapKey] = append(issues[:i:i], issues[i+1:]...)
+			} else {
+				issues[i] = ms.intern(to)
+				ms.indexAdd(mapKey, issues[i])
+			}
+			ms.indexRemove(mapKey, from)
+			ms.moveEntry(mapKey, from, to)
+		}
+	}
+	for i := range ms.state.Scheduled {
+		if ms.state.Scheduled[i].Issue == from {
+			ms.state.Scheduled[i].Issue = to
+			n++
+		}
+	}
+	if changes, ok := ms.state.Proposals[from]; ok {
+		delete(ms.state.Proposals, from)
+		ms.state.Proposals[to] = changes
+	}
+	if changes, ok := ms.state.Undo[from]; ok {
+		delete(ms.state.Undo, from)
+		ms.state.Undo[to] = changes
+	}
+	if ms.state.AutoClose[from] {
+		delete(ms.state.AutoClose, from)
+		ms.state.AutoClose[to] = true
+	}
+	if milestone, ok := ms.state.Milestones[from]; ok {
+		ms.setMilestone(from, "")
+		ms.setMilestone(to, milestone)
+	}
+
+	slog.Info("Moved the maintenance of an issue", "from", from, "to", to, "project", project, "mods", n)
+	return n
+}
+
+// moveEntry records the entry of name for the issue from under the issue to,
+// unless name already has an entry for to. The caller must hold the lock.
+func (ms *MaintenanceState) moveEntry(name string, from string, to string) {
+	key := EntryKey(name, from)
+	entry, ok := ms.state.Entries[key]
+	if !ok {
+		return
+	}
+	ms.deleteEntry(key)
+	if _, ok := ms.state.Entries[EntryKey(name, to)]; ok {
+		return
+	}
+	ms.state.Entries[EntryKey(name, to)] = entry
+	if entry.Reason != "" && !ms.scratch {
+		metrics.MaintenanceReason.WithLabelValues(name, to, entry.Reason).Set(1)
+	}
+}
+
+// SiteMachines returns the full names (e.g. mlab1-abc01) of the machines at a
+// site, according to siteinfo.
+func (ms *MaintenanceState) SiteMachines(site string) ([]string, error) {
+	machines, err := ms.sites.Machines(site)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(machines))
+	for _, m := range machines {
+		names = append(names, m+"-"+site)
+	}
+	return names, nil
+}
+
+// CountrySites returns the sites located in a country, given its ISO 3166
+// code (e.g. US).
+func (ms *MaintenanceState) CountrySites(country string) ([]string, error) {
+	countries, ok := ms.sites.(Countries)
+	if !ok {
+		return nil, errors.New("the locations of sites are not known")
+	}
+	return countries.CountrySites(country)
+}
+
+// Propose records a set of changes for an issue that must be approved before
+// they are applied, replacing any earlier proposal for the same issue. The
+// proposal is written to disk immediately.
+func (ms *MaintenanceState) Propose(issue string, changes []Change) error {
+	ms.mu.Lock()
+	if ms.state.Proposals == nil {
+		ms.state.Proposals = make(map[string][]Change)
+	}
+	ms.state.Proposals[issue] = changes
+	ms.mu.Unlock()
+	ms.flush()
+	return ms.Write()
+}
+
+// TakeProposal removes and returns the pending proposal for an issue. The
+// boolean return value is false if the issue has no pending proposal.
+func (ms *MaintenanceState) TakeProposal(issue string) ([]Change, bool) {
+	defer ms.flush()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	changes, ok := ms.state.Proposals[issue]
+	delete(ms.state.Proposals, issue)
+	return changes, ok
+}
+
+// SetUndo records the changes that revert those made by the last comment or
+// edit of an issue, and writes them to disk.
+func (ms *MaintenanceState) SetUndo(issue string, changes []Change) error {
+	ms.mu.Lock()
+	if ms.state.Undo == nil {
+		ms.state.Undo = make(map[string][]Change)
+	}
+	ms.state.Undo[issue] = changes
+	ms.mu.Unlock()
+	ms.flush()
+	return ms.Write()
+}
+
+// TakeUndo removes and returns the changes recorded by SetUndo for an issue.
+// The boolean result is false if there are none.
+func (ms *MaintenanceState) TakeUndo(issue string) ([]Change, bool) {
+	defer ms.flush()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	changes, ok := ms.state.Undo[issue]
+	delete(ms.state.Undo, issue)
+	return changes, ok
+}
+
+// Schedule records changes to be applied later by ApplyDue, and writes the
+// schedule to disk.
+func (ms *MaintenanceState) Schedule(changes []ScheduledChange) error {
+	ms.mu.Lock()
+	ms.state.Scheduled = append(ms.state.Scheduled, changes...)
+	ms.mu.Unlock()
+	ms.flush()
+	return ms.Write()
+}
+
+// Unschedule cancels scheduled changes for an issue. If name is not empty,
+// only the changes for the named machine or site are canceled. The return
+// value is the number of changes that were canceled.
+func (ms *MaintenanceState) Unschedule(issue string, name string) int {
+	defer ms.flush()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var kept []ScheduledChange
+	for _, sc := range ms.state.Scheduled {
+		if sc.Issue == issue && (name == "" || sc.Name == name) {
+			ratelog.Info("Canceled scheduled maintenance", "entity", sc.Name, "issue", issue)
+			continue
+		}
+		kept = append(kept, sc)
+	}
+	canceled := len(ms.state.Scheduled) - len(kept)
+	ms.state.Scheduled = kept
+	return canceled
+}
+
+// Scheduled returns a copy of the pending scheduled changes, ordered by the
+// time at which they will be applied.
+func (ms *MaintenanceState) Scheduled() []ScheduledChange {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	scheduled := make([]ScheduledChange, len(ms.state.Scheduled))
+	copy(scheduled, ms.state.Scheduled)
+	sort.SliceStable(scheduled, func(i, j int) bool { return scheduled[i].At.Before(scheduled[j].At) })
+	return scheduled
+}
+
+// Snapshot is a copy of the machines and sites in maintenance, and the issues
+// for which they are in maintenance.
+type Snapshot struct {
+	Machines, Sites map[string][]string
+	// Entries holds the metadata of machines and sites in maintenance, keyed
+	// by NAME/ISSUE, e.g. abc01/123.
+	Entries map[string]Entry `json:",omitempty"`
+	// Milestones holds the milestone of each issue that has one.
+	Milestones map[string]string `json:",omitempty"`
+	// Experiments holds the experiments in maintenance, keyed by
+	// ExperimentKey.
+	Experiments map[string][]string `json:",omitempty"`
+	// Switches holds the switches in maintenance, keyed by SwitchKey.
+	Switches map[string][]string `json:",omitempty"`
+}
+
+// copyStateMap returns a deep copy of a machine or site map.
+func copyStateMap(m map[string][]string) map[string][]string {
+	c := make(map[string][]string, len(m))
+	for k, v := range m {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// Project returns the project that the state was created for.
+func (ms *MaintenanceState) Project() string {
+	return ms.project
+}
+
+// Snapshot returns a copy of the machines and sites in maintenance.
+func (ms *MaintenanceState) Snapshot() Snapshot {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	snapshot := Snapshot{
+		Machines: copyStateMap(ms.state.Machines),
+		Sites:    copyStateMap(ms.state.Sites),
+	}
+	if len(ms.state.Experiments) > 0 {
+		snapshot.Experiments = copyStateMap(ms.state.Experiments)
+	}
+	if len(ms.state.Switches) > 0 {
+		snapshot.Switches = copyStateMap(ms.state.Switches)
+	}
+	if len(ms.state.Milestones) > 0 {
+		snapshot.Milestones = make(map[string]string, len(ms.state.Milestones))
+		for issue, milestone := range ms.state.Milestones {
+			snapshot.Milestones[issue] = milestone
+		}
+	}
+	if len(ms.state.Entries) > 0 {
+		snapshot.Entries = make(map[string]Entry, len(ms.state.Entries))
+		for key, entry := range ms.state.Entries {
+			snapshot.Entries[key] = entry
+		}
+	}
+	return snapshot
+}
+
+// Machines returns a copy of the machines in maintenance, each with the
+// issues for which it is in maintenance.
+func (ms *MaintenanceState) Machines() map[string][]string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return copyStateMap(ms.state.Machines)
+}
+
+// Sites is like Machines, but for sites.
+func (ms *MaintenanceState) Sites() map[string][]string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return copyStateMap(ms.state.Sites)
+}
+
+// Issues returns the sorted issues for which any machine, site, experiment
+// or switch is in maintenance.
+func (ms *MaintenanceState) Issues() []string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	issues := make([]string, 0, len(ms.issues))
+	for issue := range ms.issues {
+		issues = append(issues, issue)
+	}
+	sort.Strings(issues)
+	return issues
+}
+
+// ErrNoBackup is returned by Rollback when there is no backup to restore.
+var ErrNoBackup = errors.New("no backup to restore")
+
+// Rollback replaces the state with the newest backup made at or before t, and
+// rebuilds the metrics from it. The replaced state is itself backed up when the
+// restored state is written, so a rollback may be undone. Machines and sites
+// whose maintenance changes are reported to the listeners with the cause
+// "rollback". The return value is the time of the backup that was restored.
+func (ms *MaintenanceState) Rollback(t time.Time, project string) (time.Time, error) {
+	storage, ok := ms.storage.(BackupStorage)
+	if !ok {
+		return time.Time{}, ErrNoBackup
+	}
+	backups, err := storage.Backups()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var backup time.Time
+	for _, b := range backups {
+		if !b.After(t) {
+			backup = b
+		}
+	}
+	if backup.IsZero() {
+		return time.Time{}, ErrNoBackup
+	}
+	data, err := storage.LoadBackup(backup)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var restored state
+	if err := unmarshalState(data, &restored); err != nil {
+		return time.Time{}, fmt.Errorf("corrupt backup from %s: %w", backup.Format(time.RFC3339), err)
+	}
+
+	ms.replace(restored, "rollback", project)
+	slog.Info("Rolled back the state", "project", project, "backup", backup.Format(time.RFC3339))
+	return backup, ms.Write()
+}
+
+// replace swaps in a state read from storage and updates the metrics of the
+// project from it. Machines and sites whose maintenance changes are reported
+// to the listeners with cause.
+func (ms *MaintenanceState) replace(restored state, cause string, project string) {
+	defer ms.flush()
+	ms.mu.Lock()
+	now := time.Now()
+	for _, maps := range [][2]map[string][]string{
+		{ms.state.Machines, restored.Machines},
+		{ms.state.Sites, restored.Sites},
+		{ms.state.Experiments, restored.Experiments},
+		{ms.state.Switches, restored.Switches},
+	} {
+		ms.replaceTransitions(maps[0], maps[1], LeaveMaintenance, now, Origin{Cause: cause})
+		ms.replaceTransitions(maps[1], maps[0], EnterMaintenance, now, Origin{Cause: cause})
+	}
+	for issue, milestone := range ms.state.Milestones {
+		metrics.IssueInfo.DeleteLabelValues(issue, milestone)
+	}
+	for issue, milestone := range restored.Milestones {
+		metrics.IssueInfo.WithLabelValues(issue, milestone).Set(1)
+	}
+	ms.setReasonMetrics(ms.state.Entries, false)
+	ms.setReasonMetrics(restored.Entries, true)
+	if restored.Machines == nil {
+		restored.Machines = make(map[string][]string)
+	}
+	if restored.Sites == nil {
+		restored.Sites = make(map[string][]string)
+	}
+	old := ms.state
+	ms.state = restored
+	ms.rebuildIndex()
+	ms.replaceMetrics(old, project)
+	ms.mu.Unlock()
+}
+
+// replaceMetrics updates the maintenance metrics of the machines, sites,
+// experiments and switches of the project once the state old was replaced.
+// The series of other projects, which share the metrics, are left alone. The
+// caller must hold the lock.
+func (ms *MaintenanceState) replaceMetrics(old state, project string) {
+	for _, m := range []struct {
+		from, to map[string][]string
+		vec      *prometheus.GaugeVec
+	}{
+		{old.Machines, ms.state.Machines, metrics.Machine},
+		{old.Sites, ms.state.Sites, metrics.Site},
+		{old.Experiments, ms.state.Experiments, metrics.Experiment},
+		{old.Switches, ms.state.Switches, metrics.Switch},
+	} {
+		for mapKey := range m.from {
+			if _, ok := m.to[mapKey]; !ok {
+				ms.updateMetrics(mapKey, project, LeaveMaintenance, m.vec)
+			}
+		}
+		for mapKey := range m.to {
+			ms.updateMetrics(mapKey, project, EnterMaintenance, m.vec)
+		}
+	}
+}
+
+// replaceTransitions records a transition for every entity in from that is
+// not in to. The caller must hold the lock.
+func (ms *MaintenanceState) replaceTransitions(from, to map[string][]string, action Action, now time.Time, origin Origin) {
+	if len(ms.listeners) == 0 && ms.wal == nil {
+		return
+	}
+	for mapKey, issues := range from {
+		if _, ok := to[mapKey]; ok {
+			continue
+		}
+		ms.pending = append(ms.pending, Transition{
+			Kind:    KindOf(mapKey),
+			Name:    mapKey,
+			Action:  action,
+			Issue:   issues[0],
+			Time:    now,
+			Origin:  origin,
+			Project: ms.project,
+		})
+	}
+}
+
+// ApplyDue applies every scheduled change whose time has come, and writes the
+// state to disk if anything changed. The return value is the number of
+// modifications that were made to the machine and site maintenance state.
+func (ms *MaintenanceState) ApplyDue(now time.Time, project string) int {
+	ms.mu.Lock()
+	var due, kept []ScheduledChange
+	for _, sc := range ms.state.Scheduled {
+		if sc.At.After(now) {
+			kept = append(kept, sc)
+		} else {
+			due = append(due, sc)
+		}
+	}
+	ms.state.Scheduled = kept
+	ms.mu.Unlock()
+
+	if len(due) == 0 {
+		return 0
+	}
+	mods := 0
+	for _, sc := range due {
+		ratelog.Info("Applying scheduled maintenance", "entity", sc.Name, "issue", sc.Issue, "project", project)
+		mods += ms.Apply(sc.Change, sc.Issue, project)
+	}
+	ms.Write()
+	return mods
+}
+
+// SetAutoClose marks an issue to be closed once all of its maintenance has
+// been removed, and writes the state to disk if it was not already marked.
+func (ms *MaintenanceState) SetAutoClose(issue string) error {
+	ms.mu.Lock()
+	if ms.state.AutoClose[issue] {
+		ms.mu.Unlock()
+		return nil
+	}
+	if ms.state.AutoClose == nil {
+		ms.state.AutoClose = make(map[string]bool)
+	}
+	ms.state.AutoClose[issue] = true
+	ms.mu.Unlock()
+	ms.flush()
+	return ms.Write()
+}
+
+// AutoClose reports whether an issue should be closed once all of its
+// maintenance has been removed.
+func (ms *MaintenanceState) AutoClose(issue string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.state.AutoClose[issue]
+}
+
+// setMilestone records the milestone of an issue, or forgets it if milestone
+// is empty, and updates the issue's info metric. It reports whether anything
+// changed. The caller must hold the lock.
+func (ms *MaintenanceState) setMilestone(issue string, milestone string) bool {
+	old, ok := ms.state.Milestones[issue]
+	if old == milestone {
+		return false
+	}
+	if ok && !ms.scratch {
+		metrics.IssueInfo.DeleteLabelValues(issue, old)
+	}
+	if milestone == "" {
+		delete(ms.state.Milestones, issue)
+		return true
+	}
+	if ms.state.Milestones == nil {
+		ms.state.Milestones = make(map[string]string)
+	}
+	ms.state.Milestones[issue] = milestone
+	if !ms.scratch {
+		metrics.IssueInfo.WithLabelValues(issue, milestone).Set(1)
+	}
+	return true
+}
+
+// SetMilestone records the title of the milestone of an issue, or forgets it
+// if milestone is empty, and writes the state to disk if it changed.
+func (ms *MaintenanceState) SetMilestone(issue string, milestone string) error {
+	ms.mu.Lock()
+	changed := ms.setMilestone(issue, milestone)
+	ms.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	ms.flush()
+	return ms.Write()
+}
+
+// Milestone returns the title of the milestone recorded for an issue.
+func (ms *MaintenanceState) Milestone(issue string) string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.state.Milestones[issue]
+}
+
+// IssueEntities returns the number of machines and sites in maintenance for
+// an issue, including any that are scheduled to enter maintenance.
+func (ms *MaintenanceState) IssueEntities(issue string) int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	n := len(ms.issues[issue])
+	for _, sc := range ms.state.Scheduled {
+		if sc.Issue == issue {
+			n++
+		}
+	}
+	return n
+}
+
+// EntityIssues returns the issues for which a machine (e.g. mlab1-abc01) or
+// site is in maintenance.
+func (ms *MaintenanceState) EntityIssues(name string) []string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	issues, ok := ms.state.Sites[name]
+	if !ok {
+		issues = ms.state.Machines[name]
+	}
+	return append([]string(nil), issues...)
+}
+
+// IssueEntityNames returns the sorted names of the machines and sites that are
+// in maintenance for an issue.
+func (ms *MaintenanceState) IssueEntityNames(issue string) []string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	names := make([]string, 0, len(ms.issues[issue]))
+	for name := range ms.issues[issue] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Counts summarizes the size of the maintenance state.
+type Counts struct {
+	Machines, Sites, Scheduled, Proposals int
+}
+
+// Counts returns the number of machines and sites in maintenance, and the
+// number of scheduled changes and proposals awaiting approval.
+func (ms *MaintenanceState) Counts() Counts {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return Counts{
+		Machines:  len(ms.state.Machines),
+		Sites:     len(ms.state.Sites),
+		Scheduled: len(ms.state.Scheduled),
+		Proposals: len(ms.state.Proposals),
+	}
+}
+
 // removeSiteMachines take a site and project as parameters and iterates through
 // all machines in the current state, removing them if the site matches the
 // passed site parameter.
 func (ms *MaintenanceState) removeSiteMachines(site string, project string) {
 	for machine := range ms.state.Machines {
 		if site == strings.Split(machine, "-")[1] {
-			updateMetrics(machine, project, LeaveMaintenance, metrics.Machine)
+			ms.updateMetrics(machine, project, LeaveMaintenance, metrics.Machine)
+			ms.transition(machine, LeaveMaintenance, "", Origin{})
+			for _, issue := range ms.state.Machines[machine] {
+				ms.indexRemove(machine, issue)
+			}
 			delete(ms.state.Machines, machine)
+			ms.deleteEntries(machine)
 		}
 	}
+	for key := range ms.state.Experiments {
+		_, machine, _ := strings.Cut(key, "@")
+		if site == strings.Split(machine, "-")[1] {
+			ms.updateMetrics(key, project, LeaveMaintenance, metrics.Experiment)
+			ms.transition(key, LeaveMaintenance, "", Origin{})
+			for _, issue := range ms.state.Experiments[key] {
+				ms.indexRemove(key, issue)
+			}
+			delete(ms.state.Experiments, key)
+			ms.deleteEntries(key)
+		}
+	}
+	if issues, ok := ms.state.Switches[SwitchKey(site)]; ok {
+		key := SwitchKey(site)
+		ms.updateMetrics(key, project, LeaveMaintenance, metrics.Switch)
+		ms.transition(key, LeaveMaintenance, "", Origin{})
+		for _, issue := range issues {
+			ms.indexRemove(key, issue)
+		}
+		delete(ms.state.Switches, key)
+		ms.deleteEntries(key)
+	}
 }
 
 // removeRetired forcefully removes a site and/or machines from maintenance if
@@ -251,11 +1822,17 @@ func (ms *MaintenanceState) removeRetired(project string) bool {
 	for site := range ms.state.Sites {
 		_, err := ms.sites.Machines(site)
 		if err != nil {
-			updateMetrics(site, project, LeaveMaintenance, metrics.Site)
+			ms.updateMetrics(site, project, LeaveMaintenance, metrics.Site)
+			ms.transition(site, LeaveMaintenance, "", Origin{})
+			for _, issue := range ms.state.Sites[site] {
+				ms.indexRemove(site, issue)
+			}
 			delete(ms.state.Sites, site)
+			delete(ms.state.KnownMachines, site)
+			ms.deleteEntries(site)
 			ms.removeSiteMachines(site, project)
 			mods = true
-			log.Printf("Removed site %s from maintenace because it no longer exists", site)
+			slog.Info("Removed site from maintenance because it no longer exists", "entity", site, "project", project)
 		}
 	}
 
@@ -266,18 +1843,66 @@ func (ms *MaintenanceState) removeRetired(project string) bool {
 		if err != nil {
 			ms.removeSiteMachines(site, project)
 			mods = true
-			log.Printf("Removed machine %s from maintenace because the site no longer exists", machine)
+			slog.Info("Removed machine from maintenance because its site no longer exists", "entity", machine, "project", project)
 		}
 	}
 
 	return mods
 }
 
+// addNewMachines puts machines that were added to a site while the site was
+// in maintenance (e.g. a re-provisioned node) into maintenance for the same
+// issues as the site. Machines that were already known are left alone, so
+// that machines explicitly removed from maintenance stay out of it.
+func (ms *MaintenanceState) addNewMachines(project string) bool {
+	mods := false
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for site, issues := range ms.state.Sites {
+		machines, err := ms.sites.Machines(site)
+		if err != nil {
+			continue
+		}
+		if known, ok := ms.state.KnownMachines[site]; ok {
+			for _, m := range machines {
+				if stringInSlice(m, known) >= 0 {
+					continue
+				}
+				machine := m + "-" + site
+				if len(ms.state.Machines[machine]) == 0 {
+					ms.transition(machine, EnterMaintenance, issues[0], Origin{})
+				}
+				for _, issue := range issues {
+					if stringInSlice(issue, ms.state.Machines[machine]) < 0 {
+						ms.state.Machines[machine] = append(ms.state.Machines[machine], ms.intern(issue))
+						ms.indexAdd(machine, ms.intern(issue))
+					}
+				}
+				ms.updateMetrics(machine, project, EnterMaintenance, metrics.Machine)
+				ratelog.Info("Added new machine to maintenance because its site is in maintenance", "entity", machine, "site", site, "project", project)
+			}
+		}
+		if !reflect.DeepEqual(ms.state.KnownMachines[site], machines) {
+			if ms.state.KnownMachines == nil {
+				ms.state.KnownMachines = make(map[string][]string)
+			}
+			ms.state.KnownMachines[site] = append([]string(nil), machines...)
+			mods = true
+		}
+	}
+	return mods
+}
+
 // prune removes any sites and machines from maintenance that no longer exist in
 // siteinfo. A site will generally only disappear from siteinfo when it is
-// retired.
+// retired. It also puts machines that were added to a site in maintenance
+// into maintenance.
 func (ms *MaintenanceState) Prune(project string) {
 	mods := ms.removeRetired(project)
+	mods = ms.addNewMachines(project) || mods
+	ms.flush()
 
 	// Only write state to file if the current state was modified.
 	if mods {
@@ -285,21 +1910,87 @@ func (ms *MaintenanceState) Prune(project string) {
 	}
 }
 
+// Reload replaces the state with the one in the storage, e.g. so that a
+// replica that does not write the state follows the one that does. Machines
+// and sites whose maintenance changes are reported to the listeners with the
+// cause "sync".
+func (ms *MaintenanceState) Reload() error {
+	data, err := ms.storage.Load()
+	if err != nil {
+		return err
+	}
+	var restored state
+	if err := unmarshalState(data, &restored); err != nil {
+		return err
+	}
+	ms.replace(restored, "sync", ms.project)
+	return nil
+}
+
+// Scratch returns a copy of the state that may be modified freely to check
+// how changes would be applied. The copy is never persisted, has no
+// listeners, and does not update the metrics.
+func (ms *MaintenanceState) Scratch() *MaintenanceState {
+	ms.mu.Lock()
+	data, err := json.Marshal(ms.state)
+	ms.mu.Unlock()
+	rtx.Must(err, "Could not marshal MaintenanceState to a buffer.  This should never happen.")
+
+	s := &MaintenanceState{storage: ms.storage, sites: ms.sites, scratch: true}
+	rtx.Must(json.Unmarshal(data, &s.state), "Could not unmarshal a copy of MaintenanceState.  This should never happen.")
+	s.rebuildIndex()
+	return s
+}
+
+// CheckMetrics builds, without exporting, the maintenance metric of every
+// machine, site, experiment and switch in the state, and returns the first error.
+func (ms *MaintenanceState) CheckMetrics(project string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, m := range []struct {
+		entities map[string][]string
+		vec      *prometheus.GaugeVec
+	}{
+		{ms.state.Machines, metrics.Machine},
+		{ms.state.Sites, metrics.Site},
+		{ms.state.Experiments, metrics.Experiment},
+		{ms.state.Switches, metrics.Switch},
+	} {
+		descs := make(chan *prometheus.Desc, 1)
+		m.vec.Describe(descs)
+		desc := <-descs
+		for mapKey := range m.entities {
+			_, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, EnterMaintenance.StatusValue(), labelValues(mapKey, project)...)
+			if err != nil {
+				return fmt.Errorf("invalid metric for %s: %v", mapKey, err)
+			}
+		}
+	}
+	return nil
+}
+
 // New creates a MaintenanceState based on the passed-in filename. If it can't
 // be restored from disk, it also generates an error.
 func New(filename string, sites Sites, project string) (*MaintenanceState, error) {
+	return NewWithStorage(&FileStorage{Filename: filename}, sites, project)
+}
+
+// NewWithStorage creates a MaintenanceState that is persisted in storage. If
+// it can't be restored, it also generates an error.
+func NewWithStorage(storage Storage, sites Sites, project string) (*MaintenanceState, error) {
 	s := &MaintenanceState{
 		state: state{
 			Machines: make(map[string][]string),
 			Sites:    make(map[string][]string),
 		},
-		filename: filename,
-		sites:    sites,
+		storage: storage,
+		sites:   sites,
+		project: project,
 	}
 	err := s.Restore(project)
 	if err != nil {
-		log.Printf("WARNING: Failed to restore state file %s: %s", filename, err)
-		metrics.Error.WithLabelValues("restore", "maintenancestate.New").Add(1)
+		slog.Warn("Failed to restore state", "storage", fmt.Sprint(storage), "project", project, "err", err)
+		metrics.CountError("restore", "maintenancestate.New")
 	}
 	return s, err
 }
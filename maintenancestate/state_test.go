@@ -1,15 +1,21 @@
 package maintenancestate
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/m-lab/github-maintenance-exporter/metrics"
 	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 // Sample maintenance state as written to disk in JSON format.
@@ -90,7 +96,7 @@ func TestUpdateStateWithBadValue(t *testing.T) {
 	s, err := New(dir+"/state.json", cachingClient, "mlab-oti")
 	rtx.Must(err, "Could not read from tmpfile")
 
-	s.updateState(nil, "", nil, "", -1, "no-project") // The -1 should not be a legal action.
+	s.updateState(nil, "", nil, "", -1, "no-project", Origin{}) // The -1 should not be a legal action.
 }
 
 func TestUpdateMachine(t *testing.T) {
@@ -375,17 +381,970 @@ func TestWrite(t *testing.T) {
 
 	s2, err := New(dir+"/savedstate.json", cachingClient, "mlab-oti")
 	rtx.Must(err, "Could not restore state for s2")
-	if !reflect.DeepEqual(s2, s1) {
-		t.Error("The state was not the same after write/restore:", s1, s2)
+	if !reflect.DeepEqual(s2.state, s1.state) {
+		t.Error("The state was not the same after write/restore:", s1.state, s2.state)
+	}
+	if s1.Written().IsZero() {
+		t.Error("Written() was not set by Write()")
+	}
+	if got := testutil.ToFloat64(metrics.StateLastWrite.WithLabelValues("mlab-oti")); got != float64(s1.Written().Unix()) {
+		t.Errorf("last write timestamp = %v; want %d", got, s1.Written().Unix())
+	}
+	if testutil.ToFloat64(metrics.StateLastRestore.WithLabelValues("mlab-oti")) == 0 {
+		t.Error("last restore timestamp was not set by New()")
 	}
 	if strings.Join(s2.state.Machines["mlab1-abc01"], " ") != "1 2" {
 		t.Error("s2 was not different from the initial (not the saved and modified) input.", s2.state.Machines["mlab1-abc01"])
 	}
 
 	// Now exercise the error cases
-	s2.filename = ""
+	s2.storage = &FileStorage{Filename: ""}
 	err = s2.Write()
 	if err == nil {
 		t.Error("Should have had an error when writing s2 with an empty filename")
 	}
 }
+
+func TestProposals(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestProposals")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	s, _ := New(dir+"/state.json", cachingClient, "mlab-oti")
+	changes := []Change{{Kind: "site", Name: "abc01", Action: EnterMaintenance}}
+	rtx.Must(s.Propose("3", changes), "Could not write proposal")
+
+	// The proposal should survive a restart.
+	s2, err := New(dir+"/state.json", cachingClient, "mlab-oti")
+	rtx.Must(err, "Could not restore state")
+	got, ok := s2.TakeProposal("3")
+	if !ok || !reflect.DeepEqual(got, changes) {
+		t.Errorf("TakeProposal() = %v, %t; want %v, true", got, ok, changes)
+	}
+	if _, ok := s2.TakeProposal("3"); ok {
+		t.Error("TakeProposal() should have removed the proposal")
+	}
+
+	// Closing an issue discards its proposal.
+	rtx.Must(s.Propose("4", changes), "Could not write proposal")
+	s.CloseIssue("4", "mlab-oti")
+	if _, ok := s.TakeProposal("4"); ok {
+		t.Error("CloseIssue() should have discarded the proposal")
+	}
+}
+
+func TestUndo(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := New(dir+"/state.json", cachingClient, "mlab-oti")
+	changes := []Change{{Kind: "machine", Name: "mlab1-abc01", Action: LeaveMaintenance}}
+	rtx.Must(s.SetUndo("3", changes), "Could not write the changes to undo")
+
+	// The changes to undo survive a restart.
+	s2, err := New(dir+"/state.json", cachingClient, "mlab-oti")
+	rtx.Must(err, "Could not restore state")
+	got, ok := s2.TakeUndo("3")
+	if !ok || !reflect.DeepEqual(got, changes) {
+		t.Errorf("TakeUndo() = %v, %t; want %v, true", got, ok, changes)
+	}
+	if _, ok := s2.TakeUndo("3"); ok {
+		t.Error("TakeUndo() should have removed the changes")
+	}
+
+	// Closing an issue discards them.
+	rtx.Must(s.SetUndo("4", changes), "Could not write the changes to undo")
+	s.CloseIssue("4", "mlab-oti")
+	if _, ok := s.TakeUndo("4"); ok {
+		t.Error("CloseIssue() should have discarded the changes to undo")
+	}
+}
+
+func TestSiteMachines(t *testing.T) {
+	s := &MaintenanceState{sites: cachingClient}
+	machines, err := s.SiteMachines("odd02")
+	if err != nil || !reflect.DeepEqual(machines, []string{"mlab2-odd02", "mlab3-odd02"}) {
+		t.Errorf("SiteMachines() = %v, %v", machines, err)
+	}
+	if _, err := s.SiteMachines("not88"); err == nil {
+		t.Error("SiteMachines() should fail for a nonexistent site")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestSchedule")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	s, _ := New(dir+"/state.json", cachingClient, "mlab-oti")
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	rtx.Must(s.Schedule([]ScheduledChange{
+		{Change: Change{Kind: "site", Name: "abc01", Action: EnterMaintenance}, Issue: "1", At: now.Add(time.Minute)},
+		{Change: Change{Kind: "machine", Name: "mlab1-def01", Action: EnterMaintenance}, Issue: "1", At: now.Add(time.Hour)},
+		{Change: Change{Kind: "machine", Name: "mlab2-def01", Action: EnterMaintenance}, Issue: "2", At: now.Add(time.Hour)},
+	}), "Could not schedule changes")
+
+	if mods := s.ApplyDue(now, "mlab-oti"); mods != 0 {
+		t.Errorf("ApplyDue() applied %d changes before they were due", mods)
+	}
+	if mods := s.ApplyDue(now.Add(time.Minute), "mlab-oti"); mods != 5 {
+		t.Errorf("ApplyDue() = %d; want 5", mods)
+	}
+	if _, ok := s.state.Sites["abc01"]; !ok {
+		t.Error("ApplyDue() should have put abc01 into maintenance")
+	}
+	if n := s.Unschedule("1", "mlab1-def01"); n != 1 {
+		t.Errorf("Unschedule() = %d; want 1", n)
+	}
+	if got := s.Scheduled(); len(got) != 1 || got[0].Issue != "2" {
+		t.Errorf("Scheduled() = %+v; want only the change for issue 2", got)
+	}
+	// Closing the issue cancels the remaining scheduled change.
+	if mods := s.CloseIssue("2", "mlab-oti"); mods != 1 {
+		t.Errorf("CloseIssue() = %d; want 1", mods)
+	}
+	if mods := s.ApplyDue(now.Add(24*time.Hour), "mlab-oti"); mods != 0 {
+		t.Errorf("ApplyDue() = %d; want 0", mods)
+	}
+}
+
+func TestRevertComment(t *testing.T) {
+	s, _ := New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+	comment := Origin{Comment: 5}
+	s.Apply(Change{Kind: "site", Name: "abc01", Action: EnterMaintenance, Origin: comment}, "1", "mlab-oti")
+	s.Apply(Change{Kind: "machine", Name: "mlab1-xyz01", Action: EnterMaintenance}, "1", "mlab-oti")
+	// Already in maintenance for the body of the issue.
+	s.Apply(Change{Kind: "machine", Name: "mlab1-xyz01", Action: EnterMaintenance, Origin: comment}, "1", "mlab-oti")
+	s.Apply(Change{Kind: "machine", Name: "mlab2-xyz01", Action: EnterMaintenance, Origin: comment}, "2", "mlab-oti")
+	rtx.Must(s.Schedule([]ScheduledChange{
+		{Change: Change{Kind: "machine", Name: "mlab3-xyz01", Action: EnterMaintenance, Origin: comment}, Issue: "1", At: time.Now().Add(time.Hour)},
+	}), "Could not schedule changes")
+
+	if mods := s.RevertComment("1", 5, "mlab-oti", Origin{Cause: "deleted"}); mods != 6 {
+		t.Errorf("RevertComment() = %d; want 6", mods)
+	}
+	if got := s.IssueEntityNames("1"); !reflect.DeepEqual(got, []string{"mlab1-xyz01"}) {
+		t.Errorf("entities of issue 1 = %v; want [mlab1-xyz01]", got)
+	}
+	if n := s.IssueEntities("2"); n != 1 {
+		t.Errorf("issue 2 has %d entities; want 1", n)
+	}
+	if got := s.Scheduled(); len(got) != 0 {
+		t.Errorf("Scheduled() = %+v; want none", got)
+	}
+}
+
+func TestMoveIssue(t *testing.T) {
+	s, _ := New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+	s.Apply(Change{Kind: "site", Name: "abc01", Action: EnterMaintenance, Reason: "power"}, "1", "mlab-oti")
+	s.Apply(Change{Kind: "machine", Name: "mlab1-xyz01", Action: EnterMaintenance}, "1", "mlab-oti")
+	s.Apply(Change{Kind: "machine", Name: "mlab1-xyz01", Action: EnterMaintenance}, "repo#2", "mlab-oti")
+	rtx.Must(s.SetAutoClose("1"), "Could not set autoclose")
+	rtx.Must(s.Schedule([]ScheduledChange{
+		{Change: Change{Kind: "machine", Name: "mlab2-xyz01", Action: EnterMaintenance}, Issue: "1", At: time.Now().Add(time.Hour)},
+	}), "Could not schedule changes")
+
+	// The site, its 4 machines, mlab1-xyz01 and the scheduled change.
+	if mods := s.MoveIssue("1", "repo#2", "mlab-oti"); mods != 7 {
+		t.Errorf("MoveIssue() = %d; want 7", mods)
+	}
+	if n := s.IssueEntities("1"); n != 0 {
+		t.Errorf("moved issue still has %d entities", n)
+	}
+	if got := s.EntityIssues("mlab1-xyz01"); !reflect.DeepEqual(got, []string{"repo#2"}) {
+		t.Errorf("EntityIssues(mlab1-xyz01) = %v; want [repo#2]", got)
+	}
+	if got := s.Snapshot().Entries[EntryKey("abc01", "repo#2")].Reason; got != "power" {
+		t.Errorf("reason of the moved site = %q; want power", got)
+	}
+	if !s.AutoClose("repo#2") || s.AutoClose("1") {
+		t.Error("autoclose was not moved")
+	}
+	if got := s.Scheduled(); len(got) != 1 || got[0].Issue != "repo#2" {
+		t.Errorf("Scheduled() = %+v; want the change for repo#2", got)
+	}
+
+	// The metrics of the issues and reasons follow the move.
+	metrics.MaintenanceIssueInfo.Reset()
+	metrics.MaintenanceReason.Reset()
+	s.Apply(Change{Kind: "machine", Name: "mlab3-xyz01", Action: EnterMaintenance, Reason: "disk"}, "3", "mlab-oti")
+	if mods := s.MoveIssue("3", "repo#4", "mlab-oti"); mods != 1 {
+		t.Errorf("MoveIssue() = %d; want 1", mods)
+	}
+	if n := testutil.CollectAndCount(metrics.MaintenanceIssueInfo); n != 1 ||
+		testutil.ToFloat64(metrics.MaintenanceIssueInfo.WithLabelValues("repo#4", IssueURL("repo#4"), "mlab3-xyz01")) != 1 {
+		t.Errorf("MaintenanceIssueInfo has %d series; want only mlab3-xyz01 for repo#4", n)
+	}
+	if n := testutil.CollectAndCount(metrics.MaintenanceReason); n != 1 ||
+		testutil.ToFloat64(metrics.MaintenanceReason.WithLabelValues("mlab3-xyz01", "repo#4", "disk")) != 1 {
+		t.Errorf("MaintenanceReason has %d series; want only mlab3-xyz01 for repo#4", n)
+	}
+}
+
+func TestExpireEntries(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestExpireEntries")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	rtx.Must(os.WriteFile(dir+"/state.json", []byte(savedState), 0644), "Could not write state to tempfile")
+
+	s, err := New(dir+"/state.json", cachingClient, "mlab-oti")
+	rtx.Must(err, "Could not restore state")
+	expires := time.Now().Add(time.Hour)
+
+	// Adding an expiration to existing maintenance counts as a modification.
+	if mods := s.Apply(Change{Kind: "machine", Name: "mlab1-abc01", Action: EnterMaintenance, Expires: expires}, "1", "mlab-oti"); mods != 1 {
+		t.Errorf("Apply() = %d; want 1", mods)
+	}
+	if mods := s.Apply(Change{Kind: "site", Name: "def01", Action: EnterMaintenance, Duration: 2 * time.Hour}, "30", "mlab-oti"); mods != 5 {
+		t.Errorf("Apply() = %d; want 5", mods)
+	}
+	if mods := s.Apply(Change{Kind: "rack", Name: "def01", Action: EnterMaintenance}, "30", "mlab-oti"); mods != 0 {
+		t.Errorf("Apply() = %d; want 0 for an unknown kind", mods)
+	}
+	withExpirations := 0
+	for _, e := range s.state.Entries {
+		if !e.Expires.IsZero() {
+			withExpirations++
+		}
+	}
+	if withExpirations != 2 {
+		t.Errorf("Expected 2 entries with expirations; got %v", s.state.Entries)
+	}
+
+	if mods := s.ExpireEntries(time.Now(), "mlab-oti"); mods != 0 {
+		t.Errorf("ExpireEntries() = %d before anything expired", mods)
+	}
+	if mods := s.ExpireEntries(expires, "mlab-oti"); mods != 1 {
+		t.Errorf("ExpireEntries() = %d; want 1", mods)
+	}
+	if _, ok := s.state.Machines["mlab1-abc01"]; ok {
+		t.Error("mlab1-abc01 should have left maintenance")
+	}
+	if mods := s.ExpireEntries(expires.Add(2*time.Hour), "mlab-oti"); mods != 5 {
+		t.Errorf("ExpireEntries() = %d; want 5", mods)
+	}
+	if _, ok := s.state.Sites["def01"]; ok {
+		t.Error("def01 should have left maintenance")
+	}
+	if len(s.state.Machines["mlab3-def01"]) != 1 || len(s.state.Entries) != 0 {
+		t.Errorf("Only the expired issue should have been removed: %v, %v", s.state.Machines["mlab3-def01"], s.state.Entries)
+	}
+}
+
+func TestAutoClose(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestAutoClose")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	rtx.Must(os.WriteFile(dir+"/state.json", []byte(savedState), 0644), "Could not write state to tempfile")
+
+	s, err := New(dir+"/state.json", cachingClient, "mlab-oti")
+	rtx.Must(err, "Could not restore state")
+	if s.AutoClose("4") {
+		t.Error("Issue 4 should not be marked for autoclose")
+	}
+	rtx.Must(s.SetAutoClose("4"), "Could not set autoclose")
+	rtx.Must(s.SetAutoClose("4"), "Could not set autoclose twice")
+	if !s.AutoClose("4") {
+		t.Error("Issue 4 should be marked for autoclose")
+	}
+	if n := s.IssueEntities("4"); n != 5 {
+		t.Errorf("IssueEntities(4) = %d; want 5", n)
+	}
+	s.CloseIssue("4", "mlab-oti")
+	if s.AutoClose("4") || s.IssueEntities("4") != 0 {
+		t.Error("CloseIssue() should have removed everything for issue 4")
+	}
+}
+
+func TestMilestone(t *testing.T) {
+	dir := t.TempDir()
+	rtx.Must(os.WriteFile(dir+"/state.json", []byte(savedState), 0644), "Could not write state to tempfile")
+
+	metrics.IssueInfo.Reset()
+	s, err := New(dir+"/state.json", cachingClient, "mlab-oti")
+	rtx.Must(err, "Could not restore state")
+	rtx.Must(s.SetMilestone("4", "Kernel upgrade"), "Could not set milestone")
+	rtx.Must(s.SetMilestone("4", "Kernel upgrade Q3"), "Could not change milestone")
+	if got := s.Milestone("4"); got != "Kernel upgrade Q3" {
+		t.Errorf("Milestone(4) = %q; want %q", got, "Kernel upgrade Q3")
+	}
+	if got := s.Snapshot().Milestones; !reflect.DeepEqual(got, map[string]string{"4": "Kernel upgrade Q3"}) {
+		t.Errorf("Snapshot().Milestones = %v", got)
+	}
+	if n := testutil.CollectAndCount(metrics.IssueInfo); n != 1 {
+		t.Errorf("Expected 1 issue info series; got %d", n)
+	}
+
+	// The milestone survives a restart, and is forgotten once the issue is closed.
+	metrics.IssueInfo.Reset()
+	s2, err := New(dir+"/state.json", cachingClient, "mlab-oti")
+	rtx.Must(err, "Could not restore state")
+	if testutil.ToFloat64(metrics.IssueInfo.WithLabelValues("4", "Kernel upgrade Q3")) != 1 {
+		t.Error("The issue info metric should have been restored")
+	}
+	s2.CloseIssue("4", "mlab-oti")
+	if s2.Milestone("4") != "" || testutil.CollectAndCount(metrics.IssueInfo) != 0 {
+		t.Error("CloseIssue() should have forgotten the milestone of issue 4")
+	}
+}
+
+func TestReason(t *testing.T) {
+	dir := t.TempDir()
+	rtx.Must(os.WriteFile(dir+"/state.json", []byte(savedState), 0644), "Could not write state to tempfile")
+
+	metrics.MaintenanceReason.Reset()
+	s, err := New(dir+"/state.json", cachingClient, "mlab-oti")
+	rtx.Must(err, "Could not restore state")
+	s.Apply(Change{Kind: "site", Name: "def01", Action: EnterMaintenance, Reason: "switch replacement"}, "30", "mlab-oti")
+	s.Apply(Change{Kind: "site", Name: "def01", Action: EnterMaintenance, Reason: "new switch"}, "30", "mlab-oti")
+	rtx.Must(s.Write(), "Could not write state")
+	if got := s.Snapshot().Entries["def01/30"].Reason; got != "new switch" {
+		t.Errorf("Snapshot() reason = %q; want %q", got, "new switch")
+	}
+	if n := testutil.CollectAndCount(metrics.MaintenanceReason); n != 1 {
+		t.Errorf("Expected 1 reason series; got %d", n)
+	}
+
+	// The reason survives a restart, and is forgotten once the site leaves
+	// maintenance.
+	metrics.MaintenanceReason.Reset()
+	s2, err := New(dir+"/state.json", cachingClient, "mlab-oti")
+	rtx.Must(err, "Could not restore state")
+	if testutil.ToFloat64(metrics.MaintenanceReason.WithLabelValues("def01", "30", "new switch")) != 1 {
+		t.Error("The reason metric should have been restored")
+	}
+	s2.CloseIssue("30", "mlab-oti")
+	if len(s2.Snapshot().Entries) != 0 || testutil.CollectAndCount(metrics.MaintenanceReason) != 0 {
+		t.Error("CloseIssue() should have forgotten the reason for def01")
+	}
+}
+
+func TestExperiment(t *testing.T) {
+	dir := t.TempDir()
+	metrics.Experiment.Reset()
+	s, _ := New(dir+"/state.json", cachingClient, "mlab-oti")
+
+	key := ExperimentKey("ndt", "mlab1-abc01")
+	if mods := s.Apply(Change{Kind: "experiment", Name: key, Action: EnterMaintenance}, "40", "mlab-oti"); mods != 1 {
+		t.Errorf("Apply() = %d mods; want 1", mods)
+	}
+	if testutil.ToFloat64(metrics.Experiment.WithLabelValues("ndt", "mlab1-abc01.mlab-oti.measurement-lab.org", "abc01")) != 1 {
+		t.Error("The experiment metric should be set")
+	}
+	if _, ok := s.Snapshot().Machines["mlab1-abc01"]; ok {
+		t.Error("An experiment flag should not put the whole machine into maintenance")
+	}
+	rtx.Must(s.Write(), "Could not write state")
+
+	// The experiment survives a restart, and leaves with its issue.
+	metrics.Experiment.Reset()
+	s2, err := New(dir+"/state.json", cachingClient, "mlab-oti")
+	rtx.Must(err, "Could not restore state")
+	if !reflect.DeepEqual(s2.Snapshot().Experiments, map[string][]string{key: {"40"}}) {
+		t.Errorf("Restored experiments = %v", s2.Snapshot().Experiments)
+	}
+	if s2.CloseIssue("40", "mlab-oti") != 1 {
+		t.Error("CloseIssue() should have removed the experiment")
+	}
+	if testutil.ToFloat64(metrics.Experiment.WithLabelValues("ndt", "mlab1-abc01.mlab-oti.measurement-lab.org", "abc01")) != 0 {
+		t.Error("The experiment metric should be cleared")
+	}
+}
+
+func TestSwitch(t *testing.T) {
+	dir := t.TempDir()
+	metrics.Switch.Reset()
+	s, _ := New(dir+"/state.json", cachingClient, "mlab-oti")
+
+	key := SwitchKey("abc01")
+	if mods := s.Apply(Change{Kind: "switch", Name: key, Action: EnterMaintenance}, "41", "mlab-oti"); mods != 1 {
+		t.Errorf("Apply() = %d mods; want 1", mods)
+	}
+	if testutil.ToFloat64(metrics.Switch.WithLabelValues("mlab-oti", "abc01")) != 1 {
+		t.Error("The switch metric should be set")
+	}
+	if _, ok := s.Snapshot().Sites["abc01"]; ok {
+		t.Error("A switch flag should not put the site into maintenance")
+	}
+	rtx.Must(s.Write(), "Could not write state")
+
+	metrics.Switch.Reset()
+	s2, err := New(dir+"/state.json", cachingClient, "mlab-oti")
+	rtx.Must(err, "Could not restore state")
+	if !reflect.DeepEqual(s2.Snapshot().Switches, map[string][]string{key: {"41"}}) {
+		t.Errorf("Restored switches = %v", s2.Snapshot().Switches)
+	}
+	if s2.CloseIssue("41", "mlab-oti") != 1 {
+		t.Error("CloseIssue() should have removed the switch")
+	}
+	if testutil.ToFloat64(metrics.Switch.WithLabelValues("mlab-oti", "abc01")) != 0 {
+		t.Error("The switch metric should be cleared")
+	}
+}
+
+// growingSites is a Sites implementation whose sites gain a machine when grow
+// is set, as when a node is re-provisioned.
+type growingSites struct {
+	grow bool
+}
+
+func (g *growingSites) Machines(site string) ([]string, error) {
+	if g.grow {
+		return []string{"mlab1", "mlab2", "mlab3"}, nil
+	}
+	return []string{"mlab1", "mlab2"}, nil
+}
+
+func (g *growingSites) Reload(ctx context.Context) error {
+	return nil
+}
+
+func TestPruneAddsNewMachines(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestPruneAddsNewMachines")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	sites := &growingSites{}
+	s, _ := New(dir+"/state.json", sites, "mlab-oti")
+	s.UpdateSite("abc01", EnterMaintenance, "1", "mlab-oti")
+	s.UpdateSite("abc01", EnterMaintenance, "2", "mlab-oti")
+	// An operator explicitly brings one machine back.
+	s.UpdateMachine("mlab2-abc01", LeaveMaintenance, "1", "mlab-oti")
+	s.UpdateMachine("mlab2-abc01", LeaveMaintenance, "2", "mlab-oti")
+
+	s.Prune("mlab-oti")
+	if _, ok := s.state.Machines["mlab3-abc01"]; ok {
+		t.Error("mlab3-abc01 should not be in maintenance before it exists")
+	}
+
+	sites.grow = true
+	s.Prune("mlab-oti")
+	if got := s.state.Machines["mlab3-abc01"]; !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Errorf("mlab3-abc01 should be in maintenance for the site's issues; got %v", got)
+	}
+	if _, ok := s.state.Machines["mlab2-abc01"]; ok {
+		t.Error("mlab2-abc01 was explicitly removed and should stay out of maintenance")
+	}
+
+	// Sites without a record of their machines (e.g. from an older state
+	// file) only have their machines recorded.
+	delete(s.state.KnownMachines, "abc01")
+	delete(s.state.Machines, "mlab3-abc01")
+	s.Prune("mlab-oti")
+	if _, ok := s.state.Machines["mlab3-abc01"]; ok {
+		t.Error("mlab3-abc01 should not be added without a record of the site's machines")
+	}
+	if len(s.state.KnownMachines["abc01"]) != 3 {
+		t.Errorf("Prune() should have recorded the site's machines; got %v", s.state.KnownMachines)
+	}
+}
+
+func TestLabelScheme(t *testing.T) {
+	defer SetLabelScheme(LabelScheme{Hostnames: "v2", NodeLabel: true})
+
+	tests := []struct {
+		scheme LabelScheme
+		want   []string
+	}{
+		{
+			scheme: LabelScheme{Hostnames: "v2", NodeLabel: true},
+			want:   []string{"mlab1-abc01.mlab-oti.measurement-lab.org", "mlab1-abc01.mlab-oti.measurement-lab.org", "abc01"},
+		},
+		{
+			scheme: LabelScheme{Hostnames: "v1", NodeLabel: true},
+			want:   []string{"mlab1.abc01.measurement-lab.org", "mlab1.abc01.measurement-lab.org", "abc01"},
+		},
+		{
+			scheme: LabelScheme{Hostnames: "v2", NodeLabel: false},
+			want:   []string{"mlab1-abc01.mlab-oti.measurement-lab.org", "abc01"},
+		},
+	}
+	for _, tt := range tests {
+		if err := SetLabelScheme(tt.scheme); err != nil {
+			t.Fatalf("SetLabelScheme(%v) returned error: %v", tt.scheme, err)
+		}
+		got := labelValues("mlab1-abc01", "mlab-oti")
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("labelValues() with %v = %v; want %v", tt.scheme, got, tt.want)
+		}
+		// The metric must accept the label values of the scheme.
+		metrics.Machine.WithLabelValues(got...).Set(0)
+	}
+	if got := labelValues("abc01", "mlab-oti"); !reflect.DeepEqual(got, []string{"abc01"}) {
+		t.Errorf("labelValues() for a site = %v; want [abc01]", got)
+	}
+	rtx.Must(SetLabelScheme(LabelScheme{Hostnames: "v2", SiteProject: true}), "Could not set label scheme")
+	if got := labelValues("abc01", "mlab-oti"); !reflect.DeepEqual(got, []string{"mlab-oti", "abc01"}) {
+		t.Errorf("labelValues() for a site with SiteProject = %v; want [mlab-oti abc01]", got)
+	}
+	// The metric must accept the label values of the scheme.
+	metrics.Site.WithLabelValues(labelValues("abc01", "mlab-oti")...).Set(0)
+	if err := SetLabelScheme(LabelScheme{Hostnames: "v3"}); err == nil {
+		t.Error("SetLabelScheme() with an unknown hostname scheme returned nil error")
+	}
+}
+
+type recordingListener struct {
+	transitions []Transition
+}
+
+func (l *recordingListener) Transition(t Transition) {
+	l.transitions = append(l.transitions, t)
+}
+
+func TestListener(t *testing.T) {
+	dir := t.TempDir()
+	ms, _ := New(dir+"/state.json", cachingClient, "mlab-oti")
+	l := &recordingListener{}
+	ms.AddListener(l)
+
+	ms.UpdateSite("abc01", EnterMaintenance, "1", "mlab-oti")
+	// A second issue for an entity already in maintenance is not a transition.
+	ms.UpdateMachine("mlab1-abc01", EnterMaintenance, "2", "mlab-oti")
+	ms.CloseIssue("1", "mlab-oti")
+
+	var got []string
+	for _, tr := range l.transitions {
+		got = append(got, fmt.Sprintf("%s %s %d %s", tr.Kind, tr.Name, tr.Action, tr.Issue))
+		if tr.Project != "mlab-oti" {
+			t.Errorf("transition of %s has project %q; want mlab-oti", tr.Name, tr.Project)
+		}
+	}
+	want := []string{
+		"site abc01 2 1",
+		"machine mlab1-abc01 2 1",
+		"machine mlab2-abc01 2 1",
+		"machine mlab3-abc01 2 1",
+		"machine mlab4-abc01 2 1",
+		"machine mlab2-abc01 1 1",
+		"machine mlab3-abc01 1 1",
+		"machine mlab4-abc01 1 1",
+		"site abc01 1 1",
+	}
+	// The order in which an issue is closed depends on map iteration.
+	sort.Strings(got[5:])
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("transitions = %v; want %v", got, want)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	dir := t.TempDir()
+	storage := &FileStorage{Filename: dir + "/state.json", KeepBackups: 5}
+	ms, _ := NewWithStorage(storage, cachingClient, "mlab-oti")
+	if _, err := ms.Rollback(time.Now(), "mlab-oti"); !errors.Is(err, ErrNoBackup) {
+		t.Errorf("Rollback() without backups error = %v; want ErrNoBackup", err)
+	}
+
+	ms.UpdateMachine("mlab1-abc01", EnterMaintenance, "1", "mlab-oti")
+	rtx.Must(ms.Write(), "Could not write state")
+	rtx.Must(ms.Write(), "Could not write state")
+	before := time.Now()
+	ms.UpdateMachine("mlab1-abc01", LeaveMaintenance, "1", "mlab-oti")
+	ms.UpdateMachine("mlab2-abc01", EnterMaintenance, "2", "mlab-oti")
+	rtx.Must(ms.Write(), "Could not write state")
+
+	l := &recordingListener{}
+	ms.AddListener(l)
+	restored, err := ms.Rollback(before, "mlab-oti")
+	if err != nil || restored.After(before) {
+		t.Fatalf("Rollback() = %v, %v; want a backup from before %v", restored, err, before)
+	}
+	want := map[string][]string{"mlab1-abc01": {"1"}}
+	if got := ms.Snapshot().Machines; !reflect.DeepEqual(got, want) {
+		t.Errorf("Machines after rollback = %v; want %v", got, want)
+	}
+	if got := ms.IssueEntityNames("1"); !reflect.DeepEqual(got, []string{"mlab1-abc01"}) {
+		t.Errorf("IssueEntityNames(1) = %v; the index should have been rebuilt", got)
+	}
+	var got []string
+	for _, tr := range l.transitions {
+		got = append(got, fmt.Sprintf("%s %d %s %s", tr.Name, tr.Action, tr.Issue, tr.Cause))
+	}
+	sort.Strings(got)
+	if want := []string{"mlab1-abc01 2 1 rollback", "mlab2-abc01 1 2 rollback"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("transitions = %v; want %v", got, want)
+	}
+
+	// The rollback can itself be rolled back.
+	if _, err := ms.Rollback(time.Now(), "mlab-oti"); err != nil {
+		t.Fatalf("Rollback() error = %v", err)
+	}
+	want = map[string][]string{"mlab2-abc01": {"2"}}
+	if got := ms.Snapshot().Machines; !reflect.DeepEqual(got, want) {
+		t.Errorf("Machines after undoing the rollback = %v; want %v", got, want)
+	}
+}
+
+func TestReplaceMetrics(t *testing.T) {
+	dir := t.TempDir()
+	metrics.Machine.Reset()
+	metrics.Site.Reset()
+	oti, _ := New(dir+"/oti.json", cachingClient, "mlab-oti")
+	sandbox, _ := New(dir+"/sandbox.json", cachingClient, "mlab-sandbox")
+	oti.UpdateMachine("mlab1-abc01", EnterMaintenance, "1", "mlab-oti")
+	oti.UpdateSite("def01", EnterMaintenance, "1", "mlab-oti")
+	sandbox.UpdateMachine("mlab1-abc0t", EnterMaintenance, "1", "mlab-sandbox")
+	rtx.Must(sandbox.Write(), "Could not write state")
+	sandbox.UpdateMachine("mlab1-abc0t", LeaveMaintenance, "1", "mlab-sandbox")
+	sandbox.UpdateMachine("mlab2-abc0t", EnterMaintenance, "2", "mlab-sandbox")
+
+	// Replacing the state of one project must not touch the series of the
+	// other.
+	rtx.Must(sandbox.Reload(), "Could not reload state")
+	for _, values := range [][]string{
+		labelValues("mlab1-abc01", "mlab-oti"),
+		labelValues("mlab1-abc0t", "mlab-sandbox"),
+	} {
+		if v := testutil.ToFloat64(metrics.Machine.WithLabelValues(values...)); v != 1 {
+			t.Errorf("machine %v = %v after the reload; want 1", values, v)
+		}
+	}
+	if v := testutil.ToFloat64(metrics.Machine.WithLabelValues(labelValues("mlab2-abc0t", "mlab-sandbox")...)); v != 0 {
+		t.Errorf("mlab2-abc0t = %v after the reload; want 0", v)
+	}
+	if v := testutil.ToFloat64(metrics.Site.WithLabelValues("def01")); v != 1 {
+		t.Errorf("site def01 = %v after the reload; want 1", v)
+	}
+}
+
+func TestIssueIndex(t *testing.T) {
+	dir := t.TempDir()
+	rtx.Must(os.WriteFile(dir+"/state.json", []byte(savedState), 0644), "Could not write state to tempfile")
+	s, err := New(dir+"/state.json", cachingClient, "mlab-oti")
+	rtx.Must(err, "Could not read from tmpfile")
+
+	// checkIndex verifies that the incrementally maintained index matches one
+	// built from scratch.
+	checkIndex := func(step string) {
+		t.Helper()
+		got := s.issues
+		s.rebuildIndex()
+		if !reflect.DeepEqual(got, s.issues) {
+			t.Errorf("%s: index = %v; want %v", step, got, s.issues)
+		}
+	}
+	checkIndex("restore")
+
+	s.UpdateSite("abc01", EnterMaintenance, "30", "mlab-oti")
+	s.UpdateMachine("mlab2-def01", EnterMaintenance, "30", "mlab-oti")
+	checkIndex("enter")
+	if got := s.IssueEntities("30"); got != 6 {
+		t.Errorf("IssueEntities(30) = %d; want 6", got)
+	}
+
+	s.UpdateMachine("mlab1-abc01", LeaveMaintenance, "30", "mlab-oti")
+	checkIndex("leave")
+
+	if mods := s.CloseIssue("30", "mlab-oti"); mods != 5 {
+		t.Errorf("CloseIssue(30) = %d; want 5", mods)
+	}
+	checkIndex("close")
+	if _, ok := s.issues["30"]; ok {
+		t.Errorf("issue 30 is still indexed after being closed: %v", s.issues["30"])
+	}
+
+	s.Prune("mlab-oti")
+	checkIndex("prune")
+}
+
+func TestIssueQueries(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := New(dir+"/state.json", cachingClient, "mlab-oti")
+	s.UpdateSite("vir01", EnterMaintenance, "1", "mlab-oti")
+	s.UpdateMachine("mlab1-vir01", EnterMaintenance, "2", "mlab-oti")
+
+	if got, want := s.EntityIssues("mlab1-vir01"), []string{"1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("EntityIssues(mlab1-vir01) = %v; want %v", got, want)
+	}
+	if got, want := s.EntityIssues("vir01"), []string{"1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("EntityIssues(vir01) = %v; want %v", got, want)
+	}
+	if got := s.EntityIssues("abc01"); len(got) != 0 {
+		t.Errorf("EntityIssues(abc01) = %v; want none", got)
+	}
+	if got, want := s.IssueEntityNames("1"), []string{"mlab1-vir01", "vir01"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IssueEntityNames(1) = %v; want %v", got, want)
+	}
+	if got, want := s.Issues(), []string{"1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Issues() = %v; want %v", got, want)
+	}
+	if got, want := s.Sites(), map[string][]string{"vir01": {"1"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Sites() = %v; want %v", got, want)
+	}
+	// The maps returned are copies.
+	machines := s.Machines()
+	if got, want := machines, map[string][]string{"mlab1-vir01": {"1", "2"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Machines() = %v; want %v", got, want)
+	}
+	machines["mlab1-vir01"][0] = "changed"
+	if got := s.EntityIssues("mlab1-vir01"); got[0] != "1" {
+		t.Errorf("Modifying the result of Machines() changed the state: %v", got)
+	}
+
+	// The index is persisted, and restored along with the state.
+	rtx.Must(s.Write(), "Could not write state")
+	data, err := os.ReadFile(dir + "/state.json")
+	rtx.Must(err, "Could not read state")
+	if !strings.Contains(string(data), `"Issues"`) {
+		t.Errorf("The issue index was not persisted: %s", data)
+	}
+	s2, err := New(dir+"/state.json", cachingClient, "mlab-oti")
+	rtx.Must(err, "Could not restore state")
+	if got, want := s2.IssueEntityNames("2"), []string{"mlab1-vir01"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IssueEntityNames(2) after restore = %v; want %v", got, want)
+	}
+
+	// An inconsistent index is rebuilt from the machines and sites.
+	bad := strings.Replace(string(data), `"mlab1-vir01",`, "", 1)
+	rtx.Must(os.WriteFile(dir+"/bad.json", []byte(bad), 0644), "Could not write state")
+	s3, err := New(dir+"/bad.json", cachingClient, "mlab-oti")
+	rtx.Must(err, "Could not restore state")
+	if got, want := s3.IssueEntityNames("1"), []string{"mlab1-vir01", "vir01"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IssueEntityNames(1) after restoring a bad index = %v; want %v", got, want)
+	}
+}
+
+// fleetSites implements the Sites interface for a large fleet of sites, each
+// with four machines.
+type fleetSites struct{}
+
+func (f *fleetSites) Machines(site string) ([]string, error) {
+	return []string{"mlab1", "mlab2", "mlab3", "mlab4"}, nil
+}
+
+func (f *fleetSites) Reload(ctx context.Context) error {
+	return nil
+}
+
+// fleetSite returns the name of the i'th site of the fleet.
+func fleetSite(i int) string {
+	return fmt.Sprintf("%c%c%c%02d", 'a'+i/260%26, 'a'+i/10%26, 'a'+i%10, i%100)
+}
+
+// newFleetState returns a state in which sites of a large fleet are in
+// maintenance for a few issues each.
+func newFleetState(b *testing.B, sites int) *MaintenanceState {
+	s, _ := New(b.TempDir()+"/state.json", &fleetSites{}, "mlab-oti")
+	for i := 0; i < sites; i++ {
+		s.UpdateSite(fleetSite(i), EnterMaintenance, strconv.Itoa(i%50), "mlab-oti")
+	}
+	return s
+}
+
+func BenchmarkUpdateSite(b *testing.B) {
+	s := newFleetState(b, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		site := fleetSite(i % 1000)
+		s.UpdateSite(site, EnterMaintenance, "1000", "mlab-oti")
+		s.UpdateSite(site, LeaveMaintenance, "1000", "mlab-oti")
+	}
+}
+
+func BenchmarkCloseIssue(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		s := newFleetState(b, 1000)
+		b.StartTimer()
+		s.CloseIssue("7", "mlab-oti")
+	}
+}
+
+func BenchmarkRestore(b *testing.B) {
+	s := newFleetState(b, 1000)
+	rtx.Must(s.Write(), "Could not write state")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rtx.Must(s.Restore("mlab-oti"), "Could not restore state")
+	}
+}
+
+func BenchmarkResyncMetrics(b *testing.B) {
+	s := newFleetState(b, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ResyncAll(map[string]*MaintenanceState{"mlab-oti": s})
+	}
+}
+
+func TestScratch(t *testing.T) {
+	dir := t.TempDir()
+	rtx.Must(os.WriteFile(dir+"/state.json", []byte(savedState), 0644), "Could not write state to tempfile")
+	s, err := New(dir+"/state.json", cachingClient, "mlab-oti")
+	rtx.Must(err, "Could not restore state")
+	before, err := os.ReadFile(dir + "/state.json")
+	rtx.Must(err, "Could not read state")
+	series := testutil.CollectAndCount(metrics.Machine)
+
+	scratch := s.Scratch()
+	if !reflect.DeepEqual(scratch.Snapshot(), s.Snapshot()) {
+		t.Errorf("Scratch() = %+v; want a copy of %+v", scratch.Snapshot(), s.Snapshot())
+	}
+	scratch.UpdateMachine("mlab3-xyz09", EnterMaintenance, "99", "mlab-oti")
+	scratch.CloseIssue("1", "mlab-oti")
+	rtx.Must(scratch.Write(), "Could not write scratch state")
+	if err := scratch.CheckMetrics("mlab-oti"); err != nil {
+		t.Errorf("CheckMetrics() = %v", err)
+	}
+
+	if _, ok := s.state.Machines["mlab3-xyz09"]; ok {
+		t.Error("changing the scratch state changed the original")
+	}
+	if s.IssueEntities("1") == 0 {
+		t.Error("closing an issue in the scratch state closed it in the original")
+	}
+	if n := testutil.CollectAndCount(metrics.Machine); n != series {
+		t.Errorf("scratch state changed the number of machine metrics from %d to %d", series, n)
+	}
+	after, err := os.ReadFile(dir + "/state.json")
+	rtx.Must(err, "Could not read state")
+	if !bytes.Equal(before, after) {
+		t.Error("writing the scratch state changed the state file")
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := t.TempDir() + "/state.json"
+	writer, _ := New(path, cachingClient, "mlab-oti")
+	reader, _ := New(path, cachingClient, "mlab-oti")
+	l := &recordingListener{}
+	reader.AddListener(l)
+
+	writer.UpdateMachine("mlab1-abc01", EnterMaintenance, "1", "mlab-oti")
+	rtx.Must(writer.Write(), "Could not write state")
+	if err := reader.Reload(); err != nil {
+		t.Fatalf("Reload() = %v", err)
+	}
+	if !reflect.DeepEqual(reader.Snapshot(), writer.Snapshot()) {
+		t.Errorf("Reload() = %+v; want %+v", reader.Snapshot(), writer.Snapshot())
+	}
+	if len(l.transitions) != 1 || l.transitions[0].Cause != "sync" {
+		t.Errorf("transitions = %+v; want one sync", l.transitions)
+	}
+}
+
+func TestStateChanges(t *testing.T) {
+	s, _ := New(t.TempDir()+"/state.json", cachingClient, "mlab-changes")
+	count := func(kind, action string) float64 {
+		return testutil.ToFloat64(metrics.StateChanges.WithLabelValues(kind, action, "mlab-changes"))
+	}
+	s.UpdateMachine("mlab1-xyz01", EnterMaintenance, "1", "mlab-changes")
+	s.UpdateMachine("mlab1-xyz01", EnterMaintenance, "1", "mlab-changes")
+	s.UpdateMachine("mlab1-xyz01", EnterMaintenance, "2", "mlab-changes")
+	s.Apply(Change{Kind: "switch", Name: SwitchKey("xyz01"), Action: EnterMaintenance}, "2", "mlab-changes")
+	s.UpdateMachine("mlab1-xyz01", LeaveMaintenance, "1", "mlab-changes")
+	s.Scratch().UpdateMachine("mlab2-xyz01", EnterMaintenance, "3", "mlab-changes")
+
+	tests := []struct {
+		kind   string
+		action string
+		want   float64
+	}{
+		{kind: "machine", action: "enter", want: 2},
+		{kind: "machine", action: "leave", want: 1},
+		{kind: "switch", action: "enter", want: 1},
+		{kind: "site", action: "enter", want: 0},
+	}
+	for _, tt := range tests {
+		if got := count(tt.kind, tt.action); got != tt.want {
+			t.Errorf("%s %s changes = %v; want %v", tt.kind, tt.action, got, tt.want)
+		}
+	}
+}
+
+func TestTotals(t *testing.T) {
+	dir := t.TempDir()
+	rtx.Must(os.WriteFile(dir+"/state.json", []byte(savedState), 0644), "Could not write state to tempfile")
+	s, err := New(dir+"/state.json", cachingClient, "mlab-totals")
+	rtx.Must(err, "Could not restore state")
+	machines := func() float64 {
+		return testutil.ToFloat64(metrics.MachinesInMaintenance.WithLabelValues("mlab-totals"))
+	}
+	sites := func() float64 {
+		return testutil.ToFloat64(metrics.SitesInMaintenance.WithLabelValues("mlab-totals"))
+	}
+	if machines() != float64(len(s.state.Machines)) || sites() != float64(len(s.state.Sites)) {
+		t.Errorf("totals after restore = %v machines, %v sites; want %d, %d", machines(), sites(), len(s.state.Machines), len(s.state.Sites))
+	}
+	before := machines()
+	s.UpdateMachine("mlab1-xyz09", EnterMaintenance, "99", "mlab-totals")
+	if machines() != before+1 {
+		t.Errorf("machines in maintenance = %v; want %v", machines(), before+1)
+	}
+	s.Scratch().UpdateMachine("mlab2-xyz09", EnterMaintenance, "99", "mlab-totals")
+	if machines() != before+1 {
+		t.Errorf("scratch state changed machines in maintenance to %v", machines())
+	}
+}
+
+func TestMaintenanceIssueInfo(t *testing.T) {
+	SetIssueRepo("m-lab/ops-tracker")
+	defer SetIssueRepo("")
+	SetIssueSource("lab", "gitlab", "")
+	SetIssueSource("ops-b", "github", "https://github.com/m-lab/ops-b/issues/")
+	defer func() { issueSources = map[string]issueSource{} }()
+	metrics.MaintenanceIssueInfo.Reset()
+	s, _ := New(t.TempDir()+"/state.json", cachingClient, "mlab-oti")
+
+	for issue, want := range map[string]string{
+		"lab#3":     "",
+		"ops-b#4":   "https://github.com/m-lab/ops-b/issues/4",
+		"unknown#5": "",
+	} {
+		if got := IssueURL(issue); got != want {
+			t.Errorf("IssueURL(%q) = %q; want %q", issue, got, want)
+		}
+	}
+
+	s.UpdateMachine("mlab1-xyz01", EnterMaintenance, "7", "mlab-oti")
+	s.UpdateMachine("mlab2-xyz01", EnterMaintenance, "m-lab/other#8", "mlab-oti")
+	info := func(issue, url, entity string) float64 {
+		return testutil.ToFloat64(metrics.MaintenanceIssueInfo.WithLabelValues(issue, url, entity))
+	}
+	if info("7", "https://github.com/m-lab/ops-tracker/issues/7", "mlab1-xyz01") != 1 {
+		t.Error("The issue info of mlab1-xyz01 should link to the default repository")
+	}
+	if info("m-lab/other#8", "https://github.com/m-lab/other/issues/8", "mlab2-xyz01") != 1 {
+		t.Error("The issue info of mlab2-xyz01 should link to its own repository")
+	}
+
+	s.UpdateMachine("mlab1-xyz01", LeaveMaintenance, "7", "mlab-oti")
+	if n := testutil.CollectAndCount(metrics.MaintenanceIssueInfo); n != 1 {
+		t.Errorf("Expected 1 issue info series after leaving maintenance; got %d", n)
+	}
+	s.Scratch().UpdateMachine("mlab3-xyz01", EnterMaintenance, "9", "mlab-oti")
+	if n := testutil.CollectAndCount(metrics.MaintenanceIssueInfo); n != 1 {
+		t.Errorf("A scratch state changed the number of issue info series to %d", n)
+	}
+}
+
+func TestRestoreFromBackup(t *testing.T) {
+	dir := t.TempDir()
+	storage := &FileStorage{Filename: dir + "/state.json", KeepBackups: 3}
+	rtx.Must(storage.Save([]byte(savedState)), "Could not save state")
+	rtx.Must(storage.Save([]byte(`{"Machines": {"mlab1-xyz01": ["9"]}, "Sites": {}}`)), "Could not save state")
+	rtx.Must(storage.Save([]byte(`{"Machines": {"mlab1-xy`)), "Could not save state")
+	// The newest backup is itself truncated, so the one before it is used.
+	rtx.Must(storage.Save([]byte(`{"Machin`)), "Could not save state")
+
+	s, err := NewWithStorage(storage, cachingClient, "mlab-oti")
+	if err != nil {
+		t.Fatalf("NewWithStorage() with a corrupt state file = %v; want the backup restored", err)
+	}
+	want := map[string][]string{"mlab1-xyz01": {"9"}}
+	if got := s.Snapshot().Machines; !reflect.DeepEqual(got, want) {
+		t.Errorf("Machines = %v; want %v", got, want)
+	}
+	if s.IssueEntities("9") != 1 {
+		t.Error("the issue index was not rebuilt from the backup")
+	}
+
+	// Without valid backups, the corruption is reported.
+	rtx.Must(os.WriteFile(dir+"/other.json", []byte(`{"Machin`), 0644), "Could not write state")
+	if _, err := New(dir+"/other.json", cachingClient, "mlab-oti"); err == nil {
+		t.Error("New() with a corrupt state file and no backups returned nil error")
+	}
+}
@@ -0,0 +1,231 @@
+package maintenancestate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+// Storage persists the serialized maintenance state. FileStorage is the
+// default; other backends, or an in-memory one in tests, may be passed to
+// NewWithStorage.
+type Storage interface {
+	Load() ([]byte, error)
+	Save(data []byte) error
+}
+
+// ErrConflict is returned by a Storage that detects concurrent writers when
+// the state was saved by someone else since it was last loaded or saved.
+var ErrConflict = errors.New("state was changed by another writer")
+
+// BackupStorage is a Storage that keeps backups of earlier versions of the
+// state.
+type BackupStorage interface {
+	Storage
+	// Backups returns the times at which the backups were made, oldest
+	// first.
+	Backups() ([]time.Time, error)
+	// LoadBackup reads the backup made at t.
+	LoadBackup(t time.Time) ([]byte, error)
+}
+
+// backupTimeFormat is the format of the suffix of the names of backup files.
+const backupTimeFormat = "20060102T150405.000000000Z"
+
+// FileStorage stores the state in a file on the local filesystem.
+type FileStorage struct {
+	Filename string
+	// KeepBackups is the number of earlier versions of the file to keep, each
+	// in a file named after the time at which it was replaced.
+	KeepBackups int
+}
+
+// Load reads the state from the file.
+func (f *FileStorage) Load() ([]byte, error) {
+	return os.ReadFile(f.Filename)
+}
+
+// writeTemp writes data to a temporary file. It is a variable so that tests
+// can simulate failed writes.
+var writeTemp = func(f *os.File, data []byte) error {
+	_, err := f.Write(data)
+	return err
+}
+
+// Save writes the state to a temporary file in the same directory and renames
+// it into place, so that the file is never left partially written. If backups
+// are enabled, the existing file is first linked to a backup.
+func (f *FileStorage) Save(data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(f.Filename), filepath.Base(f.Filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = writeTemp(tmp, data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0664)
+	}
+	if err != nil {
+		return err
+	}
+
+	if f.KeepBackups > 0 {
+		backup := f.Filename + "." + time.Now().UTC().Format(backupTimeFormat)
+		err := os.Link(f.Filename, backup)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		defer f.pruneBackups()
+	}
+	return os.Rename(tmp.Name(), f.Filename)
+}
+
+// Backups returns the times at which the backups of the file were made.
+func (f *FileStorage) Backups() ([]time.Time, error) {
+	matches, err := filepath.Glob(f.Filename + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var times []time.Time
+	for _, m := range matches {
+		t, err := time.Parse(backupTimeFormat, strings.TrimPrefix(m, f.Filename+"."))
+		if err != nil {
+			// Not a backup.
+			continue
+		}
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times, nil
+}
+
+// LoadBackup reads the backup of the file made at t.
+func (f *FileStorage) LoadBackup(t time.Time) ([]byte, error) {
+	return os.ReadFile(f.Filename + "." + t.UTC().Format(backupTimeFormat))
+}
+
+// pruneBackups removes all but the newest f.KeepBackups backups.
+func (f *FileStorage) pruneBackups() {
+	times, err := f.Backups()
+	if err != nil || len(times) <= f.KeepBackups {
+		return
+	}
+	for _, t := range times[:len(times)-f.KeepBackups] {
+		err = os.Remove(f.Filename + "." + t.UTC().Format(backupTimeFormat))
+		if err != nil {
+			slog.Error("Failed to remove old backup", "storage", f.Filename, "err", err)
+			metrics.CountError("removebackup", "maintenancestate.FileStorage.Save")
+		}
+	}
+}
+
+func (f *FileStorage) String() string {
+	return f.Filename
+}
+
+// DualWrite supports migrating between storage backends. It reads from Old,
+// and writes to both Old and New, reporting whether New has diverged from Old
+// in the gmx_storage_divergence metric of Project. Once New is known to be in
+// sync, reads can be switched over to it.
+type DualWrite struct {
+	Old, New Storage
+	Project  string
+}
+
+// Load reads the state from Old, and checks whether New holds the same state.
+func (d *DualWrite) Load() ([]byte, error) {
+	data, err := d.Old.Load()
+	if err != nil {
+		return nil, err
+	}
+	newData, newErr := d.New.Load()
+	d.setDiverged(newErr != nil || !bytes.Equal(data, newData))
+	return data, nil
+}
+
+// Save writes the state to Old, then to New. Only a failure to write to Old is
+// returned, since Old remains the source of truth.
+func (d *DualWrite) Save(data []byte) error {
+	err := d.Old.Save(data)
+	if err != nil {
+		return err
+	}
+	err = d.New.Save(data)
+	if err != nil {
+		slog.Error("Failed to write state to the new storage", "storage", fmt.Sprint(d.New), "err", err)
+		metrics.CountError("writenew", "maintenancestate.DualWrite.Save")
+	}
+	d.setDiverged(err != nil)
+	return nil
+}
+
+// Backups returns the backups of Old, if it keeps any.
+func (d *DualWrite) Backups() ([]time.Time, error) {
+	b, ok := d.Old.(BackupStorage)
+	if !ok {
+		return nil, nil
+	}
+	return b.Backups()
+}
+
+// LoadBackup reads a backup of Old.
+func (d *DualWrite) LoadBackup(t time.Time) ([]byte, error) {
+	b, ok := d.Old.(BackupStorage)
+	if !ok {
+		return nil, fmt.Errorf("%v does not keep backups", d.Old)
+	}
+	return b.LoadBackup(t)
+}
+
+func (d *DualWrite) setDiverged(diverged bool) {
+	if diverged {
+		metrics.StorageDivergence.WithLabelValues(d.Project).Set(1)
+	} else {
+		metrics.StorageDivergence.WithLabelValues(d.Project).Set(0)
+	}
+}
+
+func (d *DualWrite) String() string {
+	return fmt.Sprintf("%v (migrating to %v)", d.Old, d.New)
+}
+
+// OpenStorage returns the Storage described by location, which is one of
+// gs://BUCKET/OBJECT for a Cloud Storage object,
+// firestore://PROJECT/COLLECTION/DOCUMENT for a Firestore document, or the
+// path of a file.
+func OpenStorage(location string) (Storage, error) {
+	if location == "" {
+		return nil, fmt.Errorf("empty storage location")
+	}
+	if rest, ok := strings.CutPrefix(location, "firestore://"); ok {
+		project, document, _ := strings.Cut(rest, "/")
+		segments := strings.Split(document, "/")
+		if project == "" || len(segments)%2 != 0 || strings.Contains("/"+document+"/", "//") {
+			return nil, fmt.Errorf("invalid Firestore location %q: must be firestore://PROJECT/COLLECTION/DOCUMENT", location)
+		}
+		return NewFirestoreStorage(project, document), nil
+	}
+	if rest, ok := strings.CutPrefix(location, "gs://"); ok {
+		bucket, object, _ := strings.Cut(rest, "/")
+		if bucket == "" || object == "" {
+			return nil, fmt.Errorf("invalid Cloud Storage location %q: must be gs://BUCKET/OBJECT", location)
+		}
+		return NewGCSStorage(bucket, object), nil
+	}
+	return &FileStorage{Filename: location}, nil
+}
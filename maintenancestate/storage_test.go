@@ -0,0 +1,222 @@
+package maintenancestate
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// memoryStorage implements Storage in memory for testing.
+type memoryStorage struct {
+	data []byte
+	err  error
+}
+
+func (m *memoryStorage) Load() ([]byte, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.data == nil {
+		return nil, errors.New("no data")
+	}
+	return m.data, nil
+}
+
+func (m *memoryStorage) Save(data []byte) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.data = append([]byte(nil), data...)
+	return nil
+}
+
+func TestWriteRestoreWithStorage(t *testing.T) {
+	storage := &memoryStorage{data: []byte(savedState)}
+	s1, err := NewWithStorage(storage, cachingClient, "mlab-oti")
+	rtx.Must(err, "Could not restore state from memory")
+	s1.UpdateMachine("mlab1-xyz01", EnterMaintenance, "20", "mlab-oti")
+	rtx.Must(s1.Write(), "Could not save state to memory")
+
+	s2, err := NewWithStorage(storage, cachingClient, "mlab-oti")
+	rtx.Must(err, "Could not restore the saved state from memory")
+	if !reflect.DeepEqual(s2.Snapshot(), s1.Snapshot()) {
+		t.Errorf("Snapshot() after restore = %+v; want %+v", s2.Snapshot(), s1.Snapshot())
+	}
+
+	storage.err = errors.New("unavailable")
+	if err := s2.Write(); err == nil {
+		t.Error("Write() to failing storage returned nil error")
+	}
+	if err := s2.Restore("mlab-oti"); err == nil {
+		t.Error("Restore() from failing storage returned nil error")
+	}
+}
+
+func TestDualWrite(t *testing.T) {
+	old := &memoryStorage{data: []byte(savedState)}
+	newStorage := &memoryStorage{}
+	d := &DualWrite{Old: old, New: newStorage, Project: "mlab-oti"}
+
+	s, err := NewWithStorage(d, cachingClient, "mlab-oti")
+	if err != nil {
+		t.Fatalf("NewWithStorage() returned error: %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.StorageDivergence.WithLabelValues("mlab-oti")); got != 1 {
+		t.Errorf("StorageDivergence before the first write = %v; want 1", got)
+	}
+
+	if err := s.Write(); err != nil {
+		t.Fatalf("Write() returned error: %v", err)
+	}
+	if string(old.data) != string(newStorage.data) {
+		t.Errorf("The new storage was not written: %q != %q", old.data, newStorage.data)
+	}
+	if got := testutil.ToFloat64(metrics.StorageDivergence.WithLabelValues("mlab-oti")); got != 0 {
+		t.Errorf("StorageDivergence after a write = %v; want 0", got)
+	}
+	if _, err := d.Load(); err != nil || testutil.ToFloat64(metrics.StorageDivergence.WithLabelValues("mlab-oti")) != 0 {
+		t.Errorf("Load() of storages in sync = %v, divergence %v", err, testutil.ToFloat64(metrics.StorageDivergence.WithLabelValues("mlab-oti")))
+	}
+
+	// A failure of the new storage is reported, but does not fail the write.
+	newStorage.err = errors.New("unavailable")
+	if err := s.Write(); err != nil {
+		t.Errorf("Write() with a failing new storage returned error: %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.StorageDivergence.WithLabelValues("mlab-oti")); got != 1 {
+		t.Errorf("StorageDivergence after a failed write = %v; want 1", got)
+	}
+
+	// A failure of the old storage fails the write.
+	old.err = errors.New("unavailable")
+	if err := s.Write(); err == nil {
+		t.Error("Write() with a failing old storage returned nil error")
+	}
+}
+
+func TestOpenStorage(t *testing.T) {
+	s, err := OpenStorage("/tmp/gmx-state")
+	if err != nil {
+		t.Fatalf("OpenStorage() returned error: %v", err)
+	}
+	if f, ok := s.(*FileStorage); !ok || f.Filename != "/tmp/gmx-state" {
+		t.Errorf("OpenStorage() = %v; want a FileStorage for /tmp/gmx-state", s)
+	}
+	if _, err := OpenStorage(""); err == nil {
+		t.Error("OpenStorage(\"\") returned nil error")
+	}
+
+	s, err = OpenStorage("gs://bucket/dir/gmx-state")
+	if g, ok := s.(*GCSStorage); err != nil || !ok || g.Bucket != "bucket" || g.Object != "dir/gmx-state" {
+		t.Errorf("OpenStorage() = %v, %v; want a GCSStorage for gmx-state in bucket", s, err)
+	}
+	s, err = OpenStorage("firestore://mlab-oti/gmx/state")
+	if f, ok := s.(*FirestoreStorage); err != nil || !ok || f.Project != "mlab-oti" || f.Document != "gmx/state" {
+		t.Errorf("OpenStorage() = %v, %v; want a FirestoreStorage for gmx/state in mlab-oti", s, err)
+	}
+	for _, location := range []string{"gs://bucket", "gs://bucket/", "gs:///gmx-state",
+		"firestore://mlab-oti", "firestore://mlab-oti/gmx", "firestore:///gmx/state", "firestore://mlab-oti/gmx//state/x"} {
+		if _, err := OpenStorage(location); err == nil {
+			t.Errorf("OpenStorage(%q) returned nil error", location)
+		}
+	}
+}
+
+func TestDegraded(t *testing.T) {
+	storage := &memoryStorage{data: []byte(savedState)}
+	s, err := NewWithStorage(storage, cachingClient, "mlab-oti")
+	if err != nil {
+		t.Fatalf("NewWithStorage() returned error: %v", err)
+	}
+	s.SetDegradedThreshold(2)
+
+	storage.err = errors.New("disk full")
+	s.Write()
+	if s.Degraded() {
+		t.Error("Degraded() after a single failed write = true; want false")
+	}
+	s.Write()
+	if !s.Degraded() || testutil.ToFloat64(metrics.Degraded.WithLabelValues("mlab-oti")) != 1 {
+		t.Errorf("Degraded() after two failed writes = %t, gmx_degraded %v; want true, 1",
+			s.Degraded(), testutil.ToFloat64(metrics.Degraded.WithLabelValues("mlab-oti")))
+	}
+
+	storage.err = nil
+	if err := s.Write(); err != nil {
+		t.Fatalf("Write() returned error: %v", err)
+	}
+	if s.Degraded() || testutil.ToFloat64(metrics.Degraded.WithLabelValues("mlab-oti")) != 0 {
+		t.Error("The state is still degraded after a successful write")
+	}
+}
+
+func TestFileStorageBackups(t *testing.T) {
+	dir := t.TempDir()
+	f := &FileStorage{Filename: dir + "/state.json", KeepBackups: 2}
+	for _, data := range []string{"a", "b", "c", "d"} {
+		if err := f.Save([]byte(data)); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+	}
+	// A file that merely shares the prefix is not a backup.
+	rtx.Must(os.WriteFile(dir+"/state.json.mlab-sandbox", []byte("x"), 0644), "Could not write file")
+
+	backups, err := f.Backups()
+	if err != nil || len(backups) != 2 {
+		t.Fatalf("Backups() = %v, %v; want 2 backups", backups, err)
+	}
+	for i, want := range []string{"b", "c"} {
+		data, err := f.LoadBackup(backups[i])
+		if err != nil || string(data) != want {
+			t.Errorf("LoadBackup(%v) = %q, %v; want %q", backups[i], data, err, want)
+		}
+	}
+	if data, _ := f.Load(); string(data) != "d" {
+		t.Errorf("Load() = %q; want %q", data, "d")
+	}
+
+	// DualWrite exposes the backups of the old storage.
+	d := &DualWrite{Old: f, New: &memoryStorage{}}
+	if got, _ := d.Backups(); !reflect.DeepEqual(got, backups) {
+		t.Errorf("DualWrite.Backups() = %v; want %v", got, backups)
+	}
+	if _, err := (&DualWrite{Old: &memoryStorage{}, New: f}).LoadBackup(backups[0]); err == nil {
+		t.Error("DualWrite.LoadBackup() should fail when the old storage has no backups")
+	}
+}
+
+func TestFileStorageAtomic(t *testing.T) {
+	dir := t.TempDir()
+	f := &FileStorage{Filename: dir + "/state.json"}
+	rtx.Must(f.Save([]byte(savedState)), "Could not save state")
+
+	// Simulate a crash or full disk partway through writing.
+	defer func(w func(*os.File, []byte) error) { writeTemp = w }(writeTemp)
+	writeTemp = func(tmp *os.File, data []byte) error {
+		tmp.Write(data[:len(data)/2])
+		return errors.New("disk full")
+	}
+	if err := f.Save([]byte(`{"Machines": {}, "Sites": {}}`)); err == nil {
+		t.Error("Save() with a failed write returned nil error")
+	}
+
+	data, err := f.Load()
+	if err != nil || string(data) != savedState {
+		t.Errorf("Load() after a failed write = %q, %v; want the previous state", data, err)
+	}
+	entries, err := os.ReadDir(dir)
+	rtx.Must(err, "Could not list %s", dir)
+	if len(entries) != 1 {
+		t.Errorf("files after a failed write = %v; want only state.json", entries)
+	}
+	info, err := os.Stat(f.Filename)
+	rtx.Must(err, "Could not stat %s", f.Filename)
+	if info.Mode().Perm() != 0664 {
+		t.Errorf("state file mode = %v; want 0664", info.Mode().Perm())
+	}
+}
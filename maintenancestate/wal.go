@@ -0,0 +1,297 @@
+package maintenancestate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+// walFields are the fields of the state that the write-ahead log records,
+// keyed by their JSON names. Each is a map whose keys change independently,
+// except for Scheduled, which is recorded whole under the key "".
+var walFields = []string{"Machines", "Sites", "Experiments", "Switches", "Entries", "Proposals",
+	"Undo", "AutoClose", "KnownMachines", "Milestones", "Scheduled"}
+
+// FieldChange sets one key of a field of the state to Value, or deletes it if
+// Value is empty.
+type FieldChange struct {
+	Field string
+	Key   string          `json:",omitempty"`
+	Value json.RawMessage `json:",omitempty"`
+}
+
+// Record is an entry of the write-ahead log: every change made to the state
+// by a single operation, such as applying a flag or closing an issue.
+type Record struct {
+	// Seq numbers the records of a state from 1, without gaps.
+	Seq     int64
+	Time    time.Time
+	Project string
+	// Transitions are the machines and sites that entered or left
+	// maintenance, with why and by whom, so that the log is also an audit
+	// trail.
+	Transitions []Transition `json:",omitempty"`
+	Changes     []FieldChange
+}
+
+// WAL is a write-ahead log of the changes made to a state, kept in a file of
+// JSON records, one per line. Every record is synced to disk before the
+// operation that made it returns, so that a state can be reconstructed after
+// a crash from its last snapshot and the records that follow it.
+type WAL struct {
+	mu   sync.Mutex
+	f    *os.File
+	path string
+}
+
+// OpenWAL opens the write-ahead log at path, creating it if needed. A final
+// record that was only partly written, e.g. because of a crash, is removed.
+func OpenWAL(path string) (*WAL, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if end := bytes.LastIndexByte(data, '\n') + 1; end < len(data) {
+		slog.Warn("Removing a partly written record from the end of the write-ahead log", "wal", path)
+		if err := f.Truncate(int64(end)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &WAL{f: f, path: path}, nil
+}
+
+// String returns the path of the log.
+func (w *WAL) String() string {
+	return w.path
+}
+
+// Append adds r to the log and syncs it to disk.
+func (w *WAL) Append(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// Records returns every record in the log, in order.
+func (w *WAL) Records() ([]Record, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	for i, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal(line, &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", w.path, i+1, err)
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// Close closes the log.
+func (w *WAL) Close() error {
+	return w.f.Close()
+}
+
+// fieldValues returns the JSON of every key of every field in walFields.
+func fieldValues(s *state) map[string]map[string]json.RawMessage {
+	data, err := json.Marshal(s)
+	if err != nil {
+		panic(fmt.Sprintf("could not marshal the state: %v", err))
+	}
+	var raw map[string]json.RawMessage
+	json.Unmarshal(data, &raw)
+	values := make(map[string]map[string]json.RawMessage, len(walFields))
+	for _, field := range walFields {
+		m := map[string]json.RawMessage{}
+		values[field] = m
+		v, ok := raw[field]
+		if !ok || string(v) == "null" {
+			continue
+		}
+		if field == "Scheduled" {
+			m[""] = v
+			continue
+		}
+		json.Unmarshal(v, &m)
+	}
+	return values
+}
+
+// diffFields returns the changes that turn the fields old into new.
+func diffFields(old, new map[string]map[string]json.RawMessage) []FieldChange {
+	var changes []FieldChange
+	for _, field := range walFields {
+		for key, v := range new[field] {
+			if !bytes.Equal(old[field][key], v) {
+				changes = append(changes, FieldChange{Field: field, Key: key, Value: v})
+			}
+		}
+		for key := range old[field] {
+			if _, ok := new[field][key]; !ok {
+				changes = append(changes, FieldChange{Field: field, Key: key})
+			}
+		}
+	}
+	return changes
+}
+
+// applyFields applies changes to the fields values.
+func applyFields(values map[string]map[string]json.RawMessage, changes []FieldChange) {
+	for _, c := range changes {
+		if values[c.Field] == nil {
+			values[c.Field] = map[string]json.RawMessage{}
+		}
+		if len(c.Value) == 0 {
+			delete(values[c.Field], c.Key)
+		} else {
+			values[c.Field][c.Key] = c.Value
+		}
+	}
+}
+
+// stateFromFields returns the state holding the fields values.
+func stateFromFields(values map[string]map[string]json.RawMessage) (state, error) {
+	raw := map[string]interface{}{}
+	for field, v := range values {
+		if field == "Scheduled" {
+			if s, ok := v[""]; ok {
+				raw[field] = s
+			}
+			continue
+		}
+		raw[field] = v
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return state{}, err
+	}
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		return state{}, err
+	}
+	if s.Machines == nil {
+		s.Machines = make(map[string][]string)
+	}
+	if s.Sites == nil {
+		s.Sites = make(map[string][]string)
+	}
+	return s, nil
+}
+
+// logChanges appends the changes made to the state since they were last
+// logged to the write-ahead log, along with the pending transitions. The
+// caller must hold the lock.
+func (ms *MaintenanceState) logChanges() {
+	if ms.wal == nil {
+		return
+	}
+	values := fieldValues(&ms.state)
+	changes := diffFields(ms.logged, values)
+	if len(changes) == 0 {
+		return
+	}
+	r := Record{Seq: ms.seq + 1, Time: time.Now(), Project: ms.project, Transitions: ms.pending[ms.loggedPending:], Changes: changes}
+	ms.loggedPending = len(ms.pending)
+	if err := ms.wal.Append(r); err != nil {
+		// The next Write saves a snapshot instead.
+		slog.Error("Failed to append to the write-ahead log", "wal", ms.wal.String(), "project", ms.project, "err", err)
+		metrics.CountError("wal", "maintenancestate.logChanges")
+		ms.walFailed = true
+	}
+	// The record is counted even if it was not saved, so that it is not
+	// mistaken for a later one when replaying the log.
+	ms.seq = r.Seq
+	ms.logged = values
+}
+
+// UseWAL replays the records of wal that follow the snapshot from which the
+// state was restored, and then logs every change to wal. The state is only
+// saved to the storage by Write once snapshotEvery records have been logged
+// since the last snapshot.
+func (ms *MaintenanceState) UseWAL(wal *WAL, snapshotEvery int) error {
+	records, err := wal.Records()
+	if err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	values := fieldValues(&ms.state)
+	// applied is the last record reflected in the state, and seq the last
+	// record in the log.
+	applied := ms.state.Seq
+	seq := applied
+	replayed := 0
+	gap := false
+	for _, r := range records {
+		if r.Seq > seq {
+			seq = r.Seq
+		}
+		if r.Seq <= applied || gap {
+			continue
+		}
+		if r.Seq != applied+1 {
+			// A record could not be appended, and the snapshot that
+			// should have followed it was never saved.
+			slog.Error("The write-ahead log is missing records; replaying stopped", "wal", wal.String(), "project", ms.project, "after", applied, "next", r.Seq)
+			metrics.CountError("wal", "maintenancestate.UseWAL")
+			gap = true
+			continue
+		}
+		applyFields(values, r.Changes)
+		applied = r.Seq
+		replayed++
+	}
+	restored, err := stateFromFields(values)
+	ms.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if replayed > 0 {
+		restored.Seq = ms.state.Seq
+		ms.replace(restored, "replay", ms.project)
+		slog.Info("Replayed the write-ahead log", "wal", wal.String(), "project", ms.project, "records", replayed)
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.wal = wal
+	ms.snapshotEvery = snapshotEvery
+	ms.seq = seq
+	// After a gap, the next Write saves a snapshot, so that the records that
+	// follow the gap are not replayed on top of an older state.
+	ms.walFailed = gap
+	ms.logged = fieldValues(&ms.state)
+	return nil
+}
+
+// snapshotDue reports whether Write must save the state, because it is not
+// logged to a write-ahead log or enough records have been logged since the
+// last snapshot. The caller must hold the lock.
+func (ms *MaintenanceState) snapshotDue() bool {
+	return ms.wal == nil || ms.walFailed || ms.seq-ms.state.Seq >= int64(ms.snapshotEvery)
+}
@@ -0,0 +1,112 @@
+package maintenancestate
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+)
+
+// openWithWAL opens the state in dir and replays its write-ahead log, as on
+// startup.
+func openWithWAL(t *testing.T, dir string, snapshotEvery int) (*MaintenanceState, *WAL) {
+	s, _ := New(dir+"/state.json", cachingClient, "mlab-oti")
+	wal, err := OpenWAL(dir + "/wal")
+	rtx.Must(err, "Could not open the write-ahead log")
+	t.Cleanup(func() { wal.Close() })
+	if err := s.UseWAL(wal, snapshotEvery); err != nil {
+		t.Fatalf("UseWAL() = %v", err)
+	}
+	return s, wal
+}
+
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	s, wal := openWithWAL(t, dir, 100)
+	s.Apply(Change{Kind: "site", Name: "abc01", Action: EnterMaintenance, Reason: "power",
+		Origin: Origin{Cause: "webhook", Sender: "alice"}}, "1", "mlab-oti")
+	s.UpdateMachine("mlab1-xyz01", EnterMaintenance, "2", "mlab-oti")
+	rtx.Must(s.Schedule([]ScheduledChange{{Change: Change{Kind: "machine", Name: "mlab2-xyz01", Action: EnterMaintenance}, Issue: "3", At: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}}), "Could not schedule")
+	rtx.Must(s.SetMilestone("1", "Q3"), "Could not set milestone")
+	s.CloseIssue("2", "mlab-oti")
+	rtx.Must(s.Write(), "Could not write")
+	if _, err := os.Stat(dir + "/state.json"); !os.IsNotExist(err) {
+		t.Errorf("the state was saved before a snapshot was due: %v", err)
+	}
+
+	// The state is reconstructed from the log alone after a crash.
+	restored, _ := openWithWAL(t, dir, 100)
+	if !reflect.DeepEqual(restored.Snapshot(), s.Snapshot()) {
+		t.Errorf("replayed state = %+v; want %+v", restored.Snapshot(), s.Snapshot())
+	}
+	if !reflect.DeepEqual(restored.Scheduled(), s.Scheduled()) {
+		t.Errorf("replayed schedule = %+v; want %+v", restored.Scheduled(), s.Scheduled())
+	}
+
+	// The log doubles as an audit trail.
+	records, err := wal.Records()
+	rtx.Must(err, "Could not read the write-ahead log")
+	var entered int
+	for i, r := range records {
+		if r.Seq != int64(i+1) {
+			t.Errorf("record %d has Seq %d", i, r.Seq)
+		}
+		for _, tr := range r.Transitions {
+			if tr.Name == "abc01" && tr.Action == EnterMaintenance && tr.Sender == "alice" {
+				entered++
+			}
+		}
+	}
+	if entered != 1 {
+		t.Errorf("site abc01 entered maintenance %d times in the log; want 1", entered)
+	}
+}
+
+func TestWALSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := openWithWAL(t, dir, 2)
+	s.UpdateMachine("mlab1-abc01", EnterMaintenance, "1", "mlab-oti")
+	s.UpdateMachine("mlab2-abc01", EnterMaintenance, "1", "mlab-oti")
+	rtx.Must(s.Write(), "Could not write")
+	if _, err := os.Stat(dir + "/state.json"); err != nil {
+		t.Fatalf("no snapshot after 2 records: %v", err)
+	}
+	s.UpdateMachine("mlab3-abc01", EnterMaintenance, "1", "mlab-oti")
+	rtx.Must(s.Write(), "Could not write")
+
+	// Only the record after the snapshot is replayed.
+	restored, _ := openWithWAL(t, dir, 2)
+	if restored.state.Seq != 2 || restored.seq != 3 {
+		t.Errorf("snapshot Seq = %d, log Seq = %d; want 2 and 3", restored.state.Seq, restored.seq)
+	}
+	if !reflect.DeepEqual(restored.Snapshot(), s.Snapshot()) {
+		t.Errorf("replayed state = %+v; want %+v", restored.Snapshot(), s.Snapshot())
+	}
+	rtx.Must(restored.Checkpoint(), "Could not save a checkpoint")
+	if restored.state.Seq != 3 {
+		t.Errorf("Seq after Checkpoint() = %d; want 3", restored.state.Seq)
+	}
+}
+
+func TestWALPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	s, wal := openWithWAL(t, dir, 100)
+	s.UpdateMachine("mlab1-abc01", EnterMaintenance, "1", "mlab-oti")
+	wal.Close()
+	f, err := os.OpenFile(dir+"/wal", os.O_WRONLY|os.O_APPEND, 0644)
+	rtx.Must(err, "Could not open the write-ahead log")
+	f.WriteString(`{"Seq": 2, "Chan`)
+	f.Close()
+
+	restored, wal := openWithWAL(t, dir, 100)
+	if !reflect.DeepEqual(restored.Snapshot(), s.Snapshot()) {
+		t.Errorf("replayed state = %+v; want %+v", restored.Snapshot(), s.Snapshot())
+	}
+	restored.UpdateMachine("mlab2-abc01", EnterMaintenance, "1", "mlab-oti")
+	records, err := wal.Records()
+	if err != nil || len(records) != 2 || records[1].Seq != 2 {
+		t.Errorf("Records() after a partly written record = %+v, %v; want 2 records", records, err)
+	}
+}
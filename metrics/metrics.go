@@ -7,13 +7,11 @@ import (
 )
 
 var (
-	// Error is a prometheus metric for exposing any errors that the exporter encounters.
-	//
-	// TODO: change to gmx_error_total in keeping with prometheus best practices
-	// as expressed by their linter.
+	// Error is a prometheus metric for exposing any errors that the exporter
+	// encounters. It should be incremented with CountError.
 	Error = promauto.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "gmx_error_count",
+			Name: "gmx_error_total",
 			Help: "Count of errors.",
 		},
 		[]string{
@@ -21,26 +19,388 @@ var (
 			"function",
 		},
 	)
+	// legacyError is the deprecated name of Error, kept until dashboards and
+	// alerts have moved to gmx_error_total.
+	legacyError = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gmx_error_count",
+			Help: "Count of errors. Deprecated: use gmx_error_total.",
+		},
+		[]string{
+			"type",
+			"function",
+		},
+	)
 	// Machine is a prometheus metric for exposing machine maintenance status.
-	Machine = promauto.NewGaugeVec(
+	Machine = newMachine(true)
+	// Site is a prometheus metric for exposing site maintenance status.
+	Site = newSite(false)
+	// Experiment is a prometheus metric for exposing the maintenance status
+	// of single experiments on machines.
+	Experiment = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "gmx_machine_maintenance",
-			Help: "Whether a machine is in maintenance mode or not.",
+			Name: "gmx_experiment_maintenance",
+			Help: "Whether an experiment on a machine is in maintenance mode or not.",
 		},
 		[]string{
+			"experiment",
 			"machine",
-			"node",
 			"site",
 		},
 	)
-	// Site is a prometheus metric for exposing site maintenance status.
-	Site = promauto.NewGaugeVec(
+	// Switch is a prometheus metric for exposing the maintenance status of
+	// the switch of a site.
+	Switch = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "gmx_site_maintenance",
-			Help: "Whether a site is in maintenance mode or not.",
+			Name: "gmx_switch_maintenance",
+			Help: "Whether the switch of a site is in maintenance mode or not.",
+		},
+		[]string{
+			"project",
+			"site",
+		},
+	)
+	// MassChangeEvents counts webhook events that modified more entities than
+	// the configured threshold.
+	MassChangeEvents = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gmx_mass_change_events_total",
+			Help: "Count of webhook events that modified more entities than the mass change threshold.",
+		},
+	)
+	// BlackoutRefusals counts changes that were refused because they were
+	// requested during a blackout window.
+	BlackoutRefusals = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gmx_blackout_refusals_total",
+			Help: "Count of changes refused during a blackout window.",
+		},
+	)
+	// ResyncCorrections counts metric series that were corrected when the
+	// maintenance metrics were rebuilt from the state.
+	ResyncCorrections = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gmx_metric_resync_corrections_total",
+			Help: "Count of maintenance metric series corrected by a resync from the state.",
+		},
+	)
+	// WebhookSignatures counts the GitHub webhooks that were validated with
+	// each signature scheme, either sha1 or sha256.
+	WebhookSignatures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gmx_webhook_signatures_total",
+			Help: "Count of GitHub webhooks validated with each signature scheme.",
+		},
+		[]string{"scheme"},
+	)
+	// WebhookSecretMatches counts the webhooks validated with each of the
+	// configured secrets, by their position, so that an old secret can be
+	// removed once it is no longer used.
+	WebhookSecretMatches = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gmx_webhook_secret_matches_total",
+			Help: "Count of webhooks validated with each configured secret, by position.",
+		},
+		[]string{"secret"},
+	)
+	// WebhookEvents counts the webhooks processed, by event type, action and
+	// HTTP status of the response.
+	WebhookEvents = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gmx_webhook_events_total",
+			Help: "Count of webhooks processed, by event, action and response status.",
+		},
+		[]string{
+			"event",
+			"action",
+			"status",
+		},
+	)
+	// WebhookDuration is how long webhooks took to process, including
+	// writing the state.
+	WebhookDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gmx_webhook_duration_seconds",
+			Help:    "How long webhooks took to process.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"event"},
+	)
+	// WebhookDuplicates counts webhook deliveries that were ignored because
+	// they had already been processed.
+	WebhookDuplicates = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gmx_webhook_duplicates_total",
+			Help: "Count of redelivered webhooks that were ignored.",
+		},
+	)
+	// ReconcileCorrections counts modifications made to the state when
+	// polled GitHub issues did not match it.
+	ReconcileCorrections = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gmx_reconcile_corrections_total",
+			Help: "Count of state modifications made when polled GitHub issues had drifted from the state.",
+		},
+	)
+	// StorageDivergence is 1 when the new storage backend of a migration
+	// does not hold the same state as the old one.
+	StorageDivergence = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gmx_storage_divergence",
+			Help: "Whether the new storage backend of a migration has diverged from the old one.",
+		},
+		[]string{"project"},
+	)
+	// Degraded is 1 while state writes are failing and state-changing
+	// webhooks are being refused.
+	Degraded = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gmx_degraded",
+			Help: "Whether the exporter is refusing changes because state writes are failing.",
+		},
+		[]string{"project"},
+	)
+	// Leader is 1 while this replica holds the leader lease and processes
+	// webhooks.
+	Leader = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gmx_leader",
+			Help: "Whether this replica is the leader that processes webhooks and writes the state.",
+		},
+	)
+	// StateLastWrite is when the state was last successfully written, so that
+	// alerts can fire if it cannot be persisted even though webhooks still
+	// succeed.
+	StateLastWrite = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gmx_state_last_write_timestamp_seconds",
+			Help: "Unix time at which the state was last successfully written.",
+		},
+		[]string{"project"},
+	)
+	// StateLastRestore is when the state was last successfully restored.
+	StateLastRestore = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gmx_state_last_restore_timestamp_seconds",
+			Help: "Unix time at which the state was last successfully restored.",
+		},
+		[]string{"project"},
+	)
+	// IssueInfo exposes the milestone of each issue with maintenance, so that
+	// the issues of a maintenance campaign can be grouped together.
+	IssueInfo = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gmx_issue_info",
+			Help: "Information about an issue with maintenance. Always 1.",
+		},
+		[]string{
+			"issue",
+			"milestone",
+		},
+	)
+	// MaintenanceIssueInfo links each entity in maintenance to the issue for
+	// which it is, so that dashboards can link to the issue.
+	MaintenanceIssueInfo = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gmx_maintenance_issue_info",
+			Help: "An issue for which an entity is in maintenance, with a link to it. Always 1.",
+		},
+		[]string{
+			"issue",
+			"url",
+			"entity",
+		},
+	)
+	// MaintenanceReason exposes the reason given for each machine or site
+	// being in maintenance for an issue, so that dashboards can show why it
+	// is down.
+	MaintenanceReason = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gmx_maintenance_reason_info",
+			Help: "The reason given for a machine or site being in maintenance for an issue. Always 1.",
 		},
 		[]string{
+			"name",
+			"issue",
+			"reason",
+		},
+	)
+	// MachineMaintenanceSeconds is how long each machine has been in
+	// maintenance, so that alerts can fire on maintenance that has lasted
+	// longer than policy allows.
+	MachineMaintenanceSeconds = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gmx_machine_maintenance_seconds",
+			Help: "Seconds since a machine entered maintenance.",
+		},
+		[]string{
+			"machine",
 			"site",
 		},
 	)
+	// SiteMaintenanceSeconds is how long each site has been in maintenance.
+	SiteMaintenanceSeconds = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gmx_site_maintenance_seconds",
+			Help: "Seconds since a site entered maintenance.",
+		},
+		[]string{
+			"project",
+			"site",
+		},
+	)
+	// MaintenanceDuration is how long machines and sites were in
+	// maintenance, observed as they leave it.
+	MaintenanceDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "gmx_maintenance_duration_seconds",
+			Help: "How long machines and sites were in maintenance when they left it.",
+			// From an hour to about three months.
+			Buckets: prometheus.ExponentialBuckets(3600, 2, 12),
+		},
+		[]string{"type"},
+	)
+	// DryRunMods counts the modifications that webhooks would have made to
+	// the state in dry-run mode, by the kind of entity and action.
+	DryRunMods = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gmx_dryrun_mods_total",
+			Help: "Count of modifications that webhooks would have made to the state in dry-run mode.",
+		},
+		[]string{
+			"kind",
+			"action",
+			"project",
+		},
+	)
+	// StateChanges counts machines, sites, experiments and switches entering
+	// and leaving maintenance, so that the churn of the state can be
+	// graphed and unusually large changes alerted on.
+	StateChanges = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gmx_state_changes_total",
+			Help: "Count of changes to the maintenance state of machines, sites, experiments and switches.",
+		},
+		[]string{
+			"entity_type",
+			"action",
+			"project",
+		},
+	)
+	// MachinesInMaintenance is the number of machines in maintenance, so
+	// that alerts on the share of the fleet in maintenance need not
+	// aggregate the per-machine metric.
+	MachinesInMaintenance = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gmx_machines_in_maintenance",
+			Help: "Number of machines in maintenance.",
+		},
+		[]string{"project"},
+	)
+	// SitesInMaintenance is the number of sites in maintenance.
+	SitesInMaintenance = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gmx_sites_in_maintenance",
+			Help: "Number of sites in maintenance.",
+		},
+		[]string{"project"},
+	)
+	// LastEventModifications is the number of entities changed by the most
+	// recently processed webhook event.
+	LastEventModifications = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gmx_last_event_modifications",
+			Help: "Number of entities modified by the most recent webhook event.",
+		},
+	)
 )
+
+// newMachine creates the machine maintenance metric, with or without the
+// legacy "node" label.
+func newMachine(nodeLabel bool) *prometheus.GaugeVec {
+	labels := []string{"machine", "node", "site"}
+	if !nodeLabel {
+		labels = []string{"machine", "site"}
+	}
+	return prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gmx_machine_maintenance",
+			Help: "Whether a machine is in maintenance mode or not.",
+		},
+		labels,
+	)
+}
+
+// newSite creates the site maintenance metric, with or without a "project"
+// label.
+func newSite(projectLabel bool) *prometheus.GaugeVec {
+	labels := []string{"site"}
+	if projectLabel {
+		labels = []string{"project", "site"}
+	}
+	return prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gmx_site_maintenance",
+			Help: "Whether a site is in maintenance mode or not.",
+		},
+		labels,
+	)
+}
+
+// machineCollector collects whichever Machine metric is current. It is an
+// unchecked collector so that the label names of Machine may change after
+// registration, which the registry otherwise forbids.
+type machineCollector struct{}
+
+func (machineCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (machineCollector) Collect(ch chan<- prometheus.Metric) {
+	Machine.Collect(ch)
+}
+
+// siteCollector collects whichever Site metric is current, like
+// machineCollector.
+type siteCollector struct{}
+
+func (siteCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (siteCollector) Collect(ch chan<- prometheus.Metric) {
+	Site.Collect(ch)
+}
+
+func init() {
+	prometheus.MustRegister(machineCollector{})
+	prometheus.MustRegister(siteCollector{})
+	prometheus.MustRegister(legacyError)
+}
+
+// CountError counts an error of the given type in function, under both the
+// current and the legacy name of the error metric.
+func CountError(errType string, function string) {
+	Error.WithLabelValues(errType, function).Inc()
+	legacyError.WithLabelValues(errType, function).Inc()
+}
+
+// SetLegacyErrorMetric registers or unregisters the deprecated
+// gmx_error_count metric.
+func SetLegacyErrorMetric(enabled bool) {
+	if enabled {
+		prometheus.Register(legacyError)
+	} else {
+		prometheus.Unregister(legacyError)
+	}
+}
+
+// SetMachineNodeLabel replaces the Machine metric with one that does or does
+// not have the legacy "node" label. It should be called before any machine
+// metrics are recorded, since existing series are discarded.
+func SetMachineNodeLabel(enabled bool) {
+	Machine = newMachine(enabled)
+}
+
+// SetSiteProjectLabel replaces the Site metric with one that does or does not
+// have a "project" label. It should be called before any site metrics are
+// recorded, since existing series are discarded.
+func SetSiteProjectLabel(enabled bool) {
+	Site = newSite(enabled)
+}
@@ -4,12 +4,73 @@ import (
 	"testing"
 
 	"github.com/m-lab/go/prometheusx/promtest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestMetrics(t *testing.T) {
 	Error.WithLabelValues("x", "x").Inc()
 	Machine.WithLabelValues("x", "x", "x").Inc()
 	Site.WithLabelValues("x").Inc()
+	Experiment.WithLabelValues("x", "x", "x").Inc()
+	Switch.WithLabelValues("x", "x").Inc()
+	MassChangeEvents.Inc()
+	LastEventModifications.Set(1)
+	BlackoutRefusals.Inc()
+	ResyncCorrections.Inc()
+	ReconcileCorrections.Inc()
+	WebhookDuplicates.Inc()
+	WebhookEvents.WithLabelValues("x", "x", "x").Inc()
+	WebhookDuration.WithLabelValues("x").Observe(1)
+	WebhookSignatures.WithLabelValues("x").Inc()
+	StorageDivergence.WithLabelValues("x").Set(0)
+	Degraded.WithLabelValues("x").Set(0)
+	StateLastWrite.WithLabelValues("x").SetToCurrentTime()
+	StateLastRestore.WithLabelValues("x").SetToCurrentTime()
+	IssueInfo.WithLabelValues("x", "x").Set(1)
+	MaintenanceReason.WithLabelValues("x", "x", "x").Set(1)
+	MaintenanceIssueInfo.WithLabelValues("x", "x", "x").Set(1)
+	MachineMaintenanceSeconds.WithLabelValues("x", "x").Set(1)
+	SiteMaintenanceSeconds.WithLabelValues("x", "x").Set(1)
+	MaintenanceDuration.WithLabelValues("x").Observe(1)
+	StateChanges.WithLabelValues("x", "x", "x").Inc()
+	MachinesInMaintenance.WithLabelValues("x").Set(1)
+	SitesInMaintenance.WithLabelValues("x").Set(1)
+	SetMachineNodeLabel(false)
+	Machine.WithLabelValues("x", "x").Inc()
+	SetMachineNodeLabel(true)
+	Machine.WithLabelValues("x", "x", "x").Inc()
 	// TODO: Pass in t once all metrics pass the linter.
 	promtest.LintMetrics(nil)
 }
+
+func TestCountError(t *testing.T) {
+	CountError("count", "TestCountError")
+	if v := testutil.ToFloat64(Error.WithLabelValues("count", "TestCountError")); v != 1 {
+		t.Errorf("gmx_error_total = %v; want 1", v)
+	}
+	if v := testutil.ToFloat64(legacyError.WithLabelValues("count", "TestCountError")); v != 1 {
+		t.Errorf("gmx_error_count = %v; want 1", v)
+	}
+
+	legacyRegistered := func() bool {
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatalf("Gather() = %v", err)
+		}
+		for _, f := range families {
+			if f.GetName() == "gmx_error_count" {
+				return true
+			}
+		}
+		return false
+	}
+	SetLegacyErrorMetric(false)
+	if legacyRegistered() {
+		t.Error("gmx_error_count is still exported after being disabled")
+	}
+	SetLegacyErrorMetric(true)
+	if !legacyRegistered() {
+		t.Error("gmx_error_count is not exported after being enabled")
+	}
+}
@@ -0,0 +1,327 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+const (
+	// alertmanagerQueueSize is how many transitions may be waiting to be
+	// sent before new ones are dropped.
+	alertmanagerQueueSize = 1000
+	alertmanagerTimeout   = 10 * time.Second
+	// silenceDuration is how long a silence lasts unless it is renewed, so
+	// that the silences of an exporter that stops managing them, e.g.
+	// because it was removed, soon lapse.
+	silenceDuration = time.Hour
+	// silenceRenewal is how often silences are renewed, and those that
+	// could not be created or expired are retried.
+	silenceRenewal = 15 * time.Minute
+)
+
+// Alertmanager creates an Alertmanager silence for every machine and site that
+// enters maintenance, and expires it when the maintenance ends. It manages
+// silences between Seed and Release, so that only one replica does.
+type Alertmanager struct {
+	*Queue
+	url    string
+	client *http.Client
+	// seeded is signaled by Seed.
+	seeded chan struct{}
+
+	// mu guards the fields below, and is held while they are being made to
+	// match Alertmanager.
+	mu sync.Mutex
+	// want holds the silence that each machine and site in maintenance
+	// should have, keyed by its matcher. It is nil while the silences are
+	// not managed.
+	want map[string]silence
+	// silences holds the silences that exist, keyed by their matcher.
+	silences map[string]silence
+	// loaded is true once the silences that existed when Seed was called,
+	// e.g. those created by another replica, have been found.
+	loaded bool
+}
+
+// silenceMatcher is an Alertmanager v2 matcher.
+type silenceMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual bool   `json:"isEqual"`
+}
+
+// silence is the subset of an Alertmanager v2 silence that is used.
+type silence struct {
+	ID        string           `json:"id,omitempty"`
+	Matchers  []silenceMatcher `json:"matchers"`
+	StartsAt  time.Time        `json:"startsAt"`
+	EndsAt    time.Time        `json:"endsAt"`
+	CreatedBy string           `json:"createdBy"`
+	Comment   string           `json:"comment"`
+	Status    *struct {
+		State string `json:"state"`
+	} `json:"status,omitempty"`
+}
+
+// NewAlertmanager creates a notifier for the Alertmanager at url (e.g.
+// http://alertmanager:9093).
+func NewAlertmanager(url string) *Alertmanager {
+	a := &Alertmanager{
+		url:      strings.TrimSuffix(url, "/"),
+		client:   &http.Client{Timeout: alertmanagerTimeout},
+		seeded:   make(chan struct{}, 1),
+		silences: make(map[string]silence),
+	}
+	a.Queue = NewQueue("notify.Alertmanager", alertmanagerQueueSize, a.apply)
+	return a
+}
+
+// Seed starts managing silences, so that every machine and site in a
+// snapshot of the state of each project is silenced, including maintenance
+// that began before the exporter started. Silences created earlier by the
+// exporter, e.g. by another replica, are kept, and those of entities that
+// are no longer in maintenance are expired.
+func (a *Alertmanager) Seed(snapshots ...maintenancestate.Snapshot) {
+	want := make(map[string]silence)
+	for _, snapshot := range snapshots {
+		for kind, entities := range map[string]map[string][]string{"machine": snapshot.Machines, "site": snapshot.Sites} {
+			for name, issues := range entities {
+				issue := ""
+				if len(issues) > 0 {
+					issue = issues[0]
+				}
+				if s, ok := newSilence(kind, name, issue); ok {
+					want[matcherKey(s.Matchers[0])] = s
+				}
+			}
+		}
+	}
+	a.mu.Lock()
+	a.want = want
+	a.loaded = false
+	a.mu.Unlock()
+	select {
+	case a.seeded <- struct{}{}:
+	default:
+	}
+}
+
+// Release stops managing silences, e.g. because another replica now does.
+// The silences are left to that replica, or lapse.
+func (a *Alertmanager) Release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.want = nil
+	a.silences = make(map[string]silence)
+	a.loaded = false
+}
+
+// Run creates and expires silences for queued transitions until ctx is
+// canceled. It also makes the silences match the state after Seed, and every
+// silenceRenewal.
+func (a *Alertmanager) Run(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		a.Queue.Run(ctx)
+		close(done)
+	}()
+	tick := time.NewTicker(silenceRenewal)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			<-done
+			return
+		case <-a.seeded:
+			a.sync(ctx)
+		case <-tick.C:
+			a.sync(ctx)
+		}
+	}
+}
+
+// matcher returns the matcher that silences the alerts of an entity, or
+// false if entities of its kind are not silenced.
+func matcher(kind, name string) (silenceMatcher, bool) {
+	switch kind {
+	case "machine":
+		// Match the machine whether it is labeled with a v1 or v2 hostname,
+		// or its short name.
+		node, site, _ := strings.Cut(name, "-")
+		value := regexp.QuoteMeta(node) + "[.-]" + regexp.QuoteMeta(site) + `(\..*)?`
+		return silenceMatcher{Name: "machine", Value: value, IsRegex: true, IsEqual: true}, true
+	case "site":
+		return silenceMatcher{Name: "site", Value: name, IsEqual: true}, true
+	}
+	return silenceMatcher{}, false
+}
+
+// matcherKey identifies a silence by its matcher.
+func matcherKey(m silenceMatcher) string {
+	return m.Name + "=" + m.Value
+}
+
+// newSilence returns the silence of an entity in maintenance, or false if
+// entities of its kind are not silenced.
+func newSilence(kind, name, issue string) (silence, bool) {
+	m, ok := matcher(kind, name)
+	if !ok {
+		return silence{}, false
+	}
+	comment := fmt.Sprintf("%s %s is in maintenance", kind, name)
+	if issue != "" {
+		comment += " for issue #" + issue
+	}
+	return silence{Matchers: []silenceMatcher{m}, CreatedBy: component, Comment: comment}, true
+}
+
+// apply creates or expires the silence of a single transition. Until the
+// existing silences have been found, it only records what is wanted.
+func (a *Alertmanager) apply(ctx context.Context, t maintenancestate.Transition) error {
+	s, ok := newSilence(t.Kind, t.Name, t.Issue)
+	if !ok {
+		return nil
+	}
+	key := matcherKey(s.Matchers[0])
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.want == nil {
+		return nil
+	}
+	if t.Action == maintenancestate.EnterMaintenance {
+		a.want[key] = s
+		if _, silenced := a.silences[key]; silenced || !a.loaded {
+			return nil
+		}
+		return a.put(ctx, key, s)
+	}
+	delete(a.want, key)
+	if _, silenced := a.silences[key]; !silenced || !a.loaded {
+		return nil
+	}
+	return a.expire(ctx, key)
+}
+
+// sync makes the silences match want. After Seed, it first finds the
+// silences that exist. It then expires the silences of entities that are no
+// longer in maintenance, and creates or renews the others.
+func (a *Alertmanager) sync(ctx context.Context) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.want == nil {
+		return
+	}
+	if !a.loaded {
+		if err := a.load(ctx); err != nil {
+			slog.Error("Failed to list Alertmanager silences", "err", err)
+			metrics.CountError("alertmanager", "notify.Alertmanager.sync")
+			return
+		}
+		a.loaded = true
+	}
+	for key := range a.silences {
+		if _, ok := a.want[key]; ok {
+			continue
+		}
+		if err := a.expire(ctx, key); err != nil {
+			slog.Error("Failed to expire Alertmanager silence", "matcher", key, "err", err)
+			metrics.CountError("alertmanager", "notify.Alertmanager.sync")
+		}
+	}
+	for key, s := range a.want {
+		if existing, ok := a.silences[key]; ok {
+			s = existing
+		}
+		if err := a.put(ctx, key, s); err != nil {
+			slog.Error("Failed to renew Alertmanager silence", "matcher", key, "err", err)
+			metrics.CountError("alertmanager", "notify.Alertmanager.sync")
+		}
+	}
+}
+
+// put creates a silence, or renews it if it has an ID, so that it ends
+// silenceDuration from now.
+func (a *Alertmanager) put(ctx context.Context, key string, s silence) error {
+	now := time.Now().UTC()
+	if s.ID == "" {
+		s.StartsAt = now
+	}
+	s.EndsAt = now.Add(silenceDuration)
+	s.Status = nil
+	var created struct {
+		SilenceID string `json:"silenceID"`
+	}
+	if err := a.do(ctx, http.MethodPost, "/api/v2/silences", s, &created); err != nil {
+		return err
+	}
+	s.ID = created.SilenceID
+	a.silences[key] = s
+	return nil
+}
+
+// expire expires an existing silence.
+func (a *Alertmanager) expire(ctx context.Context, key string) error {
+	if err := a.do(ctx, http.MethodDelete, "/api/v2/silence/"+a.silences[key].ID, nil, nil); err != nil {
+		return err
+	}
+	delete(a.silences, key)
+	return nil
+}
+
+// load finds the active silences that were created by the exporter.
+func (a *Alertmanager) load(ctx context.Context) error {
+	var silences []silence
+	if err := a.do(ctx, http.MethodGet, "/api/v2/silences", nil, &silences); err != nil {
+		return err
+	}
+	a.silences = make(map[string]silence)
+	for _, s := range silences {
+		if s.CreatedBy != component || len(s.Matchers) != 1 || s.Status == nil || s.Status.State != "active" {
+			continue
+		}
+		a.silences[matcherKey(s.Matchers[0])] = s
+	}
+	return nil
+}
+
+// do sends a request to the Alertmanager API, encoding in as its body and
+// decoding the response into out if they are not nil.
+func (a *Alertmanager) do(ctx context.Context, method, path string, in interface{}, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, a.url+path, &body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from Alertmanager: %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
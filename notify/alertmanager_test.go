@@ -0,0 +1,159 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/go/rtx"
+)
+
+// fakeAlertmanager records the silences that are created, renewed and
+// expired.
+type fakeAlertmanager struct {
+	mu       sync.Mutex
+	existing []silence
+	posted   []silence
+	expired  []string
+	// created is the number of silences created, which numbers their IDs.
+	created int
+}
+
+func (f *fakeAlertmanager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v2/silences":
+		json.NewEncoder(w).Encode(f.existing)
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v2/silences":
+		var s silence
+		json.NewDecoder(r.Body).Decode(&s)
+		f.posted = append(f.posted, s)
+		id := s.ID
+		if id == "" {
+			f.created++
+			id = fmt.Sprintf("new-%d", f.created)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"silenceID": id})
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/api/v2/silence/"):
+		f.expired = append(f.expired, strings.TrimPrefix(r.URL.Path, "/api/v2/silence/"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// reset returns the comments of the silences posted and the IDs of those
+// expired since the last reset.
+func (f *fakeAlertmanager) reset() (posted []string, expired []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range f.posted {
+		posted = append(posted, s.ID+" "+s.Comment)
+	}
+	sort.Strings(posted)
+	expired = f.expired
+	f.posted, f.expired = nil, nil
+	return posted, expired
+}
+
+func TestAlertmanager(t *testing.T) {
+	active := &struct {
+		State string `json:"state"`
+	}{State: "active"}
+	abc01, _ := matcher("site", "abc01")
+	def01, _ := matcher("site", "def01")
+	fake := &fakeAlertmanager{existing: []silence{
+		{ID: "old-abc01", Matchers: []silenceMatcher{abc01}, CreatedBy: component, Comment: "site abc01 is in maintenance", Status: active},
+		// def01 left maintenance while no replica managed the silences.
+		{ID: "old-def01", Matchers: []silenceMatcher{def01}, CreatedBy: component, Status: active},
+		// Silences created by others are left alone.
+		{ID: "other", Matchers: []silenceMatcher{def01}, CreatedBy: "someone", Status: active},
+	}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	a := NewAlertmanager(srv.URL + "/")
+	ctx := context.Background()
+	enter := func(kind, name string) maintenancestate.Transition {
+		return maintenancestate.Transition{Kind: kind, Name: name, Action: maintenancestate.EnterMaintenance, Issue: "12"}
+	}
+	leave := func(kind, name string) maintenancestate.Transition {
+		return maintenancestate.Transition{Kind: kind, Name: name, Action: maintenancestate.LeaveMaintenance, Issue: "12"}
+	}
+	check := func(step string, wantPosted, wantExpired []string) {
+		t.Helper()
+		posted, expired := fake.reset()
+		if strings.Join(posted, ",") != strings.Join(wantPosted, ",") || strings.Join(expired, ",") != strings.Join(wantExpired, ",") {
+			t.Errorf("%s: posted %q and expired %q; want %q and %q", step, posted, expired, wantPosted, wantExpired)
+		}
+	}
+
+	// Silences are not managed before Seed.
+	rtx.Must(a.apply(ctx, enter("site", "ghi01")), "Could not apply")
+	a.sync(ctx)
+	check("before Seed", nil, nil)
+
+	// Seeding adopts the existing silences, renewing those still wanted and
+	// expiring the others. Transitions before the silences are found are
+	// applied with them.
+	a.Seed(maintenancestate.Snapshot{Sites: map[string][]string{"abc01": {"1"}}})
+	rtx.Must(a.apply(ctx, enter("machine", "mlab1-xyz01")), "Could not apply")
+	check("before sync", nil, nil)
+	a.sync(ctx)
+	check("sync", []string{" machine mlab1-xyz01 is in maintenance for issue #12", "old-abc01 site abc01 is in maintenance"}, []string{"old-def01"})
+	for _, s := range a.silences {
+		if d := s.EndsAt.Sub(time.Now()); d <= 0 || d > silenceDuration {
+			t.Errorf("silence %+v ends in %v; want at most %v", s, d, silenceDuration)
+		}
+	}
+
+	for _, tr := range []maintenancestate.Transition{
+		enter("site", "abc01"), // Already silenced.
+		enter("machine", "mlab2-xyz01"),
+		enter("switch", "s1-xyz01"), // Not silenced.
+		leave("machine", "mlab1-xyz01"),
+		leave("site", "def01"), // Never silenced.
+	} {
+		if err := a.apply(ctx, tr); err != nil {
+			t.Errorf("apply(%+v) returned error: %v", tr, err)
+		}
+	}
+	check("apply", []string{" machine mlab2-xyz01 is in maintenance for issue #12"}, []string{"new-1"})
+
+	// Every sync renews the silences.
+	a.sync(ctx)
+	check("renewal", []string{"new-2 machine mlab2-xyz01 is in maintenance for issue #12", "old-abc01 site abc01 is in maintenance"}, nil)
+
+	// After Release, the silences are left alone.
+	a.Release()
+	rtx.Must(a.apply(ctx, leave("site", "abc01")), "Could not apply")
+	a.sync(ctx)
+	check("after Release", nil, nil)
+}
+
+func TestMatcher(t *testing.T) {
+	m, _ := matcher("machine", "mlab1-abc01")
+	for _, label := range []string{"mlab1-abc01", "mlab1.abc01.measurement-lab.org", "mlab1-abc01.mlab-oti.measurement-lab.org"} {
+		if !regexpMatches(m.Value, label) {
+			t.Errorf("machine matcher %q does not match %q", m.Value, label)
+		}
+	}
+	if regexpMatches(m.Value, "mlab1-abc011") {
+		t.Errorf("machine matcher %q matches another machine", m.Value)
+	}
+}
+
+// regexpMatches reports whether value matches pattern as Alertmanager does,
+// which anchors the pattern at both ends.
+func regexpMatches(pattern, value string) bool {
+	return regexp.MustCompile("^(?:" + pattern + ")$").MatchString(value)
+}
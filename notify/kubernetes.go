@@ -0,0 +1,95 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/kube"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+const (
+	// kubernetesQueueSize is how many transitions may be waiting to be sent
+	// before new ones are dropped.
+	kubernetesQueueSize = 100
+	kubernetesTimeout   = 10 * time.Second
+	component           = "github-maintenance-exporter"
+)
+
+// Kubernetes records a Kubernetes Event for every maintenance transition. The
+// events are attached to the exporter's own pod.
+type Kubernetes struct {
+	*Queue
+	client *kube.Client
+}
+
+// kubeObjectReference is the subset of a Kubernetes ObjectReference that is
+// needed to attach an event to a pod.
+type kubeObjectReference struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+type kubeObjectMeta struct {
+	GenerateName string `json:"generateName"`
+	Namespace    string `json:"namespace"`
+}
+
+type kubeEventSource struct {
+	Component string `json:"component"`
+}
+
+// kubeEvent is the subset of a Kubernetes core/v1 Event that is sent.
+type kubeEvent struct {
+	Metadata       kubeObjectMeta      `json:"metadata"`
+	InvolvedObject kubeObjectReference `json:"involvedObject"`
+	Reason         string              `json:"reason"`
+	Message        string              `json:"message"`
+	Type           string              `json:"type"`
+	Source         kubeEventSource     `json:"source"`
+	FirstTimestamp time.Time           `json:"firstTimestamp"`
+	LastTimestamp  time.Time           `json:"lastTimestamp"`
+	Count          int                 `json:"count"`
+}
+
+// NewKubernetes creates a Kubernetes notifier from the in-cluster
+// configuration of the pod. If namespace is empty, the namespace of the pod is
+// used.
+func NewKubernetes(namespace string) (*Kubernetes, error) {
+	client, err := kube.InCluster(namespace, kubernetesTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return newKubernetes(client), nil
+}
+
+func newKubernetes(client *kube.Client) *Kubernetes {
+	k := &Kubernetes{client: client}
+	k.Queue = NewQueue("notify.Kubernetes", kubernetesQueueSize, k.record)
+	return k
+}
+
+// record creates a single Kubernetes Event for a transition.
+func (k *Kubernetes) record(ctx context.Context, t maintenancestate.Transition) error {
+	event := kubeEvent{
+		Metadata: kubeObjectMeta{
+			GenerateName: component + "-",
+			Namespace:    k.client.Namespace,
+		},
+		InvolvedObject: kubeObjectReference{
+			Kind:      "Pod",
+			Namespace: k.client.Namespace,
+			Name:      k.client.Pod,
+		},
+		Reason:         reason(t),
+		Message:        message(t),
+		Type:           "Normal",
+		Source:         kubeEventSource{Component: component},
+		FirstTimestamp: t.Time,
+		LastTimestamp:  t.Time,
+		Count:          1,
+	}
+	return k.client.Do(ctx, http.MethodPost, "/api/v1/namespaces/"+k.client.Namespace+"/events", event, nil)
+}
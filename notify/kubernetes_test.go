@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/kube"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+func TestNewKubernetesOutsideCluster(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	if _, err := NewKubernetes("default"); err == nil {
+		t.Error("NewKubernetes() outside of a cluster returned nil error")
+	}
+}
+
+func TestKubernetesRun(t *testing.T) {
+	events := make(chan kubeEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/gmx/events" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("unexpected Authorization header: %q", got)
+		}
+		var e kubeEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("could not decode event: %v", err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		events <- e
+	}))
+	defer srv.Close()
+
+	k := newKubernetes(&kube.Client{URL: srv.URL, Token: "secret", Namespace: "gmx", Pod: "gmx-1234", HTTP: srv.Client()})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go k.Run(ctx)
+
+	k.Transition(maintenancestate.Transition{
+		Kind:   "site",
+		Name:   "abc01",
+		Action: maintenancestate.EnterMaintenance,
+		Issue:  "12",
+		Time:   time.Now(),
+	})
+	select {
+	case e := <-events:
+		if e.Reason != "EnterMaintenance" || e.Message != "site abc01 entered maintenance for issue #12" {
+			t.Errorf("unexpected event: %+v", e)
+		}
+		if e.InvolvedObject.Name != "gmx-1234" || e.InvolvedObject.Namespace != "gmx" {
+			t.Errorf("unexpected involved object: %+v", e.InvolvedObject)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+}
+
+func TestKubernetesRecordError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	k := &Kubernetes{client: &kube.Client{URL: srv.URL, Namespace: "gmx", HTTP: srv.Client()}}
+	err := k.record(context.Background(), maintenancestate.Transition{Kind: "site", Name: "abc01"})
+	if err == nil {
+		t.Error("record() returned nil error for a forbidden request")
+	}
+}
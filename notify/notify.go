@@ -0,0 +1,31 @@
+// Package notify sends maintenance transitions to systems outside of the
+// exporter, such as the Kubernetes API, a statsd server, Slack, Alertmanager,
+// arbitrary webhook subscribers or a Pub/Sub topic.
+package notify
+
+import (
+	"fmt"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+// reason returns a short, machine readable description of a transition.
+func reason(t maintenancestate.Transition) string {
+	if t.Action == maintenancestate.EnterMaintenance {
+		return "EnterMaintenance"
+	}
+	return "LeaveMaintenance"
+}
+
+// message returns a human readable description of a transition.
+func message(t maintenancestate.Transition) string {
+	verb := "left"
+	if t.Action == maintenancestate.EnterMaintenance {
+		verb = "entered"
+	}
+	msg := fmt.Sprintf("%s %s %s maintenance", t.Kind, t.Name, verb)
+	if t.Issue != "" {
+		msg += " for issue #" + t.Issue
+	}
+	return msg
+}
@@ -0,0 +1,34 @@
+package notify
+
+import (
+	"testing"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+func TestMessage(t *testing.T) {
+	tests := []struct {
+		t          maintenancestate.Transition
+		wantReason string
+		wantMsg    string
+	}{
+		{
+			t:          maintenancestate.Transition{Kind: "site", Name: "abc01", Action: maintenancestate.EnterMaintenance, Issue: "12"},
+			wantReason: "EnterMaintenance",
+			wantMsg:    "site abc01 entered maintenance for issue #12",
+		},
+		{
+			t:          maintenancestate.Transition{Kind: "machine", Name: "mlab1-abc01", Action: maintenancestate.LeaveMaintenance},
+			wantReason: "LeaveMaintenance",
+			wantMsg:    "machine mlab1-abc01 left maintenance",
+		},
+	}
+	for _, tt := range tests {
+		if got := reason(tt.t); got != tt.wantReason {
+			t.Errorf("reason() = %q; want %q", got, tt.wantReason)
+		}
+		if got := message(tt.t); got != tt.wantMsg {
+			t.Errorf("message() = %q; want %q", got, tt.wantMsg)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/m-lab/github-maintenance-exporter/gcp"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+const (
+	// pubsubQueueSize is how many transitions may be waiting to be published
+	// before new ones are dropped.
+	pubsubQueueSize = 1000
+	// pubsubBatchSize is the most transitions published in one request.
+	pubsubBatchSize = 100
+)
+
+// publisher publishes messages to a topic. *gcp.PubSub implements it.
+type publisher interface {
+	Publish(ctx context.Context, topic string, messages []gcp.Message) error
+}
+
+// PubSub publishes every maintenance transition to a Cloud Pub/Sub topic, so
+// that other systems can consume them without the exporter knowing about
+// each of them. The data of each message is the JSON sent by Webhook, and its
+// attributes are the kind, action, project and issue, for filtering.
+type PubSub struct {
+	*Queue
+	topic     string
+	publisher publisher
+}
+
+// NewPubSub creates a notifier that publishes every transition to topic,
+// which is either the name of a topic in project or its full resource name.
+func NewPubSub(project string, topic string) *PubSub {
+	p := &PubSub{
+		topic:     topic,
+		publisher: gcp.NewPubSub(project),
+	}
+	// Transitions that are queued together are published in one request.
+	p.Queue = NewBatchQueue("notify.PubSub", pubsubQueueSize, pubsubBatchSize, p.publish)
+	return p
+}
+
+// pubsubMessage converts a transition to a Pub/Sub message.
+func pubsubMessage(t maintenancestate.Transition) (gcp.Message, error) {
+	p := payload(t)
+	data, err := json.Marshal(p)
+	if err != nil {
+		return gcp.Message{}, err
+	}
+	attributes := map[string]string{"kind": p.Kind, "action": p.Action, "project": p.Project}
+	if p.Issue != "" {
+		attributes["issue"] = p.Issue
+	}
+	return gcp.Message{Data: data, Attributes: attributes}, nil
+}
+
+// publish publishes a batch of transitions. Transitions that cannot be
+// encoded are skipped.
+func (p *PubSub) publish(ctx context.Context, batch []maintenancestate.Transition) error {
+	messages := make([]gcp.Message, 0, len(batch))
+	for _, t := range batch {
+		m, err := pubsubMessage(t)
+		if err != nil {
+			slog.Error("Failed to encode transition", "entity", t.Name, "err", err)
+			metrics.CountError("marshal", "notify.PubSub.Run")
+			continue
+		}
+		messages = append(messages, m)
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return p.publisher.Publish(ctx, p.topic, messages)
+}
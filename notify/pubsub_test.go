@@ -0,0 +1,100 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/gcp"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+// fakePublisher records the messages published to it. Publishing to the
+// topic "unavailable" fails.
+type fakePublisher struct {
+	topics  chan string
+	batches chan []gcp.Message
+}
+
+func (f *fakePublisher) Publish(ctx context.Context, topic string, messages []gcp.Message) error {
+	f.topics <- topic
+	f.batches <- messages
+	if topic == "unavailable" {
+		return errors.New("unavailable")
+	}
+	return nil
+}
+
+func TestPubSubRun(t *testing.T) {
+	f := &fakePublisher{topics: make(chan string, 2), batches: make(chan []gcp.Message, 2)}
+	p := NewPubSub("mlab-oti", "maintenance")
+	p.publisher = f
+
+	// Transitions queued together are published together.
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	p.Transition(maintenancestate.Transition{Kind: "site", Name: "abc01", Action: maintenancestate.EnterMaintenance,
+		Issue: "12", Time: now, Project: "mlab-oti"})
+	p.Transition(maintenancestate.Transition{Kind: "machine", Name: "mlab1-abc01", Action: maintenancestate.LeaveMaintenance,
+		Time: now, Project: "mlab-oti", Origin: maintenancestate.Origin{Cause: "expired"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+
+	var batch []gcp.Message
+	select {
+	case batch = <-f.batches:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was published")
+	}
+	if topic := <-f.topics; topic != "maintenance" {
+		t.Errorf("published to %q; want maintenance", topic)
+	}
+	if len(batch) != 2 {
+		t.Fatalf("published %d messages; want 2", len(batch))
+	}
+	want := map[string]string{"kind": "site", "action": "enter", "project": "mlab-oti", "issue": "12"}
+	for k, v := range want {
+		if batch[0].Attributes[k] != v {
+			t.Errorf("attributes = %v; want %v", batch[0].Attributes, want)
+			break
+		}
+	}
+	if _, ok := batch[1].Attributes["issue"]; ok {
+		t.Errorf("attributes %v have an issue for a transition without one", batch[1].Attributes)
+	}
+	var got webhookPayload
+	if err := json.Unmarshal(batch[1].Data, &got); err != nil || got.Entity != "mlab1-abc01" || got.Cause != "expired" {
+		t.Errorf("data = %s, %v; want the webhook payload of mlab1-abc01", batch[1].Data, err)
+	}
+
+}
+
+func TestPubSubFailure(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+	f := &fakePublisher{topics: make(chan string, 2), batches: make(chan []gcp.Message, 2)}
+	p := NewPubSub("mlab-oti", "unavailable")
+	p.publisher = f
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+
+	// Failed publishes are retried, and do not stop later transitions.
+	for _, site := range []string{"abc01", "abc02"} {
+		p.Transition(maintenancestate.Transition{Kind: "site", Name: site})
+		for i := 0; i < sendAttempts; i++ {
+			select {
+			case batch := <-f.batches:
+				<-f.topics
+				var got webhookPayload
+				if err := json.Unmarshal(batch[0].Data, &got); err != nil || got.Entity != site {
+					t.Errorf("attempt %d published %s, %v; want %s", i, batch[0].Data, err, site)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("the transition for %s was not published", site)
+			}
+		}
+	}
+}
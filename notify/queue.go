@@ -0,0 +1,210 @@
+package notify
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+const (
+	// sendAttempts is how many times a transition is sent before it is
+	// given up on.
+	sendAttempts = 5
+	// drainTimeout bounds how long Run keeps sending the transitions still
+	// queued once its context is canceled.
+	drainTimeout = 10 * time.Second
+)
+
+// retryDelay is how long to wait before the first retry of a failed send. It
+// doubles with every further attempt.
+var retryDelay = time.Second
+
+// Queue holds transitions until Run sends them, so that a slow or unavailable
+// destination does not hold up changes to the state. Failed sends are retried
+// with backoff, and the transitions still queued when Run stops are sent
+// before it returns.
+type Queue struct {
+	// Block makes Transition wait for room in a full queue, which holds up
+	// the change to the state, rather than drop the transition. It must be
+	// set before the queue is used.
+	Block bool
+
+	name  string
+	send  func(ctx context.Context, batch []maintenancestate.Transition) error
+	batch int
+	queue chan maintenancestate.Transition
+	// running is true once Run has started, and done is closed when it has
+	// returned, having sent every queued transition. running is guarded by
+	// mu.
+	mu      sync.Mutex
+	running bool
+	done    chan struct{}
+	// stopped is true once Run no longer takes transitions from the queue.
+	// sendMu is held for reading while a transition is queued.
+	sendMu  sync.RWMutex
+	stopped bool
+}
+
+// NewQueue creates a Queue of up to size transitions that are sent one at a
+// time by send. The name, e.g. "notify.Slack", identifies the queue in logs
+// and metrics.
+func NewQueue(name string, size int, send func(ctx context.Context, t maintenancestate.Transition) error) *Queue {
+	return NewBatchQueue(name, size, 1, func(ctx context.Context, batch []maintenancestate.Transition) error {
+		return send(ctx, batch[0])
+	})
+}
+
+// NewBatchQueue is like NewQueue, but transitions that are queued together
+// are sent together, up to batch at a time.
+func NewBatchQueue(name string, size int, batch int, send func(ctx context.Context, batch []maintenancestate.Transition) error) *Queue {
+	return &Queue{
+		name:  name,
+		send:  send,
+		batch: batch,
+		queue: make(chan maintenancestate.Transition, size),
+		done:  make(chan struct{}),
+	}
+}
+
+// Transition queues a transition to be sent. If the queue is full, the
+// transition is dropped, unless Block is set. Once Run has returned, the
+// transitions of a blocking queue are sent directly, and the others are
+// dropped.
+func (q *Queue) Transition(t maintenancestate.Transition) {
+	q.sendMu.RLock()
+	defer q.sendMu.RUnlock()
+	if q.stopped {
+		if q.Block {
+			q.deliver(context.Background(), []maintenancestate.Transition{t}, 1)
+			return
+		}
+		slog.Error("Queue has stopped, dropping transition", "queue", q.name, "entity", t.Name)
+		metrics.CountError("stopped", q.name+".Transition")
+		return
+	}
+	select {
+	case q.queue <- t:
+		return
+	default:
+	}
+	if !q.Block {
+		slog.Error("Queue is full, dropping transition", "queue", q.name, "entity", t.Name)
+		metrics.CountError("queuefull", q.name+".Transition")
+		return
+	}
+	slog.Warn("Queue is full, waiting for room", "queue", q.name, "entity", t.Name)
+	metrics.CountError("queuefull", q.name+".Transition")
+	q.queue <- t
+}
+
+// Run sends queued transitions until ctx is canceled. It then sends the
+// transitions still queued, for up to drainTimeout, before it returns.
+func (q *Queue) Run(ctx context.Context) {
+	q.mu.Lock()
+	q.running = true
+	q.mu.Unlock()
+	defer close(q.done)
+	for {
+		select {
+		case <-ctx.Done():
+			q.stop()
+			return
+		case t := <-q.queue:
+			batch := q.collect(t)
+			if !q.deliver(ctx, batch, sendAttempts) {
+				// ctx was canceled while the batch was being retried.
+				q.stop(batch...)
+				return
+			}
+		}
+	}
+}
+
+// Wait waits for Run to return, having sent every queued transition, if it
+// was started.
+func (q *Queue) Wait() {
+	q.mu.Lock()
+	running := q.running
+	q.mu.Unlock()
+	if running {
+		<-q.done
+	}
+}
+
+// collect returns a batch of t and the transitions queued after it.
+func (q *Queue) collect(t maintenancestate.Transition) []maintenancestate.Transition {
+	batch := []maintenancestate.Transition{t}
+	for len(batch) < q.batch {
+		select {
+		case t := <-q.queue:
+			batch = append(batch, t)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// deliver sends a batch, making up to attempts attempts with backoff in
+// between. It returns false, without giving up on the batch, if ctx is
+// canceled before the last attempt.
+func (q *Queue) deliver(ctx context.Context, batch []maintenancestate.Transition, attempts int) bool {
+	delay := retryDelay
+	for i := 1; ; i++ {
+		err := q.send(ctx, batch)
+		switch {
+		case err == nil:
+			return true
+		case i >= attempts:
+			slog.Error("Failed to send transitions", "queue", q.name, "entity", batch[0].Name, "count", len(batch), "attempts", i, "err", err)
+			metrics.CountError("send", q.name+".Run")
+			return true
+		case ctx.Err() != nil:
+			return false
+		}
+		slog.Warn("Failed to send transitions, retrying", "queue", q.name, "entity", batch[0].Name, "retry", delay, "err", err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// stop sends pending and the transitions still queued, including those of
+// senders waiting for room, after which Transition no longer queues.
+func (q *Queue) stop(pending ...maintenancestate.Transition) {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		// Taking sendMu waits for every sender already queueing.
+		q.sendMu.Lock()
+		q.stopped = true
+		q.sendMu.Unlock()
+		close(stopped)
+	}()
+	if len(pending) > 0 {
+		q.deliver(ctx, pending, 1)
+	}
+	for {
+		select {
+		case t := <-q.queue:
+			q.deliver(ctx, q.collect(t), 1)
+		case <-stopped:
+			for {
+				select {
+				case t := <-q.queue:
+					q.deliver(ctx, q.collect(t), 1)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+// recorder records the names of the transitions sent to it. Sending fails
+// while failures is positive.
+type recorder struct {
+	mu       sync.Mutex
+	names    []string
+	failures int
+}
+
+func (r *recorder) send(ctx context.Context, t maintenancestate.Transition) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		return errors.New("unavailable")
+	}
+	r.names = append(r.names, t.Name)
+	return nil
+}
+
+func (r *recorder) sent() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.names...)
+}
+
+func TestQueueFull(t *testing.T) {
+	r := &recorder{}
+	q := NewQueue("test", 1, r.send)
+	q.Transition(maintenancestate.Transition{Name: "abc01"})
+	// The second transition must be dropped rather than block.
+	q.Transition(maintenancestate.Transition{Name: "abc02"})
+	if len(q.queue) != 1 {
+		t.Errorf("queue length = %d; want 1", len(q.queue))
+	}
+}
+
+func TestQueueRetry(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+	r := &recorder{failures: sendAttempts - 1}
+	q := NewQueue("test", 10, r.send)
+	ctx, cancel := context.WithCancel(context.Background())
+	go q.Run(ctx)
+
+	// The first transition succeeds on its last attempt.
+	q.Transition(maintenancestate.Transition{Name: "abc01"})
+	q.Transition(maintenancestate.Transition{Name: "abc02"})
+	for start := time.Now(); len(r.sent()) < 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("sent %v; want abc01 and abc02", r.sent())
+		}
+	}
+	cancel()
+	q.Wait()
+	if got := r.sent(); got[0] != "abc01" || got[1] != "abc02" {
+		t.Errorf("sent %v; want abc01 then abc02", got)
+	}
+}
+
+func TestQueueDrain(t *testing.T) {
+	r := &recorder{}
+	q := NewQueue("test", 10, r.send)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// Transitions still queued when Run stops are sent before it returns.
+	q.Transition(maintenancestate.Transition{Name: "abc01"})
+	q.Transition(maintenancestate.Transition{Name: "abc02"})
+	q.Run(ctx)
+	if got := r.sent(); len(got) != 2 {
+		t.Errorf("sent %v; want abc01 and abc02", got)
+	}
+
+	// Afterwards, transitions are dropped, unless the queue blocks.
+	q.Transition(maintenancestate.Transition{Name: "abc03"})
+	q.Block = true
+	q.Transition(maintenancestate.Transition{Name: "abc04"})
+	if got := r.sent(); len(got) != 3 || got[2] != "abc04" {
+		t.Errorf("sent %v; want abc01, abc02 and abc04", got)
+	}
+}
+
+func TestQueueBlock(t *testing.T) {
+	r := &recorder{}
+	q := NewQueue("test", 1, r.send)
+	q.Block = true
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.Transition(maintenancestate.Transition{Name: "abc01"})
+	blocked := make(chan struct{})
+	go func() {
+		// The queue is full, so this waits for Run.
+		q.Transition(maintenancestate.Transition{Name: "abc02"})
+		close(blocked)
+	}()
+	q.Run(ctx)
+	<-blocked
+	if got := r.sent(); len(got) != 2 {
+		t.Errorf("sent %v; want abc01 and abc02", got)
+	}
+}
@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+const (
+	// slackQueueSize is how many transitions may be waiting to be posted
+	// before new ones are dropped.
+	slackQueueSize = 100
+	slackTimeout   = 10 * time.Second
+)
+
+// Slack posts a message to a Slack channel, through an incoming webhook, for
+// every maintenance transition.
+type Slack struct {
+	*Queue
+	url    string
+	repo   string
+	client *http.Client
+}
+
+// slackMessage is the payload of a Slack incoming webhook.
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// NewSlack creates a Slack notifier that posts to the incoming webhook url.
+// Issues that are not qualified with a repository (e.g. 12, rather than
+// m-lab/ops#12) are linked to in repo, if it is not empty.
+func NewSlack(url, repo string) *Slack {
+	s := &Slack{
+		url:    url,
+		repo:   repo,
+		client: &http.Client{Timeout: slackTimeout},
+	}
+	s.Queue = NewQueue("notify.Slack", slackQueueSize, s.post)
+	return s
+}
+
+// text formats a transition as a Slack message, linking to its issue.
+func (s *Slack) text(t maintenancestate.Transition) string {
+	verb := ":white_check_mark: left"
+	if t.Action == maintenancestate.EnterMaintenance {
+		verb = ":construction: entered"
+	}
+	text := fmt.Sprintf("%s %s *%s* maintenance", verb, t.Kind, t.Name)
+	if t.Issue == "" {
+		if t.Cause != "" {
+			text += " (" + t.Cause + ")"
+		}
+		return text
+	}
+	repo, number, ok := strings.Cut(t.Issue, "#")
+	if !ok {
+		repo, number = s.repo, t.Issue
+	}
+	if repo == "" {
+		return text + " for issue #" + t.Issue
+	}
+	return fmt.Sprintf("%s for <https://github.com/%s/issues/%s|%s#%s>", text, repo, number, repo, number)
+}
+
+// post sends a single message to Slack.
+func (s *Slack) post(ctx context.Context, t maintenancestate.Transition) error {
+	body, err := json.Marshal(slackMessage{Text: s.text(t)})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from Slack: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+func TestSlackText(t *testing.T) {
+	s := NewSlack("", "m-lab/ops")
+	tests := []struct {
+		t    maintenancestate.Transition
+		want string
+	}{
+		{
+			t:    maintenancestate.Transition{Kind: "site", Name: "abc01", Action: maintenancestate.EnterMaintenance, Issue: "12"},
+			want: ":construction: entered site *abc01* maintenance for <https://github.com/m-lab/ops/issues/12|m-lab/ops#12>",
+		},
+		{
+			t:    maintenancestate.Transition{Kind: "machine", Name: "mlab1-abc01", Action: maintenancestate.LeaveMaintenance, Issue: "m-lab/other#3"},
+			want: ":white_check_mark: left machine *mlab1-abc01* maintenance for <https://github.com/m-lab/other/issues/3|m-lab/other#3>",
+		},
+		{
+			t:    maintenancestate.Transition{Kind: "machine", Name: "mlab1-abc01", Action: maintenancestate.LeaveMaintenance, Origin: maintenancestate.Origin{Cause: "rollback"}},
+			want: ":white_check_mark: left machine *mlab1-abc01* maintenance (rollback)",
+		},
+	}
+	for _, tt := range tests {
+		if got := s.text(tt.t); got != tt.want {
+			t.Errorf("text() = %q; want %q", got, tt.want)
+		}
+	}
+	if got := NewSlack("", "").text(tests[0].t); got != ":construction: entered site *abc01* maintenance for issue #12" {
+		t.Errorf("text() without a repo = %q", got)
+	}
+}
+
+func TestSlackRun(t *testing.T) {
+	messages := make(chan slackMessage, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m slackMessage
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			t.Errorf("could not decode message: %v", err)
+		}
+		messages <- m
+	}))
+	defer srv.Close()
+
+	s := NewSlack(srv.URL, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	s.Transition(maintenancestate.Transition{Kind: "site", Name: "abc01", Action: maintenancestate.EnterMaintenance, Issue: "12"})
+	select {
+	case m := <-messages:
+		if m.Text != ":construction: entered site *abc01* maintenance for issue #12" {
+			t.Errorf("unexpected message: %q", m.Text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+
+	// Errors are returned rather than retried.
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer failing.Close()
+	if err := NewSlack(failing.URL, "").post(ctx, maintenancestate.Transition{}); err == nil {
+		t.Error("post() returned nil error for a missing webhook")
+	}
+}
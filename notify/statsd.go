@@ -0,0 +1,170 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+const emitterTimeout = 10 * time.Second
+
+// Counter reports the size of the maintenance state.
+type Counter interface {
+	Counts() maintenancestate.Counts
+}
+
+// Counters reports the total size of several states, e.g. of every project.
+type Counters []Counter
+
+// Counts returns the sum of the counts of every state.
+func (cs Counters) Counts() maintenancestate.Counts {
+	var total maintenancestate.Counts
+	for _, c := range cs {
+		n := c.Counts()
+		total.Machines += n.Machines
+		total.Sites += n.Sites
+		total.Scheduled += n.Scheduled
+		total.Proposals += n.Proposals
+	}
+	return total
+}
+
+// Emitter pushes counts of maintenance transitions, and of the machines and
+// sites in maintenance, to a statsd or Graphite server at a fixed interval.
+type Emitter struct {
+	format   string
+	network  string
+	addr     string
+	prefix   string
+	interval time.Duration
+	counter  Counter
+	// counts holds the number of transitions of each kind since the last
+	// flush, keyed by metric name. It is guarded by mu.
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewStatsd creates an Emitter that sends to a statsd server over UDP. Every
+// metric name starts with prefix.
+func NewStatsd(addr, prefix string, interval time.Duration, counter Counter) *Emitter {
+	return newEmitter("statsd", "udp", addr, prefix, interval, counter)
+}
+
+// NewGraphite creates an Emitter that sends to a Graphite server over TCP
+// using the plaintext protocol. Every metric name starts with prefix.
+func NewGraphite(addr, prefix string, interval time.Duration, counter Counter) *Emitter {
+	return newEmitter("graphite", "tcp", addr, prefix, interval, counter)
+}
+
+func newEmitter(format, network, addr, prefix string, interval time.Duration, counter Counter) *Emitter {
+	return &Emitter{
+		format:   format,
+		network:  network,
+		addr:     addr,
+		prefix:   strings.TrimSuffix(prefix, "."),
+		interval: interval,
+		counter:  counter,
+		counts:   make(map[string]int),
+	}
+}
+
+// Transition counts a transition. Counting never waits on the server, so
+// unlike the other notifiers the Emitter needs no queue.
+func (e *Emitter) Transition(t maintenancestate.Transition) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.counts[fmt.Sprintf("transitions.%s.%s", t.Kind, t.Action)]++
+}
+
+// Run sends the counts every interval until ctx is canceled.
+func (e *Emitter) Run(ctx context.Context) {
+	tick := time.NewTicker(e.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			err := e.flush(now)
+			if err != nil {
+				slog.Error("Failed to send metrics", "format", e.format, "server", e.addr, "err", err)
+				metrics.CountError(e.format, "notify.Emitter.Run")
+			}
+		}
+	}
+}
+
+// lines formats counts of transitions and the size of the state as of now.
+func (e *Emitter) lines(counts map[string]int, now time.Time) []string {
+	c := e.counter.Counts()
+	gauges := map[string]int{
+		"machines":  c.Machines,
+		"sites":     c.Sites,
+		"scheduled": c.Scheduled,
+		"proposals": c.Proposals,
+	}
+	var lines []string
+	for name, n := range counts {
+		lines = append(lines, e.formatLine(name, n, "c", now))
+	}
+	for name, n := range gauges {
+		lines = append(lines, e.formatLine(name, n, "g", now))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// formatLine formats a single metric, where typ is its statsd type.
+func (e *Emitter) formatLine(name string, n int, typ string, now time.Time) string {
+	if e.prefix != "" {
+		name = e.prefix + "." + name
+	}
+	if e.format == "graphite" {
+		return fmt.Sprintf("%s %d %d\n", name, n, now.Unix())
+	}
+	return fmt.Sprintf("%s:%d|%s\n", name, n, typ)
+}
+
+// flush sends the current counts and takes the transitions it sent off the
+// transition counts.
+func (e *Emitter) flush(now time.Time) error {
+	e.mu.Lock()
+	counts := make(map[string]int, len(e.counts))
+	for name, n := range e.counts {
+		counts[name] = n
+	}
+	e.mu.Unlock()
+	lines := e.lines(counts, now)
+	conn, err := net.DialTimeout(e.network, e.addr, emitterTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(emitterTimeout))
+	// Statsd packets are kept to one line each, so that none are too large.
+	if e.format == "statsd" {
+		for _, line := range lines {
+			if _, err := conn.Write([]byte(line)); err != nil {
+				return err
+			}
+		}
+	} else if _, err := conn.Write([]byte(strings.Join(lines, ""))); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for name, n := range counts {
+		if e.counts[name] -= n; e.counts[name] == 0 {
+			delete(e.counts, name)
+		}
+	}
+	return nil
+}
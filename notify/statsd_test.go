@@ -0,0 +1,102 @@
+package notify
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/go/rtx"
+)
+
+type fakeCounter struct{}
+
+func (fakeCounter) Counts() maintenancestate.Counts {
+	return maintenancestate.Counts{Machines: 4, Sites: 1}
+}
+
+func TestStatsd(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	rtx.Must(err, "Could not listen")
+	defer conn.Close()
+
+	e := NewStatsd(conn.LocalAddr().String(), "gmx.", time.Hour, fakeCounter{})
+	e.Transition(maintenancestate.Transition{Kind: "site", Name: "abc01", Action: maintenancestate.EnterMaintenance})
+	e.Transition(maintenancestate.Transition{Kind: "site", Name: "abc02", Action: maintenancestate.EnterMaintenance})
+	rtx.Must(e.flush(time.Now()), "Could not flush")
+
+	var got []string
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 5; i++ {
+		n, _, err := conn.ReadFrom(buf)
+		rtx.Must(err, "Could not read packet")
+		got = append(got, string(buf[:n]))
+	}
+	want := []string{
+		"gmx.machines:4|g\n",
+		"gmx.proposals:0|g\n",
+		"gmx.scheduled:0|g\n",
+		"gmx.sites:1|g\n",
+		"gmx.transitions.site.enter:2|c\n",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("statsd packets = %q; want %q", got, want)
+	}
+	if len(e.counts) != 0 {
+		t.Errorf("counts were not reset after a flush: %v", e.counts)
+	}
+}
+
+func TestGraphite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	rtx.Must(err, "Could not listen")
+	defer l.Close()
+	received := make(chan string)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		data, _ := io.ReadAll(conn)
+		conn.Close()
+		received <- string(data)
+	}()
+
+	e := NewGraphite(l.Addr().String(), "", time.Hour, fakeCounter{})
+	e.counts["transitions.machine.leave"] = 3
+	now := time.Unix(1700000000, 0)
+	rtx.Must(e.flush(now), "Could not flush")
+	got := strings.Split(strings.TrimSpace(<-received), "\n")
+	want := []string{
+		"machines 4 1700000000",
+		"proposals 0 1700000000",
+		"scheduled 0 1700000000",
+		"sites 1 1700000000",
+		"transitions.machine.leave 3 1700000000",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("graphite lines = %q; want %q", got, want)
+	}
+
+	// Counts are kept if they cannot be sent.
+	e = NewGraphite("127.0.0.1:1", "", time.Hour, fakeCounter{})
+	e.counts["transitions.machine.leave"] = 3
+	if err := e.flush(now); err == nil {
+		t.Error("flush() to a closed port should fail")
+	}
+	if e.counts["transitions.machine.leave"] != 3 {
+		t.Error("counts should be kept after a failed flush")
+	}
+}
+
+func TestCounters(t *testing.T) {
+	got := Counters{fakeCounter{}, fakeCounter{}}.Counts()
+	want := maintenancestate.Counts{Machines: 8, Sites: 2}
+	if got != want {
+		t.Errorf("Counts() = %+v; want %+v", got, want)
+	}
+}
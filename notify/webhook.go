@@ -0,0 +1,107 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+const (
+	// webhookQueueSize is how many transitions may be waiting to be sent to
+	// a subscriber before new ones are dropped.
+	webhookQueueSize = 1000
+	webhookTimeout   = 10 * time.Second
+)
+
+// Webhook POSTs a JSON description of every maintenance transition to a set of
+// subscriber URLs. Each subscriber has its own queue, so that one that fails
+// neither holds up nor causes resends to the others.
+type Webhook struct {
+	client *http.Client
+	queues []*Queue
+}
+
+// webhookPayload is the JSON body sent to subscribers.
+type webhookPayload struct {
+	Kind      string    `json:"kind"`
+	Entity    string    `json:"entity"`
+	Action    string    `json:"action"`
+	Issue     string    `json:"issue,omitempty"`
+	Project   string    `json:"project"`
+	Cause     string    `json:"cause,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NewWebhook creates a notifier that sends every transition to each of urls.
+func NewWebhook(urls []string) *Webhook {
+	w := &Webhook{client: &http.Client{Timeout: webhookTimeout}}
+	for _, url := range urls {
+		url := url
+		w.queues = append(w.queues, NewQueue("notify.Webhook", webhookQueueSize, func(ctx context.Context, t maintenancestate.Transition) error {
+			return w.send(ctx, url, t)
+		}))
+	}
+	return w
+}
+
+// Transition queues a transition to be sent to every subscriber.
+func (w *Webhook) Transition(t maintenancestate.Transition) {
+	for _, q := range w.queues {
+		q.Transition(t)
+	}
+}
+
+// Run sends queued transitions to the subscribers until ctx is canceled.
+func (w *Webhook) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, q := range w.queues {
+		wg.Add(1)
+		go func(q *Queue) {
+			defer wg.Done()
+			q.Run(ctx)
+		}(q)
+	}
+	wg.Wait()
+}
+
+// payload converts a transition to the JSON body sent to subscribers.
+func payload(t maintenancestate.Transition) webhookPayload {
+	return webhookPayload{
+		Kind:      t.Kind,
+		Entity:    t.Name,
+		Action:    t.Action.String(),
+		Issue:     t.Issue,
+		Project:   t.Project,
+		Cause:     t.Cause,
+		Timestamp: t.Time.UTC(),
+	}
+}
+
+// send POSTs the payload of a transition to a single subscriber.
+func (w *Webhook) send(ctx context.Context, url string, t maintenancestate.Transition) error {
+	body, err := json.Marshal(payload(t))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", component)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
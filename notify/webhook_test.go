@@ -0,0 +1,68 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+func TestWebhookRun(t *testing.T) {
+	payloads := make(chan webhookPayload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		var p webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("could not decode payload: %v", err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+		payloads <- p
+	}))
+	defer srv.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	// A failing subscriber does not stop the others.
+	w := NewWebhook([]string{failing.URL, srv.URL})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	w.Transition(maintenancestate.Transition{
+		Kind:    "machine",
+		Name:    "mlab1-abc01",
+		Action:  maintenancestate.EnterMaintenance,
+		Issue:   "12",
+		Time:    now,
+		Project: "mlab-oti",
+	})
+	want := webhookPayload{
+		Kind:      "machine",
+		Entity:    "mlab1-abc01",
+		Action:    "enter",
+		Issue:     "12",
+		Project:   "mlab-oti",
+		Timestamp: now,
+	}
+	select {
+	case p := <-payloads:
+		if p != want {
+			t.Errorf("payload = %+v; want %+v", p, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for payload")
+	}
+
+	if err := w.send(ctx, failing.URL, maintenancestate.Transition{}); err == nil {
+		t.Error("send() returned nil error for a failing subscriber")
+	}
+}
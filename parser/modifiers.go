@@ -0,0 +1,148 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// delayRegExp matches a delay following a flag, e.g. "/site abc01 in 30m".
+	delayRegExp = regexp.MustCompile(`^\s+in\s+((?:[0-9]+[smh])+)\b`)
+	// overrideRegExp matches the keyword that overrides a blackout window.
+	overrideRegExp = regexp.MustCompile(`^\s+override\b`)
+	// untilRegExp matches an expiration date or time following a flag, e.g.
+	// "/site abc01 until 2024-08-01" or "until 2024-08-01T12:00:00Z".
+	untilRegExp = regexp.MustCompile(`^\s+until\s+([0-9]{4}-[0-9]{2}-[0-9]{2}(?:T[0-9:]+(?:Z|[+-][0-9]{2}:[0-9]{2}))?)`)
+	// forRegExp matches a duration in words following a flag, e.g.
+	// "/site abc01 for 2 weeks" or "for a day".
+	forRegExp = regexp.MustCompile(`^\s+for\s+([0-9]+|an?)\s*(minutes?|mins?|hours?|hrs?|h|days?|d|weeks?|w)\b`)
+	// ttlRegExp matches a compact duration following a flag, e.g.
+	// "/machine mlab1.abc01 ttl=72h" or "ttl=1w2d".
+	ttlRegExp = regexp.MustCompile(`^\s+ttl=((?:[0-9]+[smhdw])+)\b`)
+	// ttlPartRegExp matches each count and unit of a duration matched by
+	// ttlRegExp.
+	ttlPartRegExp = regexp.MustCompile(`([0-9]+)([smhdw])`)
+	// reasonRegExp matches a free-text reason that ends the line of a flag,
+	// e.g. "/site abc01 -- switch replacement".
+	reasonRegExp = regexp.MustCompile(`^[ \t]+--[ \t]+([^\r\n]*)`)
+)
+
+// Modifiers are the settings that may follow a flag.
+type Modifiers struct {
+	// Delay is how long to wait before entering maintenance.
+	Delay time.Duration `json:",omitempty"`
+	// Override allows the change to be applied during a blackout window.
+	Override bool `json:",omitempty"`
+	// Expires, if set, is when the maintenance automatically ends.
+	Expires time.Time `json:",omitempty"`
+	// Duration, if set, is how long the maintenance lasts once it begins.
+	Duration time.Duration `json:",omitempty"`
+	// Reason, if set, is a free-text explanation of the maintenance.
+	Reason string `json:",omitempty"`
+}
+
+// units maps the first letter of a duration unit to its length.
+var units = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// parseUntil parses the time matched by untilRegExp. A bare date refers to
+// midnight UTC at the start of that day.
+func parseUntil(s string) (time.Time, error) {
+	layout := "2006-01-02"
+	if strings.Contains(s, "T") {
+		layout = time.RFC3339
+	}
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a valid date or time", s)
+	}
+	return t, nil
+}
+
+// parseFor parses the count and unit matched by forRegExp.
+func parseFor(count string, unit string) (time.Duration, error) {
+	n, err := strconv.Atoi(count)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, fmt.Errorf("%s %s is too long a duration", count, unit)
+	}
+	if err != nil {
+		// The pattern only allows "a" or "an" instead of a number.
+		n = 1
+	}
+	u := units[unit[0]]
+	if n > math.MaxInt64/int(u) {
+		return 0, fmt.Errorf("%s %s is too long a duration", count, unit)
+	}
+	return time.Duration(n) * u, nil
+}
+
+// parseTTL parses the duration matched by ttlRegExp.
+func parseTTL(s string) (time.Duration, error) {
+	var d time.Duration
+	for _, m := range ttlPartRegExp.FindAllStringSubmatch(s, -1) {
+		part, err := parseFor(m[1], m[2])
+		if err != nil || d > math.MaxInt64-part {
+			return 0, fmt.Errorf("%s is too long a duration", s)
+		}
+		d += part
+	}
+	return d, nil
+}
+
+// parseModifiers parses any modifiers (e.g. "in 30m", "for 2 weeks", "ttl=72h"
+// or "override") that immediately follow a flag, in any order, and records them
+// in c. A reason after "--" ends the modifiers. An error is returned for a
+// modifier that is recognized but holds an invalid date or duration, since
+// the flag would otherwise be applied without it.
+func parseModifiers(rest string, c *Modifiers) error {
+	for {
+		if m := delayRegExp.FindStringSubmatch(rest); m != nil {
+			d, err := time.ParseDuration(m[1])
+			if err != nil {
+				return fmt.Errorf("%s is too long a delay", m[1])
+			}
+			c.Delay = d
+			rest = rest[len(m[0]):]
+		} else if m := overrideRegExp.FindString(rest); m != "" {
+			c.Override = true
+			rest = rest[len(m):]
+		} else if m := untilRegExp.FindStringSubmatch(rest); m != nil {
+			until, err := parseUntil(m[1])
+			if err != nil {
+				return err
+			}
+			c.Expires = until
+			rest = rest[len(m[0]):]
+		} else if m := forRegExp.FindStringSubmatch(rest); m != nil {
+			d, err := parseFor(m[1], m[2])
+			if err != nil {
+				return err
+			}
+			c.Duration = d
+			rest = rest[len(m[0]):]
+		} else if m := ttlRegExp.FindStringSubmatch(rest); m != nil {
+			d, err := parseTTL(m[1])
+			if err != nil {
+				return err
+			}
+			c.Duration = d
+			rest = rest[len(m[0]):]
+		} else if m := reasonRegExp.FindStringSubmatch(rest); m != nil {
+			// The reason runs to the end of the line, so nothing follows it.
+			c.Reason = strings.TrimSpace(m[1])
+			return nil
+		} else {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseModifiers(t *testing.T) {
+	tests := []struct {
+		name    string
+		rest    string
+		want    Modifiers
+		wantErr bool
+	}{
+		{
+			name: "none",
+			rest: " is down for repairs",
+			want: Modifiers{},
+		},
+		{
+			name: "delay",
+			rest: " in 1h30m",
+			want: Modifiers{Delay: 90 * time.Minute},
+		},
+		{
+			name: "until-date",
+			rest: " until 2024-08-01.",
+			want: Modifiers{Expires: time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name: "until-time",
+			rest: " until 2024-08-01T12:30:00Z",
+			want: Modifiers{Expires: time.Date(2024, 8, 1, 12, 30, 0, 0, time.UTC)},
+		},
+		{
+			name:    "until-bad-date",
+			rest:    " until 2024-13-45",
+			want:    Modifiers{},
+			wantErr: true,
+		},
+		{
+			name:    "until-day-out-of-range",
+			rest:    " until 2024-02-30",
+			want:    Modifiers{},
+			wantErr: true,
+		},
+		{
+			name:    "delay-overflow",
+			rest:    " in 9999999999h",
+			want:    Modifiers{},
+			wantErr: true,
+		},
+		{
+			name:    "for-overflow",
+			rest:    " for 99999999999999999999 weeks",
+			want:    Modifiers{},
+			wantErr: true,
+		},
+		{
+			name:    "for-multiplication-overflow",
+			rest:    " for 999999999 weeks",
+			want:    Modifiers{},
+			wantErr: true,
+		},
+		{
+			name:    "ttl-overflow",
+			rest:    " ttl=15000w15000w",
+			want:    Modifiers{},
+			wantErr: true,
+		},
+		{
+			name: "for-weeks",
+			rest: " for 2 weeks",
+			want: Modifiers{Duration: 14 * 24 * time.Hour},
+		},
+		{
+			name: "for-a-day",
+			rest: " for a day",
+			want: Modifiers{Duration: 24 * time.Hour},
+		},
+		{
+			name: "for-hours-abbreviated",
+			rest: " for 36h",
+			want: Modifiers{Duration: 36 * time.Hour},
+		},
+		{
+			name: "ttl",
+			rest: " ttl=72h",
+			want: Modifiers{Duration: 72 * time.Hour},
+		},
+		{
+			name: "ttl-compound",
+			rest: " ttl=1w2d30m",
+			want: Modifiers{Duration: 9*24*time.Hour + 30*time.Minute},
+		},
+		{
+			name: "ttl-without-unit",
+			rest: " ttl=72",
+			want: Modifiers{},
+		},
+		{
+			name: "reason",
+			rest: " for 2 weeks -- switch replacement \n/site abc02",
+			want: Modifiers{Duration: 14 * 24 * time.Hour, Reason: "switch replacement"},
+		},
+		{
+			name: "reason-on-next-line",
+			rest: "\n-- switch replacement",
+			want: Modifiers{},
+		},
+		{
+			name: "for-without-unit",
+			rest: " for 3 reasons",
+			want: Modifiers{},
+		},
+		{
+			name: "several-in-any-order",
+			rest: " for 3 days override in 10m because",
+			want: Modifiers{Duration: 3 * 24 * time.Hour, Override: true, Delay: 10 * time.Minute},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Modifiers
+			err := parseModifiers(tt.rest, &got)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseModifiers(%q) returned error %v; want error %t", tt.rest, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseModifiers(%q) = %+v; want %+v", tt.rest, got, tt.want)
+			}
+		})
+	}
+}
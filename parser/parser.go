@@ -0,0 +1,111 @@
+// Package parser finds the flags in the body of a GitHub issue or comment
+// that put machines, sites, experiments and switches into maintenance or take
+// them out of maintenance, e.g. "/machine mlab1-abc01 for 2 days" or
+// "/site abc01 del".
+package parser
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+var (
+	// The flag regexps match any plausible name. Whether the name belongs to
+	// the project is then checked against its rules.
+	machineRegExp = regexp.MustCompile(`\/machine\s+([a-z]+[0-9]+[.-][a-z0-9]+)(\s+del)?`)
+	siteRegExp    = regexp.MustCompile(`\/site\s+([a-z0-9]+)(\s+del)?`)
+	// switchRegExp matches flags for the switch of a site, e.g. "/switch abc02".
+	switchRegExp = regexp.MustCompile(`\/switch\s+([a-z0-9]+)(\s+del)?`)
+	// experimentRegExp matches flags for a single experiment on a machine,
+	// e.g. "/experiment ndt mlab1.abc01".
+	experimentRegExp = regexp.MustCompile(`\/experiment\s+([a-z0-9_-]+)\s+([a-z]+[0-9]+[.-][a-z0-9]+)(\s+del)?`)
+
+	// countryRegExp matches flags for every site in a country, given its ISO
+	// 3166 code, e.g. "/country US".
+	countryRegExp = regexp.MustCompile(`\/country\s+([A-Za-z]{2})\b(\s+del)?`)
+
+	// flagKeywordRegExp matches the keyword of every flag, whether or not the
+	// rest of the flag can be parsed.
+	flagKeywordRegExp = regexp.MustCompile(`(?:^|\s)(\/(?:machine|site|switch|experiment|country))\b`)
+)
+
+// ErrNoName is the error of a flag whose keyword is not followed by a valid
+// name.
+var ErrNoName = errors.New("the flag is not followed by a valid name")
+
+// Target is a flag found in a message.
+type Target struct {
+	// Kind is "machine", "site", "experiment", "switch" or "country".
+	Kind string
+	// Name is the machine (e.g. mlab1-abc01), site, experiment, site of the
+	// switch, or upper-case ISO 3166 code of the country that is flagged. It
+	// is empty if Err is ErrNoName.
+	Name string
+	// Machine is the machine of an experiment flag.
+	Machine string `json:",omitempty"`
+	Action  maintenancestate.Action
+	Modifiers
+	// Pos is the offset of the flag in the message.
+	Pos int
+	// Err, if not nil, is why the flag must be ignored.
+	Err error `json:"-"`
+}
+
+// Parse returns every flag in text, in the order in which they appear. The
+// names of sites and machines are checked against the rules of project, but
+// not against siteinfo; flags with invalid names have an Err. Machine names
+// are always returned in the form mlab1-abc01, even if flagged as
+// mlab1.abc01.
+func Parse(project string, text string) []Target {
+	var targets []Target
+	parsed := map[int]bool{}
+	for _, k := range []struct {
+		kind string
+		re   *regexp.Regexp
+	}{
+		{"site", siteRegExp},
+		{"machine", machineRegExp},
+		{"experiment", experimentRegExp},
+		{"switch", switchRegExp},
+		{"country", countryRegExp},
+	} {
+		for _, m := range k.re.FindAllStringSubmatchIndex(text, -1) {
+			parsed[m[0]] = true
+			t := Target{Kind: k.kind, Name: text[m[2]:m[3]], Pos: m[0], Action: maintenancestate.EnterMaintenance}
+			if k.kind == "experiment" {
+				// Drop the machine submatch so that "del" is where it is for other kinds.
+				t.Machine = strings.Replace(text[m[4]:m[5]], ".", "-", 1)
+				m = append(m[:4], m[6:]...)
+			}
+			if m[4] >= 0 && strings.TrimSpace(text[m[4]:m[5]]) == "del" {
+				t.Action = maintenancestate.LeaveMaintenance
+			}
+			switch k.kind {
+			case "site", "switch":
+				t.Err = CheckSite(project, t.Name)
+			case "machine":
+				t.Name = strings.Replace(t.Name, ".", "-", 1)
+				t.Err = CheckMachine(project, t.Name)
+			case "experiment":
+				t.Err = CheckMachine(project, t.Machine)
+			case "country":
+				t.Name = strings.ToUpper(t.Name)
+			}
+			if err := parseModifiers(text[m[1]:], &t.Modifiers); err != nil && t.Err == nil {
+				t.Err = err
+			}
+			targets = append(targets, t)
+		}
+	}
+	for _, m := range flagKeywordRegExp.FindAllStringSubmatchIndex(text, -1) {
+		if !parsed[m[2]] {
+			targets = append(targets, Target{Kind: text[m[2]+1 : m[3]], Pos: m[2], Err: ErrNoName})
+		}
+	}
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].Pos < targets[j].Pos })
+	return targets
+}
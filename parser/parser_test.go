@@ -0,0 +1,92 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+func TestParse(t *testing.T) {
+	text := "/machine mlab1.abc01 for 2 days -- disk\n" +
+		"/site abc02 del\n" +
+		"/experiment ndt mlab2-abc01 in 10m\n" +
+		"/switch abc03\n" +
+		"/country us del\n" +
+		"/site xyz0t\n" +
+		"/machine !"
+	want := []Target{
+		{Kind: "machine", Name: "mlab1-abc01", Action: maintenancestate.EnterMaintenance,
+			Modifiers: Modifiers{Duration: 48 * time.Hour, Reason: "disk"}, Pos: 0},
+		{Kind: "site", Name: "abc02", Action: maintenancestate.LeaveMaintenance, Pos: 40},
+		{Kind: "experiment", Name: "ndt", Machine: "mlab2-abc01", Action: maintenancestate.EnterMaintenance,
+			Modifiers: Modifiers{Delay: 10 * time.Minute}, Pos: 56},
+		{Kind: "switch", Name: "abc03", Action: maintenancestate.EnterMaintenance, Pos: 91},
+		{Kind: "country", Name: "US", Action: maintenancestate.LeaveMaintenance, Pos: 105},
+		{Kind: "site", Name: "xyz0t", Action: maintenancestate.EnterMaintenance, Pos: 121},
+		{Kind: "machine", Pos: 133, Err: ErrNoName},
+	}
+	got := Parse("mlab-oti", text)
+	if len(got) != len(want) {
+		t.Fatalf("Parse() = %+v; want %d targets", got, len(want))
+	}
+	for i := range want {
+		if i == 5 {
+			// A sandbox site is not a valid site in mlab-oti.
+			if got[i].Err == nil {
+				t.Errorf("Parse() target %d has no error for an invalid name", i)
+			}
+			got[i].Err = nil
+		}
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("Parse() target %d = %+v; want %+v", i, got[i], want[i])
+		}
+	}
+	if got := Parse("mlab-foo", "/site abc01"); len(got) != 1 || got[0].Err == nil {
+		t.Errorf("Parse() for a project without rules = %+v; want an error", got)
+	}
+	if got := Parse("mlab-oti", "/site abc01 until 2024-02-30"); len(got) != 1 || got[0].Err == nil {
+		t.Errorf("Parse() with an invalid date = %+v; want an error", got)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"/machine mlab1-abc01",
+		"/site abc01 del\n/machine mlab2.abc01 for a week override",
+		"/experiment ndt mlab1-abc01 until 2024-08-01T12:00:00Z -- upgrade",
+		"/switch abc01 in 1h30m /country US",
+		"/machine /site\t/country",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, text string) {
+		targets := Parse("mlab-oti", text)
+		for i, target := range targets {
+			if target.Pos < 0 || target.Pos >= len(text) || text[target.Pos] != '/' {
+				t.Fatalf("target %+v is not at a flag in %q", target, text)
+			}
+			if i > 0 && target.Pos <= targets[i-1].Pos {
+				t.Fatalf("targets %+v are not in order", targets)
+			}
+			if target.Err != nil {
+				continue
+			}
+			if !strings.HasPrefix(text[target.Pos:], "/"+target.Kind) {
+				t.Fatalf("target %+v is not a %s flag in %q", target, target.Kind, text)
+			}
+			switch target.Kind {
+			case "machine":
+				if CheckMachine("mlab-oti", target.Name) != nil {
+					t.Fatalf("target %+v has an invalid machine", target)
+				}
+			case "site", "switch":
+				if CheckSite("mlab-oti", target.Name) != nil {
+					t.Fatalf("target %+v has an invalid site", target)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// ProjectRules are the rules that the names of a project's sites and machines
+// follow.
+type ProjectRules struct {
+	// Site matches the project's sites, e.g. abc01.
+	Site *regexp.Regexp
+	// Machine matches the project's machines at a site, e.g. mlab1.
+	Machine *regexp.Regexp
+}
+
+// projects holds the rules of every known project. It may be replaced with
+// SetRules.
+var projects = map[string]ProjectRules{
+	"mlab-sandbox": {
+		Site:    regexp.MustCompile(`^[a-z]{3}[0-9]t$`),
+		Machine: regexp.MustCompile(`^mlab[1-4]$`),
+	},
+	"mlab-staging": {
+		Site:    regexp.MustCompile(`^[a-z]{3}[0-9c]{2}$`),
+		Machine: regexp.MustCompile(`^mlab4$`),
+	},
+	"mlab-oti": {
+		Site:    regexp.MustCompile(`^[a-z]{3}[0-9c]{2}$`),
+		Machine: regexp.MustCompile(`^mlab[1-3]$`),
+	},
+}
+
+// ReadRules reads a JSON object mapping each project to the patterns of its
+// sites and machines, e.g.
+//
+//	{"mlab-oti": {"site": "[a-z]{3}[0-9c]{2}", "machine": "mlab[1-3]"}}
+//
+// Patterns must match whole names.
+func ReadRules(r io.Reader) (map[string]ProjectRules, error) {
+	var raw map[string]struct {
+		Site    string `json:"site"`
+		Machine string `json:"machine"`
+	}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("no projects are defined")
+	}
+	rules := make(map[string]ProjectRules, len(raw))
+	for project, patterns := range raw {
+		if patterns.Site == "" || patterns.Machine == "" {
+			return nil, fmt.Errorf("project %q must have both a site and a machine pattern", project)
+		}
+		site, err := regexp.Compile("^(?:" + patterns.Site + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid site pattern for project %q: %w", project, err)
+		}
+		machine, err := regexp.Compile("^(?:" + patterns.Machine + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid machine pattern for project %q: %w", project, err)
+		}
+		rules[project] = ProjectRules{Site: site, Machine: machine}
+	}
+	return rules, nil
+}
+
+// SetRules replaces the rules of every project. It must be called before any
+// messages are parsed.
+func SetRules(rules map[string]ProjectRules) {
+	projects = rules
+}
+
+// Rules returns the rules of every project.
+func Rules() map[string]ProjectRules {
+	return projects
+}
+
+// CheckSite returns an error unless site is a valid name for a site in
+// project.
+func CheckSite(project string, site string) error {
+	rules, ok := projects[project]
+	if !ok {
+		return fmt.Errorf("project %s has no naming rules", project)
+	}
+	if !rules.Site.MatchString(site) {
+		return fmt.Errorf("it is not a valid name for a site in %s", project)
+	}
+	return nil
+}
+
+// CheckMachine is like CheckSite, but for a machine such as mlab1-abc01.
+func CheckMachine(project string, machine string) error {
+	rules, ok := projects[project]
+	if !ok {
+		return fmt.Errorf("project %s has no naming rules", project)
+	}
+	node, site, found := strings.Cut(machine, "-")
+	if !found || !rules.Machine.MatchString(node) || !rules.Site.MatchString(site) {
+		return fmt.Errorf("it is not a valid name for a machine in %s", project)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	rules, err := ReadRules(strings.NewReader(`{"mlab-test": {"site": "[a-z]{3}[0-9]{2}x", "machine": "mlab[15]"}}`))
+	if err != nil {
+		t.Fatalf("ReadRules() returned error: %v", err)
+	}
+	defer SetRules(Rules())
+	SetRules(rules)
+	if err := CheckMachine("mlab-test", "mlab5-abc01x"); err != nil {
+		t.Errorf("CheckMachine(mlab5-abc01x) = %v", err)
+	}
+	for _, bad := range []string{"mlab2-abc01x", "mlab5abc01x", "mlab5-abc01"} {
+		if CheckMachine("mlab-test", bad) == nil {
+			t.Errorf("CheckMachine(%s) = nil error", bad)
+		}
+	}
+	if err := CheckSite("mlab-test", "abc01x"); err != nil {
+		t.Errorf("CheckSite(abc01x) = %v", err)
+	}
+	if CheckSite("mlab-oti", "abc01") == nil {
+		t.Error("mlab-oti should no longer be a known project")
+	}
+	if _, err := ReadRules(strings.NewReader(`{"mlab-test": {"site": "[a-z"}}`)); err == nil {
+		t.Error("ReadRules() of invalid rules = nil error")
+	}
+}
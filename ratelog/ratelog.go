@@ -0,0 +1,173 @@
+// Package ratelog rate limits high-volume log lines. Lines that share a
+// format string are logged until a burst limit is reached within an interval,
+// after which they are suppressed and summarized in a single line, so that
+// bursts (e.g. every machine of a metro entering maintenance) do not drown out
+// other log lines.
+package ratelog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entry tracks the lines logged with a single format string.
+type entry struct {
+	start      time.Time
+	logged     int
+	suppressed int
+	last       string
+}
+
+// Sampler logs lines, suppressing and summarizing lines with the same format
+// string beyond the first burst lines in each interval.
+type Sampler struct {
+	logger *log.Logger
+	// structured is the logger used by Log. If nil, slog.Default() is used.
+	structured *slog.Logger
+
+	mu       sync.Mutex
+	burst    int
+	interval time.Duration
+	entries  map[string]*entry
+	now      func() time.Time
+}
+
+// New creates a Sampler that logs to logger. A burst of zero disables
+// suppression.
+func New(logger *log.Logger, burst int, interval time.Duration) *Sampler {
+	return &Sampler{
+		logger:   logger,
+		burst:    burst,
+		interval: interval,
+		entries:  make(map[string]*entry),
+		now:      time.Now,
+	}
+}
+
+// summarize logs a summary of the lines suppressed for a format. The caller
+// must hold the lock.
+func (s *Sampler) summarize(e *entry) {
+	if e.suppressed > 0 {
+		s.logger.Printf("INFO: Suppressed %d similar log lines in the last %s, the last of which was: %s",
+			e.suppressed, s.now().Sub(e.start).Round(time.Second), e.last)
+	}
+}
+
+// allow reports whether a line with key may be logged, and records it as
+// suppressed otherwise. The caller must hold the lock.
+func (s *Sampler) allow(key string, line func() string) bool {
+	if s.burst <= 0 {
+		return true
+	}
+	now := s.now()
+	e, ok := s.entries[key]
+	if !ok || now.Sub(e.start) >= s.interval {
+		if ok {
+			s.summarize(e)
+		}
+		e = &entry{start: now}
+		s.entries[key] = e
+	}
+	if e.logged < s.burst {
+		e.logged++
+		return true
+	}
+	e.suppressed++
+	e.last = line()
+	return false
+}
+
+// Printf logs a line unless too many lines with the same format have been
+// logged recently.
+func (s *Sampler) Printf(format string, v ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.allow(format, func() string { return fmt.Sprintf(format, v...) }) {
+		s.logger.Printf(format, v...)
+	}
+}
+
+// Log logs a structured line with slog at level, unless too many lines with
+// the same message have been logged recently.
+func (s *Sampler) Log(level slog.Level, msg string, args ...any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line := func() string { return strings.TrimSpace(fmt.Sprintln(append([]any{msg}, args...)...)) }
+	if s.allow(msg, line) {
+		s.slogger().Log(context.Background(), level, msg, args...)
+	}
+}
+
+// slogger returns the logger used by Log.
+func (s *Sampler) slogger() *slog.Logger {
+	if s.structured != nil {
+		return s.structured
+	}
+	return slog.Default()
+}
+
+// Flush summarizes the lines suppressed in intervals that have ended.
+func (s *Sampler) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for format, e := range s.entries {
+		if now.Sub(e.start) >= s.interval {
+			s.summarize(e)
+			delete(s.entries, format)
+		}
+	}
+}
+
+// SetLimit changes the number of lines with the same format logged in each
+// interval. A burst of zero disables suppression.
+func (s *Sampler) SetLimit(burst int, interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.burst = burst
+	s.interval = interval
+}
+
+// Run flushes the Sampler every interval until ctx is canceled, so that
+// suppressed lines are summarized even if no more lines are logged.
+func (s *Sampler) Run(ctx context.Context) {
+	s.mu.Lock()
+	interval := s.interval
+	s.mu.Unlock()
+	if interval <= 0 {
+		return
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.Flush()
+			return
+		case <-tick.C:
+			s.Flush()
+		}
+	}
+}
+
+// Default is the Sampler used by the package-level functions. It logs to the
+// standard logger.
+var Default = New(log.Default(), 20, time.Minute)
+
+// Printf logs a line with the Default Sampler.
+func Printf(format string, v ...interface{}) {
+	Default.Printf(format, v...)
+}
+
+// Info logs a structured line at the info level with the Default Sampler.
+func Info(msg string, args ...any) {
+	Default.Log(slog.LevelInfo, msg, args...)
+}
@@ -0,0 +1,118 @@
+package ratelog
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSampler(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := New(log.New(&buf, "", 0), 2, time.Minute)
+	s.now = func() time.Time { return now }
+
+	for _, m := range []string{"mlab1", "mlab2", "mlab3", "mlab4"} {
+		s.Printf("INFO: %s was added", m)
+	}
+	s.Printf("INFO: other %d", 1)
+	want := "INFO: mlab1 was added\nINFO: mlab2 was added\nINFO: other 1\n"
+	if buf.String() != want {
+		t.Errorf("log = %q; want %q", buf.String(), want)
+	}
+
+	// Nothing is summarized until the interval ends.
+	buf.Reset()
+	s.Flush()
+	if buf.Len() != 0 {
+		t.Errorf("Flush() before the end of the interval logged %q", buf.String())
+	}
+
+	now = now.Add(time.Minute)
+	s.Flush()
+	want = "INFO: Suppressed 2 similar log lines in the last 1m0s, the last of which was: INFO: mlab4 was added\n"
+	if buf.String() != want {
+		t.Errorf("Flush() logged %q; want %q", buf.String(), want)
+	}
+
+	// A new interval starts logging again.
+	buf.Reset()
+	s.Printf("INFO: %s was added", "mlab5")
+	if buf.String() != "INFO: mlab5 was added\n" {
+		t.Errorf("log = %q after the interval ended", buf.String())
+	}
+}
+
+func TestSamplerLog(t *testing.T) {
+	var buf, structured bytes.Buffer
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := New(log.New(&buf, "", 0), 1, time.Minute)
+	s.structured = slog.New(slog.NewTextHandler(&structured, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	s.now = func() time.Time { return now }
+
+	s.Log(slog.LevelInfo, "Machine entered maintenance", "entity", "mlab1")
+	s.Log(slog.LevelInfo, "Machine entered maintenance", "entity", "mlab2")
+	want := "level=INFO msg=\"Machine entered maintenance\" entity=mlab1\n"
+	if structured.String() != want {
+		t.Errorf("log = %q; want %q", structured.String(), want)
+	}
+
+	now = now.Add(time.Minute)
+	s.Flush()
+	want = "INFO: Suppressed 1 similar log lines in the last 1m0s, the last of which was: Machine entered maintenance entity mlab2\n"
+	if buf.String() != want {
+		t.Errorf("Flush() logged %q; want %q", buf.String(), want)
+	}
+}
+
+func TestSamplerSummarizesOnNextLine(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := New(log.New(&buf, "", 0), 1, time.Minute)
+	s.now = func() time.Time { return now }
+
+	s.Printf("INFO: %d", 1)
+	s.Printf("INFO: %d", 2)
+	now = now.Add(2 * time.Minute)
+	s.Printf("INFO: %d", 3)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "INFO: Suppressed 1 similar") || lines[2] != "INFO: 3" {
+		t.Errorf("unexpected log: %q", lines)
+	}
+}
+
+func TestSamplerDisabled(t *testing.T) {
+	var buf bytes.Buffer
+	s := New(log.New(&buf, "", 0), 1, time.Minute)
+	s.SetLimit(0, time.Minute)
+	for i := 0; i < 3; i++ {
+		s.Printf("INFO: %d", i)
+	}
+	if got := strings.Count(buf.String(), "\n"); got != 3 {
+		t.Errorf("disabled Sampler logged %d lines; want 3", got)
+	}
+}
+
+func TestRun(t *testing.T) {
+	var buf bytes.Buffer
+	s := New(log.New(&buf, "", 0), 1, time.Millisecond)
+	s.Printf("INFO: %d", 1)
+	s.Printf("INFO: %d", 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	s.Run(ctx)
+	if !strings.Contains(buf.String(), "Suppressed 1 similar") {
+		t.Errorf("Run() did not summarize suppressed lines: %q", buf.String())
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/gmxtest"
+)
+
+// sendTestHook implements the send-test-hook command, which sends a signed
+// synthetic webhook to a running instance and reports its response to out.
+func sendTestHook(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("send-test-hook", flag.ContinueOnError)
+	fs.SetOutput(out)
+	url := fs.String("url", "", "URL of the webhook endpoint, e.g. http://localhost:9999/webhook.")
+	secretFile := fs.String("secret-file", "", "Filesystem path of the file containing the webhook secret. If empty, GITHUB_WEBHOOK_SECRET is used.")
+	event := fs.String("event", "issue_comment", "Event to send: issues or issue_comment.")
+	action := fs.String("action", "opened", "Action of an issues event, e.g. opened, edited or closed.")
+	body := fs.String("body", "", "Body of the issue or comment, e.g. \"/machine mlab1.abc0t\".")
+	repo := fs.String("repo", "m-lab/gmx-test-hook", "Full name of the repository the issue is in.")
+	issue := fs.Int("issue", 1, "Number of the issue.")
+	sender := fs.String("sender", "gmx-test-hook", "GitHub user that sent the event.")
+	timeout := fs.Duration("timeout", 10*time.Second, "How long to wait for a response.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *url == "" {
+		return errors.New("-url is required")
+	}
+
+	var secret []byte
+	if *secretFile != "" {
+		data, err := os.ReadFile(*secretFile)
+		if err != nil {
+			return err
+		}
+		secret = bytes.TrimSpace(data)
+	} else {
+		secret = []byte(os.Getenv("GITHUB_WEBHOOK_SECRET"))
+	}
+	if len(secret) == 0 {
+		return errors.New("the webhook secret is empty")
+	}
+
+	i := gmxtest.Issue{Repo: *repo, Number: *issue, Body: *body}
+	var payload string
+	switch *event {
+	case "issues":
+		payload = gmxtest.IssuePayload(*action, i)
+	case "issue_comment":
+		i.Body = ""
+		payload = gmxtest.CommentPayload(i, *sender, *body)
+	default:
+		return fmt.Errorf("unsupported event: %q", *event)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	resp, err := gmxtest.Post(context.Background(), client, *url, secret, *event, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	notes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Status: %s\n", resp.Status)
+	if len(notes) > 0 {
+		fmt.Fprintf(out, "Response:\n%s", notes)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook was not accepted: %s", resp.Status)
+	}
+	return nil
+}
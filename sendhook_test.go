@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/github-maintenance-exporter/gmxtest"
+	"github.com/m-lab/github-maintenance-exporter/handler"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/go/rtx"
+)
+
+func TestSendTestHook(t *testing.T) {
+	dir := t.TempDir()
+	rtx.Must(os.WriteFile(dir+"/secret", []byte("test\n"), 0600), "Could not write secret")
+	s, _ := maintenancestate.NewWithStorage(&gmxtest.MemoryStorage{}, gmxtest.Sites{"abc0t": {"mlab1"}}, "mlab-sandbox")
+	srv := httptest.NewServer(handler.New(s, []byte("test"), "mlab-sandbox", handler.Config{}))
+	defer srv.Close()
+
+	var out bytes.Buffer
+	err := sendTestHook([]string{"-url", srv.URL, "-secret-file", dir + "/secret", "-body", "/machine mlab1.abc0t"}, &out)
+	if err != nil {
+		t.Fatalf("sendTestHook() error = %v; output %s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "200 OK") {
+		t.Errorf("sendTestHook() output = %q; want the status", out.String())
+	}
+	err = sendTestHook([]string{"-url", srv.URL, "-secret-file", dir + "/secret", "-event", "issues", "-action", "opened", "-issue", "2", "-body", "/site abc0t"}, &out)
+	if err != nil {
+		t.Fatalf("sendTestHook() error = %v; output %s", err, out.String())
+	}
+	want := map[string][]string{"mlab1-abc0t": {"1", "2"}}
+	if got := s.Snapshot().Machines; !reflect.DeepEqual(got, want) {
+		t.Errorf("Machines = %v; want %v", got, want)
+	}
+
+	rtx.Must(os.WriteFile(dir+"/wrong", []byte("wrong"), 0600), "Could not write secret")
+	for _, args := range [][]string{
+		{"-secret-file", dir + "/secret"},
+		{"-url", srv.URL, "-secret-file", dir + "/missing"},
+		{"-url", srv.URL, "-secret-file", dir + "/secret", "-event", "push"},
+		{"-url", srv.URL, "-secret-file", dir + "/wrong"},
+		{"-unknown"},
+	} {
+		if err := sendTestHook(args, &out); err == nil {
+			t.Errorf("sendTestHook(%v) should have failed", args)
+		}
+	}
+}
@@ -2,20 +2,43 @@ package sites
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/m-lab/go/siteinfo"
 )
 
+// locationsURLFormat is the siteinfo output that holds the location of every
+// site.
+const locationsURLFormat = "https://siteinfo.%s.measurementlab.net/v2/sites/sites.json"
+
 // CachingClient implements the maintenancestate.Sites interface.
 type CachingClient struct {
 	Project  string
 	Siteinfo *siteinfo.Client
 	Sites    map[string][]string
-	mu       sync.Mutex
+	// Locations, if not nil, is used to load the country of every site.
+	Locations siteinfo.HTTPProvider
+	// Countries maps each site to the ISO 3166 code of its country.
+	Countries map[string]string
+	mu        sync.Mutex
+	loaded    time.Time
+}
+
+// site is an entity in /v2/sites/sites.json.
+type site struct {
+	Name     string `json:"name"`
+	Location struct {
+		CountryCode string `json:"country_code"`
+	} `json:"location"`
 }
 
 // Machines takes a short site name parameter (e.g. abc02), and will return
@@ -31,6 +54,22 @@ func (cc *CachingClient) Machines(site string) ([]string, error) {
 	return machines, nil
 }
 
+// MachineNames returns the sorted full names (e.g. mlab1-abc01) of every
+// machine at every site.
+func (cc *CachingClient) MachineNames() []string {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	var names []string
+	for site, machines := range cc.Sites {
+		for _, m := range machines {
+			names = append(names, m+"-"+site)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
 // Reload reloads CachingClient.Sites with fresh data from the siteinfo API. It
 // is meant to be run periodically in some sort of loop.
 func (cc *CachingClient) Reload(ctx context.Context) error {
@@ -42,10 +81,77 @@ func (cc *CachingClient) Reload(ctx context.Context) error {
 		return err
 	}
 	cc.Sites = siteMachines
-	log.Println("INFO: successfully [re]loaded the siteinfo data.")
+	cc.loaded = time.Now()
+	if cc.Locations != nil {
+		// Without locations only country flags fail, so keep the sites.
+		countries, err := cc.loadCountries()
+		if err != nil {
+			slog.Warn("Failed to load site locations", "project", cc.Project, "err", err)
+		} else {
+			cc.Countries = countries
+		}
+	}
+	slog.Info("Successfully [re]loaded the siteinfo data", "project", cc.Project)
 	return nil
 }
 
+// loadCountries fetches the country of every site from siteinfo.
+func (cc *CachingClient) loadCountries() (map[string]string, error) {
+	resp, err := cc.Locations.Get(fmt.Sprintf(locationsURLFormat, cc.Project))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var sites []site
+	if err := json.Unmarshal(body, &sites); err != nil {
+		return nil, err
+	}
+	countries := make(map[string]string, len(sites))
+	for _, s := range sites {
+		if s.Location.CountryCode != "" {
+			countries[s.Name] = strings.ToUpper(s.Location.CountryCode)
+		}
+	}
+	return countries, nil
+}
+
+// CountrySites takes an ISO 3166 country code (e.g. US), and returns the
+// sorted sites located in that country.
+func (cc *CachingClient) CountrySites(country string) ([]string, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.Countries == nil {
+		return nil, errors.New("site locations are not loaded")
+	}
+	var sites []string
+	for site, c := range cc.Countries {
+		if _, ok := cc.Sites[site]; ok && strings.EqualFold(c, country) {
+			sites = append(sites, site)
+		}
+	}
+	if len(sites) == 0 {
+		return nil, errors.New("no sites found in country")
+	}
+	sort.Strings(sites)
+	return sites, nil
+}
+
+// Loaded returns when the siteinfo data was last successfully loaded, or the
+// zero time if it never has been.
+func (cc *CachingClient) Loaded() time.Time {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.loaded
+}
+
 func New(project string) *CachingClient {
 	siteinfo := siteinfo.New(project, "v2", &http.Client{})
 	return &CachingClient{
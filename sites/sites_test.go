@@ -135,3 +135,67 @@ func TestMachines(t *testing.T) {
 		}
 	}
 }
+
+func TestLoaded(t *testing.T) {
+	cachingClient := New("mlab-sandbox")
+	if !cachingClient.Loaded().IsZero() {
+		t.Errorf("Loaded() before Reload() = %v; want zero time", cachingClient.Loaded())
+	}
+	cachingClient.Siteinfo = siteinfo.New(cachingClient.Project, "v2", &siteinfotest.StringProvider{
+		Response: testSiteinfoData0,
+	})
+	if err := cachingClient.Reload(context.Background()); err != nil {
+		t.Fatalf("Unexpected error from Reload(): %v", err)
+	}
+	if cachingClient.Loaded().IsZero() {
+		t.Error("Loaded() after Reload() returned the zero time")
+	}
+}
+
+func TestMachineNames(t *testing.T) {
+	cc := &CachingClient{Sites: map[string][]string{
+		"xyz02": {"mlab1"},
+		"abc0t": {"mlab2", "mlab1"},
+	}}
+	want := []string{"mlab1-abc0t", "mlab1-xyz02", "mlab2-abc0t"}
+	if got := cc.MachineNames(); !reflect.DeepEqual(got, want) {
+		t.Errorf("MachineNames() = %v; want %v", got, want)
+	}
+}
+
+func TestCountrySites(t *testing.T) {
+	cachingClient := New("mlab-sandbox")
+	if _, err := cachingClient.CountrySites("US"); err == nil {
+		t.Error("CountrySites() without locations should fail")
+	}
+	cachingClient.Siteinfo = siteinfo.New(cachingClient.Project, "v2", &siteinfotest.StringProvider{
+		Response: testSiteinfoData0,
+	})
+	cachingClient.Locations = &siteinfotest.StringProvider{Response: `[
+		{"name": "abc0t", "location": {"country_code": "US"}},
+		{"name": "xyz02", "location": {"country_code": "us"}},
+		{"name": "lol01", "location": {"country_code": "DE"}},
+		{"name": "old01", "location": {"country_code": "US"}}
+	]`}
+	if err := cachingClient.Reload(context.Background()); err != nil {
+		t.Fatalf("Unexpected error from Reload(): %v", err)
+	}
+
+	// Retired sites, such as old01, are not returned.
+	sites, err := cachingClient.CountrySites("us")
+	if err != nil || !reflect.DeepEqual(sites, []string{"abc0t", "xyz02"}) {
+		t.Errorf("CountrySites(us) = %v, %v; want [abc0t xyz02]", sites, err)
+	}
+	if _, err := cachingClient.CountrySites("FR"); err == nil {
+		t.Error("CountrySites(FR) should fail")
+	}
+
+	// A failure to load the locations keeps the previous ones.
+	cachingClient.Locations = &siteinfotest.FailingProvider{}
+	if err := cachingClient.Reload(context.Background()); err != nil {
+		t.Fatalf("Unexpected error from Reload(): %v", err)
+	}
+	if sites, _ := cachingClient.CountrySites("DE"); !reflect.DeepEqual(sites, []string{"lol01"}) {
+		t.Errorf("CountrySites(DE) = %v; want [lol01]", sites)
+	}
+}
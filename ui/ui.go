@@ -0,0 +1,158 @@
+// Package ui serves a read-only web page listing the machines, sites,
+// experiments and switches in maintenance, grouped by issue, so that it is
+// easy to check whether something is down on purpose.
+package ui
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+	"github.com/m-lab/github-maintenance-exporter/metrics"
+)
+
+//go:embed index.html
+var indexHTML string
+
+var page = template.Must(template.New("ui").Parse(indexHTML))
+
+const (
+	// Maintenance younger than newAge is highlighted as new, and older than
+	// oldAge or staleAge as old or stale.
+	newAge   = 24 * time.Hour
+	oldAge   = 7 * 24 * time.Hour
+	staleAge = 30 * 24 * time.Hour
+)
+
+// UI serves the page.
+type UI struct {
+	state   *maintenancestate.MaintenanceState
+	project string
+	now     func() time.Time
+}
+
+// New creates a UI for the state of a project.
+func New(state *maintenancestate.MaintenanceState, project string) *UI {
+	return &UI{state: state, project: project, now: time.Now}
+}
+
+// kindOrder is the order in which the kinds of entity are listed.
+var kindOrder = map[string]int{"site": 0, "switch": 1, "machine": 2, "experiment": 3}
+
+// entity is a row of the page.
+type entity struct {
+	Kind, Name      string
+	Age, AgeClass   string
+	Expires, Reason string
+}
+
+// issue is a table of the page.
+type issue struct {
+	Issue, URL string
+	Entities   []entity
+}
+
+// view is the data rendered by the page.
+type view struct {
+	Project, Query, Now string
+	Issues              []issue
+}
+
+// age formats how long maintenance has lasted, e.g. "3d 4h".
+func age(d time.Duration) string {
+	days, hours := int(d/(24*time.Hour)), int(d%(24*time.Hour)/time.Hour)
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, int(d%time.Hour/time.Minute))
+	}
+	return fmt.Sprintf("%dm", int(d/time.Minute))
+}
+
+// ageClass returns the CSS class that highlights maintenance of age d.
+func ageClass(d time.Duration) string {
+	switch {
+	case d < newAge:
+		return "new"
+	case d >= staleAge:
+		return "stale"
+	case d >= oldAge:
+		return "old"
+	}
+	return ""
+}
+
+// build returns the issues with any entity or issue matching query, or every
+// issue if query is empty.
+func (u *UI) build(query string) []issue {
+	snapshot := u.state.Snapshot()
+	now := u.now()
+	byIssue := map[string][]entity{}
+	for _, k := range []struct {
+		kind     string
+		entities map[string][]string
+	}{
+		{"site", snapshot.Sites},
+		{"machine", snapshot.Machines},
+		{"experiment", snapshot.Experiments},
+		{"switch", snapshot.Switches},
+	} {
+		for name, issues := range k.entities {
+			for _, i := range issues {
+				if query != "" && !strings.Contains(name, query) && i != query {
+					continue
+				}
+				e := entity{Kind: k.kind, Name: name}
+				entry := snapshot.Entries[maintenancestate.EntryKey(name, i)]
+				if !entry.Entered.IsZero() {
+					e.Age, e.AgeClass = age(now.Sub(entry.Entered)), ageClass(now.Sub(entry.Entered))
+				}
+				if !entry.Expires.IsZero() {
+					e.Expires = entry.Expires.UTC().Format(time.RFC3339)
+				}
+				e.Reason = entry.Reason
+				byIssue[i] = append(byIssue[i], e)
+			}
+		}
+	}
+	issues := make([]issue, 0, len(byIssue))
+	for i, entities := range byIssue {
+		sort.Slice(entities, func(a, b int) bool {
+			if entities[a].Kind != entities[b].Kind {
+				return kindOrder[entities[a].Kind] < kindOrder[entities[b].Kind]
+			}
+			return entities[a].Name < entities[b].Name
+		})
+		issues = append(issues, issue{Issue: i, URL: maintenancestate.IssueURL(i), Entities: entities})
+	}
+	sort.Slice(issues, func(a, b int) bool { return issues[a].Issue < issues[b].Issue })
+	return issues
+}
+
+// ServeHTTP renders the page. The "q" parameter, if given, limits it to the
+// issue with that name and to entities whose names contain it, e.g. abc01.
+func (u *UI) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := strings.TrimSpace(req.URL.Query().Get("q"))
+	v := view{
+		Project: u.project,
+		Query:   query,
+		Now:     u.now().UTC().Format(time.RFC3339),
+		Issues:  u.build(query),
+	}
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := page.Execute(resp, v); err != nil {
+		slog.Error("Failed to render the UI", "err", err)
+		metrics.CountError("template", "ui.ServeHTTP")
+	}
+}
@@ -0,0 +1,69 @@
+package ui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/github-maintenance-exporter/gmxtest"
+	"github.com/m-lab/github-maintenance-exporter/maintenancestate"
+)
+
+func TestUI(t *testing.T) {
+	sites := gmxtest.Sites{"abc01": {"mlab1"}, "xyz02": {"mlab1", "mlab2"}}
+	// The storage is empty, so the state starts empty.
+	state, _ := maintenancestate.NewWithStorage(&gmxtest.MemoryStorage{}, sites, "mlab-oti")
+	state.Apply(maintenancestate.Change{Kind: "site", Name: "abc01", Action: maintenancestate.EnterMaintenance, Reason: "power <outage>"}, "12", "mlab-oti")
+	state.Apply(maintenancestate.Change{Kind: "machine", Name: "mlab2-xyz02", Action: maintenancestate.EnterMaintenance}, "13", "mlab-oti")
+	u := New(state, "mlab-oti")
+	u.now = func() time.Time { return time.Now().Add(40 * 24 * time.Hour) }
+
+	tests := []struct {
+		url      string
+		want     []string
+		unwanted []string
+	}{
+		{"/ui", []string{"Issue 12", "abc01", "mlab1-abc01", "Issue 13", "mlab2-xyz02", "power &lt;outage&gt;", `class="age stale">40d 0h`}, nil},
+		{"/ui?q=abc01", []string{"abc01", "mlab1-abc01"}, []string{"Issue 13"}},
+		{"/ui?q=13", []string{"mlab2-xyz02"}, []string{"Issue 12"}},
+		{"/ui?q=def01", []string{"Nothing matching &quot;def01&quot; is in maintenance."}, []string{"<h2>"}},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		u.ServeHTTP(rec, httptest.NewRequest("GET", tt.url, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s returned status %d", tt.url, rec.Code)
+		}
+		body := rec.Body.String()
+		for _, w := range tt.want {
+			if !strings.Contains(body, w) {
+				t.Errorf("GET %s does not contain %q:\n%s", tt.url, w, body)
+			}
+		}
+		for _, w := range tt.unwanted {
+			if strings.Contains(body, w) {
+				t.Errorf("GET %s contains %q", tt.url, w)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	u.ServeHTTP(rec, httptest.NewRequest("POST", "/ui", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST returned status %d", rec.Code)
+	}
+}
+
+func TestAge(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		5 * time.Minute:            "5m",
+		90 * time.Minute:           "1h 30m",
+		3*24*time.Hour + time.Hour: "3d 1h",
+	} {
+		if got := age(d); got != want {
+			t.Errorf("age(%s) = %q; want %q", d, got, want)
+		}
+	}
+}